@@ -70,9 +70,76 @@ type MintConfig struct {
 	MinPayoutAmount         uint64 `json:"min_payout_amount"`
 }
 
+// GateConfig selects the firewall backend the valve uses to let clients through
+type GateConfig struct {
+	Backend            string `json:"backend"` // "ndsctl", "opennds", "nftables" or "memory"
+	NftFamily          string `json:"nft_family"`
+	NftTable           string `json:"nft_table"`
+	NftSet             string `json:"nft_set"`
+	NftShapingChain    string `json:"nft_shaping_chain"`
+	NftWalledGardenSet string `json:"nft_walled_garden_set"`
+}
+type WalledGardenConfig struct {
+	Enabled bool     `json:"enabled"`
+	Domains []string `json:"domains"` // Hosts besides the accepted mints that unpaid clients may reach, such as LNURL services
+}
+type AutoPauseConfig struct {
+	Enabled      bool   `json:"enabled"`
+	GraceSeconds uint64 `json:"grace_seconds"` // How long a client may be disassociated before its session is paused
+}
+type TierConfig struct {
+	Name         string `json:"name"`
+	PricePerStep uint64 `json:"price_per_step"`
+	DownloadKbps uint64 `json:"download_kbps"` // 0 means unlimited
+	UploadKbps   uint64 `json:"upload_kbps"`   // 0 means unlimited
+}
+
+type PricingConfig struct {
+	Timezone  string                `json:"timezone"` // IANA time zone of schedules and holidays, empty for the system's
+	Schedules []PriceScheduleConfig `json:"schedules"`
+	Holidays  []HolidayConfig       `json:"holidays"`
+	Discounts []DiscountConfig      `json:"discounts"`
+}
+type PriceScheduleConfig struct {
+	Name         string   `json:"name"`
+	Days         []string `json:"days"`          // "mon" to "sun", empty for every day
+	Start        string   `json:"start"`         // "HH:MM"
+	End          string   `json:"end"`           // "HH:MM", before start for ranges past midnight
+	PricePercent uint64   `json:"price_percent"` // Percentage of the regular price, e.g. 50 for half price
+}
+type HolidayConfig struct {
+	Name         string `json:"name"`
+	Date         string `json:"date"` // "YYYY-MM-DD" for a single day or "MM-DD" for every year
+	PricePercent uint64 `json:"price_percent"`
+}
+type DiscountConfig struct {
+	MinSteps        uint64 `json:"min_steps"`
+	DiscountPercent uint64 `json:"discount_percent"`
+}
+
+type RefundConfig struct {
+	Enabled    bool   `json:"enabled"`
+	FeePercent uint64 `json:"fee_percent"` // Kept from the value of the unused part of a session
+}
+
+type LoyaltyConfig struct {
+	Enabled        bool                    `json:"enabled"`
+	Discounts      []LoyaltyDiscountConfig `json:"discounts"`
+	FreeStepEvery  uint64                  `json:"free_step_every"` // After every this many steps a customer paid for, one step is free, 0 for none
+	PrepaidBalance bool                    `json:"prepaid_balance"` // Customers may top up a balance and start sessions from it on any device
+}
+type LoyaltyDiscountConfig struct {
+	MonthlySpend    uint64 `json:"monthly_spend"` // Sats a customer spent in the calendar month from which the discount applies
+	DiscountPercent uint64 `json:"discount_percent"`
+}
+
 type ProfitShareConfig struct {
 	Factor           float64 `json:"factor"`
 	LightningAddress string  `json:"lightning_address"`
+	NWC              string  `json:"nwc"`        // nostr+walletconnect:// connection to get invoices from instead of a lightning address
+	Npub             string  `json:"npub"`       // Nostr user to send ecash to instead of paying over Lightning
+	Delivery         string  `json:"delivery"`   // How ecash reaches npub: "dm" (default) for a NIP-17 direct message or "nutzap" (NIP-61)
+	MinAmount        uint64  `json:"min_amount"` // Smaller shares accrue until they reach it, 0 pays out every share
 }
 
 // Config holds the configuration parameters
@@ -88,7 +155,17 @@ type Config struct {
 	AcceptedMints         []MintConfig        `json:"accepted_mints"`
 	ProfitShare           []ProfitShareConfig `json:"profit_share"`
 	PricePerMinute        uint64              `json:"price_per_minute"`
+	Metric                string              `json:"metric"`
+	StepSize              uint64              `json:"step_size"`
+	PricePerStep          uint64              `json:"price_per_step"`
+	Tiers                 []TierConfig        `json:"tiers"`
+	Pricing               PricingConfig       `json:"pricing"`
+	AutoPause             AutoPauseConfig     `json:"auto_pause"`
+	WalledGarden          WalledGardenConfig  `json:"walled_garden"`
+	Refunds               RefundConfig        `json:"refunds"`
+	Loyalty               LoyaltyConfig       `json:"loyalty"`
 	Bragging              BraggingConfig      `json:"bragging"`
+	Gate                  GateConfig          `json:"gate"`
 	Relays                []string            `json:"relays"`
 	TrustedMaintainers    []string            `json:"trusted_maintainers"`
 	ShowSetup             bool                `json:"show_setup"`
@@ -279,19 +356,6 @@ func (cm *ConfigManager) SaveConfig(config *Config) error {
 	return os.WriteFile(cm.FilePath, data, 0644)
 }
 
-// getMintFee retrieves the mint fee for a given mint URL
-// TODO: Run this every time rather than storing the information in a config file.
-func GetMintFee(mintURL string) (uint64, error) {
-	// Stub implementation: return a default mint fee
-	return 0, nil
-}
-
-// calculateMinPayment calculates the minimum payment based on the mint fee
-func CalculateMinPayment(mintFee uint64) uint64 {
-	// Stub implementation: return the mint fee as the minimum payment
-	return 2*mintFee + 1
-}
-
 // getInstalledVersion retrieves the installed version of the package
 // TODO: run this every time rather than storing the ouptut in a config file.
 func GetInstalledVersion() (string, error) {
@@ -496,14 +560,37 @@ func (cm *ConfigManager) EnsureDefaultConfig() (*Config, error) {
 				},
 			},
 			ProfitShare: []ProfitShareConfig{
-				{0.70, "tollgate@minibits.cash"}, // User should change this
-				{0.30, "tollgate@minibits.cash"},
+				{Factor: 0.70, LightningAddress: "tollgate@minibits.cash"}, // User should change this
+				{Factor: 0.30, LightningAddress: "tollgate@minibits.cash"},
 			},
 			PricePerMinute: 1,
+			Metric:         "milliseconds",
+			StepSize:       60000,
+			PricePerStep:   1,
 			Bragging: BraggingConfig{
 				Enabled: true,
 				Fields:  []string{"amount", "mint", "duration"},
 			},
+			Gate: GateConfig{
+				Backend: "ndsctl",
+			},
+			AutoPause: AutoPauseConfig{
+				Enabled:      false,
+				GraceSeconds: 120,
+			},
+			WalledGarden: WalledGardenConfig{
+				Enabled: true,
+				Domains: []string{},
+			},
+			Refunds: RefundConfig{
+				Enabled:    false,
+				FeePercent: 10,
+			},
+			Loyalty: LoyaltyConfig{
+				Enabled:        false,
+				Discounts:      []LoyaltyDiscountConfig{},
+				PrepaidBalance: false,
+			},
 			Relays: []string{
 				"wss://relay.damus.io",
 				"wss://nos.lol",
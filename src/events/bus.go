@@ -0,0 +1,79 @@
+package events
+
+import (
+	"log"
+	"reflect"
+	"sync"
+)
+
+// subscriberBuffer is how many events a subscriber can fall behind before new ones are dropped
+const subscriberBuffer = 64
+
+// Bus is an in-process publish/subscribe bus for the typed events in this package.
+// Every subscriber receives events on its own goroutine in the order they were
+// published, so a slow subscriber never blocks the publisher or other subscribers.
+type Bus struct {
+	mu          sync.RWMutex
+	subscribers map[reflect.Type][]*subscriber
+}
+
+type subscriber struct {
+	name   string
+	events chan any
+}
+
+// NewBus creates an empty event bus
+func NewBus() *Bus {
+	return &Bus{
+		subscribers: make(map[reflect.Type][]*subscriber),
+	}
+}
+
+// Publish delivers event to every subscriber of its type. Publishing on a nil
+// bus does nothing, so modules can be used without one.
+func (b *Bus) Publish(event any) {
+	if b == nil {
+		return
+	}
+
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	for _, s := range b.subscribers[reflect.TypeOf(event)] {
+		select {
+		case s.events <- event:
+		default:
+			log.Printf("Event subscriber %s is falling behind, dropping %T", s.name, event)
+		}
+	}
+}
+
+// Subscribe calls handler for every event of type T published on bus.
+// name identifies the subscriber in log messages.
+func Subscribe[T any](bus *Bus, name string, handler func(T)) {
+	s := &subscriber{
+		name:   name,
+		events: make(chan any, subscriberBuffer),
+	}
+
+	eventType := reflect.TypeOf((*T)(nil)).Elem()
+	bus.mu.Lock()
+	bus.subscribers[eventType] = append(bus.subscribers[eventType], s)
+	bus.mu.Unlock()
+
+	go func() {
+		for event := range s.events {
+			handle(s.name, handler, event.(T))
+		}
+	}()
+}
+
+// handle runs a handler, recovering from panics so one subscriber can't take down the daemon
+func handle[T any](name string, handler func(T), event T) {
+	defer func() {
+		if r := recover(); r != nil {
+			log.Printf("Event subscriber %s panicked handling %T: %v", name, event, r)
+		}
+	}()
+	handler(event)
+}
@@ -0,0 +1,67 @@
+package events
+
+import (
+	"testing"
+	"time"
+)
+
+func TestPublishSubscribe(t *testing.T) {
+	bus := NewBus()
+
+	opened := make(chan SessionOpened, 2)
+	Subscribe(bus, "test", func(event SessionOpened) {
+		opened <- event
+	})
+	expired := make(chan SessionExpired, 1)
+	Subscribe(bus, "test", func(event SessionExpired) {
+		expired <- event
+	})
+
+	bus.Publish(SessionOpened{MACAddress: "00:11:22:33:44:55"})
+	bus.Publish(SessionOpened{MACAddress: "00:11:22:33:44:56"})
+
+	for _, expected := range []string{"00:11:22:33:44:55", "00:11:22:33:44:56"} {
+		select {
+		case event := <-opened:
+			if event.MACAddress != expected {
+				t.Errorf("Received %s, expected %s", event.MACAddress, expected)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("Timed out waiting for SessionOpened")
+		}
+	}
+
+	select {
+	case event := <-expired:
+		t.Errorf("SessionExpired subscriber received %+v", event)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestPanickingSubscriber(t *testing.T) {
+	bus := NewBus()
+
+	received := make(chan PaymentReceived, 2)
+	Subscribe(bus, "test", func(event PaymentReceived) {
+		received <- event
+		if event.Amount == 1 {
+			panic("boom")
+		}
+	})
+
+	bus.Publish(PaymentReceived{Amount: 1})
+	bus.Publish(PaymentReceived{Amount: 2})
+
+	for range 2 {
+		select {
+		case <-received:
+		case <-time.After(time.Second):
+			t.Fatalf("Subscriber stopped receiving after a panic")
+		}
+	}
+}
+
+func TestNilBus(t *testing.T) {
+	var bus *Bus
+	bus.Publish(SessionOpened{})
+}
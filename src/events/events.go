@@ -0,0 +1,115 @@
+package events
+
+import "time"
+
+// SessionOpened is published when the valve opens the gate for a client without a running session
+type SessionOpened struct {
+	MACAddress string
+	Metric     string
+	// Duration is set for time-based sessions, AllowanceBytes for data-volume sessions
+	Duration       time.Duration
+	AllowanceBytes uint64
+	Amount         uint64
+	Mint           string
+	EventID        string
+}
+
+// SessionExtended is published when a client with a running session pays for more
+type SessionExtended struct {
+	MACAddress string
+	Metric     string
+	// Duration and AllowanceBytes are what the payment added to the session
+	Duration       time.Duration
+	AllowanceBytes uint64
+	Amount         uint64
+	Mint           string
+	EventID        string
+}
+
+// SessionPurchased is published when the merchant sold a session, after the valve opened the gate
+type SessionPurchased struct {
+	MACAddress string
+	Metric     string
+	Tier       string
+	// Duration is set for time-based sessions, AllowanceBytes for data-volume sessions
+	Duration       time.Duration
+	AllowanceBytes uint64
+	Amount         uint64
+	Mint           string
+	EventID        string
+	// Voucher is the batch of the voucher redeemed for the session, empty for Cashu payments
+	Voucher string
+}
+
+// Reasons a session ended
+const (
+	ReasonTimeout   = "timeout"
+	ReasonAllowance = "allowance_used"
+	ReasonRestore   = "expired_while_down"
+	ReasonRefund    = "refunded"
+)
+
+// SessionExpired is published when the valve closes the gate at the end of a session
+type SessionExpired struct {
+	MACAddress string
+	Reason     string
+}
+
+// SessionPaused is published when a session is paused, keeping the time it had left
+type SessionPaused struct {
+	MACAddress string
+	Reason     string
+	// Remaining is the time left of a time-based session
+	Remaining time.Duration
+}
+
+// SessionResumed is published when a paused session continues
+type SessionResumed struct {
+	MACAddress string
+	Remaining  time.Duration
+}
+
+// SessionTransferred is published when a session moved to another MAC address
+type SessionTransferred struct {
+	From string
+	To   string
+}
+
+// Kinds of discrepancies between the valve's sessions and the clients the gate backend has authorized
+const (
+	DiscrepancyRetriedDeauth = "retried_deauth"
+	DiscrepancyUnknownClient = "unknown_client"
+	DiscrepancyFailedDeauth  = "failed_deauth"
+	DiscrepancyMissingClient = "missing_client"
+	DiscrepancyMissingTimer  = "missing_timer"
+)
+
+// ReconcileDiscrepancy is published for every discrepancy the reconciler finds and fixes or retries
+type ReconcileDiscrepancy struct {
+	MACAddress string
+	Kind       string
+}
+
+// PaymentReceived is published when the wallet accepted a token
+type PaymentReceived struct {
+	Mint   string
+	Amount uint64
+}
+
+// PayoutCompleted is published when the wallet paid out to a lightning address or sent ecash to an npub
+type PayoutCompleted struct {
+	Mint   string
+	Amount uint64
+	// Payee is who was paid: a lightning address, the wallet of a wallet connection like
+	// nwc:<pubkey>, or the npub ecash was sent to
+	Payee string
+	// LightningAddress is the lightning address paid, empty for wallet connection and ecash payouts
+	LightningAddress string
+}
+
+// UpdateStaged is published when the janitor downloaded and verified a new package for installation
+type UpdateStaged struct {
+	Version     string
+	PackagePath string
+	EventID     string
+}
@@ -0,0 +1,3 @@
+module github.com/OpenTollGate/tollgate-module-basic-go/src/events
+
+go 1.24.2
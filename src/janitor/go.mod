@@ -2,10 +2,13 @@ module github.com/OpenTollGate/tollgate-module-basic-go/src/janitor
 
 replace github.com/OpenTollGate/tollgate-module-basic-go/src/config_manager => ../config_manager
 
+replace github.com/OpenTollGate/tollgate-module-basic-go/src/events => ../events
+
 go 1.24.2
 
 require (
 	github.com/OpenTollGate/tollgate-module-basic-go/src/config_manager v0.0.0-20250508155752-c38b5e886bf9
+	github.com/OpenTollGate/tollgate-module-basic-go/src/events v0.0.0
 	github.com/hashicorp/go-version v1.7.0
 	github.com/nbd-wtf/go-nostr v0.51.10
 )
@@ -18,6 +18,7 @@ import (
 	"time"
 
 	"github.com/OpenTollGate/tollgate-module-basic-go/src/config_manager"
+	"github.com/OpenTollGate/tollgate-module-basic-go/src/events"
 	"github.com/hashicorp/go-version"
 	"github.com/nbd-wtf/go-nostr"
 	"strconv"
@@ -25,11 +26,14 @@ import (
 
 type Janitor struct {
 	configManager *config_manager.ConfigManager
+	bus           *events.Bus
 }
 
-func NewJanitor(configManager *config_manager.ConfigManager) (*Janitor, error) {
+// NewJanitor creates a janitor that publishes staged updates on bus, which may be nil
+func NewJanitor(configManager *config_manager.ConfigManager, bus *events.Bus) (*Janitor, error) {
 	return &Janitor{
 		configManager: configManager,
+		bus:           bus,
 	}, nil
 }
 
@@ -324,6 +328,11 @@ func (j *Janitor) listenForNIP94Events() {
 					isTimerActive = false
 					return
 				}
+				j.bus.Publish(events.UpdateStaged{
+					Version:     versionStr,
+					PackagePath: pkgPath,
+					EventID:     event.ID,
+				})
 				debounceTimer.Stop()
 				isTimerActive = false
 			}
@@ -254,7 +254,7 @@ func TestUpdateInstallConfig(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	_, err = NewJanitor(cm)
+	_, err = NewJanitor(cm, nil)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -306,7 +306,7 @@ func TestDownloadPackage(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	_, err = NewJanitor(cm)
+	_, err = NewJanitor(cm, nil)
 	if err != nil {
 		t.Fatal(err)
 	}
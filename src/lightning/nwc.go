@@ -0,0 +1,249 @@
+package lightning
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"time"
+
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/nbd-wtf/go-nostr/nip04"
+)
+
+// Kinds of Nostr Wallet Connect events (NIP-47)
+const (
+	KindNWCRequest  = 23194
+	KindNWCResponse = 23195
+)
+
+// nwcTimeout is how long a wallet service has to answer a request
+const nwcTimeout = 30 * time.Second
+
+// ErrNWCNoRelay is returned when a request couldn't be published to any relay of the connection
+var ErrNWCNoRelay = errors.New("no relay of the wallet connection accepted the request")
+
+// NWCConnection is a parsed nostr+walletconnect:// connection string
+type NWCConnection struct {
+	WalletPubkey string
+	Relays       []string
+	// Secret is the private key the client signs and encrypts requests with
+	Secret string
+	// Lud16 is the lightning address of the wallet, if it has one
+	Lud16 string
+}
+
+// ParseNWCConnection parses a connection string like
+// nostr+walletconnect://<wallet pubkey>?relay=wss://relay.example&secret=<hex key>
+func ParseNWCConnection(connection string) (NWCConnection, error) {
+	parsed, err := url.Parse(connection)
+	if err != nil {
+		return NWCConnection{}, fmt.Errorf("invalid wallet connection: %w", err)
+	}
+	if parsed.Scheme != "nostr+walletconnect" && parsed.Scheme != "nostrwalletconnect" {
+		return NWCConnection{}, fmt.Errorf("invalid wallet connection scheme %q, expected nostr+walletconnect", parsed.Scheme)
+	}
+
+	// The pubkey is the host of nostr+walletconnect://pubkey and the opaque part of nostr+walletconnect:pubkey
+	walletPubkey := parsed.Host
+	if walletPubkey == "" {
+		walletPubkey = parsed.Opaque
+	}
+	if !nostr.IsValidPublicKey(walletPubkey) {
+		return NWCConnection{}, fmt.Errorf("invalid wallet pubkey %q in wallet connection", walletPubkey)
+	}
+
+	query := parsed.Query()
+	nwc := NWCConnection{
+		WalletPubkey: walletPubkey,
+		Relays:       query["relay"],
+		Secret:       query.Get("secret"),
+		Lud16:        query.Get("lud16"),
+	}
+	if len(nwc.Relays) == 0 {
+		return NWCConnection{}, fmt.Errorf("wallet connection has no relay")
+	}
+	if _, err := nostr.GetPublicKey(nwc.Secret); err != nil || len(nwc.Secret) != 64 {
+		return NWCConnection{}, fmt.Errorf("wallet connection has no valid secret")
+	}
+	return nwc, nil
+}
+
+// String describes the connection without its secret, for logs and records
+func (c NWCConnection) String() string {
+	return "nwc:" + c.WalletPubkey
+}
+
+// NWCError is an error returned by the wallet service
+type NWCError struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+func (e *NWCError) Error() string {
+	return fmt.Sprintf("wallet service error %s: %s", e.Code, e.Message)
+}
+
+type nwcRequest struct {
+	Method string      `json:"method"`
+	Params interface{} `json:"params"`
+}
+
+type nwcResponse struct {
+	ResultType string          `json:"result_type"`
+	Error      *NWCError       `json:"error"`
+	Result     json.RawMessage `json:"result"`
+}
+
+// NWCClient talks to a wallet service over Nostr Wallet Connect (NIP-47), through the relays of its connection
+type NWCClient struct {
+	connection   NWCConnection
+	pool         *nostr.SimplePool
+	clientPubkey string
+	sharedSecret []byte
+	timeout      time.Duration
+}
+
+// NewNWCClient creates a client for the wallet service of a connection string, using pool to reach its relays
+func NewNWCClient(connection string, pool *nostr.SimplePool) (*NWCClient, error) {
+	nwc, err := ParseNWCConnection(connection)
+	if err != nil {
+		return nil, err
+	}
+	clientPubkey, err := nostr.GetPublicKey(nwc.Secret)
+	if err != nil {
+		return nil, fmt.Errorf("invalid wallet connection secret: %w", err)
+	}
+	sharedSecret, err := nip04.ComputeSharedSecret(nwc.WalletPubkey, nwc.Secret)
+	if err != nil {
+		return nil, fmt.Errorf("failed to compute shared secret with wallet service: %w", err)
+	}
+
+	return &NWCClient{
+		connection:   nwc,
+		pool:         pool,
+		clientPubkey: clientPubkey,
+		sharedSecret: sharedSecret,
+		timeout:      nwcTimeout,
+	}, nil
+}
+
+// Connection returns the connection of the client
+func (c *NWCClient) Connection() NWCConnection {
+	return c.connection
+}
+
+// MakeInvoice asks the wallet service for an invoice of amountSats
+func (c *NWCClient) MakeInvoice(ctx context.Context, amountSats uint64, description string) (string, error) {
+	params := map[string]interface{}{
+		"amount":      amountSats * 1000, // millisatoshis
+		"description": description,
+	}
+	var result struct {
+		Invoice string `json:"invoice"`
+	}
+	if err := c.request(ctx, "make_invoice", params, &result); err != nil {
+		return "", err
+	}
+	if result.Invoice == "" {
+		return "", fmt.Errorf("received empty invoice from wallet service")
+	}
+	return result.Invoice, nil
+}
+
+// request sends a request to the wallet service and decodes the result of its response into result
+func (c *NWCClient) request(ctx context.Context, method string, params interface{}, result interface{}) error {
+	ctx, cancel := context.WithTimeout(ctx, c.timeout)
+	defer cancel()
+
+	payload, err := json.Marshal(nwcRequest{Method: method, Params: params})
+	if err != nil {
+		return fmt.Errorf("failed to marshal %s request: %w", method, err)
+	}
+	content, err := nip04.Encrypt(string(payload), c.sharedSecret)
+	if err != nil {
+		return fmt.Errorf("failed to encrypt %s request: %w", method, err)
+	}
+	event := nostr.Event{
+		Kind:      KindNWCRequest,
+		CreatedAt: nostr.Now(),
+		Tags:      nostr.Tags{{"p", c.connection.WalletPubkey}},
+		Content:   content,
+	}
+	if err := event.Sign(c.connection.Secret); err != nil {
+		return fmt.Errorf("failed to sign %s request: %w", method, err)
+	}
+
+	// Subscribe to the response before publishing the request, so a quick response isn't missed
+	eose := make(chan struct{})
+	responses := c.pool.SubscribeManyNotifyEOSE(ctx, c.connection.Relays, nostr.Filter{
+		Kinds:   []int{KindNWCResponse},
+		Authors: []string{c.connection.WalletPubkey},
+		Tags:    nostr.TagMap{"e": []string{event.ID}},
+	}, eose)
+	select {
+	case <-eose:
+	case <-ctx.Done():
+		return fmt.Errorf("subscribing to %s response: %w", method, ctx.Err())
+	}
+
+	published := false
+	var publishErr error
+	for result := range c.pool.PublishMany(ctx, c.connection.Relays, event) {
+		if result.Error == nil {
+			published = true
+		} else {
+			publishErr = result.Error
+		}
+	}
+	if !published {
+		return fmt.Errorf("%w: %v", ErrNWCNoRelay, publishErr)
+	}
+
+	for {
+		select {
+		case response, ok := <-responses:
+			if !ok {
+				return fmt.Errorf("relays closed the subscription before the %s response", method)
+			}
+			if !isNWCResponseTo(response.Event, event.ID, c.clientPubkey) {
+				continue
+			}
+			return c.decodeResponse(response.Event, method, result)
+		case <-ctx.Done():
+			return fmt.Errorf("waiting for %s response: %w", method, ctx.Err())
+		}
+	}
+}
+
+// isNWCResponseTo reports whether event is a valid response to the request requestID of clientPubkey
+func isNWCResponseTo(event *nostr.Event, requestID string, clientPubkey string) bool {
+	if event == nil || event.Tags.GetFirst([]string{"e", requestID}) == nil || event.Tags.GetFirst([]string{"p", clientPubkey}) == nil {
+		return false
+	}
+	valid, err := event.CheckSignature()
+	return err == nil && valid
+}
+
+func (c *NWCClient) decodeResponse(event *nostr.Event, method string, result interface{}) error {
+	plaintext, err := nip04.Decrypt(event.Content, c.sharedSecret)
+	if err != nil {
+		return fmt.Errorf("failed to decrypt %s response: %w", method, err)
+	}
+
+	var response nwcResponse
+	if err := json.Unmarshal([]byte(plaintext), &response); err != nil {
+		return fmt.Errorf("failed to parse %s response: %w", method, err)
+	}
+	if response.Error != nil {
+		return response.Error
+	}
+	if response.ResultType != method {
+		return fmt.Errorf("wallet service answered %s with %s", method, response.ResultType)
+	}
+	if err := json.Unmarshal(response.Result, result); err != nil {
+		return fmt.Errorf("failed to parse %s result: %w", method, err)
+	}
+	return nil
+}
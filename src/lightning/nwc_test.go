@@ -0,0 +1,246 @@
+package lightning
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/coder/websocket"
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/nbd-wtf/go-nostr/nip04"
+)
+
+// localRelay is a minimal in-memory nostr relay. It stores events and delivers them to
+// matching subscriptions, enough for wallet connect requests and responses.
+type localRelay struct {
+	*httptest.Server
+
+	mu     sync.Mutex
+	events []nostr.Event
+	subs   map[*relayConn]map[string]nostr.Filters
+}
+
+type relayConn struct {
+	conn *websocket.Conn
+	mu   sync.Mutex
+}
+
+func (c *relayConn) send(ctx context.Context, envelope nostr.Envelope) {
+	data, _ := json.Marshal(envelope)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.conn.Write(ctx, websocket.MessageText, data)
+}
+
+func newLocalRelay(t *testing.T) *localRelay {
+	t.Helper()
+	relay := &localRelay{subs: make(map[*relayConn]map[string]nostr.Filters)}
+	relay.Server = httptest.NewServer(http.HandlerFunc(relay.serve))
+	t.Cleanup(relay.Close)
+	return relay
+}
+
+func (r *localRelay) url() string {
+	return "ws" + strings.TrimPrefix(r.URL, "http")
+}
+
+func (r *localRelay) serve(w http.ResponseWriter, req *http.Request) {
+	conn, err := websocket.Accept(w, req, nil)
+	if err != nil {
+		return
+	}
+	client := &relayConn{conn: conn}
+	ctx := req.Context()
+	defer func() {
+		r.mu.Lock()
+		delete(r.subs, client)
+		r.mu.Unlock()
+		conn.CloseNow()
+	}()
+
+	for {
+		_, data, err := conn.Read(ctx)
+		if err != nil {
+			return
+		}
+		switch envelope := nostr.ParseMessage(string(data)).(type) {
+		case *nostr.ReqEnvelope:
+			r.mu.Lock()
+			if r.subs[client] == nil {
+				r.subs[client] = make(map[string]nostr.Filters)
+			}
+			r.subs[client][envelope.SubscriptionID] = envelope.Filters
+			var stored []nostr.Event
+			for _, event := range r.events {
+				if envelope.Filters.Match(&event) {
+					stored = append(stored, event)
+				}
+			}
+			r.mu.Unlock()
+			for _, event := range stored {
+				client.send(ctx, &nostr.EventEnvelope{SubscriptionID: &envelope.SubscriptionID, Event: event})
+			}
+			eose := nostr.EOSEEnvelope(envelope.SubscriptionID)
+			client.send(ctx, &eose)
+		case *nostr.CloseEnvelope:
+			r.mu.Lock()
+			delete(r.subs[client], string(*envelope))
+			r.mu.Unlock()
+		case *nostr.EventEnvelope:
+			event := envelope.Event
+			if valid, _ := event.CheckSignature(); !valid {
+				client.send(ctx, &nostr.OKEnvelope{EventID: event.ID, OK: false, Reason: "invalid: bad signature"})
+				continue
+			}
+			client.send(ctx, &nostr.OKEnvelope{EventID: event.ID, OK: true})
+			r.publish(event)
+		}
+	}
+}
+
+func (r *localRelay) publish(event nostr.Event) {
+	r.mu.Lock()
+	r.events = append(r.events, event)
+	type delivery struct {
+		client *relayConn
+		id     string
+	}
+	var deliveries []delivery
+	for client, subs := range r.subs {
+		for id, filters := range subs {
+			if filters.Match(&event) {
+				deliveries = append(deliveries, delivery{client, id})
+			}
+		}
+	}
+	r.mu.Unlock()
+
+	for _, d := range deliveries {
+		d.client.send(context.Background(), &nostr.EventEnvelope{SubscriptionID: &d.id, Event: event})
+	}
+}
+
+// fakeWalletService answers wallet connect requests on a relay with handle
+func fakeWalletService(t *testing.T, relayURL string, walletSecret string, handle func(request nwcRequest) nwcResponse) {
+	t.Helper()
+	walletPubkey, _ := nostr.GetPublicKey(walletSecret)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	relay, err := nostr.RelayConnect(ctx, relayURL)
+	if err != nil {
+		t.Fatalf("Wallet service failed to connect to relay: %v", err)
+	}
+	sub, err := relay.Subscribe(ctx, nostr.Filters{{Kinds: []int{KindNWCRequest}, Tags: nostr.TagMap{"p": []string{walletPubkey}}}})
+	if err != nil {
+		t.Fatalf("Wallet service failed to subscribe: %v", err)
+	}
+
+	go func() {
+		for event := range sub.Events {
+			sharedSecret, _ := nip04.ComputeSharedSecret(event.PubKey, walletSecret)
+			plaintext, err := nip04.Decrypt(event.Content, sharedSecret)
+			if err != nil {
+				continue
+			}
+			var request nwcRequest
+			json.Unmarshal([]byte(plaintext), &request)
+
+			payload, _ := json.Marshal(handle(request))
+			content, _ := nip04.Encrypt(string(payload), sharedSecret)
+			response := nostr.Event{
+				Kind:      KindNWCResponse,
+				CreatedAt: nostr.Now(),
+				Tags:      nostr.Tags{{"p", event.PubKey}, {"e", event.ID}},
+				Content:   content,
+			}
+			response.Sign(walletSecret)
+			relay.Publish(ctx, response)
+		}
+	}()
+}
+
+func TestParseNWCConnection(t *testing.T) {
+	walletPubkey, _ := nostr.GetPublicKey(nostr.GeneratePrivateKey())
+	secret := nostr.GeneratePrivateKey()
+
+	connection, err := ParseNWCConnection(fmt.Sprintf("nostr+walletconnect://%s?relay=wss%%3A%%2F%%2Frelay.one&relay=wss://relay.two&secret=%s&lud16=owner@example.com", walletPubkey, secret))
+	if err != nil {
+		t.Fatalf("Failed to parse connection: %v", err)
+	}
+	if connection.WalletPubkey != walletPubkey || connection.Secret != secret || connection.Lud16 != "owner@example.com" ||
+		len(connection.Relays) != 2 || connection.Relays[0] != "wss://relay.one" {
+		t.Errorf("Parsed connection %+v", connection)
+	}
+	if strings.Contains(connection.String(), secret) {
+		t.Errorf("Description %q of the connection contains its secret", connection.String())
+	}
+
+	invalid := []string{
+		"https://" + walletPubkey + "?relay=wss://relay.one&secret=" + secret,
+		"nostr+walletconnect://not-a-pubkey?relay=wss://relay.one&secret=" + secret,
+		"nostr+walletconnect://" + walletPubkey + "?secret=" + secret,
+		"nostr+walletconnect://" + walletPubkey + "?relay=wss://relay.one",
+		"nostr+walletconnect://" + walletPubkey + "?relay=wss://relay.one&secret=abc",
+	}
+	for _, connection := range invalid {
+		if _, err := ParseNWCConnection(connection); err == nil {
+			t.Errorf("Parsed invalid connection %q", connection)
+		}
+	}
+}
+
+func TestNWCMakeInvoice(t *testing.T) {
+	relay := newLocalRelay(t)
+	walletSecret := nostr.GeneratePrivateKey()
+	walletPubkey, _ := nostr.GetPublicKey(walletSecret)
+
+	fakeWalletService(t, relay.url(), walletSecret, func(request nwcRequest) nwcResponse {
+		params := request.Params.(map[string]interface{})
+		if request.Method != "make_invoice" {
+			return nwcResponse{ResultType: request.Method, Error: &NWCError{Code: "NOT_IMPLEMENTED", Message: "unknown method"}}
+		}
+		if params["amount"].(float64) > 1000000 {
+			return nwcResponse{ResultType: request.Method, Error: &NWCError{Code: "QUOTA_EXCEEDED", Message: "too much"}}
+		}
+		result, _ := json.Marshal(map[string]interface{}{
+			"type":    "incoming",
+			"invoice": fmt.Sprintf("lnbc%vn1fake", params["amount"]),
+		})
+		return nwcResponse{ResultType: request.Method, Result: result}
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	pool := nostr.NewSimplePool(ctx)
+	client, err := NewNWCClient(fmt.Sprintf("nostr+walletconnect://%s?relay=%s&secret=%s", walletPubkey, relay.url(), nostr.GeneratePrivateKey()), pool)
+	if err != nil {
+		t.Fatalf("Failed to create client: %v", err)
+	}
+	client.timeout = 5 * time.Second
+
+	invoice, err := client.MakeInvoice(ctx, 210, "TollGate payout")
+	if err != nil || invoice != "lnbc210000n1fake" {
+		t.Errorf("MakeInvoice returned %q, %v, expected the wallet's invoice for 210000 msats", invoice, err)
+	}
+
+	var walletErr *NWCError
+	if _, err := client.MakeInvoice(ctx, 2000, "TollGate payout"); !errors.As(err, &walletErr) || walletErr.Code != "QUOTA_EXCEEDED" {
+		t.Errorf("MakeInvoice above the quota returned %v, expected the wallet's QUOTA_EXCEEDED error", err)
+	}
+
+	// Nobody answers for another wallet
+	otherPubkey, _ := nostr.GetPublicKey(nostr.GeneratePrivateKey())
+	silent, _ := NewNWCClient(fmt.Sprintf("nostr+walletconnect://%s?relay=%s&secret=%s", otherPubkey, relay.url(), nostr.GeneratePrivateKey()), pool)
+	silent.timeout = 200 * time.Millisecond
+	if _, err := silent.MakeInvoice(ctx, 210, "TollGate payout"); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("MakeInvoice without a wallet service returned %v, expected a timeout", err)
+	}
+}
@@ -1,20 +1,30 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log"
+	"net"
 	"net/http"
+	"net/url"
 	"os"
-	"os/exec"
+	"os/signal"
+	"strconv"
 	"strings"
+	"syscall"
 	"time"
 
 	"github.com/OpenTollGate/tollgate-module-basic-go/src/bragging"
 	"github.com/OpenTollGate/tollgate-module-basic-go/src/config_manager"
+	"github.com/OpenTollGate/tollgate-module-basic-go/src/events"
 	"github.com/OpenTollGate/tollgate-module-basic-go/src/janitor"
 	"github.com/OpenTollGate/tollgate-module-basic-go/src/merchant"
+	"github.com/OpenTollGate/tollgate-module-basic-go/src/utils"
+	"github.com/OpenTollGate/tollgate-module-basic-go/src/valve"
+	"github.com/OpenTollGate/tollgate-module-basic-go/src/voucher"
 	"github.com/nbd-wtf/go-nostr"
 )
 
@@ -23,10 +33,23 @@ import (
 var configManager *config_manager.ConfigManager
 var tollgateDetailsString string
 var merchantInstance *merchant.Merchant
+var valveInstance *valve.Valve
+var eventBus *events.Bus
+
+// shutdownContext is done once the daemon was asked to stop
+var shutdownContext context.Context
+var payoutsStopped <-chan struct{}
 
 func init() {
 	var err error
 
+	shutdownContext, _ = signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+
+	eventBus = events.NewBus()
+	events.Subscribe(eventBus, "bragging", func(purchase events.SessionPurchased) {
+		announceSuccessfulPayment(purchase.MACAddress, int64(purchase.Amount), int64(purchase.Duration.Seconds()))
+	})
+
 	configManager, err = config_manager.NewConfigManager("/etc/tollgate/config.json")
 	if err != nil {
 		log.Fatalf("Failed to create config manager: %v", err)
@@ -55,8 +78,36 @@ func init() {
 		}
 	}
 
+	gate, err := valve.NewGate(valve.GateOptions{
+		Backend:            mainConfig.Gate.Backend,
+		NftFamily:          mainConfig.Gate.NftFamily,
+		NftTable:           mainConfig.Gate.NftTable,
+		NftSet:             mainConfig.Gate.NftSet,
+		NftShapingChain:    mainConfig.Gate.NftShapingChain,
+		NftWalledGardenSet: mainConfig.Gate.NftWalledGardenSet,
+	})
+	if err != nil {
+		log.Fatalf("Failed to create gate backend: %v", err)
+	}
+	sessionStore, err := valve.NewSessionStore("/etc/tollgate/sessions.json")
+	if err != nil {
+		log.Fatalf("Failed to open session store: %v", err)
+	}
+	valveInstance = valve.New(gate, sessionStore, eventBus)
+	if err := valveInstance.Restore(); err != nil {
+		log.Printf("Error restoring sessions: %v", err)
+	}
+	valveInstance.StartUsageMonitor(10 * time.Second)
+	valveInstance.StartReconciler(1 * time.Minute)
+	if mainConfig.AutoPause.Enabled {
+		valveInstance.StartAutoPause(30*time.Second, time.Duration(mainConfig.AutoPause.GraceSeconds)*time.Second)
+	}
+	if mainConfig.WalledGarden.Enabled {
+		valveInstance.StartWalledGarden(walledGardenHosts, 1*time.Minute)
+	}
+
 	var err2 error
-	merchantInstance, err2 = merchant.New(configManager)
+	merchantInstance, err2 = merchant.New(configManager, valveInstance, eventBus)
 	if err2 != nil {
 		log.Fatalf("Failed to create merchant: %v", err2)
 	}
@@ -65,14 +116,38 @@ func init() {
 		log.Fatalf("Failed to create merchant: %v", err)
 	}
 
-	merchantInstance.StartPayoutRoutine()
+	payoutsStopped = merchantInstance.StartPayoutRoutine(shutdownContext)
+	merchantInstance.StartFeeRefresh()
+	merchantInstance.StartInvoicePoller(2 * time.Second)
+	merchantInstance.StartConfigReload(shutdownContext)
 
 	// Initialize janitor module
 	initJanitor()
 }
 
+// walledGardenHosts returns the hosts of the accepted mints and the configured walled garden domains.
+// The config is reloaded on every call so the walled garden follows changes to the mint list.
+func walledGardenHosts() []string {
+	config, err := configManager.LoadConfig()
+	if err != nil {
+		log.Printf("Error loading config for walled garden: %v", err)
+		return nil
+	}
+
+	var hosts []string
+	for _, mint := range config.AcceptedMints {
+		mintURL, err := url.Parse(mint.URL)
+		if err != nil || mintURL.Hostname() == "" {
+			log.Printf("Skipping mint with invalid URL %q in walled garden", mint.URL)
+			continue
+		}
+		hosts = append(hosts, mintURL.Hostname())
+	}
+	return append(hosts, config.WalledGarden.Domains...)
+}
+
 func initJanitor() {
-	janitorInstance, err := janitor.NewJanitor(configManager)
+	janitorInstance, err := janitor.NewJanitor(configManager, eventBus)
 	if err != nil {
 		log.Fatalf("Failed to create janitor instance: %v", err)
 	}
@@ -81,17 +156,23 @@ func initJanitor() {
 	log.Println("Janitor module initialized and listening for NIP-94 events")
 }
 
+// getMacAddress returns the MAC address leased ipAddress
 func getMacAddress(ipAddress string) (string, error) {
-	cmdIn := `cat /tmp/dhcp.leases | cut -f 2,3,4 -s -d" " | grep -i ` + ipAddress + ` | cut -f 1 -s -d" "`
-	commandOutput, err := exec.Command("sh", "-c", cmdIn).Output()
+	ip := net.ParseIP(ipAddress)
+	if ip == nil {
+		return "", fmt.Errorf("invalid IP address %q", ipAddress)
+	}
 
-	var commandOutputString = string(commandOutput)
+	leases, err := os.ReadFile(utils.DHCPLeasesPath)
 	if err != nil {
-		fmt.Println(err, "Error when getting client's mac address. Command output: "+commandOutputString)
-		return "nil", err
+		return "", fmt.Errorf("error reading DHCP leases: %w", err)
 	}
 
-	return strings.Trim(commandOutputString, "\n"), nil
+	macAddress, found := utils.LeaseMACAddress(leases, ip)
+	if !found {
+		return "", fmt.Errorf("no DHCP lease for %s", ip)
+	}
+	return macAddress, nil
 }
 
 // CORS middleware to handle Cross-Origin Resource Sharing
@@ -102,7 +183,8 @@ func corsMiddleware(next http.HandlerFunc) http.HandlerFunc {
 		// Set CORS headers
 		w.Header().Set("Access-Control-Allow-Origin", "*") // Allow any origin, or specify domains like "https://yourdomain.com"
 		w.Header().Set("Access-Control-Allow-Methods", "GET, POST, OPTIONS")
-		w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization")
+		w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization, If-None-Match, If-Modified-Since")
+		w.Header().Set("Access-Control-Expose-Headers", "ETag, Last-Modified")
 
 		// Handle preflight OPTIONS requests
 		if r.Method == "OPTIONS" {
@@ -129,8 +211,14 @@ func handler(w http.ResponseWriter, r *http.Request) {
 	fmt.Fprint(w, "mac=", mac)
 }
 
+// handleDetails serves the advertisement. Its ETag and Last-Modified change whenever it is
+// signed again, so clients can poll with If-None-Match or If-Modified-Since cheaply.
 func handleDetails(w http.ResponseWriter, r *http.Request) {
-	fmt.Fprint(w, merchantInstance.GetAdvertisement())
+	advertisement := merchantInstance.GetAdvertisement()
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("ETag", `"`+advertisement.ID+`"`)
+	http.ServeContent(w, r, "", advertisement.CreatedAt, strings.NewReader(advertisement.Event))
 }
 
 // handleRootPost handles POST requests to the root endpoint
@@ -196,39 +284,591 @@ func handleRootPost(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
+	// Extract the optional tier the client wants to buy
+	var tierName string
+	for _, tag := range event.Tags {
+		if len(tag) > 0 && tag[0] == "tier" && len(tag) >= 2 {
+			tierName = tag[1]
+			break
+		}
+	}
+
 	log.Printf("Extracted MAC address: %s", macAddress)
 	log.Printf("Extracted payment token: %s", paymentToken)
 
-	purchaseSessionResult, err := merchantInstance.PurchaseSession(paymentToken, macAddress)
+	purchaseSessionResult, err := merchantInstance.PurchaseSession(paymentToken, macAddress, tierName, event)
 
 	// Set response headers and prepare JSON response
 	w.Header().Set("Content-Type", "application/json")
 
-	switch purchaseSessionResult.Status {
-	case "success":
-		w.WriteHeader(http.StatusOK)
-	case "rejected":
-		w.WriteHeader(http.StatusPaymentRequired)
-	default:
+	status := purchaseErrorStatus(err)
+	if status >= http.StatusInternalServerError {
 		// Log unexpected errors for easier debugging
-		log.Printf("Purchase session failed with status: %s, reason: %s",
-			purchaseSessionResult.Status, purchaseSessionResult.Description)
-		w.WriteHeader(http.StatusInternalServerError)
+		log.Printf("Purchase session failed with status: %s, reason: %s, error: %v",
+			purchaseSessionResult.Status, purchaseSessionResult.Description, err)
 	}
+	w.WriteHeader(status)
 
 	// Return meaningful response to the client with the operation status and reason
-	response := map[string]string{"status": purchaseSessionResult.Status}
+	response := map[string]interface{}{"status": purchaseSessionResult.Status}
 	if purchaseSessionResult.Description != "" {
 		response["reason"] = purchaseSessionResult.Description
 	}
+	if purchaseSessionResult.Code != "" {
+		response["code"] = purchaseSessionResult.Code
+	}
+	if purchaseSessionResult.Receipt != nil {
+		response["receipt"] = purchaseSessionResult.Receipt
+	}
+	if purchaseSessionResult.Balance != nil {
+		response["balance"] = *purchaseSessionResult.Balance
+	}
 
 	// Handle potential encoding errors
 	if err := json.NewEncoder(w).Encode(response); err != nil {
 		log.Printf("Error encoding response: %v", err)
 	}
+}
+
+// purchaseErrorStatus maps the error of a purchase to the HTTP status of the response.
+// Faulty requests are 400, payments that can't buy a session 402 to 409,
+// and failures of the tollgate or its mints 5xx so clients know to retry.
+func purchaseErrorStatus(err error) int {
+	switch {
+	case err == nil:
+		return http.StatusOK
+	case errors.Is(err, merchant.ErrInvalidMAC), errors.Is(err, merchant.ErrUnknownTier), errors.Is(err, merchant.ErrInvalidToken),
+		errors.Is(err, merchant.ErrInvalidEvent), errors.Is(err, merchant.ErrStaleEvent):
+		return http.StatusBadRequest
+	case errors.Is(err, merchant.ErrBelowMinimum), errors.Is(err, merchant.ErrInsufficientBalance):
+		return http.StatusPaymentRequired
+	case errors.Is(err, merchant.ErrUntrustedMint), errors.Is(err, merchant.ErrPrepaidDisabled):
+		return http.StatusForbidden
+	case errors.Is(err, merchant.ErrTokenSpent), errors.Is(err, merchant.ErrPaymentInProgress), errors.Is(err, merchant.ErrReplayedEvent):
+		return http.StatusConflict
+	case errors.Is(err, merchant.ErrMintUnreachable):
+		return http.StatusBadGateway
+	case errors.Is(err, merchant.ErrTooManyInvoices):
+		return http.StatusTooManyRequests
+	case errors.Is(err, merchant.ErrInvalidPurchase):
+		return http.StatusBadRequest
+	default:
+		return http.StatusInternalServerError
+	}
+}
 
-	fmt.Fprint(w, response)
+// handleSessionControl handles signed requests to pause, resume, transfer or refund a paid session.
+// The request is a fresh kind 21024 nostr event from the pubkey that purchased the session, tagging
+// the tollgate's pubkey, with an action tag of "pause", "resume", "transfer" or "refund" and the session's
+// device-identifier tag. Each event is accepted once. A transfer moves the session to the MAC address
+// in the new-device-identifier tag, which it requires, and a refund needs an e tag of the purchase event.
+func handleSessionControl(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		log.Println("Error reading request body:", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	defer r.Body.Close()
+
+	var event nostr.Event
+	err = json.Unmarshal(body, &event)
+	if err != nil {
+		log.Println("Error parsing nostr event:", err)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	ok, err := event.CheckSignature()
+	if err != nil || !ok {
+		log.Println("Invalid signature for nostr event:", err)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	if err := merchantInstance.AcceptSessionControl(event); err != nil {
+		log.Printf("Rejected session control event %s: %v", event.ID, err)
+		w.WriteHeader(purchaseErrorStatus(err))
+		return
+	}
+
+	var action, macAddress, newMacAddress string
+	for _, tag := range event.Tags {
+		if len(tag) >= 2 && tag[0] == "action" {
+			action = tag[1]
+		}
+		if len(tag) >= 3 && tag[0] == "device-identifier" {
+			macAddress = tag[2]
+		}
+		if len(tag) >= 3 && tag[0] == "new-device-identifier" {
+			newMacAddress = tag[2]
+		}
+	}
+
+	log.Printf("Session control request %s for MAC %s from %s", action, macAddress, event.PubKey)
+
+	var refund merchant.RefundResult
+	switch action {
+	case "pause":
+		err = valveInstance.PauseSession(macAddress, event.PubKey)
+	case "resume":
+		err = valveInstance.ResumeSession(macAddress, event.PubKey)
+	case "transfer":
+		if newMacAddress == "" {
+			err = fmt.Errorf("%w: missing new-device-identifier", valve.ErrInvalidMAC)
+			break
+		}
+		err = valveInstance.TransferSession(macAddress, newMacAddress, event.PubKey)
+	case "refund":
+		refund, err = merchantInstance.RefundSession(macAddress, event)
+	default:
+		err = fmt.Errorf("unknown action %q", action)
+	}
 
+	w.Header().Set("Content-Type", "application/json")
+	response := map[string]interface{}{"status": "success"}
+	if action == "refund" && err == nil {
+		response["token"] = refund.Token
+		response["amount"] = refund.Amount
+		response["mint"] = refund.Mint
+	}
+	if err != nil {
+		response["status"] = "rejected"
+		response["reason"] = err.Error()
+		switch {
+		case errors.Is(err, valve.ErrNoSession):
+			w.WriteHeader(http.StatusNotFound)
+		case errors.Is(err, valve.ErrNotOwner), errors.Is(err, merchant.ErrRefundsDisabled), errors.Is(err, merchant.ErrWrongPurchase):
+			w.WriteHeader(http.StatusForbidden)
+		case errors.Is(err, valve.ErrSessionPaused), errors.Is(err, valve.ErrSessionNotPaused), errors.Is(err, valve.ErrNoTimeLeft),
+			errors.Is(err, valve.ErrTargetHasSession), errors.Is(err, valve.ErrSameMACAddress), errors.Is(err, merchant.ErrNothingToRefund):
+			w.WriteHeader(http.StatusConflict)
+		case errors.Is(err, valve.ErrInvalidMAC), action != "pause" && action != "resume" && action != "transfer" && action != "refund":
+			w.WriteHeader(http.StatusBadRequest)
+		default:
+			log.Printf("Session control request %s for MAC %s failed: %v", action, macAddress, err)
+			response["status"] = "error"
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	}
+
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		log.Printf("Error encoding response: %v", err)
+	}
+}
+
+// handleInvoice lets clients pay for a session with a Lightning invoice instead of a Cashu token.
+// A POST with a signed nostr event carrying the device-identifier, an amount tag in sats and the
+// optional mint and tier tags returns the invoice of a mint quote. Once the invoice is paid the gate
+// opens, which clients can poll for with a GET of /invoice?quote=<quote id>.
+func handleInvoice(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		handleInvoiceStatus(w, r)
+		return
+	case http.MethodPost:
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		log.Println("Error reading request body:", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	defer r.Body.Close()
+
+	var event nostr.Event
+	err = json.Unmarshal(body, &event)
+	if err != nil {
+		log.Println("Error parsing nostr event:", err)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	ok, err := event.CheckSignature()
+	if err != nil || !ok {
+		log.Println("Invalid signature for nostr event:", err)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	var macAddress, mintURL, tierName, amountTag string
+	for _, tag := range event.Tags {
+		if len(tag) >= 3 && tag[0] == "device-identifier" {
+			macAddress = tag[2]
+		}
+		if len(tag) >= 2 && tag[0] == "amount" {
+			amountTag = tag[1]
+		}
+		if len(tag) >= 2 && tag[0] == "mint" {
+			mintURL = tag[1]
+		}
+		if len(tag) >= 2 && tag[0] == "tier" {
+			tierName = tag[1]
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	response := map[string]interface{}{"status": "success"}
+
+	amount, err := strconv.ParseUint(amountTag, 10, 64)
+	var purchase merchant.InvoicePurchase
+	if err != nil {
+		err = fmt.Errorf("%w: invalid amount %q", merchant.ErrInvalidPurchase, amountTag)
+	} else {
+		purchase, err = merchantInstance.RequestInvoice(amount, mintURL, macAddress, tierName, event)
+	}
+
+	if err != nil {
+		status := purchaseErrorStatus(err)
+		response["status"] = "rejected"
+		response["reason"] = err.Error()
+		response["code"] = merchant.ErrorCode(err)
+		if status >= http.StatusInternalServerError {
+			log.Printf("Creating an invoice for MAC %s failed: %v", macAddress, err)
+			response["status"] = "error"
+		}
+		w.WriteHeader(status)
+	} else {
+		response["quote"] = purchase.Quote.ID
+		response["invoice"] = purchase.Quote.Invoice
+		response["amount"] = purchase.Quote.Amount
+		response["mint"] = purchase.Quote.Mint
+		response["expiry"] = purchase.Quote.Expiry.Unix()
+	}
+
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		log.Printf("Error encoding response: %v", err)
+	}
+}
+
+// handleInvoiceStatus reports whether the invoice of a quote was paid and the gate opened
+func handleInvoiceStatus(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	purchase, err := merchantInstance.InvoiceStatus(r.URL.Query().Get("quote"))
+	if err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(map[string]interface{}{"status": "rejected", "reason": err.Error()})
+		return
+	}
+
+	response := map[string]interface{}{"status": purchase.Status}
+	if purchase.Result.Description != "" {
+		response["reason"] = purchase.Result.Description
+	}
+	if purchase.Result.Code != "" {
+		response["code"] = purchase.Result.Code
+	}
+	if purchase.Result.Receipt != nil {
+		response["receipt"] = purchase.Result.Receipt
+	}
+
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		log.Printf("Error encoding response: %v", err)
+	}
+}
+
+// handleVoucher redeems a prepaid voucher code for the requesting client.
+// The request body is a JSON object with the code, like {"code": "ABCDE-FGHJK"}.
+func handleVoucher(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	var request struct {
+		Code string `json:"code"`
+	}
+	if err := json.NewDecoder(io.LimitReader(r.Body, 1024)).Decode(&request); err != nil {
+		log.Println("Error parsing voucher request:", err)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	defer r.Body.Close()
+
+	w.Header().Set("Content-Type", "application/json")
+	response := map[string]interface{}{"status": "success"}
+
+	// Forwarding headers are set by clients, so the voucher goes to the device that connected
+	macAddress, err := getMacAddress(clientIP(r))
+	if err != nil {
+		log.Printf("Error getting MAC address of %s: %v", r.RemoteAddr, err)
+		w.WriteHeader(http.StatusInternalServerError)
+		response["status"] = "error"
+		response["reason"] = "Could not determine the MAC address of this device"
+		json.NewEncoder(w).Encode(response)
+		return
+	}
+
+	if _, err := merchantInstance.RedeemVoucher(request.Code, macAddress); err != nil {
+		status := voucherErrorStatus(err)
+		response["status"] = "rejected"
+		response["reason"] = err.Error()
+		response["code"] = merchant.ErrorCode(err)
+		if status >= http.StatusInternalServerError {
+			log.Printf("Redeeming a voucher for MAC %s failed: %v", macAddress, err)
+			response["status"] = "error"
+		}
+		w.WriteHeader(status)
+	}
+
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		log.Printf("Error encoding response: %v", err)
+	}
+}
+
+// voucherErrorStatus maps the error of a voucher redemption to an HTTP status
+func voucherErrorStatus(err error) int {
+	switch {
+	case errors.Is(err, merchant.ErrUnknownVoucher):
+		return http.StatusNotFound
+	case errors.Is(err, merchant.ErrVoucherExpired):
+		return http.StatusGone
+	case errors.Is(err, merchant.ErrVoucherUsed), errors.Is(err, merchant.ErrWrongMetric):
+		return http.StatusConflict
+	default:
+		return purchaseErrorStatus(err)
+	}
+}
+
+// handleAdminVouchers generates and exports voucher batches. It only answers requests from
+// the router itself, so venue staff generate codes over SSH or LuCI rather than the portal.
+// GET lists the vouchers of the batch query parameter as JSON, or as CSV with format=csv.
+// POST generates a batch from a JSON object like
+// {"batch": "lobby", "count": 20, "duration_seconds": 7200, "value": 100, "expires_at": 1767225600, "max_uses": 1},
+// with bytes instead of duration_seconds for data-volume vouchers.
+func handleAdminVouchers(w http.ResponseWriter, r *http.Request) {
+	if !isLoopbackRequest(r) {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		vouchers := merchantInstance.Vouchers().Vouchers(r.URL.Query().Get("batch"))
+		if r.URL.Query().Get("format") == "csv" {
+			w.Header().Set("Content-Type", "text/csv")
+			w.Header().Set("Content-Disposition", `attachment; filename="vouchers.csv"`)
+			if err := voucher.WriteCSV(w, vouchers); err != nil {
+				log.Printf("Error writing vouchers CSV: %v", err)
+			}
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(vouchers)
+	case http.MethodPost:
+		var request struct {
+			Batch           string `json:"batch"`
+			Count           int    `json:"count"`
+			DurationSeconds uint64 `json:"duration_seconds"`
+			Bytes           uint64 `json:"bytes"`
+			Value           uint64 `json:"value"`
+			ExpiresAt       int64  `json:"expires_at"`
+			MaxUses         int    `json:"max_uses"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			http.Error(w, fmt.Sprintf("Invalid voucher batch: %v", err), http.StatusBadRequest)
+			return
+		}
+
+		batch := voucher.Batch{
+			Name:      request.Batch,
+			Count:     request.Count,
+			Metric:    voucher.MetricMilliseconds,
+			Allotment: request.DurationSeconds * 1000,
+			Value:     request.Value,
+			MaxUses:   request.MaxUses,
+		}
+		if request.Bytes > 0 {
+			batch.Metric = voucher.MetricBytes
+			batch.Allotment = request.Bytes
+		}
+		if request.ExpiresAt > 0 {
+			batch.ExpiresAt = time.Unix(request.ExpiresAt, 0)
+		}
+
+		vouchers, err := merchantInstance.Vouchers().Generate(batch, time.Now())
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		log.Printf("Generated %d vouchers of %s in batch %s", len(vouchers),
+			voucher.FormatAllotment(batch.Metric, batch.Allotment), batch.Name)
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(vouchers)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+// handleAdminReconcile reports the discrepancies the reconciler found between the sessions
+// and the clients the gate backend has authorized since the daemon started
+func handleAdminReconcile(w http.ResponseWriter, r *http.Request) {
+	if !isLoopbackRequest(r) {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(valveInstance.ReconcileStats()); err != nil {
+		log.Printf("Error encoding response: %v", err)
+	}
+}
+
+// handleAdminPayouts reports when the balance of each mint was last and will next be paid out
+func handleAdminPayouts(w http.ResponseWriter, r *http.Request) {
+	if !isLoopbackRequest(r) {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(merchantInstance.PayoutStatus()); err != nil {
+		log.Printf("Error encoding response: %v", err)
+	}
+}
+
+// handleAdminPayoutLedger lists the payouts in the ledger, to reconcile them with the receiving
+// Lightning wallet. The mint and status query parameters and since and until, unix timestamps
+// bounding when payouts were created, narrow the list down.
+func handleAdminPayoutLedger(w http.ResponseWriter, r *http.Request) {
+	if !isLoopbackRequest(r) {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	query := r.URL.Query()
+	filter := merchant.PayoutFilter{Mint: query.Get("mint"), Status: query.Get("status")}
+	for name, bound := range map[string]*time.Time{"since": &filter.Since, "until": &filter.Until} {
+		if query.Get(name) == "" {
+			continue
+		}
+		timestamp, err := strconv.ParseInt(query.Get(name), 10, 64)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Invalid %s timestamp %q", name, query.Get(name)), http.StatusBadRequest)
+			return
+		}
+		*bound = time.Unix(timestamp, 0)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(merchantInstance.Payouts(filter)); err != nil {
+		log.Printf("Error encoding response: %v", err)
+	}
+}
+
+// handleAdminProfitShares reports what was split off for each profit share and what it accrued below its minimum
+func handleAdminProfitShares(w http.ResponseWriter, r *http.Request) {
+	if !isLoopbackRequest(r) {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(merchantInstance.ShareAccruals()); err != nil {
+		log.Printf("Error encoding response: %v", err)
+	}
+}
+
+// handleAdminCustomers lists the customers with their spending and prepaid balances,
+// or reports the customer with the pubkey query parameter
+func handleAdminCustomers(w http.ResponseWriter, r *http.Request) {
+	if !isLoopbackRequest(r) {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	var response interface{} = merchantInstance.Customers()
+	if pubkey := r.URL.Query().Get("pubkey"); pubkey != "" {
+		customer, exists := merchantInstance.Customer(pubkey)
+		if !exists {
+			http.Error(w, fmt.Sprintf("Unknown customer %s", pubkey), http.StatusNotFound)
+			return
+		}
+		response = customer
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		log.Printf("Error encoding response: %v", err)
+	}
+}
+
+// handleAdminResendPayout sends the token of the ecash payout with the id query parameter to its
+// npub again, for when the recipient reports it missing, and responds with the updated payout
+func handleAdminResendPayout(w http.ResponseWriter, r *http.Request) {
+	if !isLoopbackRequest(r) {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	payout, err := merchantInstance.ResendPayout(r.URL.Query().Get("id"))
+	switch {
+	case errors.Is(err, merchant.ErrUnknownPayout):
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	case errors.Is(err, merchant.ErrNoPayoutToken):
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	case err != nil:
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(payout); err != nil {
+		log.Printf("Error encoding response: %v", err)
+	}
+}
+
+// clientIP returns the IP address a request came from. Unlike getIP it ignores
+// forwarding headers, which clients can set.
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return ""
+	}
+	return host
+}
+
+// isLoopbackRequest reports whether a request comes from the router itself. Unlike getIP
+// it ignores forwarding headers, which clients can set.
+func isLoopbackRequest(r *http.Request) bool {
+	ip := net.ParseIP(clientIP(r))
+	return ip != nil && ip.IsLoopback()
 }
 
 func announceSuccessfulPayment(macAddress string, amount int64, durationSeconds int64) error {
@@ -289,6 +929,56 @@ func main() {
 		corsMiddleware(handleRoot)(w, r)
 	})
 
+	http.HandleFunc("/session", func(w http.ResponseWriter, r *http.Request) {
+		log.Printf("DEBUG: Hit /session endpoint from %s", r.RemoteAddr)
+		corsMiddleware(handleSessionControl)(w, r)
+	})
+
+	http.HandleFunc("/invoice", func(w http.ResponseWriter, r *http.Request) {
+		log.Printf("DEBUG: Hit /invoice endpoint from %s", r.RemoteAddr)
+		corsMiddleware(handleInvoice)(w, r)
+	})
+
+	http.HandleFunc("/voucher", func(w http.ResponseWriter, r *http.Request) {
+		log.Printf("DEBUG: Hit /voucher endpoint from %s", r.RemoteAddr)
+		corsMiddleware(handleVoucher)(w, r)
+	})
+
+	http.HandleFunc("/admin/vouchers", func(w http.ResponseWriter, r *http.Request) {
+		log.Printf("DEBUG: Hit /admin/vouchers endpoint from %s", r.RemoteAddr)
+		handleAdminVouchers(w, r)
+	})
+
+	http.HandleFunc("/admin/reconcile", func(w http.ResponseWriter, r *http.Request) {
+		log.Printf("DEBUG: Hit /admin/reconcile endpoint from %s", r.RemoteAddr)
+		handleAdminReconcile(w, r)
+	})
+
+	http.HandleFunc("/admin/payouts", func(w http.ResponseWriter, r *http.Request) {
+		log.Printf("DEBUG: Hit /admin/payouts endpoint from %s", r.RemoteAddr)
+		handleAdminPayouts(w, r)
+	})
+
+	http.HandleFunc("/admin/payouts/ledger", func(w http.ResponseWriter, r *http.Request) {
+		log.Printf("DEBUG: Hit /admin/payouts/ledger endpoint from %s", r.RemoteAddr)
+		handleAdminPayoutLedger(w, r)
+	})
+
+	http.HandleFunc("/admin/payouts/shares", func(w http.ResponseWriter, r *http.Request) {
+		log.Printf("DEBUG: Hit /admin/payouts/shares endpoint from %s", r.RemoteAddr)
+		handleAdminProfitShares(w, r)
+	})
+
+	http.HandleFunc("/admin/payouts/resend", func(w http.ResponseWriter, r *http.Request) {
+		log.Printf("DEBUG: Hit /admin/payouts/resend endpoint from %s", r.RemoteAddr)
+		handleAdminResendPayout(w, r)
+	})
+
+	http.HandleFunc("/admin/customers", func(w http.ResponseWriter, r *http.Request) {
+		log.Printf("DEBUG: Hit /admin/customers endpoint from %s", r.RemoteAddr)
+		handleAdminCustomers(w, r)
+	})
+
 	http.HandleFunc("/whoami", func(w http.ResponseWriter, r *http.Request) {
 		log.Printf("DEBUG: Hit /whoami endpoint from %s", r.RemoteAddr)
 		corsMiddleware(handler)(w, r)
@@ -303,7 +993,19 @@ func main() {
 		IdleTimeout:  60 * time.Second,
 	}
 
-	log.Fatal(server.ListenAndServe())
+	// Payouts that are melting finish before the daemon exits
+	go func() {
+		<-shutdownContext.Done()
+		log.Println("Stopping, waiting for running payouts to finish...")
+		<-payoutsStopped
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		server.Shutdown(ctx)
+	}()
+
+	if err := server.ListenAndServe(); !errors.Is(err, http.ErrServerClosed) {
+		log.Fatal(err)
+	}
 
 	fmt.Println("Shutting down Tollgate - Whoami")
 }
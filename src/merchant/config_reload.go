@@ -0,0 +1,94 @@
+package merchant
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"time"
+)
+
+// configReloadInterval is how often config.json is checked for changes
+const configReloadInterval = 10 * time.Second
+
+// ReloadConfig loads config.json again and applies its prices, tiers, accepted mints, profit
+// shares, loyalty rules and payout schedules, so the next advertisement carries them. An invalid
+// config is rejected and the config in effect is kept.
+func (m *Merchant) ReloadConfig() error {
+	config, err := m.configManager.LoadConfig()
+	if err != nil {
+		return fmt.Errorf("failed to load config: %w", err)
+	}
+	if config == nil {
+		return fmt.Errorf("config is empty")
+	}
+
+	if len(config.AcceptedMints) == 0 {
+		return fmt.Errorf("config accepts no mints")
+	}
+	pricing, err := NewPricing(config.Pricing)
+	if err != nil {
+		return fmt.Errorf("invalid pricing config: %w", err)
+	}
+	if err := validateProfitShares(config.ProfitShare); err != nil {
+		return fmt.Errorf("invalid profit share config: %w", err)
+	}
+	if err := validateLoyalty(config.Loyalty); err != nil {
+		return fmt.Errorf("invalid loyalty config: %w", err)
+	}
+	if err := validateTiers(config.Tiers, m.valve); err != nil {
+		return fmt.Errorf("invalid tier config: %w", err)
+	}
+
+	m.configMutex.Lock()
+	m.config = config
+	m.pricing = pricing
+	m.configMutex.Unlock()
+
+	// Newly accepted mints are advertised with their fees
+	m.tollwallet.SetAcceptedMints(mintURLs(config.AcceptedMints))
+	m.tollwallet.RefreshFees()
+	m.invalidateAdvertisement()
+	m.payouts.SetMints(config.AcceptedMints)
+
+	log.Printf("Config reloaded, accepted mints: %v", config.AcceptedMints)
+	return nil
+}
+
+// StartConfigReload checks config.json for changes every configReloadInterval and reloads it
+// when it was modified, until ctx is done
+func (m *Merchant) StartConfigReload(ctx context.Context) {
+	path := m.configManager.FilePath
+	lastModified := modTime(path)
+
+	go func() {
+		ticker := time.NewTicker(configReloadInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+
+			modified := modTime(path)
+			if modified.Equal(lastModified) {
+				continue
+			}
+			lastModified = modified
+			if err := m.ReloadConfig(); err != nil {
+				log.Printf("Error reloading %s, keeping the config in effect: %v", path, err)
+			}
+		}
+	}()
+}
+
+// modTime returns when the file at path was last modified, zero if it can't be read
+func modTime(path string) time.Time {
+	info, err := os.Stat(path)
+	if err != nil {
+		return time.Time{}
+	}
+	return info.ModTime()
+}
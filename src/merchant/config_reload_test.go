@@ -0,0 +1,103 @@
+package merchant
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/OpenTollGate/tollgate-module-basic-go/src/config_manager"
+	"github.com/OpenTollGate/tollgate-module-basic-go/src/valve"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+func TestReloadConfig(t *testing.T) {
+	mint := newStandInMint(t)
+	otherMint := newStandInMint(t)
+	m, _ := newTestMerchant(t, mint)
+
+	path := filepath.Join(t.TempDir(), "config.json")
+	m.configManager = &config_manager.ConfigManager{FilePath: path}
+	writeConfig := func(config config_manager.Config) {
+		t.Helper()
+		data, _ := json.Marshal(config)
+		if err := os.WriteFile(path, data, 0644); err != nil {
+			t.Fatalf("Failed to write config: %v", err)
+		}
+	}
+	advertisedTags := func(advertisement Advertisement) nostr.Tags {
+		t.Helper()
+		var event nostr.Event
+		if err := json.Unmarshal([]byte(advertisement.Event), &event); err != nil {
+			t.Fatalf("Failed to parse advertisement: %v", err)
+		}
+		if event.ID != advertisement.ID || event.CreatedAt.Time() != advertisement.CreatedAt {
+			t.Errorf("Advertisement %+v doesn't match its event", advertisement)
+		}
+		return event.Tags
+	}
+
+	before := m.GetAdvertisement()
+	if m.GetAdvertisement() != before {
+		t.Errorf("Advertisement was created again while nothing changed")
+	}
+	if age := time.Since(before.CreatedAt); age > time.Minute {
+		t.Errorf("Advertisement was created %s ago, expected now", age)
+	}
+
+	config := *m.config
+	config.PricePerStep = 5
+	config.AcceptedMints = []config_manager.MintConfig{{URL: mint.URL}, {URL: otherMint.URL}}
+	writeConfig(config)
+	if err := m.ReloadConfig(); err != nil {
+		t.Fatalf("Failed to reload config: %v", err)
+	}
+
+	after := m.GetAdvertisement()
+	if after.ID == before.ID {
+		t.Fatalf("Advertisement wasn't created again after the config changed")
+	}
+	tags := advertisedTags(after)
+	if tag := tags.Find("price_per_step"); tag == nil || tag[1] != "5" {
+		t.Errorf("Advertised price_per_step is %v, expected 5", tag)
+	}
+	if !slices.ContainsFunc(tags, func(tag nostr.Tag) bool { return len(tag) >= 2 && tag[0] == "mint" && tag[1] == otherMint.URL }) {
+		t.Errorf("Advertisement lacks the newly accepted mint: %v", tags)
+	}
+	if accepted := m.tollwallet.AcceptedMints(); !slices.Contains(accepted, otherMint.URL) {
+		t.Errorf("Wallet accepts %v, expected the new mint as well", accepted)
+	}
+	if status := m.PayoutStatus(); len(status) != 2 {
+		t.Errorf("Payouts are scheduled for %+v, expected the new mint as well", status)
+	}
+
+	// An invalid config is ignored
+	config.ProfitShare = []config_manager.ProfitShareConfig{{Factor: 2, LightningAddress: "owner@example.com"}}
+	writeConfig(config)
+	if err := m.ReloadConfig(); err == nil {
+		t.Errorf("Config with invalid profit shares was reloaded")
+	}
+	if m.GetAdvertisement() != after {
+		t.Errorf("Advertisement changed after an invalid config was rejected")
+	}
+
+	// So is a tier whose rate limits the gate can't enforce
+	config.ProfitShare = nil
+	config.Tiers = []config_manager.TierConfig{{Name: "fast", DownloadKbps: 10000}}
+	writeConfig(config)
+	store, err := valve.NewSessionStore(filepath.Join(t.TempDir(), "sessions.json"))
+	if err != nil {
+		t.Fatalf("Failed to create session store: %v", err)
+	}
+	m.valve = valve.New(valve.NewNdsctlGate(), store, nil)
+	if err := m.ReloadConfig(); !errors.Is(err, valve.ErrRateLimitUnsupported) {
+		t.Errorf("Reloading a rate limited tier on nodogsplash returned %v, expected %v", err, valve.ErrRateLimitUnsupported)
+	}
+	m.valve = valve.New(valve.NewOpenNDSGate(), store, nil)
+	if err := m.ReloadConfig(); err != nil {
+		t.Errorf("Failed to reload a rate limited tier on openNDS: %v", err)
+	}
+}
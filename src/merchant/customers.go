@@ -0,0 +1,380 @@
+package merchant
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/OpenTollGate/tollgate-module-basic-go/src/config_manager"
+	"github.com/OpenTollGate/tollgate-module-basic-go/src/utils"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// BalanceTopUp is the value of the balance tag of a payment event that credits its token to the
+// prepaid balance of the signer instead of opening a session. A balance tag with an amount in sats
+// pays for the session from the balance instead of a token.
+const BalanceTopUp = "top-up"
+
+// customerMaxIdle is how long a customer without a prepaid balance is remembered after their last purchase
+const customerMaxIdle = 400 * 24 * time.Hour
+
+// Customer is what the tollgate knows about the nostr pubkey that signed purchases
+type Customer struct {
+	Pubkey string `json:"pubkey"`
+	// Month is the calendar month MonthlySpend was spent in, "YYYY-MM" in the time zone of the pricing
+	Month        string `json:"month"`
+	MonthlySpend uint64 `json:"monthly_spend"`
+	TotalSpend   uint64 `json:"total_spend"`
+	// PaidSteps counts the steps the customer paid for, every free_step_every of them earn a free step
+	PaidSteps uint64 `json:"paid_steps"`
+	FreeSteps uint64 `json:"free_steps"`
+	// Balances holds the prepaid sats of the customer by mint, which the wallet keeps aside from payouts
+	Balances  map[string]uint64 `json:"balances,omitempty"`
+	FirstSeen time.Time         `json:"first_seen"`
+	LastSeen  time.Time         `json:"last_seen"`
+}
+
+// spentIn returns what the customer spent in month
+func (c Customer) spentIn(month string) uint64 {
+	if c.Month != month {
+		return 0
+	}
+	return c.MonthlySpend
+}
+
+// Balance returns the prepaid sats of the customer at all mints
+func (c Customer) Balance() uint64 {
+	var balance uint64
+	for _, amount := range c.Balances {
+		balance += amount
+	}
+	return balance
+}
+
+// Customers tracks the spending and prepaid balances of customers by pubkey, persisted to a JSON file
+type Customers struct {
+	path      string
+	mutex     sync.Mutex
+	customers map[string]Customer
+}
+
+// NewCustomers opens the customer store at path, loading any customers already on disk
+func NewCustomers(path string) (*Customers, error) {
+	customers := &Customers{
+		path:      path,
+		customers: make(map[string]Customer),
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return customers, nil
+		}
+		return nil, fmt.Errorf("failed to read customers %s: %w", path, err)
+	}
+	if len(data) == 0 {
+		return customers, nil
+	}
+
+	var loaded []Customer
+	if err := json.Unmarshal(data, &loaded); err != nil {
+		return nil, fmt.Errorf("failed to parse customers %s: %w", path, err)
+	}
+	for _, customer := range loaded {
+		customers.customers[customer.Pubkey] = customer
+	}
+	return customers, nil
+}
+
+// Customer returns the customer with pubkey, a new one if they never bought anything
+func (c *Customers) Customer(pubkey string) (Customer, bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	customer, exists := c.customers[pubkey]
+	if !exists {
+		customer.Pubkey = pubkey
+	}
+	return customer, exists
+}
+
+// List returns all customers, the most recently seen first
+func (c *Customers) List() []Customer {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	customers := c.sortedCustomers()
+	for i, j := 0, len(customers)-1; i < j; i, j = i+1, j-1 {
+		customers[i], customers[j] = customers[j], customers[i]
+	}
+	return customers
+}
+
+// RecordPurchase adds a purchase of amount sats in month to the spending of pubkey,
+// with the steps it paid for and the free steps it earned
+func (c *Customers) RecordPurchase(pubkey string, month string, amount uint64, paidSteps uint64, freeSteps uint64, now time.Time) error {
+	return c.update(pubkey, now, func(customer *Customer) error {
+		if customer.Month != month {
+			customer.Month = month
+			customer.MonthlySpend = 0
+		}
+		customer.MonthlySpend += amount
+		customer.TotalSpend += amount
+		customer.PaidSteps += paidSteps
+		customer.FreeSteps += freeSteps
+		return nil
+	})
+}
+
+// RecordRefund takes a refund of amount sats and the paid steps it refunded back out of the
+// spending of pubkey. Refunds of purchases in an earlier month only lower the total spend.
+func (c *Customers) RecordRefund(pubkey string, month string, amount uint64, refundedSteps uint64, now time.Time) error {
+	if _, exists := c.Customer(pubkey); !exists {
+		return nil
+	}
+	return c.update(pubkey, now, func(customer *Customer) error {
+		if customer.Month == month {
+			customer.MonthlySpend -= min(amount, customer.MonthlySpend)
+		}
+		customer.TotalSpend -= min(amount, customer.TotalSpend)
+		customer.PaidSteps -= min(refundedSteps, customer.PaidSteps)
+		return nil
+	})
+}
+
+// Credit adds amount sats at mint to the prepaid balance of pubkey and returns the new balance
+func (c *Customers) Credit(pubkey string, mint string, amount uint64, now time.Time) (uint64, error) {
+	var balance uint64
+	err := c.update(pubkey, now, func(customer *Customer) error {
+		if customer.Balances == nil {
+			customer.Balances = make(map[string]uint64)
+		}
+		customer.Balances[mint] += amount
+		balance = customer.Balance()
+		return nil
+	})
+	return balance, err
+}
+
+// Debit takes amount sats from the prepaid balance of pubkey at the mint holding the most of it.
+// It returns that mint and the remaining balance.
+func (c *Customers) Debit(pubkey string, amount uint64, now time.Time) (string, uint64, error) {
+	var mint string
+	var balance uint64
+	err := c.update(pubkey, now, func(customer *Customer) error {
+		for candidate, available := range customer.Balances {
+			if mint == "" || available > customer.Balances[mint] || available == customer.Balances[mint] && candidate < mint {
+				mint = candidate
+			}
+		}
+		if available := customer.Balances[mint]; available < amount {
+			return fmt.Errorf("%w: %d sats at mint %s, %d sats needed", ErrInsufficientBalance, available, mint, amount)
+		}
+		customer.Balances[mint] -= amount
+		if customer.Balances[mint] == 0 {
+			delete(customer.Balances, mint)
+		}
+		balance = customer.Balance()
+		return nil
+	})
+	return mint, balance, err
+}
+
+// Reserved returns the prepaid balances held at mint, which are not paid out
+func (c *Customers) Reserved(mint string) uint64 {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	var reserved uint64
+	for _, customer := range c.customers {
+		reserved += customer.Balances[mint]
+	}
+	return reserved
+}
+
+// update applies change to the customer with pubkey and persists it, leaving the customer as it was if either fails
+func (c *Customers) update(pubkey string, now time.Time, change func(customer *Customer) error) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	previous, exists := c.customers[pubkey]
+	customer := previous
+	if !exists {
+		customer = Customer{Pubkey: pubkey, FirstSeen: now}
+	}
+	// The balances are changed on a copy, the map of previous stays as it was
+	balances := make(map[string]uint64, len(customer.Balances))
+	for mint, amount := range customer.Balances {
+		balances[mint] = amount
+	}
+	customer.Balances = balances
+	if err := change(&customer); err != nil {
+		return err
+	}
+	if len(customer.Balances) == 0 {
+		customer.Balances = nil
+	}
+	customer.LastSeen = now
+
+	c.customers[pubkey] = customer
+	c.prune(now)
+	if err := c.persist(); err != nil {
+		if exists {
+			c.customers[pubkey] = previous
+		} else {
+			delete(c.customers, pubkey)
+		}
+		return err
+	}
+	return nil
+}
+
+// prune forgets customers without a prepaid balance not seen for customerMaxIdle. The caller must hold c.mutex.
+func (c *Customers) prune(now time.Time) {
+	for pubkey, customer := range c.customers {
+		if len(customer.Balances) == 0 && now.Sub(customer.LastSeen) > customerMaxIdle {
+			delete(c.customers, pubkey)
+		}
+	}
+}
+
+// sortedCustomers returns the customers, least recently seen first. The caller must hold c.mutex.
+func (c *Customers) sortedCustomers() []Customer {
+	customers := make([]Customer, 0, len(c.customers))
+	for _, customer := range c.customers {
+		customers = append(customers, customer)
+	}
+	sort.Slice(customers, func(i, j int) bool {
+		if !customers[i].LastSeen.Equal(customers[j].LastSeen) {
+			return customers[i].LastSeen.Before(customers[j].LastSeen)
+		}
+		return customers[i].Pubkey < customers[j].Pubkey
+	})
+	return customers
+}
+
+// persist writes the customers to disk. The caller must hold c.mutex.
+func (c *Customers) persist() error {
+	data, err := json.Marshal(c.sortedCustomers())
+	if err != nil {
+		return fmt.Errorf("failed to marshal customers: %w", err)
+	}
+	return utils.WriteFileAtomic(c.path, data)
+}
+
+// validateLoyalty rejects loyalty discounts that don't lower the price or never apply
+func validateLoyalty(loyalty config_manager.LoyaltyConfig) error {
+	for _, discount := range loyalty.Discounts {
+		if discount.MonthlySpend == 0 || discount.DiscountPercent == 0 || discount.DiscountPercent >= 100 {
+			return fmt.Errorf("invalid loyalty discount of %d%% from %d sats a month", discount.DiscountPercent, discount.MonthlySpend)
+		}
+	}
+	return nil
+}
+
+// loyaltyDiscount returns the percentage off for a customer who spent monthlySpend this month,
+// the largest of the discounts whose monthly spend they reached
+func loyaltyDiscount(loyalty config_manager.LoyaltyConfig, monthlySpend uint64) uint64 {
+	var percent uint64
+	for _, discount := range loyalty.Discounts {
+		if monthlySpend >= discount.MonthlySpend {
+			percent = max(percent, discount.DiscountPercent)
+		}
+	}
+	return percent
+}
+
+// loyaltyFreeSteps returns the free steps a customer earns by paying for steps after paidBefore
+// earlier ones, one for every freeStepEvery paid steps
+func loyaltyFreeSteps(freeStepEvery uint64, paidBefore uint64, steps uint64) uint64 {
+	if freeStepEvery == 0 {
+		return 0
+	}
+	return (paidBefore+steps)/freeStepEvery - paidBefore/freeStepEvery
+}
+
+// loyaltyMonth returns the calendar month of now in the time zone of pricing, which monthly spending counts in
+func loyaltyMonth(pricing *Pricing, now time.Time) string {
+	return now.In(pricing.location).Format("2006-01")
+}
+
+// balancePayment returns the value of the balance tag of a payment event, see BalanceTopUp
+func balancePayment(event nostr.Event) (string, bool) {
+	tag := event.Tags.Find("balance")
+	if tag == nil {
+		return "", false
+	}
+	return tag[1], true
+}
+
+// Customers returns the customers who signed purchases while loyalty was enabled, the most recently seen first
+func (m *Merchant) Customers() []Customer {
+	return m.customers.List()
+}
+
+// Customer returns the spending and prepaid balance of the customer with pubkey
+func (m *Merchant) Customer(pubkey string) (Customer, bool) {
+	return m.customers.Customer(pubkey)
+}
+
+// prepaidEnabled reports whether customers may keep a prepaid balance
+func prepaidEnabled(config *config_manager.Config) bool {
+	return config.Loyalty.Enabled && config.Loyalty.PrepaidBalance
+}
+
+// topUpBalance credits amount sats received at mint to the prepaid balance of the signer of purchaseEvent
+func (m *Merchant) topUpBalance(amount uint64, mint string, purchaseEvent nostr.Event) (PurchaseSessionResult, error) {
+	balance, err := m.customers.Credit(purchaseEvent.PubKey, mint, amount, time.Now())
+	if err != nil {
+		log.Printf("Error crediting %d sats to the balance of %s: %v", amount, purchaseEvent.PubKey, err)
+		err = fmt.Errorf("%w of %s: %w", ErrBalanceFailure, purchaseEvent.PubKey, err)
+		return failedPurchase(err, "Error while crediting the prepaid balance"), err
+	}
+
+	log.Printf("Topped up the balance of %s by %d sats at %s to %d sats", purchaseEvent.PubKey, amount, mint, balance)
+	return PurchaseSessionResult{Status: "success", Balance: &balance}, nil
+}
+
+// purchaseFromBalance opens the gate for macAddress for what the amount in the balance tag of
+// purchaseEvent buys, taken from the prepaid balance of its signer
+func (m *Merchant) purchaseFromBalance(value string, pricePerStep uint64, macAddress string, tier config_manager.TierConfig, purchaseEvent nostr.Event) (PurchaseSessionResult, error) {
+	amount, err := strconv.ParseUint(value, 10, 64)
+	if err != nil {
+		err = fmt.Errorf("%w: balance tag %q is no amount of sats", ErrInvalidEvent, value)
+		return failedPurchase(err, "Invalid balance amount"), err
+	}
+	if amount < pricePerStep {
+		err = fmt.Errorf("%w: %d sats don't buy a single step at %d sats", ErrBelowMinimum, amount, pricePerStep)
+		return failedPurchase(err, fmt.Sprintf("Payment of %d sats is below the minimum of %d sats", amount, pricePerStep)), err
+	}
+
+	mint, balance, err := m.customers.Debit(purchaseEvent.PubKey, amount, time.Now())
+	if errors.Is(err, ErrInsufficientBalance) {
+		customer, _ := m.customers.Customer(purchaseEvent.PubKey)
+		return failedPurchase(err, fmt.Sprintf("Prepaid balance of %d sats doesn't cover %d sats", customer.Balance(), amount)), err
+	}
+	if err != nil {
+		log.Printf("Error debiting %d sats from the balance of %s: %v", amount, purchaseEvent.PubKey, err)
+		err = fmt.Errorf("%w of %s: %w", ErrBalanceFailure, purchaseEvent.PubKey, err)
+		return failedPurchase(err, "Error while debiting the prepaid balance"), err
+	}
+
+	result, err := m.openSession(amount, mint, pricePerStep, macAddress, tier, purchaseEvent)
+	if err != nil {
+		// The customer keeps what the session would have cost
+		restored, creditErr := m.customers.Credit(purchaseEvent.PubKey, mint, amount, time.Now())
+		if creditErr != nil {
+			log.Printf("Error restoring %d sats to the balance of %s after failing to open the gate: %v", amount, purchaseEvent.PubKey, creditErr)
+		} else {
+			balance = restored
+		}
+	}
+	result.Balance = &balance
+	return result, err
+}
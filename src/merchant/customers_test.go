@@ -0,0 +1,113 @@
+package merchant
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/OpenTollGate/tollgate-module-basic-go/src/config_manager"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+func TestLoyalty(t *testing.T) {
+	mint := newStandInMint(t)
+	m, _ := newTestMerchant(t, mint)
+	m.config.Loyalty = config_manager.LoyaltyConfig{
+		Enabled:       true,
+		Discounts:     []config_manager.LoyaltyDiscountConfig{{MonthlySpend: 20, DiscountPercent: 50}},
+		FreeStepEvery: 10,
+	}
+
+	// 20 sats buy 10 steps at 2 sats, which earn a free one. Having spent 20 sats,
+	// the next 20 sats buy 20 steps at half price and two more free ones.
+	for i, expected := range []time.Duration{11 * time.Minute, 22 * time.Minute} {
+		macAddress := []string{"00:11:22:33:44:d0", "00:11:22:33:44:d1"}[i]
+		if _, err := m.PurchaseSession(serializeToken(t, mint.token(t, 20)), macAddress, "", paymentEvent(m)); err != nil {
+			t.Fatalf("Purchase %d failed: %v", i, err)
+		}
+		session, _ := m.valve.GetSession(macAddress)
+		if length := session.ExpiresAt.Sub(session.StartedAt); length != expected {
+			t.Errorf("Purchase %d opened a session of %s, expected %s", i, length, expected)
+		}
+	}
+
+	customer, _ := m.Customer("customer-pubkey")
+	if customer.MonthlySpend != 40 || customer.PaidSteps != 30 || customer.FreeSteps != 3 {
+		t.Errorf("Customer is %+v, expected 40 sats spent for 30 paid and 3 free steps", customer)
+	}
+	if customer.spentIn("1999-01") != 0 {
+		t.Errorf("Spending counts toward another month")
+	}
+
+	if err := validateLoyalty(config_manager.LoyaltyConfig{Discounts: []config_manager.LoyaltyDiscountConfig{{MonthlySpend: 100, DiscountPercent: 100}}}); err == nil {
+		t.Errorf("Loyalty discount of 100%% is valid")
+	}
+}
+
+func TestPrepaidBalance(t *testing.T) {
+	mint := newStandInMint(t)
+	m, gate := newTestMerchant(t, mint)
+	macAddress := "00:11:22:33:44:e0"
+	balanceEvent := func(value string) nostr.Event {
+		event := paymentEvent(m)
+		event.Tags = append(event.Tags, nostr.Tag{"balance", value})
+		return event
+	}
+
+	if _, err := m.PurchaseSession(serializeToken(t, mint.token(t, 30)), "", "", balanceEvent(BalanceTopUp)); !errors.Is(err, ErrPrepaidDisabled) {
+		t.Errorf("Top-up without prepaid balances returned %v, expected ErrPrepaidDisabled", err)
+	}
+
+	m.config.Loyalty = config_manager.LoyaltyConfig{Enabled: true, PrepaidBalance: true}
+	result, err := m.PurchaseSession(serializeToken(t, mint.token(t, 30)), "", "", balanceEvent(BalanceTopUp))
+	if err != nil || result.Balance == nil || *result.Balance != 30 {
+		t.Fatalf("Top-up returned %+v, %v, expected a balance of 30 sats", result, err)
+	}
+
+	result, err = m.PurchaseSession("", macAddress, "", balanceEvent("20"))
+	if err != nil || *result.Balance != 10 {
+		t.Fatalf("Purchase from the balance returned %+v, %v, expected 10 sats left", result, err)
+	}
+	if status, _ := gate.Status(macAddress); !status.Authorized {
+		t.Errorf("Gate is closed after a purchase from the balance")
+	}
+	session, _ := m.valve.GetSession(macAddress)
+	if length := session.ExpiresAt.Sub(session.StartedAt); session.Mint != mint.URL || length != 10*time.Minute {
+		t.Errorf("Session of %s from %s, expected 10m from %s", length, session.Mint, mint.URL)
+	}
+
+	_, err = m.PurchaseSession("", "00:11:22:33:44:e1", "", balanceEvent("20"))
+	if !errors.Is(err, ErrInsufficientBalance) || ErrorCode(err) != CodeLowBalance {
+		t.Errorf("Purchase beyond the balance returned %v, expected ErrInsufficientBalance", err)
+	}
+	if reserved := m.customers.Reserved(mint.URL); reserved != 10 {
+		t.Errorf("%d sats of the mint are reserved, expected the remaining balance of 10", reserved)
+	}
+
+	reopened, err := NewCustomers(m.customers.path)
+	if err != nil {
+		t.Fatalf("Failed to reopen customers: %v", err)
+	}
+	if customer, _ := reopened.Customer("customer-pubkey"); customer.Balance() != 10 {
+		t.Errorf("Balance after reopening is %d sats, expected 10", customer.Balance())
+	}
+}
+
+func TestCustomersPrune(t *testing.T) {
+	customers, err := NewCustomers(filepath.Join(t.TempDir(), "customers.json"))
+	if err != nil {
+		t.Fatalf("Failed to open customers: %v", err)
+	}
+	start := time.Now()
+	customers.RecordPurchase("regular", "2026-01", 10, 5, 0, start)
+	customers.Credit("prepaid", "https://mint.example", 10, start)
+
+	customers.RecordPurchase("newcomer", "2027-03", 10, 5, 0, start.Add(customerMaxIdle+time.Hour))
+	if _, exists := customers.Customer("regular"); exists {
+		t.Errorf("Idle customer wasn't forgotten")
+	}
+	if _, exists := customers.Customer("prepaid"); !exists {
+		t.Errorf("Idle customer with a balance was forgotten")
+	}
+}
@@ -0,0 +1,253 @@
+package merchant
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"slices"
+	"time"
+
+	"github.com/OpenTollGate/tollgate-module-basic-go/src/config_manager"
+	"github.com/OpenTollGate/tollgate-module-basic-go/src/events"
+	"github.com/elnosh/gonuts/cashu"
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/nbd-wtf/go-nostr/keyer"
+	"github.com/nbd-wtf/go-nostr/nip17"
+	"github.com/nbd-wtf/go-nostr/nip19"
+	"github.com/nbd-wtf/go-nostr/nip61"
+)
+
+// Ways the token of an ecash payout reaches the npub of its profit share
+const (
+	// DeliveryDM sends the token in a NIP-17 direct message, gift wrapped so relays can't tell who paid whom
+	DeliveryDM = "dm"
+	// DeliveryNutzap locks the token to the recipient's nutzap key and publishes it as a NIP-61 nutzap
+	DeliveryNutzap = "nutzap"
+)
+
+// payoutDeliveryTimeout bounds looking up where to send a token and publishing it
+const payoutDeliveryTimeout = 30 * time.Second
+
+// Errors returned when the token of a payout can't be sent again
+var (
+	ErrUnknownPayout = errors.New("unknown payout")
+	ErrNoPayoutToken = errors.New("payout has no token to send")
+)
+
+// decodeNpub returns the hex pubkey of an npub
+func decodeNpub(npub string) (string, error) {
+	prefix, value, err := nip19.Decode(npub)
+	if err != nil || prefix != "npub" {
+		return "", fmt.Errorf("invalid npub %q", npub)
+	}
+	return value.(string), nil
+}
+
+// shareDelivery returns how the ecash of a share is sent, direct messages unless it asks for nutzaps
+func shareDelivery(share config_manager.ProfitShareConfig) string {
+	if share.Npub == "" {
+		return ""
+	}
+	if share.Delivery == "" {
+		return DeliveryDM
+	}
+	return share.Delivery
+}
+
+// attemptEcashPayout sends the token of a payout to its npub, creating the token first unless
+// an earlier attempt did, and records the outcome
+func (m *Merchant) attemptEcashPayout(mintConfig config_manager.MintConfig, payout Payout) {
+	log.Printf("Processing ecash payout %s for mint %s: %d sats to %s by %s", payout.ID, mintConfig.URL, payout.AimedAmount, payout.Npub, payout.Delivery)
+
+	payout.Attempts++
+	if payout.Token == "" {
+		token, err := m.payoutToken(payout)
+		if err == nil {
+			payout.Token, err = token.Serialize()
+		}
+		if err != nil {
+			payout = settleDelivery(payout, "", err, time.Now())
+			log.Printf("Error creating token for payout %s for mint %s, %s after %d attempts: %v", payout.ID, mintConfig.URL, payout.Status, payout.Attempts, err)
+			if err := m.payoutLedger.Update(payout); err != nil {
+				log.Printf("Error recording payout %s for mint %s: %v", payout.ID, mintConfig.URL, err)
+			}
+			return
+		}
+
+		payout.Amount = token.Amount()
+		// The token left the wallet, it has to be on record before it is sent
+		if err := m.payoutLedger.Update(payout); err != nil {
+			log.Printf("Error recording token of payout %s for mint %s: %v", payout.ID, mintConfig.URL, err)
+		}
+	}
+
+	eventID, sendErr := m.sendPayoutToken(payout)
+	payout = settleDelivery(payout, eventID, sendErr, time.Now())
+	if sendErr != nil {
+		log.Printf("Error sending token of payout %s for mint %s, %s after %d attempts: %v", payout.ID, mintConfig.URL, payout.Status, payout.Attempts, sendErr)
+	} else {
+		log.Printf("Sent %d sats of payout %s for mint %s to %s in event %s", payout.Amount, payout.ID, mintConfig.URL, payout.Npub, eventID)
+		m.bus.Publish(events.PayoutCompleted{Mint: payout.Mint, Amount: payout.Amount, Payee: payout.Npub})
+	}
+	if err := m.payoutLedger.Update(payout); err != nil {
+		log.Printf("Error recording payout %s for mint %s: %v", payout.ID, mintConfig.URL, err)
+	}
+}
+
+// payoutToken creates the token of a payout. Nutzaps are locked to the recipient's nutzap key,
+// which also tells whether they take tokens of the payout's mint.
+func (m *Merchant) payoutToken(payout Payout) (cashu.Token, error) {
+	if payout.Delivery != DeliveryNutzap {
+		return m.tollwallet.Send(payout.AimedAmount, payout.Mint, false)
+	}
+
+	recipient, err := decodeNpub(payout.Npub)
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), payoutDeliveryTimeout)
+	defer cancel()
+	info, err := m.nutzapInfo(ctx, recipient)
+	if err != nil {
+		return nil, err
+	}
+	if mint, _ := nostr.NormalizeHTTPURL(payout.Mint); !slices.Contains(info.Mints, mint) {
+		return nil, fmt.Errorf("%s doesn't take nutzaps from mint %s", payout.Npub, payout.Mint)
+	}
+	// Nutzap keys are x-only, locks need the even compressed key (NIP-61)
+	return m.tollwallet.SendLocked(payout.AimedAmount, payout.Mint, "02"+info.PublicKey)
+}
+
+// sendPayoutToken publishes the token of a payout to its npub and returns the ID of the event it was sent in
+func (m *Merchant) sendPayoutToken(payout Payout) (string, error) {
+	config, _ := m.settings()
+	recipient, err := decodeNpub(payout.Npub)
+	if err != nil {
+		return "", err
+	}
+	token, err := cashu.DecodeToken(payout.Token)
+	if err != nil {
+		return "", fmt.Errorf("error decoding token of payout %s: %w", payout.ID, err)
+	}
+	message := fmt.Sprintf("TollGate payout of %d sats from %s", token.Amount(), payout.Mint)
+
+	ctx, cancel := context.WithTimeout(context.Background(), payoutDeliveryTimeout)
+	defer cancel()
+
+	if payout.Delivery == DeliveryNutzap {
+		info, err := m.nutzapInfo(ctx, recipient)
+		if err != nil {
+			return "", err
+		}
+		nutzap, err := nutzapEvent(token, recipient, message)
+		if err != nil {
+			return "", err
+		}
+		if err := nutzap.Sign(config.TollgatePrivateKey); err != nil {
+			return "", fmt.Errorf("error signing nutzap: %w", err)
+		}
+		relays := info.Relays
+		if len(relays) == 0 {
+			relays = config.Relays
+		}
+		return nutzap.ID, m.publishEvent(ctx, relays, nutzap)
+	}
+
+	signer, err := keyer.NewPlainKeySigner(config.TollgatePrivateKey)
+	if err != nil {
+		return "", fmt.Errorf("error loading tollgate key: %w", err)
+	}
+	// The recipient's copy is enough, the token stays in the ledger
+	_, giftWrap, err := nip17.PrepareMessage(ctx, message+":\n\n"+payout.Token, nil, signer, recipient, nil)
+	if err != nil {
+		return "", fmt.Errorf("error preparing direct message: %w", err)
+	}
+	relays := nip17.GetDMRelays(ctx, recipient, m.relayPool, config.Relays)
+	if len(relays) == 0 {
+		relays = config.Relays
+	}
+	return giftWrap.ID, m.publishEvent(ctx, relays, giftWrap)
+}
+
+// nutzapInfo looks up the mints, relays and key a user takes nutzaps with (kind 10019)
+func (m *Merchant) nutzapInfo(ctx context.Context, pubkey string) (nip61.Info, error) {
+	config, _ := m.settings()
+	var info nip61.Info
+	event := m.relayPool.QuerySingle(ctx, config.Relays, nostr.Filter{Kinds: []int{nostr.KindNutZapInfo}, Authors: []string{pubkey}})
+	if event == nil {
+		return info, fmt.Errorf("%w: no nutzap info of %s found", nip61.NutzapsNotAccepted, pubkey)
+	}
+	if err := info.ParseEvent(event.Event); err != nil {
+		return info, fmt.Errorf("error parsing nutzap info of %s: %w", pubkey, err)
+	}
+	if info.PublicKey == "" {
+		return info, fmt.Errorf("%w: nutzap info of %s has no pubkey", nip61.NutzapsNotAccepted, pubkey)
+	}
+	return info, nil
+}
+
+// nutzapEvent builds the unsigned nutzap carrying the proofs of token to recipient
+func nutzapEvent(token cashu.Token, recipient string, message string) (nostr.Event, error) {
+	nutzap := nostr.Event{
+		Kind:      nostr.KindNutZap,
+		Content:   message,
+		CreatedAt: nostr.Now(),
+		Tags: nostr.Tags{
+			{"p", recipient},
+			{"u", token.Mint()},
+		},
+	}
+	for _, proof := range token.Proofs() {
+		proofJSON, err := json.Marshal(proof)
+		if err != nil {
+			return nostr.Event{}, fmt.Errorf("error encoding proof: %w", err)
+		}
+		nutzap.Tags = append(nutzap.Tags, nostr.Tag{"proof", string(proofJSON)})
+	}
+	return nutzap, nil
+}
+
+// publishEvent publishes event to relays, it is sent once any of them accepted it
+func (m *Merchant) publishEvent(ctx context.Context, relays []string, event nostr.Event) error {
+	if len(relays) == 0 {
+		return fmt.Errorf("no relays to send event %s to", event.ID)
+	}
+	var lastErr error
+	published := false
+	for result := range m.relayPool.PublishMany(ctx, relays, event) {
+		if result.Error != nil {
+			lastErr = result.Error
+			continue
+		}
+		published = true
+	}
+	if !published {
+		return fmt.Errorf("no relay of %v accepted event %s: %w", relays, event.ID, lastErr)
+	}
+	return nil
+}
+
+// ResendPayout sends the token of an ecash payout again, for when the recipient reports it missing
+func (m *Merchant) ResendPayout(id string) (Payout, error) {
+	payout, exists := m.payoutLedger.Payout(id)
+	if !exists {
+		return Payout{}, ErrUnknownPayout
+	}
+	if payout.Token == "" {
+		return payout, ErrNoPayoutToken
+	}
+
+	eventID, err := m.sendPayoutToken(payout)
+	if err != nil {
+		return payout, fmt.Errorf("error sending token of payout %s: %w", id, err)
+	}
+	log.Printf("Sent the token of payout %s to %s again in event %s", id, payout.Npub, eventID)
+
+	payout = settleDelivery(payout, eventID, nil, time.Now())
+	if err := m.payoutLedger.Update(payout); err != nil {
+		return payout, fmt.Errorf("error recording payout %s: %w", id, err)
+	}
+	return payout, nil
+}
@@ -0,0 +1,40 @@
+package merchant
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/elnosh/gonuts/cashu"
+)
+
+func TestNutzapEvent(t *testing.T) {
+	mint := newStandInMint(t)
+	token := mint.token(t, 8)
+	recipient := "79be667ef9dcbbac55a06295ce870b07029bfcdb2dce28d959f2815b16f81798"
+
+	nutzap, err := nutzapEvent(token, recipient, "TollGate payout")
+	if err != nil {
+		t.Fatalf("Failed to build nutzap: %v", err)
+	}
+	if nutzap.Kind != 9321 || nutzap.Content != "TollGate payout" {
+		t.Errorf("Nutzap is %+v, expected a kind 9321 event with the message", nutzap)
+	}
+	if tag := nutzap.Tags.Find("p"); tag == nil || tag[1] != recipient {
+		t.Errorf("Nutzap p tag is %v, expected %s", tag, recipient)
+	}
+	if tag := nutzap.Tags.Find("u"); tag == nil || tag[1] != mint.URL {
+		t.Errorf("Nutzap u tag is %v, expected %s", tag, mint.URL)
+	}
+
+	var proofs cashu.Proofs
+	for tag := range nutzap.Tags.FindAll("proof") {
+		var proof cashu.Proof
+		if err := json.Unmarshal([]byte(tag[1]), &proof); err != nil {
+			t.Fatalf("Failed to decode proof tag %v: %v", tag, err)
+		}
+		proofs = append(proofs, proof)
+	}
+	if len(proofs) != 1 || proofs[0].Secret != token.Proofs()[0].Secret || proofs.Amount() != 8 {
+		t.Errorf("Nutzap carries proofs %+v, expected those of the token", proofs)
+	}
+}
@@ -0,0 +1,119 @@
+package merchant
+
+import (
+	"errors"
+
+	"github.com/OpenTollGate/tollgate-module-basic-go/src/tollwallet"
+	"github.com/OpenTollGate/tollgate-module-basic-go/src/voucher"
+)
+
+// Errors a purchase fails with. Rejections are the customer's to fix, while ErrMintUnreachable,
+// ErrGateFailure and ErrBalanceFailure are failures on the tollgate's side that a retry may overcome.
+var (
+	ErrInvalidMAC   = errors.New("invalid MAC address")
+	ErrUnknownTier  = errors.New("unknown tier")
+	ErrInvalidToken = errors.New("invalid cashu token")
+	ErrBelowMinimum = errors.New("payment below minimum")
+	ErrGateFailure  = errors.New("error opening gate")
+
+	ErrInvalidEvent      = errors.New("invalid event")
+	ErrStaleEvent        = errors.New("event is stale")
+	ErrReplayedEvent     = errors.New("event was used before")
+	ErrPaymentInProgress = errors.New("payment is being processed")
+
+	ErrPrepaidDisabled     = errors.New("prepaid balances are disabled")
+	ErrInsufficientBalance = errors.New("insufficient prepaid balance")
+	ErrBalanceFailure      = errors.New("error updating prepaid balance")
+
+	ErrUntrustedMint   = tollwallet.ErrUntrustedMint
+	ErrTokenSpent      = tollwallet.ErrTokenSpent
+	ErrMintUnreachable = tollwallet.ErrMintUnreachable
+
+	ErrUnknownVoucher = voucher.ErrUnknownVoucher
+	ErrVoucherExpired = voucher.ErrVoucherExpired
+	ErrVoucherUsed    = voucher.ErrVoucherUsed
+	ErrWrongMetric    = voucher.ErrWrongMetric
+)
+
+// Machine-readable reasons a purchase failed, returned to the portal as code
+const (
+	CodeInvalidMAC      = "invalid_mac"
+	CodeUnknownTier     = "unknown_tier"
+	CodeInvalidToken    = "invalid_token"
+	CodeBelowMinimum    = "below_minimum"
+	CodeUntrustedMint   = "untrusted_mint"
+	CodeTokenSpent      = "token_spent"
+	CodeMintUnreachable = "mint_unreachable"
+	CodeGateFailure     = "gate_failure"
+	CodeInvalidEvent    = "invalid_event"
+	CodeStaleEvent      = "stale_event"
+	CodeReplayedEvent   = "replayed_event"
+	CodeInProgress      = "payment_in_progress"
+	CodeTooManyInvoices = "too_many_invoices"
+	CodeUnknownVoucher  = "unknown_voucher"
+	CodeVoucherExpired  = "voucher_expired"
+	CodeVoucherUsed     = "voucher_used"
+	CodeWrongMetric     = "voucher_wrong_metric"
+	CodePrepaidDisabled = "prepaid_disabled"
+	CodeLowBalance      = "insufficient_balance"
+	CodeBalanceFailure  = "balance_failure"
+	CodeInternal        = "internal_error"
+)
+
+// ErrorCode returns the machine-readable reason for a purchase error
+func ErrorCode(err error) string {
+	switch {
+	case errors.Is(err, ErrInvalidMAC):
+		return CodeInvalidMAC
+	case errors.Is(err, ErrUnknownTier):
+		return CodeUnknownTier
+	case errors.Is(err, ErrInvalidToken):
+		return CodeInvalidToken
+	case errors.Is(err, ErrBelowMinimum):
+		return CodeBelowMinimum
+	case errors.Is(err, ErrUntrustedMint):
+		return CodeUntrustedMint
+	case errors.Is(err, ErrTokenSpent):
+		return CodeTokenSpent
+	case errors.Is(err, ErrMintUnreachable):
+		return CodeMintUnreachable
+	case errors.Is(err, ErrGateFailure):
+		return CodeGateFailure
+	case errors.Is(err, ErrInvalidEvent):
+		return CodeInvalidEvent
+	case errors.Is(err, ErrStaleEvent):
+		return CodeStaleEvent
+	case errors.Is(err, ErrReplayedEvent):
+		return CodeReplayedEvent
+	case errors.Is(err, ErrPaymentInProgress):
+		return CodeInProgress
+	case errors.Is(err, ErrTooManyInvoices):
+		return CodeTooManyInvoices
+	case errors.Is(err, ErrUnknownVoucher):
+		return CodeUnknownVoucher
+	case errors.Is(err, ErrVoucherExpired):
+		return CodeVoucherExpired
+	case errors.Is(err, ErrVoucherUsed):
+		return CodeVoucherUsed
+	case errors.Is(err, ErrWrongMetric):
+		return CodeWrongMetric
+	case errors.Is(err, ErrPrepaidDisabled):
+		return CodePrepaidDisabled
+	case errors.Is(err, ErrInsufficientBalance):
+		return CodeLowBalance
+	case errors.Is(err, ErrBalanceFailure):
+		return CodeBalanceFailure
+	default:
+		return CodeInternal
+	}
+}
+
+// isRejection reports whether a purchase failed because of the payment rather than the tollgate
+func isRejection(err error) bool {
+	switch ErrorCode(err) {
+	case CodeMintUnreachable, CodeGateFailure, CodeBalanceFailure, CodeInternal:
+		return false
+	default:
+		return true
+	}
+}
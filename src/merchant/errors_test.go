@@ -0,0 +1,61 @@
+package merchant
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/OpenTollGate/tollgate-module-basic-go/src/config_manager"
+	"github.com/elnosh/gonuts/cashu"
+)
+
+func serializeToken(t *testing.T, token cashu.Token) string {
+	t.Helper()
+	serialized, err := token.Serialize()
+	if err != nil {
+		t.Fatalf("Failed to serialize token: %v", err)
+	}
+	return serialized
+}
+
+func TestPurchaseSessionErrors(t *testing.T) {
+	mint := newStandInMint(t)
+	offline := newStandInMint(t)
+	offline.Close()
+	m, gate := newTestMerchant(t, mint, offline.URL)
+	m.config.Tiers = []config_manager.TierConfig{{Name: "basic"}}
+
+	spent := mint.token(t, 10)
+	mint.spend(spent)
+	untrusted, _ := cashu.NewTokenV4(mint.token(t, 10).Proofs(), "https://untrusted.example", cashu.Sat, false)
+
+	tests := []struct {
+		name       string
+		token      string
+		macAddress string
+		tier       string
+		err        error
+		status     string
+		code       string
+	}{
+		{"invalid MAC", serializeToken(t, mint.token(t, 10)), "not-a-mac", "", ErrInvalidMAC, "rejected", CodeInvalidMAC},
+		{"unknown tier", serializeToken(t, mint.token(t, 10)), "00:11:22:33:44:90", "gold", ErrUnknownTier, "rejected", CodeUnknownTier},
+		{"invalid token", "cashuBnotatoken", "00:11:22:33:44:90", "", ErrInvalidToken, "rejected", CodeInvalidToken},
+		{"below minimum", serializeToken(t, mint.token(t, 1)), "00:11:22:33:44:90", "", ErrBelowMinimum, "rejected", CodeBelowMinimum},
+		{"untrusted mint", serializeToken(t, untrusted), "00:11:22:33:44:90", "", ErrUntrustedMint, "rejected", CodeUntrustedMint},
+		{"spent token", serializeToken(t, spent), "00:11:22:33:44:90", "", ErrTokenSpent, "rejected", CodeTokenSpent},
+		{"unreachable mint", serializeToken(t, offline.token(t, 10)), "00:11:22:33:44:90", "", ErrMintUnreachable, "error", CodeMintUnreachable},
+	}
+	for _, test := range tests {
+		result, err := m.PurchaseSession(test.token, test.macAddress, test.tier, paymentEvent(m))
+		if !errors.Is(err, test.err) {
+			t.Errorf("%s: PurchaseSession returned %v, expected %v", test.name, err, test.err)
+		}
+		if result.Status != test.status || result.Code != test.code || ErrorCode(err) != test.code {
+			t.Errorf("%s: result is %+v, expected status %s and code %s", test.name, result, test.status, test.code)
+		}
+	}
+
+	if status, _ := gate.Status("00:11:22:33:44:90"); status.Authorized {
+		t.Errorf("Gate opened for a failed purchase")
+	}
+}
@@ -0,0 +1,63 @@
+package merchant
+
+import (
+	"encoding/json"
+	"errors"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+func TestMinPayment(t *testing.T) {
+	tests := []struct {
+		price   uint64
+		feePpk  uint
+		minimum uint64
+	}{
+		{2, 0, 2},
+		{2, 1000, 4},  // 3 sats take two proofs and 2 sats of fees, 4 sats take one proof
+		{10, 100, 11}, // 10 sats take two proofs costing 1 sat
+		{64, 1, 65},
+	}
+	for _, test := range tests {
+		if minimum := minPayment(test.price, test.feePpk); minimum != test.minimum {
+			t.Errorf("minPayment(%d, %d) = %d, expected %d", test.price, test.feePpk, minimum, test.minimum)
+		}
+	}
+}
+
+func TestMintFees(t *testing.T) {
+	mint := newStandInMint(t)
+	mint.keyset.InputFeePpk = 1000
+	m, _ := newTestMerchant(t, mint)
+
+	if !m.tollwallet.RefreshFees() {
+		t.Errorf("First fee refresh reported no change")
+	}
+	if m.tollwallet.RefreshFees() {
+		t.Errorf("Fee refresh reported a change for unchanged keysets")
+	}
+	if fee := m.tollwallet.InputFees()[mint.URL]; fee != 1000 {
+		t.Errorf("Input fee of the mint is %d ppk, expected 1000", fee)
+	}
+
+	// 2 sats buy a step but the mint takes 1 sat to swap the token
+	_, err := m.PurchaseSession(serializeToken(t, mint.token(t, 2)), "00:11:22:33:44:a0", "", paymentEvent(m))
+	if !errors.Is(err, ErrBelowMinimum) {
+		t.Errorf("Token that doesn't cover the mint fee returned %v, expected ErrBelowMinimum", err)
+	}
+
+	advertisement, err := CreateAdvertisement(m.config, m.pricing, m.tollwallet.InputFees(), time.Now())
+	if err != nil {
+		t.Fatalf("CreateAdvertisement failed: %v", err)
+	}
+	var event nostr.Event
+	if err := json.Unmarshal([]byte(advertisement), &event); err != nil {
+		t.Fatalf("Failed to parse advertisement: %v", err)
+	}
+	if !slices.ContainsFunc(event.Tags, func(tag nostr.Tag) bool { return slices.Equal(tag, nostr.Tag{"mint", mint.URL, "4"}) }) {
+		t.Errorf("Advertisement lacks the mint's minimum payment of 4 sats: %v", event.Tags)
+	}
+}
@@ -4,18 +4,24 @@ go 1.24.2
 
 require (
 	github.com/OpenTollGate/tollgate-module-basic-go/src/config_manager v0.0.0-20250522085419-17692bf154f8
+	github.com/OpenTollGate/tollgate-module-basic-go/src/events v0.0.0
+	github.com/OpenTollGate/tollgate-module-basic-go/src/lightning v0.0.0-00010101000000-000000000000
 	github.com/OpenTollGate/tollgate-module-basic-go/src/tollwallet v0.0.0
 	github.com/OpenTollGate/tollgate-module-basic-go/src/utils v0.0.0
 	github.com/OpenTollGate/tollgate-module-basic-go/src/valve v0.0.0
+	github.com/OpenTollGate/tollgate-module-basic-go/src/voucher v0.0.0
 	github.com/elnosh/gonuts v0.4.0
 	github.com/nbd-wtf/go-nostr v0.51.11
 )
 
 replace (
 	github.com/OpenTollGate/tollgate-module-basic-go/src/config_manager => ../config_manager
+	github.com/OpenTollGate/tollgate-module-basic-go/src/events => ../events
+	github.com/OpenTollGate/tollgate-module-basic-go/src/lightning => ../lightning
 	github.com/OpenTollGate/tollgate-module-basic-go/src/tollwallet => ../tollwallet
 	github.com/OpenTollGate/tollgate-module-basic-go/src/utils => ../utils
 	github.com/OpenTollGate/tollgate-module-basic-go/src/valve => ../valve
+	github.com/OpenTollGate/tollgate-module-basic-go/src/voucher => ../voucher
 )
 
 require (
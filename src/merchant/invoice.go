@@ -0,0 +1,223 @@
+package merchant
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/OpenTollGate/tollgate-module-basic-go/src/config_manager"
+	"github.com/OpenTollGate/tollgate-module-basic-go/src/tollwallet"
+	"github.com/OpenTollGate/tollgate-module-basic-go/src/utils"
+	"github.com/elnosh/gonuts/cashu/nuts/nut04"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// Statuses of a purchase paid with a Lightning invoice
+const (
+	InvoicePending = "pending"
+	// InvoiceClaimed is a paid invoice whose ecash is in the wallet, the gate is yet to open
+	InvoiceClaimed = "claimed"
+	InvoicePaid    = "paid"
+	InvoiceExpired = "expired"
+	InvoiceFailed  = "failed"
+)
+
+// Errors returned when an invoice can't be created for a purchase
+var (
+	ErrInvalidPurchase = errors.New("invalid purchase")
+	ErrUnknownInvoice  = errors.New("unknown invoice")
+	ErrTooManyInvoices = errors.New("too many pending invoices")
+)
+
+const (
+	// defaultInvoiceExpiry is how long invoices are watched when the mint doesn't say when they expire
+	defaultInvoiceExpiry = time.Hour
+	// invoiceRetention is how long finished invoice purchases can still be looked up
+	invoiceRetention = time.Hour
+	// maxClaimAttempts is how often minting the ecash of a paid invoice is tried before giving up
+	maxClaimAttempts = 10
+	// maxPendingInvoices bounds the invoices watched at once, and maxPendingInvoicesPerMAC
+	// those of a single client, so unpaid invoices can't pile up
+	maxPendingInvoices       = 100
+	maxPendingInvoicesPerMAC = 3
+)
+
+// InvoicePurchase is a purchase paid with the Lightning invoice of a mint quote (NUT-04).
+// Once the invoice is paid its ecash is minted into the wallet and the gate opens.
+type InvoicePurchase struct {
+	Quote      tollwallet.MintQuote
+	MACAddress string
+	Status     string
+	// Result is the outcome of opening the gate once the invoice was paid
+	Result PurchaseSessionResult
+
+	tier          config_manager.TierConfig
+	event         nostr.Event
+	requestedAt   time.Time
+	finishedAt    time.Time
+	claimAttempts int
+	// claimedAmount is the ecash minted for the invoice once it is claimed
+	claimedAmount uint64
+}
+
+// unfinished reports whether the gate may still open for the purchase
+func (p InvoicePurchase) unfinished() bool {
+	return p.Status == InvoicePending || p.Status == InvoiceClaimed
+}
+
+// RequestInvoice asks an accepted mint for a Lightning invoice of amount sats to buy a session
+// for macAddress, and opens the gate once it is paid. An empty mintURL selects the first accepted mint.
+// purchaseEvent is checked like the event of a token payment, and a retry with the same event
+// gets the invoice it already got.
+func (m *Merchant) RequestInvoice(amount uint64, mintURL string, macAddress string, tierName string, purchaseEvent nostr.Event) (InvoicePurchase, error) {
+	config, pricing := m.settings()
+	now := time.Now()
+	if err := m.checkPaymentEvent(purchaseEvent, now); err != nil {
+		return InvoicePurchase{}, err
+	}
+	if purchase, exists := m.invoices.ForEvent(purchaseEvent.ID); exists {
+		return purchase, nil
+	}
+	if !utils.ValidateMACAddress(macAddress) {
+		return InvoicePurchase{}, fmt.Errorf("%w: %w: %s", ErrInvalidPurchase, ErrInvalidMAC, macAddress)
+	}
+	tier, found := selectTier(config, tierName)
+	if !found {
+		return InvoicePurchase{}, fmt.Errorf("%w: %w: %s", ErrInvalidPurchase, ErrUnknownTier, tierName)
+	}
+	if mintURL == "" && len(config.AcceptedMints) > 0 {
+		mintURL = config.AcceptedMints[0].URL
+	}
+
+	if price := pricing.PriceAt(tierPricePerStep(config, tier), now); amount < price {
+		return InvoicePurchase{}, fmt.Errorf("%w: %w: %d sats don't buy a single step at %d sats", ErrInvalidPurchase, ErrBelowMinimum, amount, price)
+	}
+	// Checked before asking the mint as well as when the invoice is stored, so flooding
+	// /invoice doesn't create quotes at the mint either
+	if err := m.invoices.checkCapacity(macAddress); err != nil {
+		return InvoicePurchase{}, err
+	}
+
+	quote, err := m.tollwallet.RequestMintQuote(mintURL, amount)
+	if err != nil {
+		return InvoicePurchase{}, err
+	}
+	if quote.Expiry.IsZero() {
+		quote.Expiry = now.Add(defaultInvoiceExpiry)
+	}
+
+	purchase := &InvoicePurchase{
+		Quote:       quote,
+		MACAddress:  macAddress,
+		Status:      InvoicePending,
+		tier:        tier,
+		event:       purchaseEvent,
+		requestedAt: now,
+	}
+
+	if err := m.invoices.Add(*purchase, now); err != nil {
+		return InvoicePurchase{}, err
+	}
+
+	log.Printf("Created invoice for %d sats from %s for MAC %s, quote %s", amount, mintURL, macAddress, quote.ID)
+
+	return *purchase, nil
+}
+
+// InvoiceStatus returns the purchase paid by the invoice of a mint quote
+func (m *Merchant) InvoiceStatus(quoteID string) (InvoicePurchase, error) {
+	purchase, exists := m.invoices.Get(quoteID)
+	if !exists {
+		return InvoicePurchase{}, ErrUnknownInvoice
+	}
+	return purchase, nil
+}
+
+// StartInvoicePoller checks the pending invoices with their mints periodically, including
+// those requested before a restart, and opens the gate for the ones that were paid
+func (m *Merchant) StartInvoicePoller(interval time.Duration) {
+	log.Printf("Starting invoice poller, checking every %s", interval)
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for range ticker.C {
+			m.pollInvoices()
+		}
+	}()
+}
+
+// pollInvoices checks every pending invoice once
+func (m *Merchant) pollInvoices() {
+	for _, purchase := range m.invoices.Pending() {
+		m.pollInvoice(purchase)
+	}
+}
+
+// pollInvoice checks whether the invoice of a purchase was paid or expired.
+// A paid invoice is claimed and opens the gate like a token payment would. The claim is
+// stored before the gate opens, so a restart in between still opens it for the minted ecash.
+func (m *Merchant) pollInvoice(purchase InvoicePurchase) {
+	quoteID := purchase.Quote.ID
+	if purchase.Status == InvoicePending {
+		amount, claimed := m.claimInvoice(purchase)
+		if !claimed {
+			return
+		}
+		if err := m.invoices.Claim(quoteID, amount); err != nil {
+			// The mint reports the quote issued on the next poll, which claims it again
+			log.Printf("Error storing claim of invoice of quote %s: %v", quoteID, err)
+			return
+		}
+		purchase.claimedAmount = amount
+	}
+
+	// The customer gets the lower of the prices when the invoice was requested and now
+	config, pricing := m.settings()
+	regularPrice := tierPricePerStep(config, purchase.tier)
+	pricePerStep := min(pricing.PriceAt(regularPrice, purchase.requestedAt), pricing.PriceAt(regularPrice, time.Now()))
+	result, _ := m.openSession(purchase.claimedAmount, purchase.Quote.Mint, pricePerStep, purchase.MACAddress, purchase.tier, purchase.event)
+	m.finishInvoice(quoteID, InvoicePaid, result)
+}
+
+// claimInvoice mints the ecash of a paid invoice into the wallet and returns its amount.
+// A quote the mint already issued was claimed before a restart, its ecash is in the wallet.
+func (m *Merchant) claimInvoice(purchase InvoicePurchase) (uint64, bool) {
+	quoteID := purchase.Quote.ID
+	state, err := m.tollwallet.MintQuoteState(quoteID)
+	if err != nil {
+		log.Printf("Error checking invoice of quote %s: %v", quoteID, err)
+	}
+	switch state {
+	case nut04.Issued:
+		log.Printf("Ecash of the invoice of quote %s was minted before, opening the gate for MAC %s", quoteID, purchase.MACAddress)
+		return purchase.Quote.Amount, true
+	case nut04.Paid:
+	default:
+		if time.Now().After(purchase.Quote.Expiry) {
+			log.Printf("Invoice of quote %s for MAC %s expired unpaid", quoteID, purchase.MACAddress)
+			m.finishInvoice(quoteID, InvoiceExpired, PurchaseSessionResult{Status: "rejected", Description: "Invoice expired"})
+		}
+		return 0, false
+	}
+
+	amount, err := m.tollwallet.ClaimMintQuote(purchase.Quote)
+	if err != nil {
+		claimAttempts := m.invoices.claimFailed(quoteID)
+		log.Printf("Error claiming paid invoice of quote %s (attempt %d): %v", quoteID, claimAttempts, err)
+		if claimAttempts >= maxClaimAttempts {
+			m.finishInvoice(quoteID, InvoiceFailed, PurchaseSessionResult{Status: "error", Description: "Error Processing payment", Code: CodeInternal})
+		}
+		return 0, false
+	}
+	return amount, true
+}
+
+// finishInvoice records the outcome of an invoice purchase
+func (m *Merchant) finishInvoice(quoteID string, status string, result PurchaseSessionResult) {
+	if err := m.invoices.Finish(quoteID, status, result, time.Now()); err != nil {
+		log.Printf("Error storing outcome of invoice of quote %s: %v", quoteID, err)
+	}
+}
@@ -0,0 +1,255 @@
+package merchant
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/OpenTollGate/tollgate-module-basic-go/src/config_manager"
+	"github.com/OpenTollGate/tollgate-module-basic-go/src/tollwallet"
+	"github.com/OpenTollGate/tollgate-module-basic-go/src/utils"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// InvoiceStore holds purchases paid with Lightning invoices by mint quote ID. It is persisted
+// to a JSON file, so invoices paid while the daemon restarts still open the gate.
+// Finished purchases are kept for invoiceRetention so clients can look up the outcome.
+type InvoiceStore struct {
+	path      string
+	mutex     sync.Mutex
+	purchases map[string]*InvoicePurchase
+}
+
+type storedInvoice struct {
+	Quote         tollwallet.MintQuote      `json:"quote"`
+	MACAddress    string                    `json:"mac_address"`
+	Status        string                    `json:"status"`
+	Result        PurchaseSessionResult     `json:"result"`
+	Tier          config_manager.TierConfig `json:"tier"`
+	Event         nostr.Event               `json:"event"`
+	RequestedAt   time.Time                 `json:"requested_at"`
+	FinishedAt    time.Time                 `json:"finished_at,omitzero"`
+	ClaimedAmount uint64                    `json:"claimed_amount,omitempty"`
+}
+
+// NewInvoiceStore opens the invoice store at path, loading any purchases already on disk
+func NewInvoiceStore(path string) (*InvoiceStore, error) {
+	store := &InvoiceStore{
+		path:      path,
+		purchases: make(map[string]*InvoicePurchase),
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return store, nil
+		}
+		return nil, fmt.Errorf("failed to read invoice store %s: %w", path, err)
+	}
+	if len(data) == 0 {
+		return store, nil
+	}
+
+	var invoices []storedInvoice
+	if err := json.Unmarshal(data, &invoices); err != nil {
+		return nil, fmt.Errorf("failed to parse invoice store %s: %w", path, err)
+	}
+	for _, invoice := range invoices {
+		store.purchases[invoice.Quote.ID] = &InvoicePurchase{
+			Quote:         invoice.Quote,
+			MACAddress:    invoice.MACAddress,
+			Status:        invoice.Status,
+			Result:        invoice.Result,
+			tier:          invoice.Tier,
+			event:         invoice.Event,
+			requestedAt:   invoice.RequestedAt,
+			finishedAt:    invoice.FinishedAt,
+			claimedAmount: invoice.ClaimedAmount,
+		}
+	}
+	return store, nil
+}
+
+// Add stores a new purchase and forgets purchases that finished more than invoiceRetention ago.
+// A purchase that can't be persisted isn't added, so no invoice is handed out that a restart loses,
+// and neither is one beyond maxPendingInvoices or maxPendingInvoicesPerMAC.
+func (s *InvoiceStore) Add(purchase InvoicePurchase, now time.Time) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	for id, old := range s.purchases {
+		if !old.unfinished() && now.Sub(old.finishedAt) > invoiceRetention {
+			delete(s.purchases, id)
+		}
+	}
+	if err := s.capacityFor(purchase.MACAddress); err != nil {
+		return err
+	}
+	s.purchases[purchase.Quote.ID] = &purchase
+	if err := s.persist(); err != nil {
+		delete(s.purchases, purchase.Quote.ID)
+		return fmt.Errorf("error storing invoice: %w", err)
+	}
+	return nil
+}
+
+// checkCapacity returns ErrTooManyInvoices if no more invoices may be pending for macAddress
+func (s *InvoiceStore) checkCapacity(macAddress string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.capacityFor(macAddress)
+}
+
+// capacityFor returns ErrTooManyInvoices if no more invoices may be pending for macAddress.
+// The caller must hold s.mutex.
+func (s *InvoiceStore) capacityFor(macAddress string) error {
+	pending, pendingForMAC := 0, 0
+	for _, purchase := range s.purchases {
+		if !purchase.unfinished() {
+			continue
+		}
+		pending++
+		if purchase.MACAddress == macAddress {
+			pendingForMAC++
+		}
+	}
+	if pendingForMAC >= maxPendingInvoicesPerMAC {
+		return fmt.Errorf("%w: %d for MAC %s", ErrTooManyInvoices, pendingForMAC, macAddress)
+	}
+	if pending >= maxPendingInvoices {
+		return fmt.Errorf("%w: %d", ErrTooManyInvoices, pending)
+	}
+	return nil
+}
+
+// Get returns the purchase paid by the invoice of a mint quote
+func (s *InvoiceStore) Get(quoteID string) (InvoicePurchase, bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	purchase, exists := s.purchases[quoteID]
+	if !exists {
+		return InvoicePurchase{}, false
+	}
+	return *purchase, true
+}
+
+// ForEvent returns the purchase requested with the payment event eventID
+func (s *InvoiceStore) ForEvent(eventID string) (InvoicePurchase, bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	for _, purchase := range s.purchases {
+		if purchase.event.ID == eventID {
+			return *purchase, true
+		}
+	}
+	return InvoicePurchase{}, false
+}
+
+// Pending returns the purchases whose invoice is still watched or whose claimed ecash is yet
+// to open the gate, oldest first
+func (s *InvoiceStore) Pending() []InvoicePurchase {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	var pending []InvoicePurchase
+	for _, purchase := range s.sorted() {
+		if purchase.unfinished() {
+			pending = append(pending, purchase)
+		}
+	}
+	return pending
+}
+
+// Claim records that the ecash of the paid invoice of a mint quote is in the wallet
+func (s *InvoiceStore) Claim(quoteID string, amount uint64) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	purchase, exists := s.purchases[quoteID]
+	if !exists {
+		return nil
+	}
+	status := purchase.Status
+	purchase.Status = InvoiceClaimed
+	purchase.claimedAmount = amount
+	if err := s.persist(); err != nil {
+		purchase.Status = status
+		purchase.claimedAmount = 0
+		return err
+	}
+	return nil
+}
+
+// Finish records the outcome of the purchase paid by the invoice of a mint quote
+func (s *InvoiceStore) Finish(quoteID string, status string, result PurchaseSessionResult, now time.Time) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	purchase, exists := s.purchases[quoteID]
+	if !exists {
+		return nil
+	}
+	purchase.Status = status
+	purchase.Result = result
+	purchase.finishedAt = now
+	return s.persist()
+}
+
+// claimFailed counts a failed attempt to claim the ecash of a paid invoice and returns the
+// attempts so far. Attempts aren't persisted, a restart gives the invoice another maxClaimAttempts.
+func (s *InvoiceStore) claimFailed(quoteID string) int {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	purchase, exists := s.purchases[quoteID]
+	if !exists {
+		return 0
+	}
+	purchase.claimAttempts++
+	return purchase.claimAttempts
+}
+
+// sorted returns the purchases by the time they were requested. The caller must hold s.mutex.
+func (s *InvoiceStore) sorted() []InvoicePurchase {
+	purchases := make([]InvoicePurchase, 0, len(s.purchases))
+	for _, purchase := range s.purchases {
+		purchases = append(purchases, *purchase)
+	}
+	sort.Slice(purchases, func(i, j int) bool {
+		if !purchases[i].requestedAt.Equal(purchases[j].requestedAt) {
+			return purchases[i].requestedAt.Before(purchases[j].requestedAt)
+		}
+		return purchases[i].Quote.ID < purchases[j].Quote.ID
+	})
+	return purchases
+}
+
+// persist writes the purchases to disk. The caller must hold s.mutex.
+func (s *InvoiceStore) persist() error {
+	purchases := s.sorted()
+	invoices := make([]storedInvoice, 0, len(purchases))
+	for _, purchase := range purchases {
+		invoices = append(invoices, storedInvoice{
+			Quote:         purchase.Quote,
+			MACAddress:    purchase.MACAddress,
+			Status:        purchase.Status,
+			Result:        purchase.Result,
+			Tier:          purchase.tier,
+			Event:         purchase.event,
+			RequestedAt:   purchase.requestedAt,
+			FinishedAt:    purchase.finishedAt,
+			ClaimedAmount: purchase.claimedAmount,
+		})
+	}
+
+	data, err := json.Marshal(invoices)
+	if err != nil {
+		return fmt.Errorf("failed to marshal invoice store: %w", err)
+	}
+	return utils.WriteFileAtomic(s.path, data)
+}
@@ -0,0 +1,273 @@
+package merchant
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/OpenTollGate/tollgate-module-basic-go/src/config_manager"
+	"github.com/OpenTollGate/tollgate-module-basic-go/src/tollwallet"
+	"github.com/OpenTollGate/tollgate-module-basic-go/src/valve"
+	"github.com/OpenTollGate/tollgate-module-basic-go/src/voucher"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// newTestMerchant creates a merchant whose wallet uses the stand-in mint and accepts otherMints as well
+func newTestMerchant(t *testing.T, mint *standInMint, otherMints ...string) (*Merchant, *valve.MemoryGate) {
+	t.Helper()
+
+	acceptedMints := []config_manager.MintConfig{{URL: mint.URL}}
+	for _, url := range otherMints {
+		acceptedMints = append(acceptedMints, config_manager.MintConfig{URL: url})
+	}
+
+	wallet, err := tollwallet.New(t.TempDir(), append([]string{mint.URL}, otherMints...), false, nil)
+	if err != nil {
+		t.Fatalf("Failed to create wallet: %v", err)
+	}
+	store, err := valve.NewSessionStore(filepath.Join(t.TempDir(), "sessions.json"))
+	if err != nil {
+		t.Fatalf("Failed to create session store: %v", err)
+	}
+	paymentLog, err := NewPaymentLog(filepath.Join(t.TempDir(), "payments.json"))
+	if err != nil {
+		t.Fatalf("Failed to open payment log: %v", err)
+	}
+	invoices, err := NewInvoiceStore(filepath.Join(t.TempDir(), "invoices.json"))
+	if err != nil {
+		t.Fatalf("Failed to open invoice store: %v", err)
+	}
+	controlLog, err := NewControlLog(filepath.Join(t.TempDir(), "session_control.json"))
+	if err != nil {
+		t.Fatalf("Failed to open control log: %v", err)
+	}
+	vouchers, err := voucher.NewStore(filepath.Join(t.TempDir(), "vouchers.json"))
+	if err != nil {
+		t.Fatalf("Failed to open voucher store: %v", err)
+	}
+	customers, err := NewCustomers(filepath.Join(t.TempDir(), "customers.json"))
+	if err != nil {
+		t.Fatalf("Failed to open customers: %v", err)
+	}
+	gate := valve.NewMemoryGate()
+	pricing, _ := NewPricing(config_manager.PricingConfig{})
+
+	m := &Merchant{
+		config: &config_manager.Config{
+			TollgatePrivateKey: nostr.GeneratePrivateKey(),
+			AcceptedMints:      acceptedMints,
+			Metric:             valve.MetricMilliseconds,
+			StepSize:           60000,
+			PricePerStep:       2,
+		},
+		tollwallet: *wallet,
+		valve:      valve.New(gate, store, nil),
+		pricing:    pricing,
+		invoices:   invoices,
+		paymentLog: paymentLog,
+		controlLog: controlLog,
+		vouchers:   vouchers,
+		customers:  customers,
+	}
+	m.payouts = NewPayoutScheduler(acceptedMints, m.processPayout)
+	return m, gate
+}
+
+// paymentEvent returns a fresh payment event for the tollgate of m with a unique ID
+func paymentEvent(m *Merchant) nostr.Event {
+	tollgatePubkey, _ := nostr.GetPublicKey(m.config.TollgatePrivateKey)
+	return nostr.Event{
+		ID:        nostr.GeneratePrivateKey(),
+		PubKey:    "customer-pubkey",
+		Kind:      KindPayment,
+		CreatedAt: nostr.Now(),
+		Tags:      nostr.Tags{{"p", tollgatePubkey}},
+	}
+}
+
+func TestInvoicePurchase(t *testing.T) {
+	mint := newStandInMint(t)
+	m, gate := newTestMerchant(t, mint)
+	macAddress := "00:11:22:33:44:80"
+	event := paymentEvent(m)
+
+	if _, err := m.RequestInvoice(1, "", macAddress, "", event); !errors.Is(err, ErrInvalidPurchase) {
+		t.Errorf("Invoice for less than a step returned %v, expected ErrInvalidPurchase", err)
+	}
+
+	purchase, err := m.RequestInvoice(20, "", macAddress, "", event)
+	if err != nil {
+		t.Fatalf("RequestInvoice failed: %v", err)
+	}
+	if purchase.Status != InvoicePending || purchase.Quote.Invoice == "" || purchase.Quote.Mint != mint.URL {
+		t.Fatalf("Unexpected invoice purchase %+v", purchase)
+	}
+
+	// A retry with the same event gets the same invoice
+	if retry, err := m.RequestInvoice(20, "", macAddress, "", event); err != nil || retry.Quote.ID != purchase.Quote.ID {
+		t.Errorf("Retry returned quote %s, %v, expected quote %s", retry.Quote.ID, err, purchase.Quote.ID)
+	}
+
+	m.pollInvoices()
+	if status, _ := gate.Status(macAddress); status.Authorized {
+		t.Fatalf("Gate opened before the invoice was paid")
+	}
+
+	mint.pay(purchase.Quote.ID)
+	m.pollInvoices()
+	purchase, _ = m.InvoiceStatus(purchase.Quote.ID)
+
+	if purchase.Status != InvoicePaid || purchase.Result.Status != "success" || purchase.Result.Receipt == nil {
+		t.Fatalf("Invoice purchase did not succeed: %+v", purchase)
+	}
+	if status, _ := gate.Status(macAddress); !status.Authorized {
+		t.Errorf("Gate is closed after the invoice was paid")
+	}
+	session, _ := m.valve.GetSession(macAddress)
+	if remaining := time.Until(session.ExpiresAt); remaining < 9*time.Minute || remaining > 10*time.Minute {
+		t.Errorf("20 sats at 2 sats per minute bought %s, expected 10 minutes", remaining)
+	}
+	if balance := m.tollwallet.GetBalanceByMint(mint.URL); balance != 20 {
+		t.Errorf("Wallet balance is %d after the invoice was paid, expected 20", balance)
+	}
+
+	if _, err := m.InvoiceStatus("unknown"); !errors.Is(err, ErrUnknownInvoice) {
+		t.Errorf("InvoiceStatus of an unknown quote returned %v, expected ErrUnknownInvoice", err)
+	}
+}
+
+func TestInvoiceResumedAfterRestart(t *testing.T) {
+	mint := newStandInMint(t)
+	m, gate := newTestMerchant(t, mint)
+	macAddress := "00:11:22:33:44:81"
+
+	// An invoice requested before the restart, which nothing watches yet
+	quote, err := m.tollwallet.RequestMintQuote(mint.URL, 20)
+	if err != nil {
+		t.Fatalf("RequestMintQuote failed: %v", err)
+	}
+	tier := config_manager.TierConfig{Name: "basic", DownloadKbps: 1000}
+	err = m.invoices.Add(InvoicePurchase{
+		Quote:       quote,
+		MACAddress:  macAddress,
+		Status:      InvoicePending,
+		tier:        tier,
+		event:       paymentEvent(m),
+		requestedAt: time.Now(),
+	}, time.Now())
+	if err != nil {
+		t.Fatalf("Add failed: %v", err)
+	}
+
+	reopened, err := NewInvoiceStore(m.invoices.path)
+	if err != nil {
+		t.Fatalf("Failed to reopen invoice store: %v", err)
+	}
+	pending := reopened.Pending()
+	if len(pending) != 1 || pending[0].MACAddress != macAddress || pending[0].tier != tier || pending[0].Quote.ID != quote.ID {
+		t.Fatalf("Reopened store has pending invoices %+v, expected the one for MAC %s", pending, macAddress)
+	}
+	m.invoices = reopened
+
+	mint.pay(quote.ID)
+	m.pollInvoices()
+	purchase, _ := m.InvoiceStatus(quote.ID)
+	if purchase.Status != InvoicePaid {
+		t.Fatalf("Resumed invoice purchase did not succeed: %+v", purchase)
+	}
+	if status, _ := gate.Status(macAddress); !status.Authorized {
+		t.Errorf("Gate is closed after the resumed invoice was paid")
+	}
+	if session, _ := m.valve.GetSession(macAddress); session.RateLimit.DownloadKbps != 1000 {
+		t.Errorf("Session has rate limit %+v, expected the stored tier's", session.RateLimit)
+	}
+}
+
+func TestInvoiceClaimedBeforeRestart(t *testing.T) {
+	mint := newStandInMint(t)
+	m, gate := newTestMerchant(t, mint)
+
+	addPurchase := func(macAddress string) tollwallet.MintQuote {
+		t.Helper()
+		quote, err := m.tollwallet.RequestMintQuote(mint.URL, 20)
+		if err != nil {
+			t.Fatalf("RequestMintQuote failed: %v", err)
+		}
+		err = m.invoices.Add(InvoicePurchase{
+			Quote:       quote,
+			MACAddress:  macAddress,
+			Status:      InvoicePending,
+			event:       paymentEvent(m),
+			requestedAt: time.Now(),
+		}, time.Now())
+		if err != nil {
+			t.Fatalf("Add failed: %v", err)
+		}
+		mint.pay(quote.ID)
+		return quote
+	}
+
+	// The daemon stopped after minting the ecash but before it stored the claim
+	issued := addPurchase("00:11:22:33:44:84")
+	if _, err := m.tollwallet.ClaimMintQuote(issued); err != nil {
+		t.Fatalf("ClaimMintQuote failed: %v", err)
+	}
+
+	// The daemon stopped after storing the claim but before the gate opened
+	claimed := addPurchase("00:11:22:33:44:85")
+	if _, err := m.tollwallet.ClaimMintQuote(claimed); err != nil {
+		t.Fatalf("ClaimMintQuote failed: %v", err)
+	}
+	if err := m.invoices.Claim(claimed.ID, 20); err != nil {
+		t.Fatalf("Claim failed: %v", err)
+	}
+
+	reopened, err := NewInvoiceStore(m.invoices.path)
+	if err != nil {
+		t.Fatalf("Failed to reopen invoice store: %v", err)
+	}
+	m.invoices = reopened
+	m.pollInvoices()
+
+	for macAddress, quote := range map[string]tollwallet.MintQuote{"00:11:22:33:44:84": issued, "00:11:22:33:44:85": claimed} {
+		purchase, _ := m.InvoiceStatus(quote.ID)
+		if purchase.Status != InvoicePaid || purchase.Result.Status != "success" {
+			t.Errorf("Invoice purchase for MAC %s was not completed after the restart: %+v", macAddress, purchase)
+		}
+		if status, _ := gate.Status(macAddress); !status.Authorized {
+			t.Errorf("Gate of MAC %s is closed after its claimed invoice was resumed", macAddress)
+		}
+	}
+	if balance := m.tollwallet.GetBalanceByMint(mint.URL); balance != 40 {
+		t.Errorf("Wallet balance is %d, expected the 40 sats minted once", balance)
+	}
+}
+
+func TestRequestInvoiceLimits(t *testing.T) {
+	mint := newStandInMint(t)
+	m, _ := newTestMerchant(t, mint)
+	macAddress := "00:11:22:33:44:82"
+
+	unsigned := nostr.Event{ID: "unsigned-event-id", PubKey: "customer-pubkey"}
+	if _, err := m.RequestInvoice(20, "", macAddress, "", unsigned); !errors.Is(err, ErrInvalidEvent) {
+		t.Errorf("Invoice for an event without kind and p tag returned %v, expected ErrInvalidEvent", err)
+	}
+	stale := paymentEvent(m)
+	stale.CreatedAt = nostr.Timestamp(time.Now().Add(-11 * time.Minute).Unix())
+	if _, err := m.RequestInvoice(20, "", macAddress, "", stale); !errors.Is(err, ErrStaleEvent) {
+		t.Errorf("Invoice for a stale event returned %v, expected ErrStaleEvent", err)
+	}
+
+	for i := 0; i < maxPendingInvoicesPerMAC; i++ {
+		if _, err := m.RequestInvoice(20, "", macAddress, "", paymentEvent(m)); err != nil {
+			t.Fatalf("RequestInvoice %d failed: %v", i, err)
+		}
+	}
+	if _, err := m.RequestInvoice(20, "", macAddress, "", paymentEvent(m)); !errors.Is(err, ErrTooManyInvoices) {
+		t.Errorf("Invoice beyond the limit per MAC returned %v, expected ErrTooManyInvoices", err)
+	}
+	if _, err := m.RequestInvoice(20, "", "00:11:22:33:44:83", "", paymentEvent(m)); err != nil {
+		t.Errorf("Invoice for another MAC failed: %v", err)
+	}
+}
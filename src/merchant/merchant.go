@@ -1,28 +1,74 @@
 package merchant
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
-	"math"
+	"math/bits"
+	"sync"
 	"time"
 
 	"github.com/OpenTollGate/tollgate-module-basic-go/src/config_manager"
+	"github.com/OpenTollGate/tollgate-module-basic-go/src/events"
+	"github.com/OpenTollGate/tollgate-module-basic-go/src/lightning"
 	"github.com/OpenTollGate/tollgate-module-basic-go/src/tollwallet"
 	"github.com/OpenTollGate/tollgate-module-basic-go/src/utils"
 	"github.com/OpenTollGate/tollgate-module-basic-go/src/valve"
+	"github.com/OpenTollGate/tollgate-module-basic-go/src/voucher"
 	"github.com/elnosh/gonuts/cashu"
 	"github.com/nbd-wtf/go-nostr"
 )
 
 // TollWallet represents a Cashu wallet that can receive, swap, and send tokens
 type Merchant struct {
+	// configMutex guards config and pricing, which ReloadConfig replaces when config.json
+	// changes. Read them with settings.
+	configMutex   sync.RWMutex
 	config        *config_manager.Config
+	configManager *config_manager.ConfigManager
 	tollwallet    tollwallet.TollWallet
-	advertisement string
+	valve         *valve.Valve
+	bus           *events.Bus
+	pricing       *Pricing
+
+	// advertisement is recreated once advertisementExpiry passes: when the active price
+	// changes, the config or mint fees changed, or after advertisementMaxAge
+	advertisementMutex  sync.Mutex
+	advertisement       Advertisement
+	advertisementExpiry time.Time
+
+	// invoices holds purchases paid with Lightning invoices by mint quote ID
+	invoices *InvoiceStore
+
+	paymentLog *PaymentLog
+	controlLog *ControlLog
+	vouchers   *voucher.Store
+	payouts    *PayoutScheduler
+
+	payoutLedger  *PayoutLedger
+	shareAccruals *ShareAccruals
+
+	// customers tracks spending for loyalty rules and holds prepaid balances by pubkey
+	customers *Customers
+
+	// relayPool reaches the wallet services of profit shares paid through Nostr Wallet Connect
+	relayPool *nostr.SimplePool
 }
 
-func New(configManager *config_manager.ConfigManager) (*Merchant, error) {
+// priceGracePeriod is how long after an advertised price changed a purchase signed before
+// the change still gets the lower of both prices, so customers aren't caught out by the switch
+const priceGracePeriod = 2 * time.Minute
+
+// mintFeeRefreshInterval is how often the fees of the accepted mints are fetched
+const mintFeeRefreshInterval = 1 * time.Hour
+
+// advertisementMaxAge is how long an advertisement is served before it is signed again,
+// so its created_at stays recent for clients that check it
+const advertisementMaxAge = 1 * time.Hour
+
+func New(configManager *config_manager.ConfigManager, valve *valve.Valve, bus *events.Bus) (*Merchant, error) {
 	log.Printf("=== Merchant Initializing ===")
 
 	config, err := configManager.LoadConfig()
@@ -30,66 +76,158 @@ func New(configManager *config_manager.ConfigManager) (*Merchant, error) {
 		return nil, fmt.Errorf("failed to load config: %w", err)
 	}
 
-	// Extract mint URLs from MintConfig
-	mintURLs := make([]string, len(config.AcceptedMints))
-	for i, mint := range config.AcceptedMints {
-		mintURLs[i] = mint.URL
-	}
-
 	log.Printf("Setting up wallet...")
-	tollwallet, walletErr := tollwallet.New("/etc/tollgate", mintURLs, false)
+	tollwallet, walletErr := tollwallet.New("/etc/tollgate", mintURLs(config.AcceptedMints), false, bus)
 
 	if walletErr != nil {
 		return nil, fmt.Errorf("failed to create wallet: %w", walletErr)
 	}
 	balance := tollwallet.GetBalance()
 
+	pricing, err := NewPricing(config.Pricing)
+	if err != nil {
+		return nil, fmt.Errorf("invalid pricing config: %w", err)
+	}
+
+	if err := validateProfitShares(config.ProfitShare); err != nil {
+		return nil, fmt.Errorf("invalid profit share config: %w", err)
+	}
+
+	if err := validateLoyalty(config.Loyalty); err != nil {
+		return nil, fmt.Errorf("invalid loyalty config: %w", err)
+	}
+
+	if err := validateTiers(config.Tiers, valve); err != nil {
+		return nil, fmt.Errorf("invalid tier config: %w", err)
+	}
+
+	// The advertisement carries the minimum payment of each mint, which depends on its fees
+	tollwallet.RefreshFees()
+
 	// Set advertisement
-	var advertisementStr string
-	advertisementStr, err = CreateAdvertisement(config)
+	now := time.Now()
+	advertisement, err := createAdvertisement(config, pricing, tollwallet.InputFees(), now)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create advertisement: %w", err)
 	}
 
+	paymentLog, err := NewPaymentLog("/etc/tollgate/payments.json")
+	if err != nil {
+		return nil, fmt.Errorf("failed to open payment log: %w", err)
+	}
+
+	invoices, err := NewInvoiceStore("/etc/tollgate/invoices.json")
+	if err != nil {
+		return nil, fmt.Errorf("failed to open invoice store: %w", err)
+	}
+
+	controlLog, err := NewControlLog("/etc/tollgate/session_control.json")
+	if err != nil {
+		return nil, fmt.Errorf("failed to open session control log: %w", err)
+	}
+
+	vouchers, err := voucher.NewStore("/etc/tollgate/vouchers.json")
+	if err != nil {
+		return nil, fmt.Errorf("failed to open voucher store: %w", err)
+	}
+
+	payoutLedger, err := NewPayoutLedger("/etc/tollgate/payouts.json")
+	if err != nil {
+		return nil, fmt.Errorf("failed to open payout ledger: %w", err)
+	}
+
+	shareAccruals, err := NewShareAccruals("/etc/tollgate/profit_shares.json")
+	if err != nil {
+		return nil, fmt.Errorf("failed to open share accruals: %w", err)
+	}
+
+	customers, err := NewCustomers("/etc/tollgate/customers.json")
+	if err != nil {
+		return nil, fmt.Errorf("failed to open customers: %w", err)
+	}
+
 	log.Printf("Accepted Mints: %v", config.AcceptedMints)
 	log.Printf("Wallet Balance: %d", balance)
-	log.Printf("Advertisement: %s", advertisementStr)
+	log.Printf("Advertisement: %s", advertisement.Event)
 	log.Printf("=== Merchant ready ===")
 
-	return &Merchant{
-		config:        config,
-		tollwallet:    *tollwallet,
-		advertisement: advertisementStr,
-	}, nil
+	m := &Merchant{
+		config:              config,
+		configManager:       configManager,
+		tollwallet:          *tollwallet,
+		valve:               valve,
+		bus:                 bus,
+		pricing:             pricing,
+		advertisement:       advertisement,
+		advertisementExpiry: advertisementExpiry(pricing, now),
+		invoices:            invoices,
+		paymentLog:          paymentLog,
+		controlLog:          controlLog,
+		vouchers:            vouchers,
+		payoutLedger:        payoutLedger,
+		shareAccruals:       shareAccruals,
+		customers:           customers,
+		relayPool:           configManager.GetRelayPool(),
+	}
+	m.payouts = NewPayoutScheduler(config.AcceptedMints, m.processPayout)
+	return m, nil
 }
 
-func (m *Merchant) StartPayoutRoutine() {
-	log.Printf("Starting payout routine")
+// StartFeeRefresh fetches the fees of the accepted mints periodically and
+// updates the advertisement when they change
+func (m *Merchant) StartFeeRefresh() {
+	go func() {
+		ticker := time.NewTicker(mintFeeRefreshInterval)
+		defer ticker.Stop()
 
-	// Create timer for each mint
-	for _, mint := range m.config.AcceptedMints {
-		go func(mintConfig config_manager.MintConfig) {
-			ticker := time.NewTicker(1 * time.Minute)
-			defer ticker.Stop()
-
-			for range ticker.C {
-				m.processPayout(mintConfig)
+		for range ticker.C {
+			if m.tollwallet.RefreshFees() {
+				m.invalidateAdvertisement()
 			}
-		}(mint)
+		}
+	}()
+}
+
+// mintURLs returns the URLs of mints
+func mintURLs(mints []config_manager.MintConfig) []string {
+	urls := make([]string, len(mints))
+	for i, mint := range mints {
+		urls[i] = mint.URL
 	}
+	return urls
+}
 
-	log.Printf("Payout routine started")
+// settings returns the config and pricing in effect. ReloadConfig may replace them at any
+// time, so a purchase reads them once and keeps using what it got.
+func (m *Merchant) settings() (*config_manager.Config, *Pricing) {
+	m.configMutex.RLock()
+	defer m.configMutex.RUnlock()
+	return m.config, m.pricing
 }
 
-// processPayout checks balances and processes payouts for each mint
+// processPayout settles earlier payouts of a mint, then splits the rest of its balance among the profit shares
 func (m *Merchant) processPayout(mintConfig config_manager.MintConfig) {
-	// Get current balance
-	// Note: The current implementation only returns total balance, not per mint
+	config, _ := m.settings()
+	now := time.Now()
+	m.retryPayouts(mintConfig, now)
+
+	forgotten, err := m.shareAccruals.Forget(mintConfig.URL, config.ProfitShare)
+	if err != nil {
+		log.Printf("Error forgetting accruals of removed profit shares for mint %s: %v", mintConfig.URL, err)
+	}
+	for _, accrual := range forgotten {
+		log.Printf("Profit share %d to %s was removed, paying its %d accrued sats to the other shares", accrual.Share, accrual.payee(), accrual.Accrued)
+	}
+
+	// Get current balance, less what failed payouts and shares below their minimum still owe
+	// and the prepaid balances of customers
 	balance := m.tollwallet.GetBalanceByMint(mintConfig.URL)
+	reserved := m.payoutLedger.Reserved(mintConfig.URL) + m.shareAccruals.Reserved(mintConfig.URL) + m.customers.Reserved(mintConfig.URL)
+	balance -= min(reserved, balance)
 
 	// Skip if balance is below minimum payout amount
-	if balance < mintConfig.MinPayoutAmount {
-		log.Printf("Skipping payout %s, Balance %d does not meet threshold of %d", mintConfig.URL, balance, mintConfig.MinPayoutAmount)
+	if balance < mintConfig.MinPayoutAmount || balance <= mintConfig.MinBalance {
+		log.Printf("Skipping payout %s, Balance %d does not meet threshold of %d", mintConfig.URL, balance, max(mintConfig.MinPayoutAmount, mintConfig.MinBalance+1))
 		return
 	}
 
@@ -97,159 +235,586 @@ func (m *Merchant) processPayout(mintConfig config_manager.MintConfig) {
 	// The tolerancePaymentAmount is the max amount we're willing to spend on the transaction, most of which should come back as change.
 	aimedPaymentAmount := balance - mintConfig.MinBalance
 
-	for _, profitShare := range m.config.ProfitShare {
-		aimedAmount := uint64(math.Round(float64(aimedPaymentAmount) * profitShare.Factor))
-		m.PayoutShare(mintConfig, aimedAmount, profitShare.LightningAddress)
+	for share, amount := range splitProfit(aimedPaymentAmount, config.ProfitShare) {
+		profitShare := config.ProfitShare[share]
+		due, err := m.shareAccruals.Accrue(mintConfig.URL, share, profitShare, amount, now)
+		if err != nil {
+			log.Printf("Error recording profit share %d for mint %s: %v", share, mintConfig.URL, err)
+			continue
+		}
+		if due == 0 {
+			log.Printf("Profit share %d to %s is below its minimum of %d sats, accruing %d sats", share, sharePayee(profitShare), profitShare.MinAmount, amount)
+			continue
+		}
+		m.PayoutShare(mintConfig, share, due, profitShare)
 	}
 
 	log.Printf("Payout completed for mint %s", mintConfig.URL)
 }
 
-func (m *Merchant) PayoutShare(mintConfig config_manager.MintConfig, aimedPaymentAmount uint64, lightningAddress string) {
-	tolerancePaymentAmount := aimedPaymentAmount + (aimedPaymentAmount * mintConfig.BalanceTolerancePercent / 100)
+// PayoutShare pays aimedPaymentAmount of a mint's balance to the lightning address, wallet
+// connection or npub of a profit share and records the payout in the ledger
+func (m *Merchant) PayoutShare(mintConfig config_manager.MintConfig, share int, aimedPaymentAmount uint64, profitShare config_manager.ProfitShareConfig) {
+	payout, err := m.payoutLedger.Add(Payout{
+		Mint:             mintConfig.URL,
+		Share:            share,
+		LightningAddress: profitShare.LightningAddress,
+		NWCWallet:        shareNWCWallet(profitShare),
+		Npub:             profitShare.Npub,
+		Delivery:         shareDelivery(profitShare),
+		AimedAmount:      aimedPaymentAmount,
+	}, time.Now())
+	if err != nil {
+		log.Printf("Error recording payout for mint %s, skipping: %v", mintConfig.URL, err)
+		return
+	}
+	m.attemptPayout(mintConfig, payout)
+}
 
-	log.Printf("Processing payout for mint %s: aiming for %d sats with %d sats tolerance", mintConfig.URL, aimedPaymentAmount, tolerancePaymentAmount)
+// attemptPayout melts a payout to its lightning address or wallet connection, or sends it as ecash
+// to its npub, and records the outcome
+func (m *Merchant) attemptPayout(mintConfig config_manager.MintConfig, payout Payout) {
+	if payout.Npub != "" {
+		m.attemptEcashPayout(mintConfig, payout)
+		return
+	}
 
-	maxCost := aimedPaymentAmount + tolerancePaymentAmount
-	meltErr := m.tollwallet.MeltToLightning(mintConfig.URL, aimedPaymentAmount, maxCost, lightningAddress)
+	tolerancePaymentAmount := payout.AimedAmount + (payout.AimedAmount * mintConfig.BalanceTolerancePercent / 100)
+
+	log.Printf("Processing payout %s for mint %s: aiming for %d sats with %d sats tolerance", payout.ID, mintConfig.URL, payout.AimedAmount, tolerancePaymentAmount)
+
+	maxCost := payout.AimedAmount + tolerancePaymentAmount
+	payout.Attempts++
+	var melt tollwallet.Melt
+	var meltErr error
+	if payout.NWCWallet == "" {
+		melt, meltErr = m.tollwallet.MeltToLightning(mintConfig.URL, payout.AimedAmount, maxCost, payout.LightningAddress)
+	} else if client, err := m.nwcClient(payout); err != nil {
+		// The wallet connection was removed from the config, there is nowhere left to pay
+		payout.Attempts = maxPayoutAttempts
+		meltErr = err
+	} else {
+		melt, meltErr = m.tollwallet.MeltToInvoice(mintConfig.URL, payout.AimedAmount, maxCost, client.Connection().String(), func(amountSats uint64) (string, error) {
+			return client.MakeInvoice(context.Background(), amountSats, "TollGate payout")
+		})
+	}
+	payout = settlePayout(payout, melt, meltErr, time.Now())
 
-	// If melting fails try to return the money to the wallet
-	if meltErr != nil {
-		log.Printf("Error during payout for mint %s. Error melting to lightning. Skipping... %v", mintConfig.URL, meltErr)
-		return
+	if payout.Status == PayoutFailed || payout.Status == PayoutAbandoned {
+		log.Printf("Error during payout %s for mint %s, %s after %d attempts: %v", payout.ID, mintConfig.URL, payout.Status, payout.Attempts, meltErr)
+	}
+	if err := m.payoutLedger.Update(payout); err != nil {
+		log.Printf("Error recording payout %s for mint %s: %v", payout.ID, mintConfig.URL, err)
+	}
+}
+
+// nwcClient connects to the wallet service a payout is for, as long as its profit share is still configured
+func (m *Merchant) nwcClient(payout Payout) (*lightning.NWCClient, error) {
+	config, _ := m.settings()
+	if payout.Share < len(config.ProfitShare) {
+		share := config.ProfitShare[payout.Share]
+		if shareNWCWallet(share) == payout.NWCWallet {
+			return lightning.NewNWCClient(share.NWC, m.relayPool)
+		}
+	}
+	return nil, fmt.Errorf("no profit share pays to wallet nwc:%s anymore", payout.NWCWallet)
+}
+
+// retryPayouts checks whether pending melts of a mint were paid and retries failed payouts that are due
+func (m *Merchant) retryPayouts(mintConfig config_manager.MintConfig, now time.Time) {
+	for _, payout := range m.payoutLedger.Unsettled(mintConfig.URL) {
+		switch payout.Status {
+		case PayoutPending:
+			if payout.MeltQuote == "" {
+				// Ecash payouts are only pending while being sent
+				continue
+			}
+			melt, err := m.tollwallet.MeltState(tollwallet.Melt{
+				Quote:            payout.MeltQuote,
+				Invoice:          payout.Invoice,
+				Mint:             payout.Mint,
+				Payee:            payout.payee(),
+				LightningAddress: payout.LightningAddress,
+			})
+			if err != nil {
+				log.Printf("Error checking pending payout %s for mint %s: %v", payout.ID, mintConfig.URL, err)
+				continue
+			}
+			payout = settlePayout(payout, melt, nil, now)
+			log.Printf("Pending payout %s for mint %s is %s", payout.ID, mintConfig.URL, payout.Status)
+			if err := m.payoutLedger.Update(payout); err != nil {
+				log.Printf("Error recording payout %s for mint %s: %v", payout.ID, mintConfig.URL, err)
+			}
+		case PayoutFailed:
+			if now.Before(payout.NextRetry) {
+				continue
+			}
+			log.Printf("Retrying payout %s for mint %s, attempt %d", payout.ID, mintConfig.URL, payout.Attempts+1)
+			m.attemptPayout(mintConfig, payout)
+		}
 	}
 }
 
+// Payouts returns the payouts in the ledger matching filter, for reconciliation with the Lightning wallet
+func (m *Merchant) Payouts(filter PayoutFilter) []Payout {
+	return m.payoutLedger.Payouts(filter)
+}
+
+// ShareAccruals returns the progress of every profit share
+func (m *Merchant) ShareAccruals() []ShareAccrual {
+	return m.shareAccruals.Accruals()
+}
+
 type PurchaseSessionResult struct {
 	Status      string
 	Description string
+	// Code is the machine-readable reason of a failed purchase, see ErrorCode
+	Code string
+	// Receipt is the signed receipt of a successful purchase
+	Receipt *nostr.Event
+	// Balance is the prepaid balance of the customer after a top-up or a purchase paid from it
+	Balance *uint64
+}
+
+// failedPurchase describes a purchase that failed with err. Its status is "rejected" if the
+// payment was at fault and "error" if the tollgate was.
+func failedPurchase(err error, description string) PurchaseSessionResult {
+	status := "error"
+	if isRejection(err) {
+		status = "rejected"
+	}
+	return PurchaseSessionResult{Status: status, Description: description, Code: ErrorCode(err)}
+}
+
+// PurchaseSession opens the gate for macAddress in exchange for paymentToken.
+// tierName selects one of the configured tiers, an empty name selects the first one.
+// The signer of purchaseEvent becomes the owner of the session. A balance tag on purchaseEvent
+// tops up the prepaid balance of the signer with paymentToken or pays from it, see BalanceTopUp.
+// A failed purchase returns its result together with the error, see ErrorCode.
+// Payments are idempotent: a retried purchaseEvent gets the result of the first attempt.
+func (m *Merchant) PurchaseSession(paymentToken string, macAddress string, tierName string, purchaseEvent nostr.Event) (PurchaseSessionResult, error) {
+	if err := m.checkPaymentEvent(purchaseEvent, time.Now()); err != nil {
+		return failedPurchase(err, "Invalid payment event"), err
+	}
+
+	previous, processed, inFlight := m.paymentLog.Begin(purchaseEvent.ID)
+	if processed {
+		log.Printf("Payment event %s was processed before, returning its result", purchaseEvent.ID)
+		if previous.Code != "" {
+			// Only failures after the token was received are logged
+			return previous, fmt.Errorf("%w: payment event %s failed before", ErrGateFailure, purchaseEvent.ID)
+		}
+		return previous, nil
+	}
+	if inFlight {
+		err := fmt.Errorf("%w: %s", ErrPaymentInProgress, purchaseEvent.ID)
+		return failedPurchase(err, "Payment is being processed"), err
+	}
+
+	result, err := m.purchaseSession(paymentToken, macAddress, tierName, purchaseEvent)
+
+	// Once the token was received a retry can't pay again, so it gets this result
+	received := err == nil || errors.Is(err, ErrGateFailure) || errors.Is(err, ErrBalanceFailure)
+	if logErr := m.paymentLog.Finish(purchaseEvent.ID, purchaseEvent.CreatedAt.Time(), result, received); logErr != nil {
+		log.Printf("Error logging payment event %s: %v", purchaseEvent.ID, logErr)
+	}
+	return result, err
 }
 
-func (m *Merchant) PurchaseSession(paymentToken string, macAddress string) (PurchaseSessionResult, error) {
-	valid := utils.ValidateMACAddress(macAddress)
+// purchaseSession receives the payment of a purchase and opens the gate
+func (m *Merchant) purchaseSession(paymentToken string, macAddress string, tierName string, purchaseEvent nostr.Event) (PurchaseSessionResult, error) {
+	config, _ := m.settings()
+	balanceTag, usesBalance := balancePayment(purchaseEvent)
+	topUp := usesBalance && balanceTag == BalanceTopUp
+	if topUp && !prepaidEnabled(config) {
+		return failedPurchase(ErrPrepaidDisabled, "Prepaid balances are not offered"), ErrPrepaidDisabled
+	}
+
+	// Top-ups open no session, so they need no device
+	valid := topUp || utils.ValidateMACAddress(macAddress)
 
 	if !valid {
-		return PurchaseSessionResult{
-			Status:      "rejected",
-			Description: fmt.Sprintf("%s is not a valid MAC address", macAddress),
-		}, nil
+		err := fmt.Errorf("%w: %s", ErrInvalidMAC, macAddress)
+		return failedPurchase(err, fmt.Sprintf("%s is not a valid MAC address", macAddress)), err
+	}
+
+	tier, found := selectTier(config, tierName)
+	if !found {
+		err := fmt.Errorf("%w: %s", ErrUnknownTier, tierName)
+		return failedPurchase(err, fmt.Sprintf("Unknown tier %s", tierName)), err
 	}
 
-	// TODO: prevent payment with les than step_size/price in sats (aka, fee > value)
+	pricePerStep := m.purchasePrice(tierPricePerStep(config, tier), purchaseEvent.CreatedAt.Time(), time.Now())
+	if usesBalance && !topUp {
+		return m.purchaseFromBalance(balanceTag, pricePerStep, macAddress, tier, purchaseEvent)
+	}
 
 	paymentCashuToken, err := cashu.DecodeToken(paymentToken)
 
 	if err != nil {
-		return PurchaseSessionResult{
-			Status:      "rejected",
-			Description: "Invalid cashu token",
-		}, nil
+		err = fmt.Errorf("%w: %w", ErrInvalidToken, err)
+		return failedPurchase(err, "Invalid cashu token"), err
 	}
-	amountAfterSwap, err := m.tollwallet.Receive(paymentCashuToken)
 
-	// TODO: distinguish between rejection and errors
+	// Tokens that don't buy a single step after the mint's fees are rejected before they are swapped,
+	// so customers keep them
+	amount := paymentCashuToken.Amount()
+	fee := m.tollwallet.TokenFee(paymentCashuToken)
+	if amount < pricePerStep+fee {
+		err = fmt.Errorf("%w: %d sats minus %d sats of mint fees don't buy a single step at %d sats", ErrBelowMinimum, amount, fee, pricePerStep)
+		return failedPurchase(err, fmt.Sprintf("Payment of %d sats is below the minimum of %d sats", amount, pricePerStep+fee)), err
+	}
+
+	amountAfterSwap, err := m.tollwallet.Receive(paymentCashuToken)
 	if err != nil {
 		log.Printf("Error Processing payment. %s", err)
-		return PurchaseSessionResult{
-			Status:      "error",
-			Description: fmt.Sprintf("Error Processing payment"),
-		}, nil
+		switch {
+		case errors.Is(err, ErrUntrustedMint):
+			return failedPurchase(err, fmt.Sprintf("Mint %s is not accepted", paymentCashuToken.Mint())), err
+		case errors.Is(err, ErrTokenSpent):
+			return failedPurchase(err, "Token was already spent"), err
+		case errors.Is(err, ErrMintUnreachable):
+			return failedPurchase(err, fmt.Sprintf("Mint %s is unreachable", paymentCashuToken.Mint())), err
+		default:
+			return failedPurchase(err, "Error Processing payment"), err
+		}
 	}
 
 	log.Printf("Amount after swap: %d", amountAfterSwap)
 
-	// Calculate minutes based on the net value
-	// TODO: Update frontend to show the correct duration after fees
-	//       Already tested to verify that allottedMinutes is correct
-	var allottedMinutes = uint64(amountAfterSwap / m.config.PricePerMinute)
-	if allottedMinutes < 1 {
-		allottedMinutes = 1 // Minimum 1 minute
+	if topUp {
+		return m.topUpBalance(amountAfterSwap, paymentCashuToken.Mint(), purchaseEvent)
+	}
+
+	return m.openSession(amountAfterSwap, paymentCashuToken.Mint(), pricePerStep, macAddress, tier, purchaseEvent)
+}
+
+// openSession opens the gate for macAddress for what amount buys at pricePerStep in the given tier,
+// once the payment was received into the wallet
+func (m *Merchant) openSession(amount uint64, mint string, pricePerStep uint64, macAddress string, tier config_manager.TierConfig, purchaseEvent nostr.Event) (PurchaseSessionResult, error) {
+	config, pricing := m.settings()
+	now := time.Now()
+
+	// Regulars get a lower price once they spent enough this month
+	loyal := config.Loyalty.Enabled && purchaseEvent.PubKey != ""
+	month := loyaltyMonth(pricing, now)
+	customer, _ := m.customers.Customer(purchaseEvent.PubKey)
+	if loyal {
+		if percent := loyaltyDiscount(config.Loyalty, customer.spentIn(month)); percent > 0 {
+			pricePerStep = max(pricePerStep*(100-percent)/100, 1)
+			log.Printf("Loyalty discount of %d%% for %s, who spent %d sats this month", percent, purchaseEvent.PubKey, customer.spentIn(month))
+		}
+	}
+
+	// Calculate the purchased steps based on the net value
+	// TODO: Update frontend to show the correct allotment after fees
+	metric, stepSize, _ := stepPricing(config)
+	var allottedSteps = AllottedSteps(amount, pricePerStep, pricing.Discounts())
+	if allottedSteps < 1 {
+		allottedSteps = 1 // Minimum 1 step
+	}
+	var freeSteps uint64
+	if loyal {
+		freeSteps = loyaltyFreeSteps(config.Loyalty.FreeStepEvery, customer.PaidSteps, allottedSteps)
 	}
 
-	// Convert to seconds for gate opening
-	durationSeconds := int64(allottedMinutes * 60)
+	log.Printf("Calculated steps: %d and %d free of %d %s (from value %d at %d per step, tier %q)",
+		allottedSteps, freeSteps, stepSize, metric, amount, pricePerStep, tier.Name)
+
+	payment := valve.Payment{
+		Amount:    amount,
+		Mint:      mint,
+		EventID:   purchaseEvent.ID,
+		PaidSteps: allottedSteps,
+		Pubkey:    purchaseEvent.PubKey,
+		Tier:      tier.Name,
+		RateLimit: valve.RateLimit{
+			DownloadKbps: tier.DownloadKbps,
+			UploadKbps:   tier.UploadKbps,
+		},
+	}
 
-	log.Printf("Calculated minutes: %d (from value %d)",
-		allottedMinutes, amountAfterSwap)
+	purchased := events.SessionPurchased{
+		MACAddress: macAddress,
+		Metric:     metric,
+		Tier:       tier.Name,
+		Amount:     amount,
+		Mint:       mint,
+		EventID:    purchaseEvent.ID,
+	}
 
-	// Open gate for the specified duration using the valve module
-	err = valve.OpenGate(macAddress, durationSeconds)
+	// Open gate for the purchased allotment using the valve module
+	var allotment string
+	var err error
+	if metric == valve.MetricBytes {
+		purchased.AllowanceBytes = (allottedSteps + freeSteps) * stepSize
+		allotment = fmt.Sprintf("%d bytes", purchased.AllowanceBytes)
+		err = m.valve.OpenGateForBytes(macAddress, purchased.AllowanceBytes, payment)
+	} else {
+		durationSeconds := int64((allottedSteps + freeSteps) * stepSize / 1000)
+		purchased.Duration = time.Duration(durationSeconds) * time.Second
+		allotment = fmt.Sprintf("%d seconds", durationSeconds)
+		err = m.valve.OpenGate(macAddress, durationSeconds, payment)
+	}
 
 	if err != nil {
 		log.Printf("Error opening gate for MAC %s: %v", macAddress, err)
-		return PurchaseSessionResult{
-			Status:      "error",
-			Description: fmt.Sprintf("Error while opening gate for %s", macAddress),
-		}, nil
+		err = fmt.Errorf("%w for %s: %w", ErrGateFailure, macAddress, err)
+		return failedPurchase(err, fmt.Sprintf("Error while opening gate for %s", macAddress)), err
 	}
 
-	// Check if bragging is enabled
-	if m.config.Bragging.Enabled {
-		// err = bragging.AnnounceSuccessfulPayment(m.config.ConfigManager, int64(amountAfterSwap), durationSeconds)
-		// if err != nil {
-		// 	log.Printf("Error while bragging: %v", err)
-		// 	// Don't return error, continue with success
-		// }
+	// Subscribers such as bragging react to the sale without the merchant knowing about them
+	m.bus.Publish(purchased)
+
+	log.Printf("Access granted to %s for %s", macAddress, allotment)
+
+	if loyal {
+		if recordErr := m.customers.RecordPurchase(purchaseEvent.PubKey, month, amount, allottedSteps, freeSteps, now); recordErr != nil {
+			log.Printf("Error recording purchase of %s for loyalty: %v", purchaseEvent.PubKey, recordErr)
+		}
 	}
 
-	log.Printf("Access granted to %s for %d minutes", macAddress, allottedMinutes)
+	// The gate is open either way, a missing receipt only costs the customer their proof
+	var receipt *nostr.Event
+	if session, exists := m.valve.GetSession(macAddress); exists {
+		receipt, err = createReceipt(config, purchased, session, purchaseEvent)
+		if err != nil {
+			log.Printf("Error creating receipt for MAC %s: %v", macAddress, err)
+		}
+	}
 
 	return PurchaseSessionResult{
 		Status:      "success",
 		Description: "",
+		Receipt:     receipt,
 	}, nil
 }
 
-func (m *Merchant) GetAdvertisement() string {
-	return m.advertisement
+// minPayment returns the smallest payment that buys a step at pricePerStep once the mint
+// charged inputFeePpk for each proof, for tokens made of as few proofs as possible
+func minPayment(pricePerStep uint64, inputFeePpk uint) uint64 {
+	for payment := pricePerStep; ; payment++ {
+		proofs := uint64(bits.OnesCount64(payment))
+		fee := (proofs*uint64(inputFeePpk) + 999) / 1000
+		if payment >= pricePerStep+fee {
+			return payment
+		}
+	}
 }
 
-func CreateAdvertisement(config *config_manager.Config) (string, error) {
-	// Create a map of accepted mints and their minimum payments
-	mintMinPayments := make(map[string]uint64)
-	for _, mintConfig := range config.AcceptedMints {
-		mintFee, err := config_manager.GetMintFee(mintConfig.URL)
-		if err != nil {
-			log.Printf("Error getting mint fee for %s: %v", mintConfig.URL, err)
-			continue
+// purchasePrice returns the price of a step for a purchase signed at signedAt and processed at now.
+// A purchase signed shortly before the price changed gets the lower of the two prices.
+func (m *Merchant) purchasePrice(regularPrice uint64, signedAt time.Time, now time.Time) uint64 {
+	_, pricing := m.settings()
+	price := pricing.PriceAt(regularPrice, now)
+	if signedAt.Before(now) && now.Sub(signedAt) <= priceGracePeriod {
+		if signedPrice := pricing.PriceAt(regularPrice, signedAt); signedPrice < price {
+			return signedPrice
+		}
+	}
+	return price
+}
+
+// stepPricing returns the metric sessions are sold in, the size of a step in that
+// metric and the price of a step. Configs from before metered sessions only have
+// price_per_minute, which is a step of 60000 milliseconds.
+func stepPricing(config *config_manager.Config) (string, uint64, uint64) {
+	metric := config.Metric
+	if metric == "" {
+		metric = valve.MetricMilliseconds
+	}
+
+	stepSize := config.StepSize
+	if stepSize == 0 {
+		if metric == valve.MetricBytes {
+			stepSize = 1000000 // 1 MB
+		} else {
+			stepSize = 60000 // 1 minute
+		}
+	}
+
+	pricePerStep := config.PricePerStep
+	if pricePerStep == 0 {
+		pricePerStep = config.PricePerMinute
+	}
+	if pricePerStep == 0 {
+		pricePerStep = 1
+	}
+
+	return metric, stepSize, pricePerStep
+}
+
+// selectTier returns the configured tier with the given name. An empty name selects
+// the first tier. Without configured tiers every purchase gets an unlimited tier at the base price.
+func selectTier(config *config_manager.Config, name string) (config_manager.TierConfig, bool) {
+	if len(config.Tiers) == 0 {
+		if name != "" {
+			log.Printf("No tiers configured, ignoring requested tier %s", name)
 		}
-		paymentAmount := uint64(config_manager.CalculateMinPayment(mintFee))
-		mintMinPayments[mintConfig.URL] = paymentAmount
+		return config_manager.TierConfig{}, true
+	}
+
+	if name == "" {
+		return config.Tiers[0], true
+	}
+	for _, tier := range config.Tiers {
+		if tier.Name == name {
+			return tier, true
+		}
+	}
+	return config_manager.TierConfig{}, false
+}
+
+// validateTiers checks that the gate can enforce the rate limits of every tier,
+// so no tier is advertised with a bandwidth its clients wouldn't get
+func validateTiers(tiers []config_manager.TierConfig, gate *valve.Valve) error {
+	for _, tier := range tiers {
+		limit := valve.RateLimit{DownloadKbps: tier.DownloadKbps, UploadKbps: tier.UploadKbps}
+		if err := gate.CheckRateLimit(limit); err != nil {
+			return fmt.Errorf("tier %q: %w", tier.Name, err)
+		}
+	}
+	return nil
+}
+
+// tierPricePerStep returns the price of a step in the given tier, falling back to the base price
+func tierPricePerStep(config *config_manager.Config, tier config_manager.TierConfig) uint64 {
+	if tier.PricePerStep != 0 {
+		return tier.PricePerStep
+	}
+	_, _, pricePerStep := stepPricing(config)
+	return pricePerStep
+}
+
+// Advertisement is the signed kind 21021 event announcing the prices and mints of the tollgate
+type Advertisement struct {
+	// Event is the event as JSON
+	Event     string
+	ID        string
+	CreatedAt time.Time
+}
+
+// GetAdvertisement returns the advertisement of the currently active prices, mints and fees
+func (m *Merchant) GetAdvertisement() Advertisement {
+	m.advertisementMutex.Lock()
+	defer m.advertisementMutex.Unlock()
+
+	now := time.Now()
+	if m.advertisement.Event != "" && now.Before(m.advertisementExpiry) {
+		return m.advertisement
 	}
 
-	// Create the nostr event with the mintMinPayments map
+	config, pricing := m.settings()
+	advertisement, err := createAdvertisement(config, pricing, m.tollwallet.InputFees(), now)
+	if err != nil {
+		// Keep the stale advertisement, purchases are priced at the active price regardless
+		log.Printf("Error recreating advertisement: %v", err)
+		return m.advertisement
+	}
+	m.advertisement = advertisement
+	m.advertisementExpiry = advertisementExpiry(pricing, now)
+	log.Printf("Advertisement updated: %s", advertisement.Event)
+	return m.advertisement
+}
+
+// invalidateAdvertisement makes the next GetAdvertisement create a new advertisement
+func (m *Merchant) invalidateAdvertisement() {
+	m.advertisementMutex.Lock()
+	defer m.advertisementMutex.Unlock()
+	m.advertisementExpiry = time.Time{}
+}
+
+// advertisementExpiry returns when an advertisement created at now is due to be recreated:
+// when the active price changes, or after advertisementMaxAge
+func advertisementExpiry(pricing *Pricing, now time.Time) time.Time {
+	expiry := now.Add(advertisementMaxAge)
+	if change := pricing.NextChange(now); !change.IsZero() && change.Before(expiry) {
+		return change
+	}
+	return expiry
+}
+
+// CreateAdvertisement creates the signed advertisement of the prices active at now as JSON.
+// mintFees holds the input_fee_ppk of the mints whose fees are known.
+func CreateAdvertisement(config *config_manager.Config, pricing *Pricing, mintFees map[string]uint, now time.Time) (string, error) {
+	advertisement, err := createAdvertisement(config, pricing, mintFees, now)
+	return advertisement.Event, err
+}
+
+func createAdvertisement(config *config_manager.Config, pricing *Pricing, mintFees map[string]uint, now time.Time) (Advertisement, error) {
+	// The price_per_step tag is the price of the default tier for clients that don't know about tiers
+	metric, stepSize, _ := stepPricing(config)
+	defaultTier, _ := selectTier(config, "")
 	tags := nostr.Tags{
-		{"metric", "milliseconds"},
-		{"step_size", "60000"},
-		{"price_per_step", fmt.Sprintf("%d", config.PricePerMinute), "sat"},
+		{"metric", metric},
+		{"step_size", fmt.Sprintf("%d", stepSize)},
+		{"price_per_step", fmt.Sprintf("%d", pricing.PriceAt(tierPricePerStep(config, defaultTier), now)), "sat"},
 		{"tips", "1", "2", "3"},
 	}
 
-	// Create a separate tag for each accepted mint
-	for mint, minPayment := range mintMinPayments {
-		// TODO: include min payment in future - requires TIP-01 & frontend logic adjustment
-		log.Printf("TODO: include min payment (%d) for %s in future", minPayment, mint)
-		//tags = append(tags, nostr.Tag{"mint", mint, fmt.Sprintf("%d", minPayment)})
-		tags = append(tags, nostr.Tag{"mint", mint})
+	// Tell clients until when the prices hold and which schedule or holiday set them
+	if percent, name := pricing.PricePercentAt(now); name != "" {
+		tags = append(tags, nostr.Tag{"price_rule", name, fmt.Sprintf("%d", percent)})
+	}
+	if expiry := pricing.NextChange(now); !expiry.IsZero() {
+		tags = append(tags, nostr.Tag{"price_valid_until", fmt.Sprintf("%d", expiry.Unix())})
+	}
+
+	// Volume discounts: minimum steps and percentage off the price per step
+	for _, discount := range pricing.Discounts() {
+		tags = append(tags, nostr.Tag{
+			"discount",
+			fmt.Sprintf("%d", discount.MinSteps),
+			fmt.Sprintf("%d", discount.DiscountPercent),
+		})
+	}
+
+	// Advertise each tier as its own option: name, price per step, unit, download and upload kbit/s
+	for _, tier := range config.Tiers {
+		tags = append(tags, nostr.Tag{
+			"tier",
+			tier.Name,
+			fmt.Sprintf("%d", pricing.PriceAt(tierPricePerStep(config, tier), now)),
+			"sat",
+			fmt.Sprintf("%d", tier.DownloadKbps),
+			fmt.Sprintf("%d", tier.UploadKbps),
+		})
+	}
+
+	// Create a separate tag for each accepted mint with the minimum payment that buys a step
+	// of the default tier after its fees, left out while the mint's fees are unknown
+	defaultPrice := pricing.PriceAt(tierPricePerStep(config, defaultTier), now)
+	for _, mintConfig := range config.AcceptedMints {
+		feePpk, known := mintFees[mintConfig.URL]
+		if !known {
+			tags = append(tags, nostr.Tag{"mint", mintConfig.URL})
+			continue
+		}
+		tags = append(tags, nostr.Tag{"mint", mintConfig.URL, fmt.Sprintf("%d", minPayment(defaultPrice, feePpk))})
 	}
 
 	advertisementEvent := nostr.Event{
-		Kind:    21021,
-		Tags:    tags,
-		Content: "",
+		Kind:      21021,
+		CreatedAt: nostr.Timestamp(now.Unix()),
+		Tags:      tags,
+		Content:   "",
 	}
 
 	// Sign
 	err := advertisementEvent.Sign(config.TollgatePrivateKey)
 	if err != nil {
-		return "", fmt.Errorf("Error signing advertisement event: %v", err)
+		return Advertisement{}, fmt.Errorf("Error signing advertisement event: %v", err)
 	}
 
 	// Convert to JSON string for storage
 	detailsBytes, err := json.Marshal(advertisementEvent)
 	if err != nil {
-		return "", fmt.Errorf("Error marshaling advertisement event: %v", err)
+		return Advertisement{}, fmt.Errorf("Error marshaling advertisement event: %v", err)
 	}
 
-	return string(detailsBytes), nil
+	return Advertisement{
+		Event:     string(detailsBytes),
+		ID:        advertisementEvent.ID,
+		CreatedAt: advertisementEvent.CreatedAt.Time(),
+	}, nil
 }
@@ -0,0 +1,310 @@
+package merchant
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/btcsuite/btcd/btcec/v2"
+	"github.com/btcsuite/btcd/btcec/v2/ecdsa"
+	"github.com/btcsuite/btcd/btcutil"
+	"github.com/btcsuite/btcd/btcutil/hdkeychain"
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/decred/dcrd/dcrec/secp256k1/v4"
+	"github.com/elnosh/gonuts/cashu"
+	"github.com/elnosh/gonuts/cashu/nuts/nut01"
+	"github.com/elnosh/gonuts/cashu/nuts/nut02"
+	"github.com/elnosh/gonuts/cashu/nuts/nut03"
+	"github.com/elnosh/gonuts/cashu/nuts/nut04"
+	"github.com/elnosh/gonuts/cashu/nuts/nut07"
+	"github.com/elnosh/gonuts/crypto"
+	"github.com/lightningnetwork/lnd/lnwire"
+	"github.com/lightningnetwork/lnd/zpay32"
+)
+
+// standInMint is a minimal Cashu mint for tests. It serves its keyset and NUT-04 mint
+// quotes with real bolt11 invoices, and signs blinded messages once a quote is marked paid.
+type standInMint struct {
+	*httptest.Server
+	keyset  *crypto.MintKeyset
+	nodeKey *btcec.PrivateKey
+
+	mu      sync.Mutex
+	quotes  map[string]*nut04.PostMintQuoteBolt11Response
+	amounts map[string]uint64
+	// spent holds the Ys of spent proofs
+	spent map[string]bool
+}
+
+func newStandInMint(t *testing.T) *standInMint {
+	t.Helper()
+
+	seed := make([]byte, 32)
+	rand.Read(seed)
+	master, err := hdkeychain.NewMaster(seed, &chaincfg.MainNetParams)
+	if err != nil {
+		t.Fatalf("Failed to create mint master key: %v", err)
+	}
+	keyset, err := crypto.GenerateKeyset(master, 0, 0)
+	if err != nil {
+		t.Fatalf("Failed to generate mint keyset: %v", err)
+	}
+	nodeKey, err := btcec.NewPrivateKey()
+	if err != nil {
+		t.Fatalf("Failed to create node key: %v", err)
+	}
+
+	mint := &standInMint{
+		keyset:  keyset,
+		nodeKey: nodeKey,
+		quotes:  make(map[string]*nut04.PostMintQuoteBolt11Response),
+		amounts: make(map[string]uint64),
+		spent:   make(map[string]bool),
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /v1/keysets", mint.handleKeysets)
+	mux.HandleFunc("GET /v1/keys/{id}", mint.handleKeys)
+	mux.HandleFunc("POST /v1/mint/quote/bolt11", mint.handleMintQuote)
+	mux.HandleFunc("GET /v1/mint/quote/bolt11/{quote}", mint.handleMintQuoteState)
+	mux.HandleFunc("POST /v1/mint/bolt11", mint.handleMint)
+	mux.HandleFunc("POST /v1/checkstate", mint.handleCheckState)
+	mux.HandleFunc("POST /v1/swap", mint.handleSwap)
+	mint.Server = httptest.NewServer(mux)
+	t.Cleanup(mint.Close)
+	return mint
+}
+
+// pay marks the invoice of a quote as paid
+func (m *standInMint) pay(quoteID string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.quotes[quoteID].State = nut04.Paid
+}
+
+// token creates a token of amount sats from the mint. The stand-in mint doesn't verify
+// signatures of proofs, so its tokens are made up rather than minted.
+func (m *standInMint) token(t *testing.T, amount uint64) cashu.Token {
+	t.Helper()
+
+	secret := make([]byte, 32)
+	rand.Read(secret)
+	C, _ := btcec.NewPrivateKey()
+	proofs := cashu.Proofs{{
+		Amount: amount,
+		Id:     m.keyset.Id,
+		Secret: hex.EncodeToString(secret),
+		C:      hex.EncodeToString(C.PubKey().SerializeCompressed()),
+	}}
+	token, err := cashu.NewTokenV4(proofs, m.URL, cashu.Sat, false)
+	if err != nil {
+		t.Fatalf("Failed to create token: %v", err)
+	}
+	return token
+}
+
+// spend marks the proofs of a token as spent
+func (m *standInMint) spend(token cashu.Token) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, proof := range token.Proofs() {
+		Y, _ := crypto.HashToCurve([]byte(proof.Secret))
+		m.spent[hex.EncodeToString(Y.SerializeCompressed())] = true
+	}
+}
+
+func (m *standInMint) handleKeysets(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, nut02.GetKeysetsResponse{Keysets: []nut02.Keyset{
+		{Id: m.keyset.Id, Unit: cashu.Sat.String(), Active: true, InputFeePpk: m.keyset.InputFeePpk},
+	}})
+}
+
+func (m *standInMint) handleKeys(w http.ResponseWriter, r *http.Request) {
+	keys := make(nut01.KeysMap)
+	for amount, pair := range m.keyset.Keys {
+		keys[amount] = hex.EncodeToString(pair.PublicKey.SerializeCompressed())
+	}
+	writeJSON(w, nut01.GetKeysResponse{Keysets: []nut01.Keyset{
+		{Id: m.keyset.Id, Unit: cashu.Sat.String(), Keys: keys},
+	}})
+}
+
+func (m *standInMint) handleMintQuote(w http.ResponseWriter, r *http.Request) {
+	var request nut04.PostMintQuoteBolt11Request
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	invoice, err := m.invoice(request.Amount)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	quote := &nut04.PostMintQuoteBolt11Response{
+		Quote:   fmt.Sprintf("quote-%d", len(m.quotes)+1),
+		Request: invoice,
+		State:   nut04.Unpaid,
+		Expiry:  uint64(time.Now().Add(time.Hour).Unix()),
+	}
+	m.quotes[quote.Quote] = quote
+	m.amounts[quote.Quote] = request.Amount
+	writeJSON(w, quote)
+}
+
+func (m *standInMint) handleMintQuoteState(w http.ResponseWriter, r *http.Request) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	quote, exists := m.quotes[r.PathValue("quote")]
+	if !exists {
+		http.Error(w, `{"detail": "quote not found", "code": 20004}`, http.StatusBadRequest)
+		return
+	}
+	writeJSON(w, quote)
+}
+
+func (m *standInMint) handleMint(w http.ResponseWriter, r *http.Request) {
+	var request nut04.PostMintBolt11Request
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	quote, exists := m.quotes[request.Quote]
+	if !exists || quote.State != nut04.Paid {
+		http.Error(w, `{"detail": "quote not paid", "code": 20001}`, http.StatusBadRequest)
+		return
+	}
+
+	signatures, total, err := m.sign(request.Outputs)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if total != m.amounts[request.Quote] {
+		http.Error(w, `{"detail": "outputs don't match quote amount", "code": 11002}`, http.StatusBadRequest)
+		return
+	}
+
+	quote.State = nut04.Issued
+	writeJSON(w, nut04.PostMintBolt11Response{Signatures: signatures})
+}
+
+func (m *standInMint) handleSwap(w http.ResponseWriter, r *http.Request) {
+	var request nut03.PostSwapRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	Ys := make([]string, 0, len(request.Inputs))
+	for _, proof := range request.Inputs {
+		Y, _ := crypto.HashToCurve([]byte(proof.Secret))
+		Ys = append(Ys, hex.EncodeToString(Y.SerializeCompressed()))
+		if m.spent[Ys[len(Ys)-1]] {
+			http.Error(w, `{"detail": "proof already used", "code": 11001}`, http.StatusBadRequest)
+			return
+		}
+	}
+
+	signatures, total, err := m.sign(request.Outputs)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	fee := (uint64(len(request.Inputs))*uint64(m.keyset.InputFeePpk) + 999) / 1000
+	if total+fee != request.Inputs.Amount() {
+		http.Error(w, `{"detail": "inputs and outputs are not balanced", "code": 11002}`, http.StatusBadRequest)
+		return
+	}
+
+	for _, Y := range Ys {
+		m.spent[Y] = true
+	}
+	writeJSON(w, nut03.PostSwapResponse{Signatures: signatures})
+}
+
+// sign signs blinded messages with the mint's keyset and returns their total amount
+func (m *standInMint) sign(outputs cashu.BlindedMessages) (cashu.BlindedSignatures, uint64, error) {
+	var total uint64
+	signatures := make(cashu.BlindedSignatures, 0, len(outputs))
+	for _, output := range outputs {
+		B_bytes, err := hex.DecodeString(output.B_)
+		if err != nil {
+			return nil, 0, err
+		}
+		B_, err := secp256k1.ParsePubKey(B_bytes)
+		if err != nil {
+			return nil, 0, err
+		}
+		C_ := crypto.SignBlindedMessage(B_, m.keyset.Keys[output.Amount].PrivateKey)
+		signatures = append(signatures, cashu.BlindedSignature{
+			Amount: output.Amount,
+			C_:     hex.EncodeToString(C_.SerializeCompressed()),
+			Id:     m.keyset.Id,
+		})
+		total += output.Amount
+	}
+	return signatures, total, nil
+}
+
+func (m *standInMint) handleCheckState(w http.ResponseWriter, r *http.Request) {
+	var request nut07.PostCheckStateRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var response nut07.PostCheckStateResponse
+	for _, Y := range request.Ys {
+		state := nut07.Unspent
+		if m.spent[Y] {
+			state = nut07.Spent
+		}
+		response.States = append(response.States, nut07.ProofState{Y: Y, State: state})
+	}
+	writeJSON(w, response)
+}
+
+// invoice creates a mainnet bolt11 invoice for amount sats signed by the mint's node key
+func (m *standInMint) invoice(amount uint64) (string, error) {
+	var preimage [32]byte
+	rand.Read(preimage[:])
+	paymentHash := sha256.Sum256(preimage[:])
+
+	invoice, err := zpay32.NewInvoice(&chaincfg.MainNetParams, paymentHash, time.Now(),
+		zpay32.Amount(lnwire.NewMSatFromSatoshis(btcutil.Amount(amount))),
+		zpay32.Description("stand-in mint quote"),
+		zpay32.PaymentAddr(paymentHash),
+	)
+	if err != nil {
+		return "", err
+	}
+	return invoice.Encode(zpay32.MessageSigner{
+		SignCompact: func(msg []byte) ([]byte, error) {
+			hash := sha256.Sum256(msg)
+			return ecdsa.SignCompact(m.nodeKey, hash[:], true), nil
+		},
+	})
+}
+
+func writeJSON(w http.ResponseWriter, value interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(value)
+}
@@ -0,0 +1,183 @@
+package merchant
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"slices"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/OpenTollGate/tollgate-module-basic-go/src/utils"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// KindPayment is the kind of the signed event a customer pays with (TIP-01)
+const KindPayment = 21000
+
+const (
+	// paymentEventMaxAge is how old a payment event may be when it arrives
+	paymentEventMaxAge = 10 * time.Minute
+	// paymentEventMaxSkew is how far ahead of the tollgate's clock a payment event may be dated
+	paymentEventMaxSkew = 1 * time.Minute
+	// maxLoggedPayments bounds the payment log, older payments are forgotten first
+	maxLoggedPayments = 10000
+)
+
+// checkPaymentEvent rejects payment events of the wrong kind, for another tollgate,
+// or signed too long ago or in the future to tell replays from retries
+func (m *Merchant) checkPaymentEvent(event nostr.Event, now time.Time) error {
+	return m.checkEvent(event, KindPayment, now)
+}
+
+// checkEvent rejects events that aren't of kind, have no p tag for this tollgate,
+// or were signed more than paymentEventMaxAge ago or dated ahead of the tollgate's clock
+func (m *Merchant) checkEvent(event nostr.Event, kind int, now time.Time) error {
+	config, _ := m.settings()
+	if event.Kind != kind {
+		return fmt.Errorf("%w: kind %d, expected %d", ErrInvalidEvent, event.Kind, kind)
+	}
+
+	tollgatePubkey, err := nostr.GetPublicKey(config.TollgatePrivateKey)
+	if err != nil {
+		return fmt.Errorf("error deriving tollgate pubkey: %w", err)
+	}
+	if !slices.ContainsFunc(event.Tags, func(tag nostr.Tag) bool {
+		return len(tag) >= 2 && tag[0] == "p" && tag[1] == tollgatePubkey
+	}) {
+		return fmt.Errorf("%w: event has no p tag for this tollgate", ErrInvalidEvent)
+	}
+
+	createdAt := event.CreatedAt.Time()
+	if age := now.Sub(createdAt); age > paymentEventMaxAge {
+		return fmt.Errorf("%w: signed %s ago", ErrStaleEvent, age.Round(time.Second))
+	}
+	if ahead := createdAt.Sub(now); ahead > paymentEventMaxSkew {
+		return fmt.Errorf("%w: dated %s in the future", ErrStaleEvent, ahead.Round(time.Second))
+	}
+	return nil
+}
+
+// PaymentLog remembers the outcome of payment events whose token was received, so a client
+// retrying a payment gets its original result instead of a double-spend error. Payments are
+// kept until their events are too old to be accepted anyway, and persisted to a JSON file
+// so retries are recognised across restarts.
+type PaymentLog struct {
+	path     string
+	mutex    sync.Mutex
+	payments map[string]loggedPayment
+	// inFlight holds the event IDs of payments being processed
+	inFlight map[string]bool
+}
+
+type loggedPayment struct {
+	EventID    string                `json:"event_id"`
+	EventTime  time.Time             `json:"event_time"`
+	Result     PurchaseSessionResult `json:"result"`
+	RecordedAt time.Time             `json:"recorded_at"`
+}
+
+// NewPaymentLog opens the payment log at path, loading any payments already on disk
+func NewPaymentLog(path string) (*PaymentLog, error) {
+	paymentLog := &PaymentLog{
+		path:     path,
+		payments: make(map[string]loggedPayment),
+		inFlight: make(map[string]bool),
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return paymentLog, nil
+		}
+		return nil, fmt.Errorf("failed to read payment log %s: %w", path, err)
+	}
+	if len(data) == 0 {
+		return paymentLog, nil
+	}
+
+	var payments []loggedPayment
+	if err := json.Unmarshal(data, &payments); err != nil {
+		return nil, fmt.Errorf("failed to parse payment log %s: %w", path, err)
+	}
+	for _, payment := range payments {
+		paymentLog.payments[payment.EventID] = payment
+	}
+	return paymentLog, nil
+}
+
+// Begin marks the payment of eventID as being processed. If the payment was processed before
+// its original result is returned, and inFlight is true while another request processes it.
+func (l *PaymentLog) Begin(eventID string) (result PurchaseSessionResult, found bool, inFlight bool) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	if payment, exists := l.payments[eventID]; exists {
+		return payment.Result, true, false
+	}
+	if l.inFlight[eventID] {
+		return PurchaseSessionResult{}, false, true
+	}
+	l.inFlight[eventID] = true
+	return PurchaseSessionResult{}, false, false
+}
+
+// Finish ends processing of the payment of eventID. Results are only recorded once the
+// token was received, payments that failed before may be retried with the same event.
+func (l *PaymentLog) Finish(eventID string, eventTime time.Time, result PurchaseSessionResult, record bool) error {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	delete(l.inFlight, eventID)
+	if !record {
+		return nil
+	}
+
+	now := time.Now()
+	l.payments[eventID] = loggedPayment{EventID: eventID, EventTime: eventTime, Result: result, RecordedAt: now}
+	l.prune(now)
+	return l.persist()
+}
+
+// prune forgets payments whose events are no longer accepted and the oldest payments
+// beyond maxLoggedPayments. The caller must hold l.mutex.
+func (l *PaymentLog) prune(now time.Time) {
+	for id, payment := range l.payments {
+		if now.Sub(payment.EventTime) > paymentEventMaxAge {
+			delete(l.payments, id)
+		}
+	}
+
+	if len(l.payments) <= maxLoggedPayments {
+		return
+	}
+	payments := l.sortedPayments()
+	for _, payment := range payments[:len(payments)-maxLoggedPayments] {
+		delete(l.payments, payment.EventID)
+	}
+}
+
+// sortedPayments returns the payments, oldest first. The caller must hold l.mutex.
+func (l *PaymentLog) sortedPayments() []loggedPayment {
+	payments := make([]loggedPayment, 0, len(l.payments))
+	for _, payment := range l.payments {
+		payments = append(payments, payment)
+	}
+	sort.Slice(payments, func(i, j int) bool {
+		if !payments[i].RecordedAt.Equal(payments[j].RecordedAt) {
+			return payments[i].RecordedAt.Before(payments[j].RecordedAt)
+		}
+		return payments[i].EventID < payments[j].EventID
+	})
+	return payments
+}
+
+// persist writes the payments to disk. The caller must hold l.mutex.
+func (l *PaymentLog) persist() error {
+	data, err := json.Marshal(l.sortedPayments())
+	if err != nil {
+		return fmt.Errorf("failed to marshal payment log: %w", err)
+	}
+	return utils.WriteFileAtomic(l.path, data)
+}
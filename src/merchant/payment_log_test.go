@@ -0,0 +1,105 @@
+package merchant
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+func TestCheckPaymentEvent(t *testing.T) {
+	m, _ := newTestMerchant(t, newStandInMint(t))
+	now := time.Now()
+
+	valid := paymentEvent(m)
+	if err := m.checkPaymentEvent(valid, now); err != nil {
+		t.Errorf("Valid payment event rejected: %v", err)
+	}
+
+	wrongKind := paymentEvent(m)
+	wrongKind.Kind = 1
+	otherTollgate := paymentEvent(m)
+	otherTollgate.Tags = nostr.Tags{{"p", "someone-else"}}
+	stale := paymentEvent(m)
+	stale.CreatedAt = nostr.Timestamp(now.Add(-11 * time.Minute).Unix())
+	future := paymentEvent(m)
+	future.CreatedAt = nostr.Timestamp(now.Add(2 * time.Minute).Unix())
+
+	tests := []struct {
+		name  string
+		event nostr.Event
+		err   error
+	}{
+		{"wrong kind", wrongKind, ErrInvalidEvent},
+		{"other tollgate", otherTollgate, ErrInvalidEvent},
+		{"stale", stale, ErrStaleEvent},
+		{"future-dated", future, ErrStaleEvent},
+	}
+	for _, test := range tests {
+		if err := m.checkPaymentEvent(test.event, now); !errors.Is(err, test.err) {
+			t.Errorf("%s event returned %v, expected %v", test.name, err, test.err)
+		}
+	}
+}
+
+func TestPurchaseSessionIdempotent(t *testing.T) {
+	mint := newStandInMint(t)
+	m, gate := newTestMerchant(t, mint)
+	macAddress := "00:11:22:33:44:b0"
+	token := serializeToken(t, mint.token(t, 20))
+	event := paymentEvent(m)
+
+	first, err := m.PurchaseSession(token, macAddress, "", event)
+	if err != nil || first.Status != "success" || first.Receipt == nil {
+		t.Fatalf("Purchase failed: %+v, %v", first, err)
+	}
+	if status, _ := gate.Status(macAddress); !status.Authorized {
+		t.Fatalf("Gate is closed after the purchase")
+	}
+	session, _ := m.valve.GetSession(macAddress)
+
+	// A retry of the same event gets the original result without extending the session
+	retry, err := m.PurchaseSession(token, macAddress, "", event)
+	if err != nil || retry.Status != "success" || retry.Receipt == nil || retry.Receipt.ID != first.Receipt.ID {
+		t.Errorf("Retry returned %+v, %v, expected the original result", retry, err)
+	}
+	if again, _ := m.valve.GetSession(macAddress); !again.ExpiresAt.Equal(session.ExpiresAt) {
+		t.Errorf("Retry extended the session from %s to %s", session.ExpiresAt, again.ExpiresAt)
+	}
+
+	// Paying again with the token in a new event is a double spend
+	if _, err := m.PurchaseSession(token, macAddress, "", paymentEvent(m)); !errors.Is(err, ErrTokenSpent) {
+		t.Errorf("Spending the token again returned %v, expected ErrTokenSpent", err)
+	}
+
+	// The outcome survives a restart
+	reopened, err := NewPaymentLog(m.paymentLog.path)
+	if err != nil {
+		t.Fatalf("Failed to reopen payment log: %v", err)
+	}
+	if result, processed, _ := reopened.Begin(event.ID); !processed || result.Receipt == nil || result.Receipt.ID != first.Receipt.ID {
+		t.Errorf("Reopened payment log returned %+v (processed %v), expected the original result", result, processed)
+	}
+}
+
+func TestPaymentLogRetriesRejections(t *testing.T) {
+	paymentLog, err := NewPaymentLog(filepath.Join(t.TempDir(), "payments.json"))
+	if err != nil {
+		t.Fatalf("Failed to open payment log: %v", err)
+	}
+
+	if _, _, inFlight := paymentLog.Begin("event"); inFlight {
+		t.Fatalf("New payment reported in flight")
+	}
+	if _, _, inFlight := paymentLog.Begin("event"); !inFlight {
+		t.Errorf("Concurrent payment of the same event not reported in flight")
+	}
+
+	// Payments rejected before their token was received may be retried
+	paymentLog.Finish("event", time.Now(), PurchaseSessionResult{Status: "error", Code: CodeMintUnreachable}, false)
+	if _, processed, inFlight := paymentLog.Begin("event"); processed || inFlight {
+		t.Errorf("Retry of a payment that failed before receiving its token was refused")
+	}
+}
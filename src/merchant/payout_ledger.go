@@ -0,0 +1,336 @@
+package merchant
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/OpenTollGate/tollgate-module-basic-go/src/tollwallet"
+	"github.com/OpenTollGate/tollgate-module-basic-go/src/utils"
+)
+
+// Statuses of a payout in the ledger
+const (
+	// PayoutPending payouts are being melted or sent, or the mint hasn't settled their melt yet
+	PayoutPending = "pending"
+	PayoutPaid    = "paid"
+	// PayoutFailed payouts are retried once their NextRetry passed
+	PayoutFailed = "failed"
+	// PayoutAbandoned payouts are no longer retried, their amount is paid out with the next
+	// payout unless their token was already created
+	PayoutAbandoned = "abandoned"
+)
+
+const (
+	// payoutRetryDelay is how long a failed payout waits for its first retry, doubling with every attempt
+	payoutRetryDelay = 1 * time.Minute
+	// maxPayoutRetryDelay bounds the wait between retries
+	maxPayoutRetryDelay = 24 * time.Hour
+	// maxPayoutAttempts is how often a payout is tried before it is abandoned
+	maxPayoutAttempts = 10
+	// maxSettledPayouts bounds the ledger, the oldest paid and abandoned payouts are forgotten first
+	maxSettledPayouts = 10000
+)
+
+// Payout is the payout of a profit share of a mint's balance over Lightning or as ecash
+type Payout struct {
+	ID   string `json:"id"`
+	Mint string `json:"mint"`
+	// Share is the position of the profit share in the config. It is paid to its
+	// lightning address, the wallet service of its wallet connection or its npub.
+	Share            int    `json:"share"`
+	LightningAddress string `json:"lightning_address,omitempty"`
+	NWCWallet        string `json:"nwc_wallet,omitempty"`
+	Npub             string `json:"npub,omitempty"`
+	AimedAmount      uint64 `json:"aimed_amount"`
+
+	// Ecash payouts to an npub record their token, so it can be sent again if it goes
+	// missing, and the ID of the event it was last sent in
+	Delivery string `json:"delivery,omitempty"`
+	Token    string `json:"token,omitempty"`
+	EventID  string `json:"event_id,omitempty"`
+
+	// The melt of the last attempt. Amount is what the invoice was for, which may be less
+	// than aimed for when fees were too high, and Fee the Lightning fee paid on top.
+	MeltQuote string `json:"melt_quote,omitempty"`
+	Invoice   string `json:"invoice,omitempty"`
+	Preimage  string `json:"preimage,omitempty"`
+	Amount    uint64 `json:"amount,omitempty"`
+	Fee       uint64 `json:"fee,omitempty"`
+
+	Status    string    `json:"status"`
+	Error     string    `json:"error,omitempty"`
+	Attempts  int       `json:"attempts"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+	NextRetry time.Time `json:"next_retry,omitzero"`
+}
+
+// payee returns who the payout is paid to
+func (p Payout) payee() string {
+	if p.NWCWallet != "" {
+		return "nwc:" + p.NWCWallet
+	}
+	if p.Npub != "" {
+		return p.Npub
+	}
+	return p.LightningAddress
+}
+
+// settled reports whether nothing more happens to the payout
+func (p Payout) settled() bool {
+	return p.Status == PayoutPaid || p.Status == PayoutAbandoned
+}
+
+// PayoutFilter selects payouts from the ledger, empty fields match every payout
+type PayoutFilter struct {
+	Mint   string
+	Status string
+	// Since and Until bound when payouts were created
+	Since time.Time
+	Until time.Time
+}
+
+func (f PayoutFilter) matches(payout Payout) bool {
+	return (f.Mint == "" || payout.Mint == f.Mint) &&
+		(f.Status == "" || payout.Status == f.Status) &&
+		(f.Since.IsZero() || !payout.CreatedAt.Before(f.Since)) &&
+		(f.Until.IsZero() || payout.CreatedAt.Before(f.Until))
+}
+
+// PayoutLedger records every payout and its attempts in a JSON file, so failed payouts
+// are retried across restarts and the operator can reconcile them with their Lightning wallet
+type PayoutLedger struct {
+	path    string
+	mutex   sync.Mutex
+	payouts map[string]Payout
+}
+
+// NewPayoutLedger opens the payout ledger at path, loading any payouts already on disk.
+// Payouts that were being melted or turned into a token when the daemon stopped have an
+// unknown outcome and are abandoned: their amount is still in the wallet if the melt didn't
+// happen. Tokens that were created but not sent yet are sent with the next payout.
+func NewPayoutLedger(path string) (*PayoutLedger, error) {
+	ledger := &PayoutLedger{
+		path:    path,
+		payouts: make(map[string]Payout),
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return ledger, nil
+		}
+		return nil, fmt.Errorf("failed to read payout ledger %s: %w", path, err)
+	}
+	if len(data) == 0 {
+		return ledger, nil
+	}
+
+	var payouts []Payout
+	if err := json.Unmarshal(data, &payouts); err != nil {
+		return nil, fmt.Errorf("failed to parse payout ledger %s: %w", path, err)
+	}
+	for _, payout := range payouts {
+		switch {
+		case payout.Status != PayoutPending || payout.MeltQuote != "":
+		case payout.Token != "":
+			payout.Status = PayoutFailed
+			payout.Error = "interrupted while sending the token"
+		case payout.Npub != "":
+			payout.Status = PayoutAbandoned
+			payout.Error = "interrupted while creating the token, check the wallet's pending proofs"
+		default:
+			payout.Status = PayoutAbandoned
+			payout.Error = "interrupted while melting, check the Lightning wallet"
+		}
+		ledger.payouts[payout.ID] = payout
+	}
+	return ledger, nil
+}
+
+// Add records a new pending payout and returns it with its ID
+func (l *PayoutLedger) Add(payout Payout, now time.Time) (Payout, error) {
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		return Payout{}, fmt.Errorf("failed to generate payout ID: %w", err)
+	}
+	payout.ID = hex.EncodeToString(id)
+	payout.Status = PayoutPending
+	payout.CreatedAt = now
+	payout.UpdatedAt = now
+
+	return payout, l.Update(payout)
+}
+
+// Update records the new state of a payout
+func (l *PayoutLedger) Update(payout Payout) error {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	l.payouts[payout.ID] = payout
+	l.prune()
+	return l.persist()
+}
+
+// Unsettled returns the pending and failed payouts of a mint, oldest first
+func (l *PayoutLedger) Unsettled(mint string) []Payout {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	var payouts []Payout
+	for _, payout := range l.sortedPayouts() {
+		if payout.Mint == mint && !payout.settled() {
+			payouts = append(payouts, payout)
+		}
+	}
+	return payouts
+}
+
+// Reserved returns the amount of a mint's balance owed to failed payouts. The tokens
+// of failed ecash payouts already left the balance.
+func (l *PayoutLedger) Reserved(mint string) uint64 {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	var reserved uint64
+	for _, payout := range l.payouts {
+		if payout.Mint == mint && payout.Status == PayoutFailed && payout.Token == "" {
+			reserved += payout.AimedAmount
+		}
+	}
+	return reserved
+}
+
+// Payout returns the payout with id
+func (l *PayoutLedger) Payout(id string) (Payout, bool) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	payout, exists := l.payouts[id]
+	return payout, exists
+}
+
+// Payouts returns the payouts matching filter, oldest first
+func (l *PayoutLedger) Payouts(filter PayoutFilter) []Payout {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	payouts := make([]Payout, 0)
+	for _, payout := range l.sortedPayouts() {
+		if filter.matches(payout) {
+			payouts = append(payouts, payout)
+		}
+	}
+	return payouts
+}
+
+// prune forgets the oldest settled payouts beyond maxSettledPayouts. The caller must hold l.mutex.
+func (l *PayoutLedger) prune() {
+	var settled []Payout
+	for _, payout := range l.sortedPayouts() {
+		if payout.settled() {
+			settled = append(settled, payout)
+		}
+	}
+	if len(settled) <= maxSettledPayouts {
+		return
+	}
+	for _, payout := range settled[:len(settled)-maxSettledPayouts] {
+		delete(l.payouts, payout.ID)
+	}
+}
+
+// sortedPayouts returns the payouts, oldest first. The caller must hold l.mutex.
+func (l *PayoutLedger) sortedPayouts() []Payout {
+	payouts := make([]Payout, 0, len(l.payouts))
+	for _, payout := range l.payouts {
+		payouts = append(payouts, payout)
+	}
+	sort.Slice(payouts, func(i, j int) bool {
+		if !payouts[i].CreatedAt.Equal(payouts[j].CreatedAt) {
+			return payouts[i].CreatedAt.Before(payouts[j].CreatedAt)
+		}
+		return payouts[i].ID < payouts[j].ID
+	})
+	return payouts
+}
+
+// persist writes the payouts to disk. The caller must hold l.mutex.
+func (l *PayoutLedger) persist() error {
+	data, err := json.Marshal(l.sortedPayouts())
+	if err != nil {
+		return fmt.Errorf("failed to marshal payout ledger: %w", err)
+	}
+	return utils.WriteFileAtomic(l.path, data)
+}
+
+// settlePayout records the outcome of an attempt to melt a payout. Failed attempts are
+// retried with exponential backoff until maxPayoutAttempts is reached.
+func settlePayout(payout Payout, melt tollwallet.Melt, err error, now time.Time) Payout {
+	payout.UpdatedAt = now
+	payout.NextRetry = time.Time{}
+	if melt.Quote != "" {
+		payout.MeltQuote = melt.Quote
+		payout.Invoice = melt.Invoice
+		payout.Preimage = melt.Preimage
+		payout.Amount = melt.Amount
+		payout.Fee = melt.Fee
+	}
+
+	switch {
+	case err == nil && melt.Paid():
+		payout.Status = PayoutPaid
+		payout.Error = ""
+	case melt.Pending():
+		payout.Status = PayoutPending
+		payout.Error = ""
+	default:
+		if err == nil {
+			err = fmt.Errorf("mint didn't pay melt quote %s", melt.Quote)
+		}
+		payout = failPayout(payout, err, now)
+	}
+	return payout
+}
+
+// settleDelivery records the outcome of an attempt to send the token of an ecash payout
+// in the event eventID
+func settleDelivery(payout Payout, eventID string, err error, now time.Time) Payout {
+	payout.UpdatedAt = now
+	payout.NextRetry = time.Time{}
+	if err != nil {
+		return failPayout(payout, err, now)
+	}
+	payout.EventID = eventID
+	payout.Status = PayoutPaid
+	payout.Error = ""
+	return payout
+}
+
+// failPayout records a failed attempt, to be retried with exponential backoff until
+// maxPayoutAttempts is reached
+func failPayout(payout Payout, err error, now time.Time) Payout {
+	payout.Error = err.Error()
+	if payout.Attempts >= maxPayoutAttempts {
+		payout.Status = PayoutAbandoned
+		return payout
+	}
+	payout.Status = PayoutFailed
+	payout.NextRetry = now.Add(payoutRetryBackoff(payout.Attempts))
+	return payout
+}
+
+// payoutRetryBackoff returns how long to wait after the attempts of a payout failed
+func payoutRetryBackoff(attempts int) time.Duration {
+	delay := payoutRetryDelay
+	for i := 1; i < attempts && delay < maxPayoutRetryDelay; i++ {
+		delay *= 2
+	}
+	return min(delay, maxPayoutRetryDelay)
+}
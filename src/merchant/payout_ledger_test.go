@@ -0,0 +1,191 @@
+package merchant
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/OpenTollGate/tollgate-module-basic-go/src/tollwallet"
+)
+
+func TestPayoutRetryBackoff(t *testing.T) {
+	tests := []struct {
+		attempts int
+		expected time.Duration
+	}{
+		{1, time.Minute},
+		{2, 2 * time.Minute},
+		{5, 16 * time.Minute},
+		{12, 24 * time.Hour},
+	}
+	for _, test := range tests {
+		if backoff := payoutRetryBackoff(test.attempts); backoff != test.expected {
+			t.Errorf("Backoff after %d attempts is %s, expected %s", test.attempts, backoff, test.expected)
+		}
+	}
+}
+
+func TestPayoutPayee(t *testing.T) {
+	tests := []struct {
+		payout   Payout
+		expected string
+	}{
+		{Payout{LightningAddress: "owner@example.com"}, "owner@example.com"},
+		{Payout{NWCWallet: "walletpubkey"}, "nwc:walletpubkey"},
+		{Payout{Npub: "npub1owner"}, "npub1owner"},
+	}
+	for _, test := range tests {
+		if payee := test.payout.payee(); payee != test.expected {
+			t.Errorf("Payee of %+v is %s, expected %s", test.payout, payee, test.expected)
+		}
+	}
+}
+
+func TestSettlePayout(t *testing.T) {
+	now := time.Date(2025, 3, 1, 12, 0, 0, 0, time.UTC)
+	payout := Payout{ID: "payout", Mint: "https://mint.example", AimedAmount: 100, Status: PayoutPending, Attempts: 1}
+
+	paid := settlePayout(payout, tollwallet.Melt{Quote: "quote", Amount: 95, Fee: 2, State: "PAID", Preimage: "preimage"}, nil, now)
+	if paid.Status != PayoutPaid || paid.MeltQuote != "quote" || paid.Amount != 95 || paid.Fee != 2 || paid.Preimage != "preimage" {
+		t.Errorf("Paid melt settled as %+v", paid)
+	}
+
+	pending := settlePayout(payout, tollwallet.Melt{Quote: "quote", State: "PENDING"}, tollwallet.ErrMeltPending, now)
+	if pending.Status != PayoutPending || pending.Error != "" || !pending.NextRetry.IsZero() {
+		t.Errorf("Pending melt settled as %+v", pending)
+	}
+
+	failed := settlePayout(payout, tollwallet.Melt{}, errors.New("no route"), now)
+	if failed.Status != PayoutFailed || failed.Error != "no route" || !failed.NextRetry.Equal(now.Add(time.Minute)) {
+		t.Errorf("Failed melt settled as %+v, expected a retry in a minute", failed)
+	}
+
+	unpaid := settlePayout(payout, tollwallet.Melt{Quote: "quote", State: "UNPAID"}, nil, now)
+	if unpaid.Status != PayoutFailed || unpaid.Error == "" {
+		t.Errorf("Unpaid melt settled as %+v, expected failed", unpaid)
+	}
+
+	payout.Attempts = maxPayoutAttempts
+	if abandoned := settlePayout(payout, tollwallet.Melt{}, errors.New("no route"), now); abandoned.Status != PayoutAbandoned || !abandoned.NextRetry.IsZero() {
+		t.Errorf("Melt failing for the last time settled as %+v, expected abandoned", abandoned)
+	}
+}
+
+func TestPayoutLedger(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "payouts.json")
+	ledger, err := NewPayoutLedger(path)
+	if err != nil {
+		t.Fatalf("Failed to open payout ledger: %v", err)
+	}
+	now := time.Date(2025, 3, 1, 12, 0, 0, 0, time.UTC)
+	mint := "https://mint.example"
+
+	add := func(aimedAmount uint64, at time.Time) Payout {
+		payout, err := ledger.Add(Payout{Mint: mint, LightningAddress: "owner@example.com", AimedAmount: aimedAmount}, at)
+		if err != nil {
+			t.Fatalf("Failed to add payout: %v", err)
+		}
+		return payout
+	}
+
+	paid := add(100, now)
+	paid.Status = PayoutPaid
+	ledger.Update(paid)
+
+	failed := add(40, now.Add(time.Minute))
+	failed = settlePayout(failed, tollwallet.Melt{}, errors.New("no route"), now)
+	ledger.Update(failed)
+
+	pending := add(60, now.Add(2*time.Minute))
+	pending.MeltQuote = "quote"
+	ledger.Update(pending)
+
+	// Melting when the daemon stopped
+	add(30, now.Add(3*time.Minute))
+
+	ledger.Add(Payout{Mint: "https://other.mint", AimedAmount: 10}, now)
+
+	if reserved := ledger.Reserved(mint); reserved != 40 {
+		t.Errorf("Reserved %d sats, expected the 40 sats of the failed payout", reserved)
+	}
+	if unsettled := ledger.Unsettled(mint); len(unsettled) != 3 || unsettled[0].ID != failed.ID {
+		t.Errorf("Unsettled payouts are %+v, expected the failed and both pending payouts", unsettled)
+	}
+
+	reopened, err := NewPayoutLedger(path)
+	if err != nil {
+		t.Fatalf("Failed to reopen payout ledger: %v", err)
+	}
+	unsettled := reopened.Unsettled(mint)
+	if len(unsettled) != 2 || unsettled[0].ID != failed.ID || unsettled[1].ID != pending.ID {
+		t.Errorf("Unsettled payouts after a restart are %+v, expected the failed payout and the melt to check", unsettled)
+	}
+	if interrupted := reopened.Payouts(PayoutFilter{Mint: mint, Status: PayoutAbandoned}); len(interrupted) != 1 || interrupted[0].AimedAmount != 30 {
+		t.Errorf("Abandoned payouts after a restart are %+v, expected the interrupted melt", interrupted)
+	}
+	if retried := reopened.Payouts(PayoutFilter{Mint: mint, Status: PayoutFailed}); len(retried) != 1 || !retried[0].NextRetry.Equal(failed.NextRetry) {
+		t.Errorf("Failed payouts after a restart are %+v, expected the retry to be kept", retried)
+	}
+
+	if payouts := reopened.Payouts(PayoutFilter{Mint: mint, Since: now.Add(time.Minute), Until: now.Add(3 * time.Minute)}); len(payouts) != 2 {
+		t.Errorf("Found %d payouts between one and three minutes in, expected 2", len(payouts))
+	}
+	if payouts := reopened.Payouts(PayoutFilter{}); len(payouts) != 5 {
+		t.Errorf("Found %d payouts in total, expected 5", len(payouts))
+	}
+}
+
+func TestEcashPayoutLedger(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "payouts.json")
+	ledger, err := NewPayoutLedger(path)
+	if err != nil {
+		t.Fatalf("Failed to open payout ledger: %v", err)
+	}
+	now := time.Date(2025, 3, 1, 12, 0, 0, 0, time.UTC)
+	mint := "https://mint.example"
+
+	add := func(aimedAmount uint64, token string) Payout {
+		payout, err := ledger.Add(Payout{Mint: mint, Npub: "npub1owner", Delivery: DeliveryDM, AimedAmount: aimedAmount, Token: token}, now)
+		if err != nil {
+			t.Fatalf("Failed to add payout: %v", err)
+		}
+		return payout
+	}
+
+	// The token was created but no relay took it
+	undelivered := add(40, "cashuBtoken")
+	undelivered.Attempts = 1
+	undelivered = settleDelivery(undelivered, "", errors.New("no relay accepted it"), now)
+	ledger.Update(undelivered)
+	if undelivered.Status != PayoutFailed || !undelivered.NextRetry.Equal(now.Add(time.Minute)) {
+		t.Errorf("Undelivered token settled as %+v, expected a retry in a minute", undelivered)
+	}
+
+	delivered := settleDelivery(undelivered, "event", nil, now)
+	if delivered.Status != PayoutPaid || delivered.EventID != "event" || delivered.Error != "" || !delivered.NextRetry.IsZero() {
+		t.Errorf("Delivered token settled as %+v, expected paid", delivered)
+	}
+
+	// Stopped while sending and while creating the token
+	sending := add(20, "cashuBother")
+	add(10, "")
+
+	if reserved := ledger.Reserved(mint); reserved != 0 {
+		t.Errorf("Reserved %d sats, expected none as the tokens left the wallet", reserved)
+	}
+	if payout, found := ledger.Payout(sending.ID); !found || payout.Token != "cashuBother" {
+		t.Errorf("Found payout %+v, expected the token to be recorded", payout)
+	}
+
+	reopened, err := NewPayoutLedger(path)
+	if err != nil {
+		t.Fatalf("Failed to reopen payout ledger: %v", err)
+	}
+	if retried := reopened.Payouts(PayoutFilter{Status: PayoutFailed}); len(retried) != 2 {
+		t.Errorf("Failed payouts after a restart are %+v, expected both tokens to be sent again", retried)
+	}
+	if interrupted := reopened.Payouts(PayoutFilter{Status: PayoutAbandoned}); len(interrupted) != 1 || interrupted[0].AimedAmount != 10 {
+		t.Errorf("Abandoned payouts after a restart are %+v, expected the payout without token", interrupted)
+	}
+}
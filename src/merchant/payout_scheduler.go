@@ -0,0 +1,229 @@
+package merchant
+
+import (
+	"context"
+	"log"
+	"math/rand/v2"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/OpenTollGate/tollgate-module-basic-go/src/config_manager"
+)
+
+// defaultPayoutInterval is used for mints without a payout interval
+const defaultPayoutInterval = 1 * time.Minute
+
+// payoutJitter is the largest fraction of its interval a payout is delayed by, so tollgates
+// started at the same time don't all melt at their mint at once
+const payoutJitter = 0.1
+
+// PayoutStatus is the schedule of the payouts of a mint
+type PayoutStatus struct {
+	Mint            string    `json:"mint"`
+	IntervalSeconds uint64    `json:"interval_seconds"`
+	LastRun         time.Time `json:"last_run,omitzero"`
+	NextRun         time.Time `json:"next_run,omitzero"`
+	Running         bool      `json:"running"`
+}
+
+// PayoutScheduler runs the payout of every mint at the mint's interval. Payouts never run
+// at the same time, since they share the wallet and its balance.
+type PayoutScheduler struct {
+	payout func(config_manager.MintConfig)
+
+	// running is held while a payout runs
+	running sync.Mutex
+
+	// mutex guards schedules and ctx, which is set while Run schedules payouts
+	mutex     sync.Mutex
+	schedules map[string]*mintSchedule
+	ctx       context.Context
+	runners   sync.WaitGroup
+}
+
+// mintSchedule is the payout schedule of a mint. stop ends the runner paying it out.
+type mintSchedule struct {
+	mint     config_manager.MintConfig
+	interval time.Duration
+	status   PayoutStatus
+	stop     context.CancelFunc
+}
+
+// NewPayoutScheduler creates a scheduler that calls payout for each of mints
+func NewPayoutScheduler(mints []config_manager.MintConfig, payout func(config_manager.MintConfig)) *PayoutScheduler {
+	s := &PayoutScheduler{
+		payout:    payout,
+		schedules: make(map[string]*mintSchedule, len(mints)),
+	}
+	s.SetMints(mints)
+	return s
+}
+
+// SetMints replaces the mints that are paid out. Mints no longer in mints stop being paid out
+// once a payout of theirs that is running finished. A changed interval starts a new delay,
+// other changes apply from the next payout.
+func (s *PayoutScheduler) SetMints(mints []config_manager.MintConfig) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	accepted := make(map[string]bool, len(mints))
+	for _, mint := range mints {
+		accepted[mint.URL] = true
+		schedule, exists := s.schedules[mint.URL]
+		if !exists {
+			schedule = &mintSchedule{status: PayoutStatus{Mint: mint.URL}}
+			s.schedules[mint.URL] = schedule
+		}
+		schedule.mint = mint
+
+		interval := payoutInterval(mint)
+		if exists && schedule.interval == interval {
+			continue
+		}
+		schedule.interval = interval
+		schedule.status.IntervalSeconds = uint64(interval / time.Second)
+		s.start(schedule)
+	}
+
+	for url, schedule := range s.schedules {
+		if !accepted[url] {
+			if schedule.stop != nil {
+				schedule.stop()
+			}
+			delete(s.schedules, url)
+		}
+	}
+}
+
+// start replaces the runner of schedule while Run schedules payouts. The caller must hold s.mutex.
+func (s *PayoutScheduler) start(schedule *mintSchedule) {
+	if schedule.stop != nil {
+		schedule.stop()
+		schedule.stop = nil
+	}
+	schedule.status.NextRun = time.Time{}
+	if s.ctx == nil {
+		return
+	}
+
+	ctx, stop := context.WithCancel(s.ctx)
+	schedule.stop = stop
+	s.runners.Add(1)
+	go func() {
+		defer s.runners.Done()
+		s.runMint(ctx, schedule)
+	}()
+}
+
+// payoutInterval returns how often the balance of a mint is paid out
+func payoutInterval(mint config_manager.MintConfig) time.Duration {
+	if mint.PayoutIntervalSeconds == 0 {
+		return defaultPayoutInterval
+	}
+	return time.Duration(mint.PayoutIntervalSeconds) * time.Second
+}
+
+// withJitter delays interval by a random part of up to payoutJitter of it
+func withJitter(interval time.Duration) time.Duration {
+	return interval + time.Duration(rand.Float64()*payoutJitter*float64(interval))
+}
+
+// Run schedules payouts until ctx is done. It returns once a payout that is running finished.
+func (s *PayoutScheduler) Run(ctx context.Context) {
+	s.mutex.Lock()
+	s.ctx = ctx
+	for _, schedule := range s.schedules {
+		s.start(schedule)
+	}
+	s.mutex.Unlock()
+
+	<-ctx.Done()
+	s.mutex.Lock()
+	s.ctx = nil
+	for _, schedule := range s.schedules {
+		s.start(schedule)
+	}
+	s.mutex.Unlock()
+	s.runners.Wait()
+}
+
+// runMint pays out the mint of schedule at its interval until ctx is done
+func (s *PayoutScheduler) runMint(ctx context.Context, schedule *mintSchedule) {
+	for {
+		// Once ctx is done the schedule belongs to another runner or to nobody
+		s.mutex.Lock()
+		if ctx.Err() != nil {
+			s.mutex.Unlock()
+			return
+		}
+		delay := withJitter(schedule.interval)
+		schedule.status.NextRun = time.Now().Add(delay)
+		s.mutex.Unlock()
+
+		timer := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+
+		s.running.Lock()
+		// Another payout may have held the wallet until the mint's payouts were stopped
+		s.mutex.Lock()
+		if ctx.Err() != nil {
+			s.mutex.Unlock()
+			s.running.Unlock()
+			return
+		}
+		schedule.status.Running = true
+		schedule.status.NextRun = time.Time{}
+		mint := schedule.mint
+		s.mutex.Unlock()
+
+		s.payout(mint)
+
+		s.mutex.Lock()
+		schedule.status.Running = false
+		schedule.status.LastRun = time.Now()
+		s.mutex.Unlock()
+		s.running.Unlock()
+	}
+}
+
+// Status returns the payout schedule of every mint, ordered by mint URL
+func (s *PayoutScheduler) Status() []PayoutStatus {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	status := make([]PayoutStatus, 0, len(s.schedules))
+	for _, schedule := range s.schedules {
+		status = append(status, schedule.status)
+	}
+	sort.Slice(status, func(i, j int) bool { return status[i].Mint < status[j].Mint })
+	return status
+}
+
+// StartPayoutRoutine pays out the balance of each accepted mint at its payout interval
+// until ctx is done. The returned channel is closed once a running payout finished.
+func (m *Merchant) StartPayoutRoutine(ctx context.Context) <-chan struct{} {
+	log.Printf("Starting payout routine")
+	for _, status := range m.payouts.Status() {
+		log.Printf("Paying out %s every %d seconds", status.Mint, status.IntervalSeconds)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		m.payouts.Run(ctx)
+		log.Printf("Payout routine stopped")
+	}()
+	return done
+}
+
+// PayoutStatus returns the payout schedule of every accepted mint. Nothing is scheduled
+// before the payout routine started.
+func (m *Merchant) PayoutStatus() []PayoutStatus {
+	return m.payouts.Status()
+}
@@ -0,0 +1,143 @@
+package merchant
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/OpenTollGate/tollgate-module-basic-go/src/config_manager"
+)
+
+func TestPayoutInterval(t *testing.T) {
+	if interval := payoutInterval(config_manager.MintConfig{PayoutIntervalSeconds: 3600}); interval != time.Hour {
+		t.Errorf("Interval is %s, expected 1h", interval)
+	}
+	if interval := payoutInterval(config_manager.MintConfig{}); interval != defaultPayoutInterval {
+		t.Errorf("Interval without configuration is %s, expected %s", interval, defaultPayoutInterval)
+	}
+	for i := 0; i < 100; i++ {
+		if delay := withJitter(time.Hour); delay < time.Hour || delay > time.Hour+6*time.Minute {
+			t.Fatalf("Jittered delay of 1h is %s, expected up to 6m more", delay)
+		}
+	}
+}
+
+func TestPayoutScheduler(t *testing.T) {
+	mints := []config_manager.MintConfig{{URL: "https://a.mint"}, {URL: "https://b.mint"}, {URL: "https://slow.mint"}}
+
+	var mutex sync.Mutex
+	runs := make(map[string]int)
+	var running, overlapped atomic.Bool
+	started := make(chan struct{}, 100)
+	release := make(chan struct{})
+	scheduler := NewPayoutScheduler(mints, func(mint config_manager.MintConfig) {
+		if running.Swap(true) {
+			overlapped.Store(true)
+		}
+		mutex.Lock()
+		runs[mint.URL]++
+		mutex.Unlock()
+		started <- struct{}{}
+		<-release
+		running.Store(false)
+	})
+	scheduler.schedules["https://a.mint"].interval = 10 * time.Millisecond
+	scheduler.schedules["https://b.mint"].interval = 10 * time.Millisecond
+	scheduler.schedules["https://slow.mint"].interval = time.Hour
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		scheduler.Run(ctx)
+		close(done)
+	}()
+
+	for i := 0; i < 5; i++ {
+		<-started
+		release <- struct{}{}
+	}
+	<-started
+
+	status := scheduler.Status()
+	if !status[0].Running && !status[1].Running {
+		t.Errorf("Status is %+v, expected a payout to be running", status)
+	}
+	if status[2].Running || !status[2].LastRun.IsZero() || time.Until(status[2].NextRun) < 59*time.Minute {
+		t.Errorf("Slow mint status is %+v, expected the first run in an hour", status[2])
+	}
+
+	// Stopping waits for the running payout
+	cancel()
+	select {
+	case <-done:
+		t.Fatalf("Scheduler stopped while a payout was running")
+	case <-time.After(20 * time.Millisecond):
+	}
+	release <- struct{}{}
+	<-done
+
+	if overlapped.Load() {
+		t.Errorf("Payouts ran at the same time")
+	}
+	if runs["https://a.mint"] == 0 || runs["https://b.mint"] == 0 || runs["https://slow.mint"] != 0 ||
+		runs["https://a.mint"]+runs["https://b.mint"] != 6 {
+		t.Errorf("Payouts ran %v times, expected 6 for the fast mints and none for the slow one", runs)
+	}
+	for _, status := range scheduler.Status() {
+		if status.Running || !status.NextRun.IsZero() {
+			t.Errorf("Status of stopped scheduler is %+v, expected nothing scheduled", status)
+		}
+	}
+}
+
+func TestPayoutSchedulerSetMints(t *testing.T) {
+	paid := make(chan config_manager.MintConfig, 10)
+	scheduler := NewPayoutScheduler([]config_manager.MintConfig{{URL: "https://a.mint"}, {URL: "https://b.mint"}}, func(mint config_manager.MintConfig) {
+		paid <- mint
+	})
+	scheduler.schedules["https://a.mint"].interval = time.Hour
+	scheduler.schedules["https://b.mint"].interval = time.Hour
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		scheduler.Run(ctx)
+		close(done)
+	}()
+
+	// A shorter interval and min balance apply to the running scheduler, a removed mint stops
+	// and a new one is scheduled
+	scheduler.SetMints([]config_manager.MintConfig{
+		{URL: "https://a.mint", PayoutIntervalSeconds: 1, MinBalance: 64},
+		{URL: "https://c.mint", PayoutIntervalSeconds: 3600},
+	})
+	select {
+	case mint := <-paid:
+		if mint.URL != "https://a.mint" || mint.MinBalance != 64 {
+			t.Errorf("Paid out %+v, expected https://a.mint with its new min balance", mint)
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatalf("Mint with a shortened interval wasn't paid out")
+	}
+
+	status := scheduler.Status()
+	if len(status) != 2 || status[0].Mint != "https://a.mint" || status[1].Mint != "https://c.mint" {
+		t.Fatalf("Status is %+v, expected https://a.mint and https://c.mint", status)
+	}
+	if status[0].IntervalSeconds != 1 || (!status[0].Running && status[0].LastRun.IsZero()) {
+		t.Errorf("Status of https://a.mint is %+v, expected a run every second", status[0])
+	}
+	if status[1].IntervalSeconds != 3600 || time.Until(status[1].NextRun) < 59*time.Minute {
+		t.Errorf("Status of https://c.mint is %+v, expected the first run in an hour", status[1])
+	}
+
+	cancel()
+	<-done
+	for _, status := range scheduler.Status() {
+		if !status.NextRun.IsZero() {
+			t.Errorf("Status of stopped scheduler is %+v, expected nothing scheduled", status)
+		}
+	}
+}
@@ -0,0 +1,226 @@
+package merchant
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/OpenTollGate/tollgate-module-basic-go/src/config_manager"
+)
+
+// Pricing applies price schedules, holiday overrides and volume discounts to the configured prices.
+// The advertisement carries the price active when it was created and the discounts, from which
+// customers compute the same allotment as the merchant using AllottedSteps.
+type Pricing struct {
+	location  *time.Location
+	schedules []priceSchedule
+	holidays  []holiday
+	// discounts are sorted by MinSteps, largest first
+	discounts []config_manager.DiscountConfig
+}
+
+// priceSchedule is a recurring time range with its own price
+type priceSchedule struct {
+	name string
+	// days is empty for schedules that apply every day
+	days map[time.Weekday]bool
+	// start and end are minutes since midnight, a range with end <= start runs past midnight
+	start        int
+	end          int
+	pricePercent uint64
+}
+
+// holiday overrides the price for a whole day
+type holiday struct {
+	name string
+	// year is 0 for holidays that recur every year
+	year         int
+	month        time.Month
+	day          int
+	pricePercent uint64
+}
+
+var weekdays = map[string]time.Weekday{
+	"sun": time.Sunday,
+	"mon": time.Monday,
+	"tue": time.Tuesday,
+	"wed": time.Wednesday,
+	"thu": time.Thursday,
+	"fri": time.Friday,
+	"sat": time.Saturday,
+}
+
+// pricingLookahead bounds the search for the next price change, covering weekly schedules
+const pricingLookahead = 8 * 24 * time.Hour
+
+// NewPricing validates a pricing config. An empty config charges the regular price at all times.
+func NewPricing(config config_manager.PricingConfig) (*Pricing, error) {
+	pricing := &Pricing{location: time.Local}
+
+	if config.Timezone != "" {
+		location, err := time.LoadLocation(config.Timezone)
+		if err != nil {
+			return nil, fmt.Errorf("invalid pricing timezone %q: %w", config.Timezone, err)
+		}
+		pricing.location = location
+	}
+
+	for _, scheduleConfig := range config.Schedules {
+		schedule := priceSchedule{
+			name:         scheduleConfig.Name,
+			days:         make(map[time.Weekday]bool),
+			pricePercent: scheduleConfig.PricePercent,
+		}
+		if schedule.pricePercent == 0 {
+			return nil, fmt.Errorf("price schedule %q has no price_percent", schedule.name)
+		}
+		for _, day := range scheduleConfig.Days {
+			weekday, valid := weekdays[strings.ToLower(day)]
+			if !valid {
+				return nil, fmt.Errorf("price schedule %q has invalid day %q", schedule.name, day)
+			}
+			schedule.days[weekday] = true
+		}
+
+		var err error
+		if schedule.start, err = parseClock(scheduleConfig.Start); err != nil {
+			return nil, fmt.Errorf("price schedule %q has invalid start: %w", schedule.name, err)
+		}
+		if schedule.end, err = parseClock(scheduleConfig.End); err != nil {
+			return nil, fmt.Errorf("price schedule %q has invalid end: %w", schedule.name, err)
+		}
+		pricing.schedules = append(pricing.schedules, schedule)
+	}
+
+	for _, holidayConfig := range config.Holidays {
+		parsed := holiday{name: holidayConfig.Name, pricePercent: holidayConfig.PricePercent}
+		if parsed.pricePercent == 0 {
+			return nil, fmt.Errorf("holiday %q has no price_percent", parsed.name)
+		}
+
+		if date, err := time.Parse("2006-01-02", holidayConfig.Date); err == nil {
+			parsed.year, parsed.month, parsed.day = date.Date()
+		} else if date, err := time.Parse("01-02", holidayConfig.Date); err == nil {
+			_, parsed.month, parsed.day = date.Date()
+		} else {
+			return nil, fmt.Errorf("holiday %q has invalid date %q, expected YYYY-MM-DD or MM-DD", parsed.name, holidayConfig.Date)
+		}
+		pricing.holidays = append(pricing.holidays, parsed)
+	}
+
+	for _, discount := range config.Discounts {
+		if discount.MinSteps == 0 || discount.DiscountPercent >= 100 {
+			return nil, fmt.Errorf("invalid volume discount of %d%% from %d steps", discount.DiscountPercent, discount.MinSteps)
+		}
+		pricing.discounts = append(pricing.discounts, discount)
+	}
+	sort.Slice(pricing.discounts, func(i, j int) bool {
+		return pricing.discounts[i].MinSteps > pricing.discounts[j].MinSteps
+	})
+
+	return pricing, nil
+}
+
+// parseClock parses "HH:MM" into minutes since midnight
+func parseClock(clock string) (int, error) {
+	parsed, err := time.Parse("15:04", clock)
+	if err != nil {
+		return 0, fmt.Errorf("%q is not HH:MM", clock)
+	}
+	return parsed.Hour()*60 + parsed.Minute(), nil
+}
+
+// PricePercentAt returns the percentage of the regular price charged at t and the name of the
+// holiday or schedule setting it. Holidays take precedence over schedules, and the first
+// matching holiday or schedule in the config wins.
+func (p *Pricing) PricePercentAt(t time.Time) (uint64, string) {
+	t = t.In(p.location)
+	year, month, day := t.Date()
+	for _, holiday := range p.holidays {
+		if (holiday.year == 0 || holiday.year == year) && holiday.month == month && holiday.day == day {
+			return holiday.pricePercent, holiday.name
+		}
+	}
+
+	minute := t.Hour()*60 + t.Minute()
+	weekday := t.Weekday()
+	yesterday := (weekday + 6) % 7
+	for _, schedule := range p.schedules {
+		if schedule.covers(weekday, yesterday, minute) {
+			return schedule.pricePercent, schedule.name
+		}
+	}
+	return 100, ""
+}
+
+// covers reports whether the schedule applies at minute of weekday
+func (s priceSchedule) covers(weekday time.Weekday, yesterday time.Weekday, minute int) bool {
+	onDay := func(day time.Weekday) bool {
+		return len(s.days) == 0 || s.days[day]
+	}
+
+	switch {
+	case s.start == s.end:
+		return onDay(weekday)
+	case s.start < s.end:
+		return onDay(weekday) && minute >= s.start && minute < s.end
+	default:
+		// The range started on the previous day if it is past midnight
+		return (onDay(weekday) && minute >= s.start) || (onDay(yesterday) && minute < s.end)
+	}
+}
+
+// PriceAt returns the price of a step at t for a regular price per step.
+// Adjusted prices are rounded to the nearest sat and never drop below 1 sat.
+func (p *Pricing) PriceAt(pricePerStep uint64, t time.Time) uint64 {
+	percent, _ := p.PricePercentAt(t)
+	return applyPercent(pricePerStep, percent)
+}
+
+func applyPercent(price uint64, percent uint64) uint64 {
+	adjusted := (price*percent + 50) / 100
+	if adjusted < 1 {
+		return 1
+	}
+	return adjusted
+}
+
+// NextChange returns when the price percentage after t changes next,
+// or the zero time if it doesn't change within the next eight days
+func (p *Pricing) NextChange(t time.Time) time.Time {
+	if len(p.schedules) == 0 && len(p.holidays) == 0 {
+		return time.Time{}
+	}
+
+	// Schedules and holidays start and end on whole minutes
+	current, _ := p.PricePercentAt(t)
+	next := t.Truncate(time.Minute)
+	for next.Sub(t) < pricingLookahead {
+		next = next.Add(time.Minute)
+		if percent, _ := p.PricePercentAt(next); percent != current {
+			return next
+		}
+	}
+	return time.Time{}
+}
+
+// Discounts returns the volume discounts, largest minimum first
+func (p *Pricing) Discounts() []config_manager.DiscountConfig {
+	return p.discounts
+}
+
+// AllottedSteps returns how many steps amount buys at pricePerStep. Every volume discount
+// whose minimum is reached at its discounted price qualifies and the one buying the most
+// steps applies. Customers compute their allotment from the advertised price_per_step and
+// discount tags the same way.
+func AllottedSteps(amount uint64, pricePerStep uint64, discounts []config_manager.DiscountConfig) uint64 {
+	allotted := amount / pricePerStep
+	for _, discount := range discounts {
+		steps := amount * 100 / (pricePerStep * (100 - discount.DiscountPercent))
+		if steps >= discount.MinSteps && steps > allotted {
+			allotted = steps
+		}
+	}
+	return allotted
+}
@@ -0,0 +1,120 @@
+package merchant
+
+import (
+	"testing"
+	"time"
+
+	"github.com/OpenTollGate/tollgate-module-basic-go/src/config_manager"
+)
+
+func newTestPricing(t *testing.T) *Pricing {
+	pricing, err := NewPricing(config_manager.PricingConfig{
+		Timezone: "UTC",
+		Schedules: []config_manager.PriceScheduleConfig{
+			{Name: "happy hour", Days: []string{"fri"}, Start: "17:00", End: "19:00", PricePercent: 50},
+			{Name: "night", Start: "23:00", End: "06:00", PricePercent: 75},
+		},
+		Holidays: []config_manager.HolidayConfig{
+			{Name: "new year", Date: "01-01", PricePercent: 200},
+		},
+		Discounts: []config_manager.DiscountConfig{
+			{MinSteps: 30, DiscountPercent: 10},
+			{MinSteps: 60, DiscountPercent: 20},
+		},
+	})
+	if err != nil {
+		t.Fatalf("NewPricing failed: %v", err)
+	}
+	return pricing
+}
+
+func TestPricePercentAt(t *testing.T) {
+	pricing := newTestPricing(t)
+
+	tests := []struct {
+		at      string
+		percent uint64
+		rule    string
+	}{
+		{"2026-10-16T12:00:00Z", 100, ""},          // Friday noon
+		{"2026-10-16T17:00:00Z", 50, "happy hour"}, // Friday happy hour starts
+		{"2026-10-16T18:59:00Z", 50, "happy hour"}, // and lasts until 19:00
+		{"2026-10-16T19:00:00Z", 100, ""},          // exclusive end
+		{"2026-10-17T17:30:00Z", 100, ""},          // Saturday has no happy hour
+		{"2026-10-16T23:30:00Z", 75, "night"},      // night rate before midnight
+		{"2026-10-17T05:59:00Z", 75, "night"},      // and after midnight
+		{"2027-01-01T23:30:00Z", 200, "new year"},  // holidays override schedules
+		{"2027-01-02T00:30:00Z", 75, "night"},      // the night rate is back after the holiday
+	}
+	for _, test := range tests {
+		at, _ := time.Parse(time.RFC3339, test.at)
+		percent, rule := pricing.PricePercentAt(at)
+		if percent != test.percent || rule != test.rule {
+			t.Errorf("PricePercentAt(%s) = %d%% (%q), expected %d%% (%q)", test.at, percent, rule, test.percent, test.rule)
+		}
+	}
+}
+
+func TestNextChange(t *testing.T) {
+	pricing := newTestPricing(t)
+
+	at, _ := time.Parse(time.RFC3339, "2026-10-16T16:42:30Z")
+	expected, _ := time.Parse(time.RFC3339, "2026-10-16T17:00:00Z")
+	if next := pricing.NextChange(at); !next.Equal(expected) {
+		t.Errorf("NextChange(%s) = %s, expected %s", at, next, expected)
+	}
+
+	flat, _ := NewPricing(config_manager.PricingConfig{})
+	if next := flat.NextChange(at); !next.IsZero() {
+		t.Errorf("NextChange without schedules = %s, expected zero time", next)
+	}
+}
+
+func TestPriceAt(t *testing.T) {
+	pricing := newTestPricing(t)
+
+	happyHour, _ := time.Parse(time.RFC3339, "2026-10-16T17:30:00Z")
+	if price := pricing.PriceAt(5, happyHour); price != 3 {
+		t.Errorf("Half of 5 sats is %d, expected 3", price)
+	}
+	if price := pricing.PriceAt(1, happyHour); price != 1 {
+		t.Errorf("Half of 1 sat is %d, expected the minimum of 1", price)
+	}
+}
+
+func TestAllottedSteps(t *testing.T) {
+	discounts := newTestPricing(t).Discounts()
+
+	tests := []struct {
+		amount uint64
+		steps  uint64
+	}{
+		{10, 10}, // below every minimum
+		{27, 30}, // 27 sats at 0.9 sats per step reach the 30 step discount
+		{26, 26}, // 28 steps at 0.9 sats per step don't reach the 30 step minimum
+		{50, 62}, // 50 sats at 0.8 sats per step reach 60 steps
+		{53, 66}, // the 20% discount buys more than the 10% one
+		{100, 125},
+	}
+	for _, test := range tests {
+		if steps := AllottedSteps(test.amount, 1, discounts); steps != test.steps {
+			t.Errorf("AllottedSteps(%d) = %d, expected %d", test.amount, steps, test.steps)
+		}
+	}
+}
+
+func TestNewPricingValidation(t *testing.T) {
+	invalid := []config_manager.PricingConfig{
+		{Timezone: "Not/AZone"},
+		{Schedules: []config_manager.PriceScheduleConfig{{Name: "bad", Start: "25:00", End: "06:00", PricePercent: 50}}},
+		{Schedules: []config_manager.PriceScheduleConfig{{Name: "bad", Days: []string{"someday"}, Start: "01:00", End: "06:00", PricePercent: 50}}},
+		{Schedules: []config_manager.PriceScheduleConfig{{Name: "free", Start: "01:00", End: "06:00"}}},
+		{Holidays: []config_manager.HolidayConfig{{Name: "bad", Date: "christmas", PricePercent: 50}}},
+		{Discounts: []config_manager.DiscountConfig{{MinSteps: 10, DiscountPercent: 100}}},
+	}
+	for i, config := range invalid {
+		if _, err := NewPricing(config); err == nil {
+			t.Errorf("NewPricing accepted invalid config %d: %+v", i, config)
+		}
+	}
+}
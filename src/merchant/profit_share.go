@@ -0,0 +1,292 @@
+package merchant
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"math/bits"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/OpenTollGate/tollgate-module-basic-go/src/config_manager"
+	"github.com/OpenTollGate/tollgate-module-basic-go/src/lightning"
+	"github.com/OpenTollGate/tollgate-module-basic-go/src/utils"
+)
+
+// shareNWCWallet returns the pubkey of the wallet service a share gets invoices from, empty for lightning addresses
+func shareNWCWallet(share config_manager.ProfitShareConfig) string {
+	if share.NWC == "" {
+		return ""
+	}
+	connection, err := lightning.ParseNWCConnection(share.NWC)
+	if err != nil {
+		return ""
+	}
+	return connection.WalletPubkey
+}
+
+// sharePayee describes where a share is paid to for logs
+func sharePayee(share config_manager.ProfitShareConfig) string {
+	if wallet := shareNWCWallet(share); wallet != "" {
+		return "nwc:" + wallet
+	}
+	if share.Npub != "" {
+		return share.Npub
+	}
+	return share.LightningAddress
+}
+
+// sharePartsPerMillion is the precision profit share factors are applied with
+const sharePartsPerMillion = 1000000
+
+// validateProfitShares checks that every share gets a positive part of the balance,
+// that the shares don't add up to more than the balance and that each has a target
+func validateProfitShares(shares []config_manager.ProfitShareConfig) error {
+	var total uint64
+	for i, share := range shares {
+		if math.IsNaN(share.Factor) || share.Factor <= 0 || share.Factor > 1 {
+			return fmt.Errorf("profit share %d has factor %v, expected more than 0 and at most 1", i, share.Factor)
+		}
+		targets := 0
+		for _, target := range []string{share.LightningAddress, share.NWC, share.Npub} {
+			if target != "" {
+				targets++
+			}
+		}
+		if targets != 1 {
+			return fmt.Errorf("profit share %d has %d of lightning_address, nwc and npub, expected one", i, targets)
+		}
+		if share.NWC != "" {
+			if _, err := lightning.ParseNWCConnection(share.NWC); err != nil {
+				return fmt.Errorf("profit share %d: %w", i, err)
+			}
+		}
+		if share.Npub != "" {
+			if _, err := decodeNpub(share.Npub); err != nil {
+				return fmt.Errorf("profit share %d: %w", i, err)
+			}
+		}
+		if share.Delivery != "" && (share.Npub == "" || share.Delivery != DeliveryDM && share.Delivery != DeliveryNutzap) {
+			return fmt.Errorf("profit share %d has delivery %q, expected %q or %q with an npub", i, share.Delivery, DeliveryDM, DeliveryNutzap)
+		}
+		total += shareParts(share)
+	}
+	if total > sharePartsPerMillion {
+		return fmt.Errorf("profit share factors add up to %v, more than 1", float64(total)/sharePartsPerMillion)
+	}
+	return nil
+}
+
+// shareParts returns the factor of a share in parts per million
+func shareParts(share config_manager.ProfitShareConfig) uint64 {
+	return uint64(math.Round(share.Factor * sharePartsPerMillion))
+}
+
+// splitProfit divides amount among shares by their factors. Every share gets its part rounded
+// down, and the sats lost to rounding go one each to the shares with the largest remainders,
+// earlier shares first on ties. The part of amount the factors don't cover isn't split.
+func splitProfit(amount uint64, shares []config_manager.ProfitShareConfig) []uint64 {
+	amounts := make([]uint64, len(shares))
+	remainders := make([]uint64, len(shares))
+	var totalParts, distributed uint64
+	for i, share := range shares {
+		parts := shareParts(share)
+		totalParts += parts
+		amounts[i], remainders[i] = mulDiv(amount, parts)
+		distributed += amounts[i]
+	}
+
+	total, _ := mulDiv(amount, totalParts)
+	order := make([]int, len(shares))
+	for i := range order {
+		order[i] = i
+	}
+	sort.SliceStable(order, func(i, j int) bool { return remainders[order[i]] > remainders[order[j]] })
+	for _, i := range order[:total-distributed] {
+		amounts[i]++
+	}
+	return amounts
+}
+
+// mulDiv returns amount*parts/sharePartsPerMillion and its remainder without overflowing
+func mulDiv(amount uint64, parts uint64) (uint64, uint64) {
+	hi, lo := bits.Mul64(amount, parts)
+	return bits.Div64(hi, lo, sharePartsPerMillion)
+}
+
+// ShareAccrual is the progress of a profit share of a mint's balance
+type ShareAccrual struct {
+	Mint             string `json:"mint"`
+	Share            int    `json:"share"`
+	LightningAddress string `json:"lightning_address,omitempty"`
+	NWCWallet        string `json:"nwc_wallet,omitempty"`
+	Npub             string `json:"npub,omitempty"`
+	// Accrued is split off for the share but not paid out yet, as it is below the share's minimum
+	Accrued uint64 `json:"accrued"`
+	// Distributed is everything split off for the share, paid out or accrued
+	Distributed uint64    `json:"distributed"`
+	UpdatedAt   time.Time `json:"updated_at"`
+}
+
+// newShareAccrual starts the accrual of a configured profit share of a mint
+func newShareAccrual(mint string, share int, config config_manager.ProfitShareConfig) ShareAccrual {
+	return ShareAccrual{
+		Mint:             mint,
+		Share:            share,
+		LightningAddress: config.LightningAddress,
+		NWCWallet:        shareNWCWallet(config),
+		Npub:             config.Npub,
+	}
+}
+
+// payee describes where the share is paid to for logs
+func (a ShareAccrual) payee() string {
+	if a.NWCWallet != "" {
+		return "nwc:" + a.NWCWallet
+	}
+	if a.Npub != "" {
+		return a.Npub
+	}
+	return a.LightningAddress
+}
+
+func (a ShareAccrual) key() string {
+	return fmt.Sprintf("%s|%d|%s|%s|%s", a.Mint, a.Share, a.LightningAddress, a.NWCWallet, a.Npub)
+}
+
+// ShareAccruals tracks the progress of every profit share in a JSON file, so shares below
+// their minimum keep accruing across restarts
+type ShareAccruals struct {
+	path     string
+	mutex    sync.Mutex
+	accruals map[string]ShareAccrual
+}
+
+// NewShareAccruals opens the share accruals at path, loading any already on disk
+func NewShareAccruals(path string) (*ShareAccruals, error) {
+	accruals := &ShareAccruals{
+		path:     path,
+		accruals: make(map[string]ShareAccrual),
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return accruals, nil
+		}
+		return nil, fmt.Errorf("failed to read share accruals %s: %w", path, err)
+	}
+	if len(data) == 0 {
+		return accruals, nil
+	}
+
+	var loaded []ShareAccrual
+	if err := json.Unmarshal(data, &loaded); err != nil {
+		return nil, fmt.Errorf("failed to parse share accruals %s: %w", path, err)
+	}
+	for _, accrual := range loaded {
+		accruals.accruals[accrual.key()] = accrual
+	}
+	return accruals, nil
+}
+
+// Accrue adds amount to a share of a mint and returns what is due to be paid out: everything
+// accrued once it reaches the share's minimum, nothing before
+func (a *ShareAccruals) Accrue(mint string, share int, config config_manager.ProfitShareConfig, amount uint64, now time.Time) (uint64, error) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	accrual := newShareAccrual(mint, share, config)
+	if existing, exists := a.accruals[accrual.key()]; exists {
+		accrual = existing
+	}
+	accrual.Accrued += amount
+	accrual.Distributed += amount
+	accrual.UpdatedAt = now
+
+	var due uint64
+	if accrual.Accrued > 0 && accrual.Accrued >= config.MinAmount {
+		due = accrual.Accrued
+		accrual.Accrued = 0
+	}
+
+	a.accruals[accrual.key()] = accrual
+	if err := a.persist(); err != nil {
+		return 0, err
+	}
+	return due, nil
+}
+
+// Reserved returns the amount of a mint's balance accrued for its shares
+func (a *ShareAccruals) Reserved(mint string) uint64 {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	var reserved uint64
+	for _, accrual := range a.accruals {
+		if accrual.Mint == mint {
+			reserved += accrual.Accrued
+		}
+	}
+	return reserved
+}
+
+// Forget drops the accruals of a mint for shares that are no longer configured and returns
+// them, their amount is paid out to the configured shares again
+func (a *ShareAccruals) Forget(mint string, shares []config_manager.ProfitShareConfig) ([]ShareAccrual, error) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	configured := make(map[string]bool, len(shares))
+	for i, share := range shares {
+		configured[newShareAccrual(mint, i, share).key()] = true
+	}
+
+	var forgotten []ShareAccrual
+	for key, accrual := range a.accruals {
+		if accrual.Mint == mint && !configured[key] {
+			forgotten = append(forgotten, accrual)
+			delete(a.accruals, key)
+		}
+	}
+	if len(forgotten) == 0 {
+		return nil, nil
+	}
+	return forgotten, a.persist()
+}
+
+// Accruals returns the progress of every share, ordered by mint and share
+func (a *ShareAccruals) Accruals() []ShareAccrual {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	return a.sortedAccruals()
+}
+
+// sortedAccruals returns the accruals ordered by mint and share. The caller must hold a.mutex.
+func (a *ShareAccruals) sortedAccruals() []ShareAccrual {
+	accruals := make([]ShareAccrual, 0, len(a.accruals))
+	for _, accrual := range a.accruals {
+		accruals = append(accruals, accrual)
+	}
+	sort.Slice(accruals, func(i, j int) bool {
+		if accruals[i].Mint != accruals[j].Mint {
+			return accruals[i].Mint < accruals[j].Mint
+		}
+		if accruals[i].Share != accruals[j].Share {
+			return accruals[i].Share < accruals[j].Share
+		}
+		return accruals[i].key() < accruals[j].key()
+	})
+	return accruals
+}
+
+// persist writes the accruals to disk. The caller must hold a.mutex.
+func (a *ShareAccruals) persist() error {
+	data, err := json.Marshal(a.sortedAccruals())
+	if err != nil {
+		return fmt.Errorf("failed to marshal share accruals: %w", err)
+	}
+	return utils.WriteFileAtomic(a.path, data)
+}
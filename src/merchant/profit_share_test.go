@@ -0,0 +1,150 @@
+package merchant
+
+import (
+	"math"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/OpenTollGate/tollgate-module-basic-go/src/config_manager"
+	"github.com/nbd-wtf/go-nostr/nip19"
+)
+
+func shares(factors ...float64) []config_manager.ProfitShareConfig {
+	shares := make([]config_manager.ProfitShareConfig, len(factors))
+	for i, factor := range factors {
+		shares[i] = config_manager.ProfitShareConfig{Factor: factor, LightningAddress: "owner@example.com"}
+	}
+	return shares
+}
+
+// testNpub is the npub of the pubkey of testNWC
+var testNpub, _ = nip19.EncodePublicKey("79be667ef9dcbbac55a06295ce870b07029bfcdb2dce28d959f2815b16f81798")
+
+// testNWC is a wallet connection with made up keys, it is only parsed
+var testNWC = "nostr+walletconnect://79be667ef9dcbbac55a06295ce870b07029bfcdb2dce28d959f2815b16f81798?relay=wss%3A%2F%2Frelay.example.com&secret=" + strings.Repeat("1", 64)
+
+func TestValidateProfitShares(t *testing.T) {
+	valid := [][]config_manager.ProfitShareConfig{
+		nil,
+		shares(1),
+		shares(0.7, 0.3),
+		shares(0.1, 0.2, 0.3, 0.4),
+		shares(0.5),
+		{{Factor: 1, NWC: testNWC}},
+		{{Factor: 0.5, Npub: testNpub}, {Factor: 0.5, Npub: testNpub, Delivery: DeliveryNutzap}},
+	}
+	for _, config := range valid {
+		if err := validateProfitShares(config); err != nil {
+			t.Errorf("Profit shares %+v rejected: %v", config, err)
+		}
+	}
+
+	invalid := [][]config_manager.ProfitShareConfig{
+		shares(0.7, 0.4),
+		shares(0),
+		shares(-0.5, 0.5),
+		shares(1.5),
+		shares(math.NaN()),
+		{{Factor: 1}},
+		{{Factor: 1, LightningAddress: "tollgate@minibits.cash", NWC: testNWC}},
+		{{Factor: 1, LightningAddress: "tollgate@minibits.cash", Npub: testNpub}},
+		{{Factor: 1, Npub: "npub1notanpub"}},
+		{{Factor: 1, Npub: testNpub, Delivery: "carrier pigeon"}},
+		{{Factor: 1, LightningAddress: "tollgate@minibits.cash", Delivery: DeliveryNutzap}},
+		{{Factor: 1, NWC: "nostr+walletconnect://not-a-pubkey?relay=wss://relay.example.com&secret=" + strings.Repeat("1", 64)}},
+	}
+	for _, config := range invalid {
+		if err := validateProfitShares(config); err == nil {
+			t.Errorf("Profit shares %+v accepted", config)
+		}
+	}
+}
+
+func TestSplitProfit(t *testing.T) {
+	tests := []struct {
+		amount   uint64
+		factors  []float64
+		expected []uint64
+	}{
+		{100, []float64{0.7, 0.3}, []uint64{70, 30}},
+		// The rounding leftover goes to the largest remainder
+		{101, []float64{0.7, 0.3}, []uint64{71, 30}},
+		{3, []float64{0.25, 0.25, 0.5}, []uint64{1, 1, 1}},
+		// Ties go to earlier shares
+		{1, []float64{0.5, 0.5}, []uint64{1, 0}},
+		// Thirds are a part per million short of the whole amount
+		{10, []float64{1.0 / 3, 1.0 / 3, 1.0 / 3}, []uint64{3, 3, 3}},
+		// The part not covered by the factors isn't split
+		{100, []float64{0.25, 0.25}, []uint64{25, 25}},
+		{7, []float64{0.5}, []uint64{3}},
+		{0, []float64{0.7, 0.3}, []uint64{0, 0}},
+		// Large amounts don't overflow
+		{math.MaxUint64 / 2, []float64{0.5, 0.5}, []uint64{math.MaxUint64/4 + 1, math.MaxUint64 / 4}},
+	}
+	for _, test := range tests {
+		if amounts := splitProfit(test.amount, shares(test.factors...)); !slices.Equal(amounts, test.expected) {
+			t.Errorf("Splitting %d by %v gave %v, expected %v", test.amount, test.factors, amounts, test.expected)
+		}
+	}
+
+	// Shares covering the whole amount split all of it
+	for amount := uint64(0); amount < 1000; amount++ {
+		var total uint64
+		for _, share := range splitProfit(amount, shares(0.33, 0.33, 0.34)) {
+			total += share
+		}
+		if total != amount {
+			t.Fatalf("Splitting %d gave %d in total", amount, total)
+		}
+	}
+}
+
+func TestShareAccruals(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "profit_shares.json")
+	accruals, err := NewShareAccruals(path)
+	if err != nil {
+		t.Fatalf("Failed to open share accruals: %v", err)
+	}
+	now := time.Date(2025, 3, 1, 12, 0, 0, 0, time.UTC)
+	mint := "https://mint.example"
+	small := config_manager.ProfitShareConfig{Factor: 0.1, LightningAddress: "small@example.com", MinAmount: 50}
+	large := config_manager.ProfitShareConfig{Factor: 0.9, LightningAddress: "large@example.com"}
+
+	if due, _ := accruals.Accrue(mint, 1, large, 90, now); due != 90 {
+		t.Errorf("Share without minimum is due %d, expected 90", due)
+	}
+	if due, _ := accruals.Accrue(mint, 0, small, 30, now); due != 0 {
+		t.Errorf("Share below its minimum is due %d, expected nothing", due)
+	}
+	if reserved := accruals.Reserved(mint); reserved != 30 {
+		t.Errorf("Reserved %d sats, expected the 30 accrued", reserved)
+	}
+
+	// Accruals survive a restart
+	accruals, err = NewShareAccruals(path)
+	if err != nil {
+		t.Fatalf("Failed to reopen share accruals: %v", err)
+	}
+	if due, _ := accruals.Accrue(mint, 0, small, 25, now); due != 55 {
+		t.Errorf("Share reaching its minimum is due %d, expected 55", due)
+	}
+	progress := accruals.Accruals()
+	if len(progress) != 2 || progress[0].Accrued != 0 || progress[0].Distributed != 55 || progress[1].Distributed != 90 {
+		t.Errorf("Progress is %+v, expected 55 and 90 sats distributed and nothing accrued", progress)
+	}
+
+	// Accruals of shares that were removed or retargeted are given up
+	accruals.Accrue(mint, 0, small, 10, now)
+	retargeted := small
+	retargeted.LightningAddress = "new@example.com"
+	forgotten, err := accruals.Forget(mint, []config_manager.ProfitShareConfig{retargeted, large})
+	if err != nil || len(forgotten) != 1 || forgotten[0].Accrued != 10 {
+		t.Errorf("Forgot %+v, %v, expected the 10 sats accrued for the old target", forgotten, err)
+	}
+	if reserved := accruals.Reserved(mint); reserved != 0 {
+		t.Errorf("Reserved %d sats after forgetting, expected none", reserved)
+	}
+}
@@ -0,0 +1,54 @@
+package merchant
+
+import (
+	"fmt"
+
+	"github.com/OpenTollGate/tollgate-module-basic-go/src/config_manager"
+	"github.com/OpenTollGate/tollgate-module-basic-go/src/events"
+	"github.com/OpenTollGate/tollgate-module-basic-go/src/valve"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// KindSessionReceipt is the kind of the signed receipt a customer gets for a purchase
+const KindSessionReceipt = 21023
+
+// createReceipt creates the receipt of a purchase, signed by the tollgate. It references
+// the customer's payment event and describes what the payment bought and the state of
+// the session after it, so the customer can show a countdown and prove the purchase later.
+func createReceipt(config *config_manager.Config, purchased events.SessionPurchased, session valve.Session, purchaseEvent nostr.Event) (*nostr.Event, error) {
+	tags := nostr.Tags{
+		{"e", purchaseEvent.ID},
+		{"p", purchaseEvent.PubKey},
+		{"device-identifier", "mac", purchased.MACAddress},
+		{"metric", purchased.Metric},
+		{"amount", fmt.Sprintf("%d", purchased.Amount), "sat"},
+		{"mint", purchased.Mint},
+	}
+	if purchased.Tier != "" {
+		tags = append(tags, nostr.Tag{"tier", purchased.Tier})
+	}
+
+	// allotment is what this payment bought, expires_at and allowance describe the whole session
+	if purchased.Metric == valve.MetricBytes {
+		tags = append(tags,
+			nostr.Tag{"allotment", fmt.Sprintf("%d", purchased.AllowanceBytes)},
+			nostr.Tag{"allowance", fmt.Sprintf("%d", session.AllowanceBytes), fmt.Sprintf("%d", session.UsedBytes)},
+		)
+	} else {
+		tags = append(tags,
+			nostr.Tag{"allotment", fmt.Sprintf("%d", purchased.Duration.Milliseconds())},
+			nostr.Tag{"expires_at", fmt.Sprintf("%d", session.ExpiresAt.Unix())},
+		)
+	}
+
+	receipt := &nostr.Event{
+		Kind:      KindSessionReceipt,
+		CreatedAt: nostr.Now(),
+		Tags:      tags,
+		Content:   "",
+	}
+	if err := receipt.Sign(config.TollgatePrivateKey); err != nil {
+		return nil, fmt.Errorf("error signing receipt: %w", err)
+	}
+	return receipt, nil
+}
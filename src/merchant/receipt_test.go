@@ -0,0 +1,57 @@
+package merchant
+
+import (
+	"testing"
+	"time"
+
+	"github.com/OpenTollGate/tollgate-module-basic-go/src/config_manager"
+	"github.com/OpenTollGate/tollgate-module-basic-go/src/events"
+	"github.com/OpenTollGate/tollgate-module-basic-go/src/valve"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+func TestCreateReceipt(t *testing.T) {
+	config := &config_manager.Config{TollgatePrivateKey: nostr.GeneratePrivateKey()}
+	tollgatePubkey, _ := nostr.GetPublicKey(config.TollgatePrivateKey)
+
+	purchaseEvent := nostr.Event{ID: "purchase-event-id", PubKey: "customer-pubkey"}
+	expiresAt := time.Unix(1760000000, 0)
+	purchased := events.SessionPurchased{
+		MACAddress: "00:11:22:33:44:55",
+		Metric:     valve.MetricMilliseconds,
+		Duration:   10 * time.Minute,
+		Amount:     10,
+		Mint:       "https://mint.example.com",
+	}
+	session := valve.Session{MACAddress: purchased.MACAddress, ExpiresAt: expiresAt}
+
+	receipt, err := createReceipt(config, purchased, session, purchaseEvent)
+	if err != nil {
+		t.Fatalf("createReceipt failed: %v", err)
+	}
+	if ok, err := receipt.CheckSignature(); !ok || err != nil || receipt.PubKey != tollgatePubkey {
+		t.Errorf("Receipt is not signed by the tollgate: %v", err)
+	}
+	if receipt.Kind != KindSessionReceipt {
+		t.Errorf("Receipt has kind %d, expected %d", receipt.Kind, KindSessionReceipt)
+	}
+
+	expected := map[string]string{
+		"e":          "purchase-event-id",
+		"p":          "customer-pubkey",
+		"metric":     "milliseconds",
+		"allotment":  "600000",
+		"expires_at": "1760000000",
+		"amount":     "10",
+		"mint":       "https://mint.example.com",
+	}
+	for name, value := range expected {
+		tag := receipt.Tags.GetFirst([]string{name})
+		if tag == nil || (*tag)[1] != value {
+			t.Errorf("Receipt tag %s is %v, expected %s", name, tag, value)
+		}
+	}
+	if tag := receipt.Tags.GetFirst([]string{"device-identifier", "mac"}); tag == nil || (*tag)[2] != purchased.MACAddress {
+		t.Errorf("Receipt has device-identifier %v, expected %s", tag, purchased.MACAddress)
+	}
+}
@@ -0,0 +1,130 @@
+package merchant
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/OpenTollGate/tollgate-module-basic-go/src/events"
+	"github.com/OpenTollGate/tollgate-module-basic-go/src/valve"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// Errors returned when a refund is refused
+var (
+	ErrRefundsDisabled = errors.New("refunds are disabled")
+	ErrNothingToRefund = errors.New("nothing left to refund")
+	ErrWrongPurchase   = errors.New("refund is not for the purchase of the session")
+)
+
+// RefundResult is the token a customer gets back for the unused part of a session
+type RefundResult struct {
+	Token  string
+	Amount uint64
+	Mint   string
+}
+
+// RefundSession ends the session of macAddress and returns a token for its unused part.
+// Only the signer of refundEvent that purchased the session may request a refund, and
+// refundEvent must reference the event of that purchase in an e tag.
+func (m *Merchant) RefundSession(macAddress string, refundEvent nostr.Event) (RefundResult, error) {
+	config, pricing := m.settings()
+	if !config.Refunds.Enabled {
+		return RefundResult{}, ErrRefundsDisabled
+	}
+
+	var result RefundResult
+	var refundedSteps uint64
+	err := m.valve.EndSession(macAddress, refundEvent.PubKey, events.ReasonRefund, func(session valve.Session) error {
+		if session.PurchaseEventID == "" || !referencesEvent(refundEvent, session.PurchaseEventID) {
+			return fmt.Errorf("%w: expected an e tag of %q", ErrWrongPurchase, session.PurchaseEventID)
+		}
+
+		var amount uint64
+		amount, refundedSteps = m.refundAmount(session, time.Now())
+		if amount == 0 {
+			return ErrNothingToRefund
+		}
+
+		// The refund comes from the mint the customer paid with, so they can redeem it
+		token, err := m.tollwallet.Send(amount, session.Mint, false)
+		if err != nil {
+			return fmt.Errorf("error creating refund token: %w", err)
+		}
+		serialized, err := token.Serialize()
+		if err != nil {
+			return fmt.Errorf("error serializing refund token: %w", err)
+		}
+
+		result = RefundResult{Token: serialized, Amount: amount, Mint: session.Mint}
+		return nil
+	})
+	if err != nil {
+		return RefundResult{}, err
+	}
+
+	log.Printf("Refunded %d sats from %s for the unused part of the session of MAC %s", result.Amount, result.Mint, macAddress)
+
+	// What was refunded no longer counts toward loyalty discounts and free steps
+	if config.Loyalty.Enabled {
+		now := time.Now()
+		if err := m.customers.RecordRefund(refundEvent.PubKey, loyaltyMonth(pricing, now), result.Amount, refundedSteps, now); err != nil {
+			log.Printf("Error recording refund of %s for loyalty: %v", refundEvent.PubKey, err)
+		}
+	}
+	return result, nil
+}
+
+// referencesEvent reports whether event has an e tag referencing the event eventID
+func referencesEvent(event nostr.Event, eventID string) bool {
+	for _, tag := range event.Tags {
+		if len(tag) >= 2 && tag[0] == "e" && tag[1] == eventID {
+			return true
+		}
+	}
+	return false
+}
+
+// refundAmount prices the unused whole steps of a session at the active price of its tier or
+// what the customer paid per step, whichever is lower, and deducts the refund fee. A step bought
+// at a discount or during a cheap period is never refunded at more than it cost.
+// It returns the amount and how many of the steps the customer paid for it refunds.
+func (m *Merchant) refundAmount(session valve.Session, now time.Time) (uint64, uint64) {
+	config, pricing := m.settings()
+	metric, stepSize, _ := stepPricing(config)
+	if session.Metric != metric {
+		log.Printf("Session of MAC %s is metered in %s but %s are sold now, not refunding", session.MACAddress, session.Metric, metric)
+		return 0, 0
+	}
+
+	var unusedSteps uint64
+	if session.IsMetered() {
+		unusedSteps = session.RemainingBytes() / stepSize
+	} else {
+		unusedSteps = uint64(session.Remaining.Milliseconds()) / stepSize
+	}
+
+	tier, found := selectTier(config, session.Tier)
+	if !found {
+		// The tier was removed since the purchase
+		tier, _ = selectTier(config, "")
+	}
+	value := unusedSteps * pricing.PriceAt(tierPricePerStep(config, tier), now)
+	if session.PaidSteps > 0 {
+		value = min(value, unusedSteps*session.AmountPaid/session.PaidSteps)
+	}
+	value = min(value, session.AmountPaid)
+
+	refundedSteps := unusedSteps
+	if session.PaidSteps > 0 {
+		// Free steps are refunded last
+		refundedSteps = min(unusedSteps, session.PaidSteps)
+	}
+
+	feePercent := config.Refunds.FeePercent
+	if feePercent >= 100 {
+		return 0, 0
+	}
+	return value - value*feePercent/100, refundedSteps
+}
@@ -0,0 +1,116 @@
+package merchant
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/OpenTollGate/tollgate-module-basic-go/src/config_manager"
+	"github.com/OpenTollGate/tollgate-module-basic-go/src/valve"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+func TestRefundAmount(t *testing.T) {
+	pricing, err := NewPricing(config_manager.PricingConfig{})
+	if err != nil {
+		t.Fatalf("NewPricing failed: %v", err)
+	}
+	m := &Merchant{
+		config: &config_manager.Config{
+			Metric:       valve.MetricMilliseconds,
+			StepSize:     60000,
+			PricePerStep: 2,
+			Tiers: []config_manager.TierConfig{
+				{Name: "basic"},
+				{Name: "fast", PricePerStep: 5},
+			},
+			Refunds: config_manager.RefundConfig{Enabled: true, FeePercent: 10},
+		},
+		pricing: pricing,
+	}
+
+	tests := []struct {
+		name    string
+		session valve.Session
+		amount  uint64
+	}{
+		// 10 unused minutes at 2 sats, minus 10%
+		{"basic", valve.Session{Metric: valve.MetricMilliseconds, Tier: "basic", Remaining: 10*time.Minute + 30*time.Second, AmountPaid: 100}, 18},
+		{"fast tier", valve.Session{Metric: valve.MetricMilliseconds, Tier: "fast", Remaining: 10 * time.Minute, AmountPaid: 100}, 45},
+		{"removed tier", valve.Session{Metric: valve.MetricMilliseconds, Tier: "gone", Remaining: 10 * time.Minute, AmountPaid: 100}, 18},
+		// 10 unused minutes at the 2 sats paid per step rather than the 5 of the tier
+		{"paid less than the tier", valve.Session{Metric: valve.MetricMilliseconds, Tier: "fast", Remaining: 10 * time.Minute, AmountPaid: 100, PaidSteps: 50}, 18},
+		// 10 unused minutes at the 1 sat per step a discount made them cost
+		{"discounted purchase", valve.Session{Metric: valve.MetricMilliseconds, Tier: "basic", Remaining: 10 * time.Minute, AmountPaid: 100, PaidSteps: 100}, 9},
+		{"paid more than the tier", valve.Session{Metric: valve.MetricMilliseconds, Tier: "basic", Remaining: 10 * time.Minute, AmountPaid: 100, PaidSteps: 20}, 18},
+		{"capped at amount paid", valve.Session{Metric: valve.MetricMilliseconds, Tier: "fast", Remaining: time.Hour, AmountPaid: 100}, 90},
+		{"less than a step", valve.Session{Metric: valve.MetricMilliseconds, Remaining: 59 * time.Second, AmountPaid: 100}, 0},
+		{"other metric", valve.Session{Metric: valve.MetricBytes, AllowanceBytes: 1e9, AmountPaid: 100}, 0},
+	}
+	for _, test := range tests {
+		if amount, _ := m.refundAmount(test.session, time.Now()); amount != test.amount {
+			t.Errorf("%s: refundAmount = %d, expected %d", test.name, amount, test.amount)
+		}
+	}
+}
+
+func TestRefundSessionBoundToPurchase(t *testing.T) {
+	mint := newStandInMint(t)
+	m, gate := newTestMerchant(t, mint)
+	m.config.Refunds.Enabled = true
+	macAddress := "00:11:22:33:44:c0"
+
+	purchase := paymentEvent(m)
+	if _, err := m.PurchaseSession(serializeToken(t, mint.token(t, 20)), macAddress, "", purchase); err != nil {
+		t.Fatalf("Purchase failed: %v", err)
+	}
+
+	refund := paymentEvent(m)
+	refund.Kind = KindSessionControl
+	if _, err := m.RefundSession(macAddress, refund); !errors.Is(err, ErrWrongPurchase) {
+		t.Fatalf("Refund without the purchase event returned %v, expected ErrWrongPurchase", err)
+	}
+	refund.Tags = append(refund.Tags, nostr.Tag{"e", "other-purchase"})
+	if _, err := m.RefundSession(macAddress, refund); !errors.Is(err, ErrWrongPurchase) {
+		t.Fatalf("Refund of another purchase returned %v, expected ErrWrongPurchase", err)
+	}
+	if status, _ := gate.Status(macAddress); !status.Authorized {
+		t.Fatalf("Rejected refund closed the gate")
+	}
+
+	refund.Tags = append(refund.Tags, nostr.Tag{"e", purchase.ID})
+	result, err := m.RefundSession(macAddress, refund)
+	if err != nil || result.Amount == 0 || result.Token == "" {
+		t.Fatalf("Refund of the purchase returned %+v, %v", result, err)
+	}
+	if status, _ := gate.Status(macAddress); status.Authorized {
+		t.Errorf("Gate is open after the refund")
+	}
+}
+
+func TestRefundReversesLoyalty(t *testing.T) {
+	mint := newStandInMint(t)
+	m, _ := newTestMerchant(t, mint)
+	m.config.Refunds.Enabled = true
+	m.config.Loyalty = config_manager.LoyaltyConfig{Enabled: true, FreeStepEvery: 100}
+	macAddress := "00:11:22:33:44:c1"
+
+	purchase := paymentEvent(m)
+	if _, err := m.PurchaseSession(serializeToken(t, mint.token(t, 20)), macAddress, "", purchase); err != nil {
+		t.Fatalf("Purchase failed: %v", err)
+	}
+
+	refund := paymentEvent(m)
+	refund.Kind = KindSessionControl
+	refund.Tags = append(refund.Tags, nostr.Tag{"e", purchase.ID})
+	result, err := m.RefundSession(macAddress, refund)
+	if err != nil {
+		t.Fatalf("Refund failed: %v", err)
+	}
+
+	// 10 steps were bought for 20 sats, the 9 unused ones are refunded at 2 sats each
+	customer, _ := m.Customer("customer-pubkey")
+	if result.Amount != 18 || customer.MonthlySpend != 2 || customer.TotalSpend != 2 || customer.PaidSteps != 1 {
+		t.Errorf("Refund of %d sats left customer %+v, expected 2 sats spent for 1 paid step", result.Amount, customer)
+	}
+}
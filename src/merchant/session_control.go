@@ -0,0 +1,111 @@
+package merchant
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/OpenTollGate/tollgate-module-basic-go/src/utils"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// KindSessionControl is the kind of the signed event a customer pauses, resumes,
+// transfers or refunds their session with
+const KindSessionControl = 21024
+
+// AcceptSessionControl checks a session control event like a payment event and makes sure
+// it is only used once, so a captured event can't be replayed against the customer's session
+func (m *Merchant) AcceptSessionControl(event nostr.Event) error {
+	now := time.Now()
+	if err := m.checkEvent(event, KindSessionControl, now); err != nil {
+		return err
+	}
+	return m.controlLog.Record(event.ID, event.CreatedAt.Time(), now)
+}
+
+// ControlLog remembers the session control events that were used until they are too old to be
+// accepted anyway. It is persisted to a JSON file so events can't be replayed after a restart.
+type ControlLog struct {
+	path   string
+	mutex  sync.Mutex
+	events map[string]time.Time
+}
+
+type loggedControlEvent struct {
+	EventID   string    `json:"event_id"`
+	EventTime time.Time `json:"event_time"`
+}
+
+// NewControlLog opens the control log at path, loading any events already on disk
+func NewControlLog(path string) (*ControlLog, error) {
+	controlLog := &ControlLog{
+		path:   path,
+		events: make(map[string]time.Time),
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return controlLog, nil
+		}
+		return nil, fmt.Errorf("failed to read control log %s: %w", path, err)
+	}
+	if len(data) == 0 {
+		return controlLog, nil
+	}
+
+	var events []loggedControlEvent
+	if err := json.Unmarshal(data, &events); err != nil {
+		return nil, fmt.Errorf("failed to parse control log %s: %w", path, err)
+	}
+	for _, event := range events {
+		controlLog.events[event.EventID] = event.EventTime
+	}
+	return controlLog, nil
+}
+
+// Record marks the event eventID as used, or returns ErrReplayedEvent if it was used before.
+// An event that can't be persisted isn't used, so the customer can send it again.
+func (l *ControlLog) Record(eventID string, eventTime time.Time, now time.Time) error {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	if _, used := l.events[eventID]; used {
+		return fmt.Errorf("%w: %s", ErrReplayedEvent, eventID)
+	}
+
+	l.events[eventID] = eventTime
+	for id, usedAt := range l.events {
+		if now.Sub(usedAt) > paymentEventMaxAge {
+			delete(l.events, id)
+		}
+	}
+	if err := l.persist(); err != nil {
+		delete(l.events, eventID)
+		return err
+	}
+	return nil
+}
+
+// persist writes the events to disk, oldest first. The caller must hold l.mutex.
+func (l *ControlLog) persist() error {
+	events := make([]loggedControlEvent, 0, len(l.events))
+	for id, eventTime := range l.events {
+		events = append(events, loggedControlEvent{EventID: id, EventTime: eventTime})
+	}
+	sort.Slice(events, func(i, j int) bool {
+		if !events[i].EventTime.Equal(events[j].EventTime) {
+			return events[i].EventTime.Before(events[j].EventTime)
+		}
+		return events[i].EventID < events[j].EventID
+	})
+
+	data, err := json.Marshal(events)
+	if err != nil {
+		return fmt.Errorf("failed to marshal control log: %w", err)
+	}
+	return utils.WriteFileAtomic(l.path, data)
+}
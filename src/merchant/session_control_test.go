@@ -0,0 +1,61 @@
+package merchant
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+func TestAcceptSessionControl(t *testing.T) {
+	m, _ := newTestMerchant(t, newStandInMint(t))
+
+	event := paymentEvent(m)
+	event.Kind = KindSessionControl
+	if err := m.AcceptSessionControl(event); err != nil {
+		t.Fatalf("Valid session control event rejected: %v", err)
+	}
+	if err := m.AcceptSessionControl(event); !errors.Is(err, ErrReplayedEvent) {
+		t.Errorf("Replayed session control event returned %v, expected ErrReplayedEvent", err)
+	}
+
+	if err := m.AcceptSessionControl(paymentEvent(m)); !errors.Is(err, ErrInvalidEvent) {
+		t.Errorf("Payment event used for session control returned %v, expected ErrInvalidEvent", err)
+	}
+
+	stale := paymentEvent(m)
+	stale.Kind = KindSessionControl
+	stale.CreatedAt = nostr.Timestamp(time.Now().Add(-11 * time.Minute).Unix())
+	if err := m.AcceptSessionControl(stale); !errors.Is(err, ErrStaleEvent) {
+		t.Errorf("Stale session control event returned %v, expected ErrStaleEvent", err)
+	}
+}
+
+func TestControlLogSurvivesRestart(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "session_control.json")
+	now := time.Now()
+
+	controlLog, err := NewControlLog(path)
+	if err != nil {
+		t.Fatalf("Failed to open control log: %v", err)
+	}
+	if err := controlLog.Record("old-event", now.Add(-20*time.Minute), now.Add(-20*time.Minute)); err != nil {
+		t.Fatalf("Record failed: %v", err)
+	}
+	if err := controlLog.Record("event", now, now); err != nil {
+		t.Fatalf("Record failed: %v", err)
+	}
+
+	reopened, err := NewControlLog(path)
+	if err != nil {
+		t.Fatalf("Failed to reopen control log: %v", err)
+	}
+	if err := reopened.Record("event", now, now); !errors.Is(err, ErrReplayedEvent) {
+		t.Errorf("Event replayed after a restart returned %v, expected ErrReplayedEvent", err)
+	}
+	if _, kept := reopened.events["old-event"]; kept {
+		t.Errorf("Event older than the accepted age was not pruned")
+	}
+}
@@ -0,0 +1,74 @@
+package merchant
+
+import (
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/OpenTollGate/tollgate-module-basic-go/src/events"
+	"github.com/OpenTollGate/tollgate-module-basic-go/src/utils"
+	"github.com/OpenTollGate/tollgate-module-basic-go/src/valve"
+	"github.com/OpenTollGate/tollgate-module-basic-go/src/voucher"
+)
+
+// Vouchers returns the store of prepaid voucher codes
+func (m *Merchant) Vouchers() *voucher.Store {
+	return m.vouchers
+}
+
+// RedeemVoucher opens the gate for macAddress for the allotment of a voucher code.
+// Redemptions are published as sales of the voucher's value, like Cashu payments.
+func (m *Merchant) RedeemVoucher(code string, macAddress string) (PurchaseSessionResult, error) {
+	config, _ := m.settings()
+	if !utils.ValidateMACAddress(macAddress) {
+		err := fmt.Errorf("%w: %s", ErrInvalidMAC, macAddress)
+		return failedPurchase(err, fmt.Sprintf("%s is not a valid MAC address", macAddress)), err
+	}
+
+	metric, _, _ := stepPricing(config)
+	redeemed, err := m.vouchers.Redeem(code, macAddress, metric, time.Now())
+	if err != nil {
+		return failedPurchase(err, "Voucher can't be redeemed: "+err.Error()), err
+	}
+
+	// Voucher sessions get the bandwidth of the default tier and have no owner who could pause them
+	tier, _ := selectTier(config, "")
+	payment := valve.Payment{
+		Amount: redeemed.Value,
+		Tier:   tier.Name,
+		RateLimit: valve.RateLimit{
+			DownloadKbps: tier.DownloadKbps,
+			UploadKbps:   tier.UploadKbps,
+		},
+	}
+	purchased := events.SessionPurchased{
+		MACAddress: macAddress,
+		Metric:     metric,
+		Tier:       tier.Name,
+		Amount:     redeemed.Value,
+		Voucher:    redeemed.Batch,
+	}
+
+	if metric == valve.MetricBytes {
+		purchased.AllowanceBytes = redeemed.Allotment
+		err = m.valve.OpenGateForBytes(macAddress, redeemed.Allotment, payment)
+	} else {
+		durationSeconds := int64(redeemed.Allotment / 1000)
+		purchased.Duration = time.Duration(durationSeconds) * time.Second
+		err = m.valve.OpenGate(macAddress, durationSeconds, payment)
+	}
+	if err != nil {
+		log.Printf("Error opening gate for voucher of MAC %s: %v", macAddress, err)
+		if cancelErr := m.vouchers.Cancel(redeemed.Code, macAddress); cancelErr != nil {
+			log.Printf("Error restoring voucher %s after failing to open the gate: %v", redeemed.Code, cancelErr)
+		}
+		err = fmt.Errorf("%w for %s: %w", ErrGateFailure, macAddress, err)
+		return failedPurchase(err, fmt.Sprintf("Error while opening gate for %s", macAddress)), err
+	}
+
+	m.bus.Publish(purchased)
+	log.Printf("Access granted to %s for voucher of batch %s worth %s", macAddress, redeemed.Batch,
+		voucher.FormatAllotment(redeemed.Metric, redeemed.Allotment))
+
+	return PurchaseSessionResult{Status: "success"}, nil
+}
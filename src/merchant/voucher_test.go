@@ -0,0 +1,59 @@
+package merchant
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/OpenTollGate/tollgate-module-basic-go/src/events"
+	"github.com/OpenTollGate/tollgate-module-basic-go/src/voucher"
+)
+
+func TestRedeemVoucher(t *testing.T) {
+	mint := newStandInMint(t)
+	m, gate := newTestMerchant(t, mint)
+	m.bus = events.NewBus()
+	sales := make(chan events.SessionPurchased, 1)
+	events.Subscribe(m.bus, "test", func(purchase events.SessionPurchased) { sales <- purchase })
+	macAddress := "00:11:22:33:44:c0"
+
+	vouchers, err := m.Vouchers().Generate(voucher.Batch{
+		Name:      "counter",
+		Count:     1,
+		Metric:    voucher.MetricMilliseconds,
+		Allotment: 2 * 60 * 60 * 1000,
+		Value:     100,
+	}, time.Now())
+	if err != nil {
+		t.Fatalf("Failed to generate vouchers: %v", err)
+	}
+
+	if _, err := m.RedeemVoucher("NOPE2-NOPE3", macAddress); !errors.Is(err, ErrUnknownVoucher) {
+		t.Errorf("Redeeming an unknown code returned %v, expected ErrUnknownVoucher", err)
+	}
+
+	result, err := m.RedeemVoucher(vouchers[0].Code, macAddress)
+	if err != nil || result.Status != "success" {
+		t.Fatalf("Redemption failed: %+v, %v", result, err)
+	}
+	if status, _ := gate.Status(macAddress); !status.Authorized {
+		t.Errorf("Gate is closed after the redemption")
+	}
+	session, _ := m.valve.GetSession(macAddress)
+	if length := session.ExpiresAt.Sub(session.StartedAt); session.VoucherValue != 100 || session.AmountPaid != 0 || length != 2*time.Hour {
+		t.Errorf("Session of %s for %d sats and a voucher of %d sats, expected 2h for a voucher of 100 sats", length, session.AmountPaid, session.VoucherValue)
+	}
+
+	select {
+	case sale := <-sales:
+		if sale.Voucher != "counter" || sale.Amount != 100 || sale.Duration != 2*time.Hour {
+			t.Errorf("Published sale %+v, expected 2h for 100 sats from batch counter", sale)
+		}
+	case <-time.After(time.Second):
+		t.Errorf("Redemption wasn't published as a sale")
+	}
+
+	if _, err := m.RedeemVoucher(vouchers[0].Code, "00:11:22:33:44:c1"); !errors.Is(err, ErrVoucherUsed) || ErrorCode(err) != CodeVoucherUsed {
+		t.Errorf("Redeeming a used voucher returned %v, expected ErrVoucherUsed", err)
+	}
+}
@@ -0,0 +1,70 @@
+package tollwallet
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"net/url"
+
+	"github.com/elnosh/gonuts/cashu"
+	"github.com/elnosh/gonuts/cashu/nuts/nut07"
+	"github.com/elnosh/gonuts/crypto"
+	"github.com/elnosh/gonuts/wallet/client"
+)
+
+// Errors that tell why a payment was not received, as opposed to the wallet failing
+var (
+	ErrUntrustedMint   = errors.New("mint is not accepted")
+	ErrTokenSpent      = errors.New("token was already spent")
+	ErrMintUnreachable = errors.New("mint is unreachable")
+)
+
+// ErrMeltPending is returned for melts the mint hasn't settled yet, their outcome is unknown
+var ErrMeltPending = errors.New("melt is pending")
+
+// checkUnspent asks the mint whether the proofs of a token are still unspent (NUT-07).
+// The wallet reports every failed swap alike, so spent tokens and unreachable mints are told
+// apart here. Mints that don't support checking proof states are left for the swap to judge.
+func checkUnspent(token cashu.Token) error {
+	mint := token.Mint()
+	proofs := token.Proofs()
+
+	request := nut07.PostCheckStateRequest{Ys: make([]string, 0, len(proofs))}
+	for _, proof := range proofs {
+		Y, err := crypto.HashToCurve([]byte(proof.Secret))
+		if err != nil {
+			return fmt.Errorf("invalid proof secret: %w", err)
+		}
+		request.Ys = append(request.Ys, hex.EncodeToString(Y.SerializeCompressed()))
+	}
+
+	response, err := client.PostCheckProofState(mint, request)
+	if err != nil {
+		if err := mintError(mint, err); errors.Is(err, ErrMintUnreachable) {
+			return err
+		}
+		log.Printf("Could not check proof states with %s, relying on the swap: %v", mint, err)
+		return nil
+	}
+
+	for _, state := range response.States {
+		if state.State != nut07.Unspent {
+			return fmt.Errorf("%w: proof is %s at %s", ErrTokenSpent, state.State, mint)
+		}
+	}
+	return nil
+}
+
+// mintError classifies an error returned by a request to mint
+func mintError(mint string, err error) error {
+	var urlErr *url.Error
+	if errors.As(err, &urlErr) {
+		return fmt.Errorf("%w: %s: %w", ErrMintUnreachable, mint, err)
+	}
+	var cashuErr cashu.Error
+	if errors.As(err, &cashuErr) && cashuErr.Code == cashu.ProofAlreadyUsedErrCode {
+		return fmt.Errorf("%w: %s", ErrTokenSpent, cashuErr.Detail)
+	}
+	return err
+}
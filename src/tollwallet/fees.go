@@ -0,0 +1,123 @@
+package tollwallet
+
+import (
+	"fmt"
+	"log"
+	"maps"
+	"sync"
+
+	"github.com/elnosh/gonuts/cashu"
+	"github.com/elnosh/gonuts/wallet/client"
+)
+
+// keysetFees caches the input fees the accepted mints charge per proof (NUT-02)
+type keysetFees struct {
+	mutex sync.RWMutex
+	// byKeyset holds the input_fee_ppk of every sat keyset by mint URL and keyset ID
+	byKeyset map[string]map[string]uint
+	// active holds the input_fee_ppk of the active sat keyset of each mint
+	active map[string]uint
+}
+
+func newKeysetFees() *keysetFees {
+	return &keysetFees{
+		byKeyset: make(map[string]map[string]uint),
+		active:   make(map[string]uint),
+	}
+}
+
+// RefreshFees fetches the keysets of all accepted mints and reports whether any fee changed.
+// Mints that can't be reached keep the fees fetched last.
+func (w *TollWallet) RefreshFees() bool {
+	changed := false
+	for _, mintUrl := range w.AcceptedMints() {
+		mintChanged, err := w.refreshMintFees(mintUrl)
+		if err != nil {
+			log.Printf("Error refreshing fees of mint %s: %v", mintUrl, err)
+			continue
+		}
+		changed = changed || mintChanged
+	}
+	return changed
+}
+
+// refreshMintFees fetches the keysets of a mint and reports whether its fees changed
+func (w *TollWallet) refreshMintFees(mintUrl string) (bool, error) {
+	response, err := client.GetAllKeysets(mintUrl)
+	if err != nil {
+		return false, fmt.Errorf("Failed to get keysets of %s: %w", mintUrl, mintError(mintUrl, err))
+	}
+
+	byKeyset := make(map[string]uint)
+	var active uint
+	hasActive := false
+	for _, keyset := range response.Keysets {
+		if keyset.Unit != cashu.Sat.String() {
+			continue
+		}
+		byKeyset[keyset.Id] = keyset.InputFeePpk
+		if keyset.Active && !hasActive {
+			active = keyset.InputFeePpk
+			hasActive = true
+		}
+	}
+
+	w.fees.mutex.Lock()
+	defer w.fees.mutex.Unlock()
+
+	previousActive, known := w.fees.active[mintUrl]
+	changed := !maps.Equal(w.fees.byKeyset[mintUrl], byKeyset) || known != hasActive || previousActive != active
+	w.fees.byKeyset[mintUrl] = byKeyset
+	if hasActive {
+		w.fees.active[mintUrl] = active
+	} else {
+		delete(w.fees.active, mintUrl)
+	}
+
+	if changed {
+		log.Printf("Mint %s charges %d ppk per input on its active keyset", mintUrl, active)
+	}
+	return changed, nil
+}
+
+// InputFees returns the input_fee_ppk of the active keyset of each accepted mint whose keysets are known
+func (w *TollWallet) InputFees() map[string]uint {
+	w.fees.mutex.RLock()
+	defer w.fees.mutex.RUnlock()
+	return maps.Clone(w.fees.active)
+}
+
+// TokenFee returns the fee in sats the mint of token charges to swap its proofs.
+// Keysets missing from the cache are fetched from accepted mints, fees of other mints are unknown and 0.
+func (w *TollWallet) TokenFee(token cashu.Token) uint64 {
+	mintUrl := token.Mint()
+	proofs := token.Proofs()
+
+	feePpk, known := w.proofFees(mintUrl, proofs)
+	if !known && w.acceptedMints.contains(mintUrl) {
+		if _, err := w.refreshMintFees(mintUrl); err != nil {
+			log.Printf("Error fetching fees for token of %s: %v", mintUrl, err)
+		}
+		feePpk, _ = w.proofFees(mintUrl, proofs)
+	}
+
+	return (feePpk + 999) / 1000
+}
+
+// proofFees sums the input_fee_ppk of proofs and reports whether the keysets of all of them are known
+func (w *TollWallet) proofFees(mintUrl string, proofs cashu.Proofs) (uint64, bool) {
+	w.fees.mutex.RLock()
+	defer w.fees.mutex.RUnlock()
+
+	var feePpk uint64
+	known := true
+	for _, proof := range proofs {
+		fee, exists := w.fees.byKeyset[mintUrl][proof.Id]
+		if !exists {
+			known = false
+			continue
+		}
+		feePpk += uint64(fee)
+	}
+	return feePpk, known
+}
@@ -3,18 +3,22 @@ module github.com/OpenTollGate/tollgate-module-basic-go/src/tollwallet
 go 1.24.2
 
 require (
+	github.com/OpenTollGate/tollgate-module-basic-go/src/events v0.0.0
 	github.com/OpenTollGate/tollgate-module-basic-go/src/lightning v0.0.0-00010101000000-000000000000
+	github.com/btcsuite/btcd/btcec/v2 v2.3.4
 	github.com/elnosh/gonuts v0.4.0
 	github.com/stretchr/testify v1.10.0
 )
 
-replace github.com/OpenTollGate/tollgate-module-basic-go/src/lightning => ../lightning
+replace (
+	github.com/OpenTollGate/tollgate-module-basic-go/src/events => ../events
+	github.com/OpenTollGate/tollgate-module-basic-go/src/lightning => ../lightning
+)
 
 require (
 	github.com/aead/chacha20 v0.0.0-20180709150244-8b13a72661da // indirect
 	github.com/aead/siphash v1.0.1 // indirect
 	github.com/btcsuite/btcd v0.24.3-0.20250318170759-4f4ea81776d6 // indirect
-	github.com/btcsuite/btcd/btcec/v2 v2.3.4 // indirect
 	github.com/btcsuite/btcd/btcutil v1.1.6 // indirect
 	github.com/btcsuite/btcd/btcutil/psbt v1.1.10 // indirect
 	github.com/btcsuite/btcd/chaincfg/chainhash v1.1.0 // indirect
@@ -1,23 +1,37 @@
 package tollwallet
 
 import (
+	"encoding/hex"
+	"errors"
 	"fmt"
 	"log"
+	"slices"
+	"sync"
+	"time"
 
+	"github.com/OpenTollGate/tollgate-module-basic-go/src/events"
 	"github.com/OpenTollGate/tollgate-module-basic-go/src/lightning"
+	"github.com/btcsuite/btcd/btcec/v2"
 	"github.com/elnosh/gonuts/cashu"
+	"github.com/elnosh/gonuts/cashu/nuts/nut04"
+	"github.com/elnosh/gonuts/cashu/nuts/nut05"
 	"github.com/elnosh/gonuts/wallet"
 )
 
 // TollWallet represents a Cashu wallet that can receive, swap, and send tokens
 type TollWallet struct {
 	wallet                     *wallet.Wallet
-	acceptedMints              []string
+	acceptedMints              *mintList
 	allowAndSwapUntrustedMints bool
+	bus                        *events.Bus
+	fees                       *keysetFees
+	// mutex serializes access to the wallet, which isn't safe for concurrent use.
+	// It is a pointer because TollWallet is copied by value.
+	mutex *sync.Mutex
 }
 
-// New creates a new Cashu wallet instance
-func New(walletPath string, acceptedMints []string, allowAndSwapUntrustedMints bool) (*TollWallet, error) {
+// New creates a new Cashu wallet instance. Payments and payouts are published on bus, which may be nil.
+func New(walletPath string, acceptedMints []string, allowAndSwapUntrustedMints bool, bus *events.Bus) (*TollWallet, error) {
 
 	// TODO: We want to restore from our mnemnonic seed phrase on startup as we have to keep our db in memory
 	// TODO: Copy approach from alby: https://github.com/getAlby/hub/blob/158d4a2539307bda289149792c3748d44c9fed37/lnclient/cashu/cashu.go#L46
@@ -35,8 +49,11 @@ func New(walletPath string, acceptedMints []string, allowAndSwapUntrustedMints b
 
 	return &TollWallet{
 		wallet:                     cashuWallet,
-		acceptedMints:              acceptedMints,
+		acceptedMints:              newMintList(acceptedMints),
 		allowAndSwapUntrustedMints: allowAndSwapUntrustedMints,
+		bus:                        bus,
+		fees:                       newKeysetFees(),
+		mutex:                      &sync.Mutex{},
 	}, nil
 }
 
@@ -46,29 +63,140 @@ func (w *TollWallet) Receive(token cashu.Token) (uint64, error) {
 	swapToTrusted := false
 
 	// If mint is untrusted, check if operator allows swapping or rejects untrusted mints.
-	if !contains(w.acceptedMints, mint) {
+	if !w.acceptedMints.contains(mint) {
 		if !w.allowAndSwapUntrustedMints {
-			return 0, fmt.Errorf("Token rejected. Token for mint %s is not accepted and wallet does not allow swapping of untrusted mints.", mint)
+			return 0, fmt.Errorf("%w: token for mint %s is rejected and wallet does not allow swapping of untrusted mints", ErrUntrustedMint, mint)
 		}
 		swapToTrusted = true
 	}
 
+	if err := checkUnspent(token); err != nil {
+		return 0, err
+	}
+
+	w.mutex.Lock()
 	amountAfterSwap, err := w.wallet.Receive(token, swapToTrusted)
-	return amountAfterSwap, err
+	w.mutex.Unlock()
+	if err != nil {
+		return amountAfterSwap, fmt.Errorf("Failed to receive token from %s: %w", mint, err)
+	}
+
+	w.bus.Publish(events.PaymentReceived{Mint: mint, Amount: amountAfterSwap})
+	return amountAfterSwap, nil
 }
 
 func (w *TollWallet) Send(amount uint64, mintUrl string, includeFees bool) (cashu.Token, error) {
+	w.mutex.Lock()
 	proofs, err := w.wallet.Send(amount, mintUrl, includeFees)
+	w.mutex.Unlock()
 
 	if err != nil {
 		return nil, fmt.Errorf("Failed to send %d to %s: %w", amount, mintUrl, err)
 	}
 
 	token, err := cashu.NewTokenV4(proofs, mintUrl, cashu.Sat, true) // TODO: Support multi unit
+	if err != nil {
+		return nil, fmt.Errorf("Failed to create token for %d from %s: %w", amount, mintUrl, err)
+	}
 
 	return token, nil
 }
 
+// SendLocked returns a token of amount sats from a mint that only the holder of pubkey can
+// redeem (NUT-11). pubkey is a compressed secp256k1 public key in hex.
+func (w *TollWallet) SendLocked(amount uint64, mintUrl string, pubkey string) (cashu.Token, error) {
+	pubkeyBytes, err := hex.DecodeString(pubkey)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid pubkey %q to lock to: %w", pubkey, err)
+	}
+	lockPubkey, err := btcec.ParsePubKey(pubkeyBytes)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid pubkey %q to lock to: %w", pubkey, err)
+	}
+
+	w.mutex.Lock()
+	proofs, err := w.wallet.SendToPubkey(amount, mintUrl, lockPubkey, nil, false)
+	w.mutex.Unlock()
+
+	if err != nil {
+		return nil, fmt.Errorf("Failed to send %d locked to %s from %s: %w", amount, pubkey, mintUrl, err)
+	}
+
+	token, err := cashu.NewTokenV4(proofs, mintUrl, cashu.Sat, true)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to create token for %d from %s: %w", amount, mintUrl, err)
+	}
+
+	return token, nil
+}
+
+// MintQuote is a mint's offer to issue ecash once its Lightning invoice is paid (NUT-04)
+type MintQuote struct {
+	ID      string
+	Invoice string
+	Mint    string
+	Amount  uint64
+	// Expiry is when the invoice expires, zero if the mint didn't say
+	Expiry time.Time
+}
+
+// RequestMintQuote asks an accepted mint for a Lightning invoice of amount sats
+func (w *TollWallet) RequestMintQuote(mintUrl string, amount uint64) (MintQuote, error) {
+	if !w.acceptedMints.contains(mintUrl) {
+		return MintQuote{}, fmt.Errorf("%w: %s", ErrUntrustedMint, mintUrl)
+	}
+
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	response, err := w.wallet.RequestMint(amount, mintUrl)
+	if errors.Is(err, wallet.ErrMintNotExist) {
+		// The wallet only knows the accepted mints it received tokens from so far
+		if _, err := w.wallet.AddMint(mintUrl); err != nil {
+			return MintQuote{}, fmt.Errorf("Failed to add mint %s: %w", mintUrl, err)
+		}
+		response, err = w.wallet.RequestMint(amount, mintUrl)
+	}
+	if err != nil {
+		return MintQuote{}, fmt.Errorf("Failed to request mint quote for %d from %s: %w", amount, mintUrl, mintError(mintUrl, err))
+	}
+
+	quote := MintQuote{
+		ID:      response.Quote,
+		Invoice: response.Request,
+		Mint:    mintUrl,
+		Amount:  amount,
+	}
+	if response.Expiry != 0 {
+		quote.Expiry = time.Unix(int64(response.Expiry), 0)
+	}
+	return quote, nil
+}
+
+// MintQuoteState returns the mint's state of a mint quote: nut04.Unpaid until its invoice is
+// paid, nut04.Paid until its ecash is minted and nut04.Issued after that
+func (w *TollWallet) MintQuoteState(quoteId string) (nut04.State, error) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	state, err := w.wallet.MintQuoteState(quoteId)
+	if err != nil {
+		return nut04.Unknown, fmt.Errorf("Failed to check mint quote %s: %w", quoteId, err)
+	}
+	return state.State, nil
+}
+
+// ClaimMintQuote mints the ecash of a paid mint quote into the wallet and returns its amount
+func (w *TollWallet) ClaimMintQuote(quote MintQuote) (uint64, error) {
+	w.mutex.Lock()
+	amount, err := w.wallet.MintTokens(quote.ID)
+	w.mutex.Unlock()
+	if err != nil {
+		return 0, fmt.Errorf("Failed to mint tokens for quote %s: %w", quote.ID, err)
+	}
+
+	w.bus.Publish(events.PaymentReceived{Mint: quote.Mint, Amount: amount})
+	return amount, nil
+}
+
 func (w *TollWallet) ParseToken(token string) (cashu.Token, error) {
 	return cashu.DecodeToken(token)
 }
@@ -83,8 +211,46 @@ func contains(slice []string, str string) bool {
 	return false
 }
 
+// mintList holds the accepted mints. It is shared by the copies of a TollWallet, so
+// SetAcceptedMints reaches all of them.
+type mintList struct {
+	mutex sync.RWMutex
+	urls  []string
+}
+
+func newMintList(urls []string) *mintList {
+	return &mintList{urls: urls}
+}
+
+func (l *mintList) contains(url string) bool {
+	l.mutex.RLock()
+	defer l.mutex.RUnlock()
+	return contains(l.urls, url)
+}
+
+func (l *mintList) list() []string {
+	l.mutex.RLock()
+	defer l.mutex.RUnlock()
+	return slices.Clone(l.urls)
+}
+
+// AcceptedMints returns the URLs of the mints the wallet takes tokens from
+func (w *TollWallet) AcceptedMints() []string {
+	return w.acceptedMints.list()
+}
+
+// SetAcceptedMints replaces the mints the wallet takes tokens from, for when the config changed.
+// Tokens of mints that are no longer accepted stay in the wallet.
+func (w *TollWallet) SetAcceptedMints(urls []string) {
+	w.acceptedMints.mutex.Lock()
+	defer w.acceptedMints.mutex.Unlock()
+	w.acceptedMints.urls = slices.Clone(urls)
+}
+
 // GetBalance returns the current balance of the wallet
 func (w *TollWallet) GetBalance() uint64 {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
 	balance := w.wallet.GetBalance()
 
 	return balance
@@ -92,6 +258,8 @@ func (w *TollWallet) GetBalance() uint64 {
 
 // GetBalanceByMint returns the balance of a specific mint in the wallet
 func (w *TollWallet) GetBalanceByMint(mintUrl string) uint64 {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
 	balanceByMints := w.wallet.GetBalanceByMints()
 
 	if balance, exists := balanceByMints[mintUrl]; exists {
@@ -100,10 +268,67 @@ func (w *TollWallet) GetBalanceByMint(mintUrl string) uint64 {
 	return 0
 }
 
+// Melt is a payment of a Lightning invoice with ecash of a mint (NUT-05)
+type Melt struct {
+	Quote   string
+	Invoice string
+	Mint    string
+	Amount  uint64
+	// Fee is the Lightning fee paid, the fee reserve less the change returned by the mint
+	Fee      uint64
+	State    string
+	Preimage string
+	// Payee is who the invoice pays, LightningAddress is set when that is a lightning address
+	Payee            string
+	LightningAddress string
+}
+
+// Paid reports whether the invoice of the melt was paid
+func (m Melt) Paid() bool {
+	return m.State == nut05.Paid.String()
+}
+
+// Pending reports whether the mint is still trying to pay the invoice of the melt
+func (m Melt) Pending() bool {
+	return m.State == nut05.Pending.String()
+}
+
+func newMelt(mintUrl string, invoice string, response *nut05.PostMeltQuoteBolt11Response) Melt {
+	var change uint64
+	for _, signature := range response.Change {
+		change += signature.Amount
+	}
+	return Melt{
+		Quote:    response.Quote,
+		Invoice:  invoice,
+		Mint:     mintUrl,
+		Amount:   response.Amount,
+		Fee:      response.FeeReserve - min(change, response.FeeReserve),
+		State:    response.State.String(),
+		Preimage: response.Preimage,
+	}
+}
+
+// InvoiceSource returns a Lightning invoice of amountSats for the payee of a payout
+type InvoiceSource func(amountSats uint64) (string, error)
+
 // MeltToLightning melts a token to a lightning invoice using LNURL
-// It attempts to melt for the target amount, reducing by 5% each time if fees are too high
-func (w *TollWallet) MeltToLightning(mintUrl string, targetAmount uint64, maxCost uint64, lnurl string) error {
-	log.Printf("Attempting to melt %d sats to LNURL %s with max %d sats", targetAmount, lnurl, maxCost)
+// It attempts to melt for the target amount, reducing by 5% each time if fees are too high.
+// A melt the mint is still paying is returned with ErrMeltPending, check it later with MeltState.
+func (w *TollWallet) MeltToLightning(mintUrl string, targetAmount uint64, maxCost uint64, lnurl string) (Melt, error) {
+	return w.melt(mintUrl, targetAmount, maxCost, lnurl, lnurl, func(amountSats uint64) (string, error) {
+		return lightning.GetInvoiceFromLightningAddress(lnurl, amountSats)
+	})
+}
+
+// MeltToInvoice melts to invoices of payee from invoice, like MeltToLightning does for a lightning address
+func (w *TollWallet) MeltToInvoice(mintUrl string, targetAmount uint64, maxCost uint64, payee string, invoice InvoiceSource) (Melt, error) {
+	return w.melt(mintUrl, targetAmount, maxCost, payee, "", invoice)
+}
+
+// melt melts to invoices of payee, whose lightning address is lightningAddress if it has one
+func (w *TollWallet) melt(mintUrl string, targetAmount uint64, maxCost uint64, payee string, lightningAddress string, invoice InvoiceSource) (Melt, error) {
+	log.Printf("Attempting to melt %d sats to %s with max %d sats", targetAmount, payee, maxCost)
 
 	// Start with the aimed payment amount
 	currentAmount := targetAmount
@@ -116,8 +341,8 @@ func (w *TollWallet) MeltToLightning(mintUrl string, targetAmount uint64, maxCos
 	for attempts < maxAttempts {
 		log.Printf("Attempt %d: Trying to melt %d sats", attempts+1, currentAmount)
 
-		// Get a Lightning invoice from the LNURL
-		invoice, err := lightning.GetInvoiceFromLightningAddress(lnurl, currentAmount)
+		// Get a Lightning invoice from the payee
+		request, err := invoice(currentAmount)
 		if err != nil {
 			log.Printf("Error getting invoice: %v", err)
 			meltError = err
@@ -126,7 +351,9 @@ func (w *TollWallet) MeltToLightning(mintUrl string, targetAmount uint64, maxCos
 		}
 
 		// Try to pay the invoice using the wallet
-		meltQuote, meltQuoteErr := w.wallet.RequestMeltQuote(invoice, mintUrl)
+		w.mutex.Lock()
+		meltQuote, meltQuoteErr := w.wallet.RequestMeltQuote(request, mintUrl)
+		w.mutex.Unlock()
 
 		if meltQuoteErr != nil {
 			log.Printf("Error requesting melt quote for %s: %v", mintUrl, meltQuoteErr)
@@ -136,14 +363,16 @@ func (w *TollWallet) MeltToLightning(mintUrl string, targetAmount uint64, maxCos
 		}
 
 		if meltQuote.Amount > maxCost {
-			log.Printf("Melting %d to %s costs too much, reducing by 5%%", targetAmount, lnurl)
+			log.Printf("Melting %d to %s costs too much, reducing by 5%%", targetAmount, payee)
 			meltError = fmt.Errorf("melt cost exceeds maximum allowed: %d > %d", meltQuote.Amount, maxCost)
 			currentAmount = currentAmount - (currentAmount * 5 / 100) // Reduce by 5%
 			attempts++
 			continue
 		}
 
+		w.mutex.Lock()
 		meltResult, meltErr := w.wallet.Melt(meltQuote.Quote)
+		w.mutex.Unlock()
 
 		if meltErr != nil {
 			log.Printf("Error melting quote %s for %s: %v", meltQuote.Quote, mintUrl, meltErr)
@@ -152,12 +381,45 @@ func (w *TollWallet) MeltToLightning(mintUrl string, targetAmount uint64, maxCos
 			continue
 		}
 
-		log.Printf("meltResult: %s", meltResult.State)
-		log.Printf("Successfully melted %d sats with %d sats in fees", currentAmount, meltResult.FeeReserve)
-		return nil
+		melt := newMelt(mintUrl, request, meltResult)
+		melt.Payee = payee
+		melt.LightningAddress = lightningAddress
+		switch {
+		case melt.Pending():
+			log.Printf("Melt quote %s for %s is pending", melt.Quote, mintUrl)
+			return melt, fmt.Errorf("%w: quote %s", ErrMeltPending, melt.Quote)
+		case !melt.Paid():
+			log.Printf("Mint %s didn't pay melt quote %s", mintUrl, melt.Quote)
+			meltError = fmt.Errorf("mint didn't pay melt quote %s", melt.Quote)
+			attempts++
+			continue
+		}
+
+		log.Printf("Successfully melted %d sats with %d sats in fees", currentAmount, melt.Fee)
+		w.bus.Publish(events.PayoutCompleted{Mint: mintUrl, Amount: currentAmount, Payee: payee, LightningAddress: lightningAddress})
+		return melt, nil
 
 	}
 
 	// If we get here, all attempts failed
-	return fmt.Errorf("failed to melt after %d attempts: %w", attempts, meltError)
+	return Melt{}, fmt.Errorf("failed to melt after %d attempts: %w", attempts, meltError)
+}
+
+// MeltState asks the mint whether it paid the invoice of a pending melt, whose Payee and
+// LightningAddress are reported when it was
+func (w *TollWallet) MeltState(melt Melt) (Melt, error) {
+	w.mutex.Lock()
+	response, err := w.wallet.CheckMeltQuoteState(melt.Quote)
+	w.mutex.Unlock()
+	if err != nil {
+		return melt, fmt.Errorf("Failed to check melt quote %s: %w", melt.Quote, mintError(melt.Mint, err))
+	}
+
+	checked := newMelt(melt.Mint, melt.Invoice, response)
+	checked.Payee = melt.Payee
+	checked.LightningAddress = melt.LightningAddress
+	if checked.Paid() && !melt.Paid() {
+		w.bus.Publish(events.PayoutCompleted{Mint: melt.Mint, Amount: checked.Amount, Payee: melt.Payee, LightningAddress: melt.LightningAddress})
+	}
+	return checked, nil
 }
@@ -72,12 +72,12 @@ func TestNew(t *testing.T) {
 	// Test case with valid parameters
 	t.Run("Valid parameters", func(t *testing.T) {
 		acceptedMints := []string{"https://testmint.com"}
-		wallet, err := New(walletPath, acceptedMints, false)
+		wallet, err := New(walletPath, acceptedMints, false, nil)
 
 		assert.NoError(t, err)
 		assert.NotNil(t, wallet)
 		assert.NotNil(t, wallet.wallet)
-		assert.Equal(t, acceptedMints, wallet.acceptedMints)
+		assert.Equal(t, acceptedMints, wallet.AcceptedMints())
 	})
 
 	// Test case with no accepted mints
@@ -86,7 +86,7 @@ func TestNew(t *testing.T) {
 		t.Skip("This test would call os.Exit and terminate the test process")
 
 		acceptedMints := []string{}
-		_, _ = New(walletPath, acceptedMints, false)
+		_, _ = New(walletPath, acceptedMints, false, nil)
 	})
 }
 
@@ -96,7 +96,7 @@ func TestReceive(t *testing.T) {
 		// Create a manually constructed TollWallet with fields we control
 		tollWallet := &TollWallet{
 			// wallet is nil, but we won't use it for this test
-			acceptedMints:              []string{"https://accepted-mint.com"},
+			acceptedMints:              newMintList([]string{"https://accepted-mint.com"}),
 			allowAndSwapUntrustedMints: false,
 		}
 
@@ -0,0 +1,43 @@
+package utils
+
+import (
+	"bufio"
+	"bytes"
+	"net"
+	"strings"
+)
+
+// DHCPLeasesPath is the dnsmasq lease file of OpenWrt
+const DHCPLeasesPath = "/tmp/dhcp.leases"
+
+// LeaseMACAddress returns the MAC address leased the IP address ip in the contents of
+// a dnsmasq lease file, whose lines read "<expiry> <mac> <ip> <hostname> <client id>"
+func LeaseMACAddress(leases []byte, ip net.IP) (string, bool) {
+	scanner := bufio.NewScanner(bytes.NewReader(leases))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 3 {
+			continue
+		}
+		if leased := net.ParseIP(fields[2]); leased != nil && leased.Equal(ip) && ValidateMACAddress(fields[1]) {
+			return strings.ToLower(fields[1]), true
+		}
+	}
+	return "", false
+}
+
+// LeaseIPAddress returns the IP address leased to the MAC address macAddress in the contents
+// of a dnsmasq lease file
+func LeaseIPAddress(leases []byte, macAddress string) (net.IP, bool) {
+	scanner := bufio.NewScanner(bytes.NewReader(leases))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 3 || !strings.EqualFold(fields[1], strings.TrimSpace(macAddress)) {
+			continue
+		}
+		if leased := net.ParseIP(fields[2]); leased != nil {
+			return leased, true
+		}
+	}
+	return nil, false
+}
@@ -1,6 +1,7 @@
 package utils
 
 import (
+	"net"
 	"testing"
 )
 
@@ -38,3 +39,59 @@ func TestValidateMACAddress(t *testing.T) {
 		})
 	}
 }
+
+func TestLeaseMACAddress(t *testing.T) {
+	leases := []byte(`1767225600 aa:bb:cc:dd:ee:01 192.168.1.12 phone 01:aa:bb:cc:dd:ee:01
+1767225600 AA:BB:CC:DD:EE:02 192.168.1.1 laptop *
+duid 00:01:00:01:2c:5f:6a:7b:00:11:22:33:44:55
+1767225600 not-a-mac 192.168.1.13 broken *
+`)
+
+	tests := []struct {
+		name  string
+		ip    string
+		mac   string
+		found bool
+	}{
+		{"Leased address", "192.168.1.12", "aa:bb:cc:dd:ee:01", true},
+		{"Prefix of another lease", "192.168.1.1", "aa:bb:cc:dd:ee:02", true},
+		{"Unleased address", "192.168.1.2", "", false},
+		{"Lease with invalid MAC", "192.168.1.13", "", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mac, found := LeaseMACAddress(leases, net.ParseIP(tt.ip))
+			if mac != tt.mac || found != tt.found {
+				t.Errorf("LeaseMACAddress(%s) = %q, %v, want %q, %v", tt.ip, mac, found, tt.mac, tt.found)
+			}
+		})
+	}
+}
+
+func TestLeaseIPAddress(t *testing.T) {
+	leases := []byte(`1767225600 aa:bb:cc:dd:ee:01 192.168.1.12 phone 01:aa:bb:cc:dd:ee:01
+1767225600 AA:BB:CC:DD:EE:02 192.168.1.1 laptop *
+duid 00:01:00:01:2c:5f:6a:7b:00:11:22:33:44:55
+`)
+
+	tests := []struct {
+		name  string
+		mac   string
+		ip    string
+		found bool
+	}{
+		{"Leased MAC", "aa:bb:cc:dd:ee:01", "192.168.1.12", true},
+		{"Uppercase lease", "aa:bb:cc:dd:ee:02", "192.168.1.1", true},
+		{"Unleased MAC", "aa:bb:cc:dd:ee:03", "<nil>", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ip, found := LeaseIPAddress(leases, tt.mac)
+			if ip.String() != tt.ip || found != tt.found {
+				t.Errorf("LeaseIPAddress(%s) = %s, %v, want %s, %v", tt.mac, ip, found, tt.ip, tt.found)
+			}
+		})
+	}
+}
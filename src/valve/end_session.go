@@ -0,0 +1,74 @@
+package valve
+
+import (
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/OpenTollGate/tollgate-module-basic-go/src/events"
+)
+
+// EndSession closes a session before it runs out on behalf of the pubkey that purchased it.
+// settle is called with what's left of the session, in Remaining for time-based and
+// RemainingBytes for data-volume sessions, and the session is only closed if settle succeeds,
+// so a client never loses its session without getting what settle hands out for it.
+// settle runs without the sessions locked, so it may talk to a mint, while changes to
+// this session wait for it.
+func (v *Valve) EndSession(macAddress string, pubkey string, reason string, settle func(Session) error) error {
+	macAddress = normalizeMAC(macAddress)
+
+	v.sessionMutex.Lock()
+	defer v.sessionMutex.Unlock()
+	v.waitUntilSettled(macAddress)
+
+	session, err := v.ownedSession(macAddress, pubkey)
+	if err != nil {
+		return err
+	}
+
+	running := !session.IsPaused()
+	if running {
+		if session.IsMetered() {
+			// Settling on a stale counter would hand out traffic the client already used
+			counted, err := v.countUsage(session)
+			if err != nil {
+				return fmt.Errorf("error reading traffic counter: %w", err)
+			}
+			session = counted
+		} else {
+			session.Remaining = max(time.Until(session.ExpiresAt), 0)
+		}
+	}
+
+	if err := v.settleUnlocked(session, settle); err != nil {
+		return err
+	}
+
+	delete(v.missingSince, macAddress)
+	if running {
+		v.cancelExistingTimer(macAddress)
+		v.closeSession(macAddress, reason)
+	} else {
+		// A paused session's MAC address is deauthorized already
+		if err := v.store.Delete(macAddress); err != nil {
+			log.Printf("Error removing session for MAC %s: %v", macAddress, err)
+		}
+		v.bus.Publish(events.SessionExpired{MACAddress: macAddress, Reason: reason})
+	}
+
+	log.Printf("Ended session of MAC %s early (%s)", macAddress, reason)
+	return nil
+}
+
+// settleUnlocked calls settle for session with sessionMutex, which the caller holds, released.
+// The session is marked as ending meanwhile, so nothing else changes it before it is closed.
+func (v *Valve) settleUnlocked(session Session, settle func(Session) error) error {
+	v.ending[session.MACAddress] = true
+	v.sessionMutex.Unlock()
+	defer func() {
+		v.sessionMutex.Lock()
+		delete(v.ending, session.MACAddress)
+		v.endingDone.Broadcast()
+	}()
+	return settle(session)
+}
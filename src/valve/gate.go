@@ -0,0 +1,113 @@
+package valve
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os/exec"
+	"strings"
+)
+
+// Supported gate backends, selectable through the "gate" section of config.json
+const (
+	BackendNdsctl   = "ndsctl"
+	BackendOpenNDS  = "opennds"
+	BackendNftables = "nftables"
+	BackendMemory   = "memory"
+)
+
+// Gate is a firewall backend that lets authorized clients through the captive portal
+type Gate interface {
+	// Authorize grants network access to a MAC address
+	Authorize(macAddress string) error
+	// Deauthorize revokes network access from a MAC address
+	Deauthorize(macAddress string) error
+	// List returns the MAC addresses the backend currently has authorized
+	List() ([]string, error)
+	// Status reports the backend's view of a single MAC address
+	Status(macAddress string) (ClientStatus, error)
+}
+
+// ClientStatus describes a client as seen by the gate backend
+type ClientStatus struct {
+	MACAddress string
+	Authorized bool
+	// Bytes is the traffic counted for the client in both directions. Backends
+	// reset it when a client is reauthorized, so consumers must handle it going down.
+	Bytes uint64
+}
+
+// RateLimit is the bandwidth a client may use in kilobits per second.
+// Zero means the direction is not limited.
+type RateLimit struct {
+	DownloadKbps uint64 `json:"download_kbps,omitempty"`
+	UploadKbps   uint64 `json:"upload_kbps,omitempty"`
+}
+
+// IsUnlimited reports whether neither direction is limited
+func (l RateLimit) IsUnlimited() bool {
+	return l.DownloadKbps == 0 && l.UploadKbps == 0
+}
+
+// ErrRateLimitUnsupported is returned for rate limits the gate backend can't enforce
+var ErrRateLimitUnsupported = errors.New("gate backend can't enforce rate limits")
+
+// RateLimiter is implemented by gate backends that can shape the bandwidth of individual clients
+type RateLimiter interface {
+	// AuthorizeWithRateLimit grants network access to a MAC address at the given bandwidth.
+	// Calling it for an authorized MAC address replaces its rate limit.
+	AuthorizeWithRateLimit(macAddress string, limit RateLimit) error
+	// CanRateLimit reports whether the backend is set up to limit both directions
+	CanRateLimit() bool
+}
+
+// Allowlist is implemented by gate backends that can let unauthorized clients reach
+// a walled garden of addresses, such as the mints clients pay with
+type Allowlist interface {
+	// SetAllowedAddresses replaces the walled garden with the given addresses
+	SetAllowedAddresses(addresses []net.IP) error
+}
+
+// GateOptions selects and configures a gate backend
+type GateOptions struct {
+	Backend   string
+	NftFamily string
+	NftTable  string
+	NftSet    string
+	// NftShapingChain is the nftables chain the nftables backend adds per-client
+	// rate limit rules to. Rate limiting is disabled when it is empty.
+	NftShapingChain string
+	// NftWalledGardenSet is the name prefix of the nftables sets, suffixed with _v4
+	// and _v6, holding the addresses unauthorized clients may reach
+	NftWalledGardenSet string
+}
+
+// NewGate creates the gate backend described by options.
+// An empty backend defaults to nodogsplash's ndsctl.
+func NewGate(options GateOptions) (Gate, error) {
+	switch options.Backend {
+	case "", BackendNdsctl:
+		return NewNdsctlGate(), nil
+	case BackendOpenNDS:
+		return NewOpenNDSGate(), nil
+	case BackendNftables:
+		return NewNftablesGate(options), nil
+	case BackendMemory:
+		return NewMemoryGate(), nil
+	default:
+		return nil, fmt.Errorf("unknown gate backend %q", options.Backend)
+	}
+}
+
+// commandRunner runs an external command and returns its standard output
+type commandRunner func(name string, args ...string) ([]byte, error)
+
+// runCommand is the commandRunner used by the backends outside of tests
+func runCommand(name string, args ...string) ([]byte, error) {
+	return exec.Command(name, args...).Output()
+}
+
+// normalizeMAC returns the lowercase form of a MAC address used for comparisons
+func normalizeMAC(macAddress string) string {
+	return strings.ToLower(strings.TrimSpace(macAddress))
+}
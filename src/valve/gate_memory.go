@@ -0,0 +1,110 @@
+package valve
+
+import (
+	"net"
+	"sort"
+	"sync"
+)
+
+// MemoryGate is an in-memory gate backend for tests and development machines without a captive portal
+type MemoryGate struct {
+	mu         sync.Mutex
+	authorized map[string]bool
+	bytes      map[string]uint64
+	rateLimits map[string]RateLimit
+	allowed    []net.IP
+}
+
+// NewMemoryGate creates an empty in-memory gate
+func NewMemoryGate() *MemoryGate {
+	return &MemoryGate{
+		authorized: make(map[string]bool),
+		bytes:      make(map[string]uint64),
+		rateLimits: make(map[string]RateLimit),
+	}
+}
+
+// Authorize marks a MAC address as authorized
+func (g *MemoryGate) Authorize(macAddress string) error {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.authorized[normalizeMAC(macAddress)] = true
+	return nil
+}
+
+// AuthorizeWithRateLimit marks a MAC address as authorized and records its rate limit
+func (g *MemoryGate) AuthorizeWithRateLimit(macAddress string, limit RateLimit) error {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	mac := normalizeMAC(macAddress)
+	g.authorized[mac] = true
+	g.rateLimits[mac] = limit
+	return nil
+}
+
+// CanRateLimit reports that rate limits are recorded
+func (g *MemoryGate) CanRateLimit() bool {
+	return true
+}
+
+// RateLimitOf returns the rate limit recorded for a MAC address
+func (g *MemoryGate) RateLimitOf(macAddress string) RateLimit {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.rateLimits[normalizeMAC(macAddress)]
+}
+
+// Deauthorize removes a MAC address from the authorized clients and resets its traffic counter
+func (g *MemoryGate) Deauthorize(macAddress string) error {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	mac := normalizeMAC(macAddress)
+	delete(g.authorized, mac)
+	delete(g.bytes, mac)
+	delete(g.rateLimits, mac)
+	return nil
+}
+
+// SetBytes sets the traffic counter of a MAC address, simulating client usage
+func (g *MemoryGate) SetBytes(macAddress string, bytes uint64) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.bytes[normalizeMAC(macAddress)] = bytes
+}
+
+// List returns the authorized MAC addresses in sorted order
+func (g *MemoryGate) List() ([]string, error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	macAddresses := make([]string, 0, len(g.authorized))
+	for mac := range g.authorized {
+		macAddresses = append(macAddresses, mac)
+	}
+	sort.Strings(macAddresses)
+	return macAddresses, nil
+}
+
+// Status reports whether a MAC address is authorized and its traffic counter
+func (g *MemoryGate) Status(macAddress string) (ClientStatus, error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	mac := normalizeMAC(macAddress)
+	return ClientStatus{MACAddress: mac, Authorized: g.authorized[mac], Bytes: g.bytes[mac]}, nil
+}
+
+// SetAllowedAddresses records the walled garden
+func (g *MemoryGate) SetAllowedAddresses(addresses []net.IP) error {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.allowed = append([]net.IP(nil), addresses...)
+	return nil
+}
+
+// AllowedAddresses returns the walled garden
+func (g *MemoryGate) AllowedAddresses() []net.IP {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return append([]net.IP(nil), g.allowed...)
+}
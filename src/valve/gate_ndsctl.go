@@ -0,0 +1,355 @@
+package valve
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// NdsctlGate controls nodogsplash through its ndsctl command line tool
+type NdsctlGate struct {
+	run commandRunner
+}
+
+// NewNdsctlGate creates a gate backend for nodogsplash
+func NewNdsctlGate() *NdsctlGate {
+	return &NdsctlGate{run: runCommand}
+}
+
+// Authorize authorizes a MAC address using ndsctl
+func (g *NdsctlGate) Authorize(macAddress string) error {
+	output, err := g.run("ndsctl", "auth", macAddress)
+	if err != nil {
+		log.Printf("Error authorizing MAC address %s: %v", macAddress, err)
+		return err
+	}
+
+	log.Printf("Authorization successful for MAC %s: %s", macAddress, string(output))
+	return nil
+}
+
+// Deauthorize deauthorizes a MAC address using ndsctl
+func (g *NdsctlGate) Deauthorize(macAddress string) error {
+	output, err := g.run("ndsctl", "deauth", macAddress)
+	if err != nil {
+		log.Printf("Error deauthorizing MAC address %s: %v", macAddress, err)
+		return err
+	}
+
+	log.Printf("Deauthorization successful for MAC %s: %s", macAddress, string(output))
+	return nil
+}
+
+// List returns the MAC addresses of all authenticated ndsctl clients
+func (g *NdsctlGate) List() ([]string, error) {
+	return listNdsctlClients(g.run)
+}
+
+// Status reports whether ndsctl has a MAC address authenticated and how much traffic it used
+func (g *NdsctlGate) Status(macAddress string) (ClientStatus, error) {
+	return ndsctlClientStatus(g.run, macAddress)
+}
+
+// SetAllowedAddresses replaces the addresses nodogsplash's walled garden rules let through
+func (g *NdsctlGate) SetAllowedAddresses(addresses []net.IP) error {
+	return setWalledGarden(g.run, "nodogsplash", addresses)
+}
+
+// OpenNDSGate controls openNDS, which ships its own ndsctl with a different auth syntax
+type OpenNDSGate struct {
+	run commandRunner
+}
+
+// NewOpenNDSGate creates a gate backend for openNDS
+func NewOpenNDSGate() *OpenNDSGate {
+	return &OpenNDSGate{run: runCommand}
+}
+
+// Authorize authorizes a MAC address using openNDS' ndsctl.
+// A session timeout of 0 makes openNDS fall back to its global sessiontimeout,
+// which should be longer than any session sold since the valve handles expiry itself.
+func (g *OpenNDSGate) Authorize(macAddress string) error {
+	output, err := g.run("ndsctl", "auth", macAddress, "0")
+	if err != nil {
+		log.Printf("Error authorizing MAC address %s: %v", macAddress, err)
+		return err
+	}
+
+	log.Printf("Authorization successful for MAC %s: %s", macAddress, string(output))
+	return nil
+}
+
+// AuthorizeWithRateLimit authorizes a MAC address with openNDS' per-client upload and download rates.
+// openNDS only applies rates on authentication, so an authorized client is deauthorized first.
+func (g *OpenNDSGate) AuthorizeWithRateLimit(macAddress string, limit RateLimit) error {
+	status, err := ndsctlClientStatus(g.run, macAddress)
+	if err != nil {
+		return err
+	}
+	if status.Authorized {
+		if err := g.Deauthorize(macAddress); err != nil {
+			return err
+		}
+	}
+
+	output, err := g.run("ndsctl", "auth", macAddress, "0",
+		strconv.FormatUint(limit.UploadKbps, 10), strconv.FormatUint(limit.DownloadKbps, 10))
+	if err != nil {
+		log.Printf("Error authorizing MAC address %s with rate limit: %v", macAddress, err)
+		return err
+	}
+
+	log.Printf("Authorization successful for MAC %s at %d/%d kbit/s down/up: %s", macAddress, limit.DownloadKbps, limit.UploadKbps, string(output))
+	return nil
+}
+
+// CanRateLimit reports that openNDS limits both directions
+func (g *OpenNDSGate) CanRateLimit() bool {
+	return true
+}
+
+// Deauthorize deauthorizes a MAC address using openNDS' ndsctl
+func (g *OpenNDSGate) Deauthorize(macAddress string) error {
+	output, err := g.run("ndsctl", "deauth", macAddress)
+	if err != nil {
+		log.Printf("Error deauthorizing MAC address %s: %v", macAddress, err)
+		return err
+	}
+
+	log.Printf("Deauthorization successful for MAC %s: %s", macAddress, string(output))
+	return nil
+}
+
+// List returns the MAC addresses of all authenticated openNDS clients
+func (g *OpenNDSGate) List() ([]string, error) {
+	return listNdsctlClients(g.run)
+}
+
+// Status reports whether openNDS has a MAC address authenticated and how much traffic it used
+func (g *OpenNDSGate) Status(macAddress string) (ClientStatus, error) {
+	return ndsctlClientStatus(g.run, macAddress)
+}
+
+// SetAllowedAddresses replaces the addresses openNDS' walled garden rules let through
+func (g *OpenNDSGate) SetAllowedAddresses(addresses []net.IP) error {
+	return setWalledGarden(g.run, "opennds", addresses)
+}
+
+// ndsctlClient is a single client entry of `ndsctl json`
+type ndsctlClient struct {
+	IP         string    `json:"ip"`
+	MAC        string    `json:"mac"`
+	State      string    `json:"state"`
+	Downloaded kilobytes `json:"downloaded"`
+	Uploaded   kilobytes `json:"uploaded"`
+}
+
+// kilobytes is a traffic counter reported by ndsctl in units of 1000 bytes.
+// Depending on the version it is printed as a JSON number or a string.
+type kilobytes uint64
+
+func (k *kilobytes) UnmarshalJSON(data []byte) error {
+	unquoted, err := strconv.Unquote(string(data))
+	if err != nil {
+		unquoted = string(data)
+	}
+	if unquoted == "" || unquoted == "null" {
+		*k = 0
+		return nil
+	}
+	value, err := strconv.ParseUint(unquoted, 10, 64)
+	if err != nil {
+		return fmt.Errorf("invalid traffic counter %s: %w", string(data), err)
+	}
+	*k = kilobytes(value)
+	return nil
+}
+
+// ndsctlOutput is the output of `ndsctl json`, shared by nodogsplash and openNDS
+type ndsctlOutput struct {
+	Clients map[string]ndsctlClient `json:"clients"`
+}
+
+// parseNdsctlClients parses `ndsctl json` output into clients keyed by lowercase MAC address
+func parseNdsctlClients(output []byte) (map[string]ndsctlClient, error) {
+	var parsed ndsctlOutput
+	if err := json.Unmarshal(output, &parsed); err != nil {
+		return nil, fmt.Errorf("failed to parse ndsctl output: %w", err)
+	}
+
+	clients := make(map[string]ndsctlClient, len(parsed.Clients))
+	for key, client := range parsed.Clients {
+		mac := client.MAC
+		if mac == "" {
+			mac = key
+		}
+		clients[normalizeMAC(mac)] = client
+	}
+	return clients, nil
+}
+
+func listNdsctlClients(run commandRunner) ([]string, error) {
+	output, err := run("ndsctl", "json")
+	if err != nil {
+		return nil, fmt.Errorf("failed to list ndsctl clients: %w", err)
+	}
+
+	clients, err := parseNdsctlClients(output)
+	if err != nil {
+		return nil, err
+	}
+
+	macAddresses := make([]string, 0, len(clients))
+	for mac, client := range clients {
+		if client.State == "Authenticated" {
+			macAddresses = append(macAddresses, mac)
+		}
+	}
+	return macAddresses, nil
+}
+
+func ndsctlClientStatus(run commandRunner, macAddress string) (ClientStatus, error) {
+	status := ClientStatus{MACAddress: normalizeMAC(macAddress)}
+
+	output, err := run("ndsctl", "json")
+	if err != nil {
+		return status, fmt.Errorf("failed to get ndsctl status for %s: %w", macAddress, err)
+	}
+
+	clients, err := parseNdsctlClients(output)
+	if err != nil {
+		return status, err
+	}
+
+	if client, exists := clients[status.MACAddress]; exists {
+		status.Authorized = client.State == "Authenticated"
+		status.Bytes = (uint64(client.Downloaded) + uint64(client.Uploaded)) * 1000
+	}
+	return status, nil
+}
+
+// walledGardenIpset is the ipset of addresses nodogsplash's and openNDS' walled garden rules let
+// unauthorized clients reach. Both write their rules with iptables, which matches ipsets by name.
+const walledGardenIpset = "tollgate_walled_garden"
+
+// walledGardenRules are the preauthenticated_users rules of the walled garden
+var walledGardenRules = []string{
+	"allow tcp port 80 ipset " + walledGardenIpset,
+	"allow tcp port 443 ipset " + walledGardenIpset,
+}
+
+// walledGardenRule matches the preauthenticated_users rules managed by the walled garden, including
+// the per-address rules of earlier versions. Other rules are the operator's and are kept.
+var walledGardenRule = regexp.MustCompile(`^allow tcp port (80|443) (to [0-9.]+|ipset ` + walledGardenIpset + `)$`)
+
+// uciListValue matches a single quoted value in `uci show` output
+var uciListValue = regexp.MustCompile(`'([^']*)'`)
+
+// portalRestartTimeout is how long a restarted captive portal may take until ndsctl answers again
+const portalRestartTimeout = 30 * time.Second
+
+// setWalledGarden lets unauthorized clients of nodogsplash or openNDS reach the IPv4 addresses.
+// The addresses are swapped into walledGardenIpset, which the portal's rules reference, so changes
+// apply without touching authorized clients. Only installing the rules restarts the portal.
+func setWalledGarden(run commandRunner, service string, addresses []net.IP) error {
+	// The set must exist before the portal loads rules referencing it
+	if err := fillIpset(run, walledGardenIpset, addresses); err != nil {
+		return err
+	}
+	return installWalledGardenRules(run, service)
+}
+
+// fillIpset replaces the IPv4 addresses in an ipset, creating it if it is missing.
+// The addresses are added to a staging set that is swapped in, so none of the
+// addresses staying in the set is missing in between.
+func fillIpset(run commandRunner, set string, addresses []net.IP) error {
+	staging := set + "_new"
+	for _, name := range []string{set, staging} {
+		if _, err := run("ipset", "-exist", "create", name, "hash:ip", "family", "inet"); err != nil {
+			return fmt.Errorf("failed to create ipset %s: %w", name, err)
+		}
+	}
+	if _, err := run("ipset", "flush", staging); err != nil {
+		return fmt.Errorf("failed to flush ipset %s: %w", staging, err)
+	}
+	for _, address := range addresses {
+		// nodogsplash and openNDS only filter IPv4 before authentication
+		if ipv4 := address.To4(); ipv4 != nil {
+			if _, err := run("ipset", "-exist", "add", staging, ipv4.String()); err != nil {
+				return fmt.Errorf("failed to add %s to ipset %s: %w", ipv4, staging, err)
+			}
+		}
+	}
+	if _, err := run("ipset", "swap", staging, set); err != nil {
+		return fmt.Errorf("failed to swap ipset %s into %s: %w", staging, set, err)
+	}
+	// A leftover staging set is flushed and reused next time
+	run("ipset", "destroy", staging)
+	return nil
+}
+
+// installWalledGardenRules adds walledGardenRules to the preauthenticated_users list of a
+// nodogsplash or openNDS UCI config. Both only read the list on startup, so the service is
+// restarted when the rules were missing, which drops authorized clients until they are
+// authorized again. It returns once ndsctl answers again.
+func installWalledGardenRules(run commandRunner, service string) error {
+	option := fmt.Sprintf("%s.@%s[0].preauthenticated_users", service, service)
+
+	// A missing option fails, which is the same as an empty list
+	var current []string
+	if output, err := run("uci", "-q", "show", option); err == nil {
+		current = parseUciList(output)
+	}
+
+	var rules []string
+	for _, rule := range current {
+		if !walledGardenRule.MatchString(rule) {
+			rules = append(rules, rule)
+		}
+	}
+	rules = append(rules, walledGardenRules...)
+	if strings.Join(rules, "\n") == strings.Join(current, "\n") {
+		return nil
+	}
+
+	// Deleting a missing option fails, which is fine
+	run("uci", "-q", "delete", option)
+	for _, rule := range rules {
+		if _, err := run("uci", "add_list", option+"="+rule); err != nil {
+			return fmt.Errorf("failed to add %s rule %q: %w", service, rule, err)
+		}
+	}
+	if _, err := run("uci", "commit", service); err != nil {
+		return fmt.Errorf("failed to commit %s config: %w", service, err)
+	}
+	log.Printf("Installed walled garden rules for ipset %s in %s, restarting it once", walledGardenIpset, service)
+	if _, err := run("/etc/init.d/"+service, "restart"); err != nil {
+		return fmt.Errorf("failed to restart %s: %w", service, err)
+	}
+
+	deadline := time.Now().Add(portalRestartTimeout)
+	for {
+		_, err := run("ndsctl", "json")
+		if err == nil {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("%s didn't answer within %s of restarting: %w", service, portalRestartTimeout, err)
+		}
+		time.Sleep(time.Second)
+	}
+}
+
+// parseUciList returns the values of a list option in `uci show` output
+func parseUciList(output []byte) []string {
+	var values []string
+	for _, match := range uciListValue.FindAllStringSubmatch(string(output), -1) {
+		values = append(values, match[1])
+	}
+	return values
+}
@@ -0,0 +1,335 @@
+package valve
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"strings"
+
+	"github.com/OpenTollGate/tollgate-module-basic-go/src/utils"
+)
+
+// Defaults for the nftables sets holding authorized MAC addresses and walled garden addresses
+const (
+	defaultNftFamily       = "inet"
+	defaultNftTable        = "fw4"
+	defaultNftSet          = "tollgate_clients"
+	defaultNftWalledGarden = "tollgate_walled_garden"
+)
+
+// NftablesGate authorizes clients by adding their MAC address to an nftables set.
+// The firewall is expected to accept forwarded traffic whose source MAC is in the set.
+type NftablesGate struct {
+	family       string
+	table        string
+	set          string
+	shapingChain string
+	walledGarden string
+	run          commandRunner
+	// readLeases returns the DHCP leases the IP addresses of rate limited clients are looked up in
+	readLeases func() ([]byte, error)
+}
+
+// NewNftablesGate creates a gate backend that manages membership of the nftables set in options.
+// Empty options fall back to the inet fw4 tollgate_clients set. Per-client rate limits
+// are added as rules to the shaping chain, which is disabled when empty.
+func NewNftablesGate(options GateOptions) *NftablesGate {
+	gate := &NftablesGate{
+		family:       options.NftFamily,
+		table:        options.NftTable,
+		set:          options.NftSet,
+		shapingChain: options.NftShapingChain,
+		walledGarden: options.NftWalledGardenSet,
+		run:          runCommand,
+		readLeases: func() ([]byte, error) {
+			return os.ReadFile(utils.DHCPLeasesPath)
+		},
+	}
+	if gate.family == "" {
+		gate.family = defaultNftFamily
+	}
+	if gate.table == "" {
+		gate.table = defaultNftTable
+	}
+	if gate.set == "" {
+		gate.set = defaultNftSet
+	}
+	if gate.walledGarden == "" {
+		gate.walledGarden = defaultNftWalledGarden
+	}
+	return gate
+}
+
+// Authorize adds a MAC address to the nftables set
+func (g *NftablesGate) Authorize(macAddress string) error {
+	output, err := g.run("nft", "add", "element", g.family, g.table, g.set, fmt.Sprintf("{ %s }", normalizeMAC(macAddress)))
+	if err != nil {
+		log.Printf("Error adding MAC address %s to nftables set %s: %v", macAddress, g.set, err)
+		return err
+	}
+
+	log.Printf("Authorization successful for MAC %s: %s", macAddress, string(output))
+	return nil
+}
+
+// CanRateLimit reports whether a shaping chain is configured
+func (g *NftablesGate) CanRateLimit() bool {
+	return g.shapingChain != ""
+}
+
+// AuthorizeWithRateLimit adds a MAC address to the nftables set and replaces its rate limit rules.
+// Upload is matched by the client's MAC address. Routed traffic towards a client has no destination
+// MAC address yet when it passes the forward hook, so download is matched by the IPv4 address
+// of the client's DHCP lease.
+func (g *NftablesGate) AuthorizeWithRateLimit(macAddress string, limit RateLimit) error {
+	if !g.CanRateLimit() {
+		return fmt.Errorf("no nftables shaping chain configured to limit MAC %s", macAddress)
+	}
+
+	var clientIP net.IP
+	if limit.DownloadKbps != 0 {
+		leases, err := g.readLeases()
+		if err != nil {
+			return fmt.Errorf("failed to read DHCP leases to limit download of MAC %s: %w", macAddress, err)
+		}
+		ip, found := utils.LeaseIPAddress(leases, macAddress)
+		if !found || ip.To4() == nil {
+			return fmt.Errorf("no IPv4 DHCP lease to limit download of MAC %s", macAddress)
+		}
+		clientIP = ip.To4()
+	}
+
+	if err := g.Authorize(macAddress); err != nil {
+		return err
+	}
+	if err := g.removeRateLimit(macAddress); err != nil {
+		return err
+	}
+
+	if limit.UploadKbps != 0 {
+		if err := g.addRateLimit(macAddress, limit.UploadKbps, "ether", "saddr", normalizeMAC(macAddress)); err != nil {
+			return err
+		}
+	}
+	if limit.DownloadKbps != 0 {
+		if err := g.addRateLimit(macAddress, limit.DownloadKbps, "ip", "daddr", clientIP.String()); err != nil {
+			return err
+		}
+	}
+
+	log.Printf("Limited MAC %s to %d/%d kbit/s down/up", macAddress, limit.DownloadKbps, limit.UploadKbps)
+	return nil
+}
+
+// addRateLimit adds a rule dropping the traffic of a MAC address that matches and exceeds kbps
+func (g *NftablesGate) addRateLimit(macAddress string, kbps uint64, match ...string) error {
+	// nft limits in kbytes, round up so a slow tier never ends up unlimited
+	kbytes := (kbps + 7) / 8
+	args := append([]string{"add", "rule", g.family, g.table, g.shapingChain}, match...)
+	args = append(args, "limit", "rate", "over", fmt.Sprintf("%d", kbytes), "kbytes/second", "drop",
+		"comment", fmt.Sprintf("%q", shapingComment(macAddress)))
+	if _, err := g.run("nft", args...); err != nil {
+		log.Printf("Error adding rate limit for MAC address %s to nftables chain %s: %v", macAddress, g.shapingChain, err)
+		return err
+	}
+	return nil
+}
+
+// Deauthorize removes a MAC address from the nftables set
+func (g *NftablesGate) Deauthorize(macAddress string) error {
+	if g.shapingChain != "" {
+		if err := g.removeRateLimit(macAddress); err != nil {
+			log.Printf("Error removing rate limit for MAC address %s: %v", macAddress, err)
+		}
+	}
+
+	output, err := g.run("nft", "delete", "element", g.family, g.table, g.set, fmt.Sprintf("{ %s }", normalizeMAC(macAddress)))
+	if err != nil {
+		log.Printf("Error removing MAC address %s from nftables set %s: %v", macAddress, g.set, err)
+		return err
+	}
+
+	log.Printf("Deauthorization successful for MAC %s: %s", macAddress, string(output))
+	return nil
+}
+
+// List returns the MAC addresses in the nftables set
+func (g *NftablesGate) List() ([]string, error) {
+	elements, err := g.elements()
+	if err != nil {
+		return nil, err
+	}
+
+	macAddresses := make([]string, 0, len(elements))
+	for _, element := range elements {
+		macAddresses = append(macAddresses, element.MACAddress)
+	}
+	return macAddresses, nil
+}
+
+// Status reports whether a MAC address is in the nftables set.
+// Traffic is only counted when the set is declared with the counter flag.
+func (g *NftablesGate) Status(macAddress string) (ClientStatus, error) {
+	status := ClientStatus{MACAddress: normalizeMAC(macAddress)}
+
+	elements, err := g.elements()
+	if err != nil {
+		return status, err
+	}
+
+	for _, element := range elements {
+		if element.MACAddress == status.MACAddress {
+			status.Authorized = true
+			status.Bytes = element.Bytes
+			break
+		}
+	}
+	return status, nil
+}
+
+// removeRateLimit deletes the shaping rules of a MAC address, found by their comment
+func (g *NftablesGate) removeRateLimit(macAddress string) error {
+	output, err := g.run("nft", "-a", "-j", "list", "chain", g.family, g.table, g.shapingChain)
+	if err != nil {
+		return fmt.Errorf("failed to list nftables chain %s: %w", g.shapingChain, err)
+	}
+
+	handles, err := parseNftRuleHandles(output, shapingComment(macAddress))
+	if err != nil {
+		return err
+	}
+	for _, handle := range handles {
+		_, err := g.run("nft", "delete", "rule", g.family, g.table, g.shapingChain, "handle", fmt.Sprintf("%d", handle))
+		if err != nil {
+			return fmt.Errorf("failed to delete rule %d from nftables chain %s: %w", handle, g.shapingChain, err)
+		}
+	}
+	return nil
+}
+
+// shapingComment is the comment identifying the rate limit rules of a MAC address
+func shapingComment(macAddress string) string {
+	return "tollgate-" + normalizeMAC(macAddress)
+}
+
+// parseNftRuleHandles returns the handles of the rules with the given comment in `nft -a -j list chain` output
+func parseNftRuleHandles(output []byte, comment string) ([]uint64, error) {
+	var parsed struct {
+		Nftables []struct {
+			Rule *struct {
+				Handle  uint64 `json:"handle"`
+				Comment string `json:"comment"`
+			} `json:"rule"`
+		} `json:"nftables"`
+	}
+	if err := json.Unmarshal(output, &parsed); err != nil {
+		return nil, fmt.Errorf("failed to parse nft output: %w", err)
+	}
+
+	handles := []uint64{}
+	for _, entry := range parsed.Nftables {
+		if entry.Rule != nil && entry.Rule.Comment == comment {
+			handles = append(handles, entry.Rule.Handle)
+		}
+	}
+	return handles, nil
+}
+
+// SetAllowedAddresses replaces the contents of the walled garden sets, <name>_v4 and <name>_v6,
+// whose addresses the firewall lets unauthorized clients reach
+func (g *NftablesGate) SetAllowedAddresses(addresses []net.IP) error {
+	var ipv4, ipv6 []string
+	for _, address := range addresses {
+		if address.To4() != nil {
+			ipv4 = append(ipv4, address.String())
+		} else {
+			ipv6 = append(ipv6, address.String())
+		}
+	}
+
+	for _, set := range []struct {
+		name      string
+		addresses []string
+	}{
+		{g.walledGarden + "_v4", ipv4},
+		{g.walledGarden + "_v6", ipv6},
+	} {
+		if _, err := g.run("nft", "flush", "set", g.family, g.table, set.name); err != nil {
+			return fmt.Errorf("failed to flush nftables set %s: %w", set.name, err)
+		}
+		if len(set.addresses) == 0 {
+			continue
+		}
+		_, err := g.run("nft", "add", "element", g.family, g.table, set.name, fmt.Sprintf("{ %s }", strings.Join(set.addresses, ", ")))
+		if err != nil {
+			return fmt.Errorf("failed to add addresses to nftables set %s: %w", set.name, err)
+		}
+	}
+	return nil
+}
+
+func (g *NftablesGate) elements() ([]nftSetElement, error) {
+	output, err := g.run("nft", "-j", "list", "set", g.family, g.table, g.set)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list nftables set %s: %w", g.set, err)
+	}
+
+	return parseNftSetElements(output)
+}
+
+// nftSetOutput is the output of `nft -j list set`
+type nftSetOutput struct {
+	Nftables []struct {
+		Set *struct {
+			Elem []json.RawMessage `json:"elem"`
+		} `json:"set"`
+	} `json:"nftables"`
+}
+
+// nftSetElement is a MAC address in the nftables set with its traffic counter
+type nftSetElement struct {
+	MACAddress string
+	Bytes      uint64
+}
+
+// parseNftSetElements extracts the MAC addresses from `nft -j list set` output.
+// Elements are plain strings, or objects when the set keeps per-element counters.
+func parseNftSetElements(output []byte) ([]nftSetElement, error) {
+	var parsed nftSetOutput
+	if err := json.Unmarshal(output, &parsed); err != nil {
+		return nil, fmt.Errorf("failed to parse nft output: %w", err)
+	}
+
+	elements := []nftSetElement{}
+	for _, entry := range parsed.Nftables {
+		if entry.Set == nil {
+			continue
+		}
+		for _, raw := range entry.Set.Elem {
+			var mac string
+			if err := json.Unmarshal(raw, &mac); err == nil {
+				elements = append(elements, nftSetElement{MACAddress: normalizeMAC(mac)})
+				continue
+			}
+
+			var element struct {
+				Elem struct {
+					Val     string `json:"val"`
+					Counter struct {
+						Bytes uint64 `json:"bytes"`
+					} `json:"counter"`
+				} `json:"elem"`
+			}
+			if err := json.Unmarshal(raw, &element); err != nil {
+				return nil, fmt.Errorf("failed to parse nft set element %s: %w", string(raw), err)
+			}
+			elements = append(elements, nftSetElement{
+				MACAddress: normalizeMAC(element.Elem.Val),
+				Bytes:      element.Elem.Counter.Bytes,
+			})
+		}
+	}
+	return elements, nil
+}
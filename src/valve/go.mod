@@ -1,3 +1,13 @@
 module github.com/OpenTollGate/tollgate-module-basic-go/src/valve
 
 go 1.24.2
+
+require (
+	github.com/OpenTollGate/tollgate-module-basic-go/src/events v0.0.0
+	github.com/OpenTollGate/tollgate-module-basic-go/src/utils v0.0.0
+)
+
+replace (
+	github.com/OpenTollGate/tollgate-module-basic-go/src/events => ../events
+	github.com/OpenTollGate/tollgate-module-basic-go/src/utils => ../utils
+)
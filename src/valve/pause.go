@@ -0,0 +1,162 @@
+package valve
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/OpenTollGate/tollgate-module-basic-go/src/events"
+)
+
+// Reasons a session was paused
+const (
+	PauseReasonClient        = "client"
+	PauseReasonDisassociated = "disassociated"
+)
+
+// Errors returned when a client's request doesn't match the state of its session
+var (
+	ErrNoSession        = errors.New("no session for this MAC address")
+	ErrNotOwner         = errors.New("session was purchased by a different pubkey")
+	ErrSessionPaused    = errors.New("session is paused")
+	ErrSessionNotPaused = errors.New("session is not paused")
+	ErrNoTimeLeft       = errors.New("session has no time left")
+)
+
+// PauseSession closes the gate for a MAC address and keeps the rest of its session
+// for later. Only the pubkey that purchased the session may pause it.
+func (v *Valve) PauseSession(macAddress string, pubkey string) error {
+	macAddress = normalizeMAC(macAddress)
+
+	v.sessionMutex.Lock()
+	defer v.sessionMutex.Unlock()
+	v.waitUntilSettled(macAddress)
+
+	session, err := v.ownedSession(macAddress, pubkey)
+	if err != nil {
+		return err
+	}
+	return v.pause(session, PauseReasonClient)
+}
+
+// ResumeSession opens the gate again for a paused session.
+// Only the pubkey that purchased the session may resume it.
+func (v *Valve) ResumeSession(macAddress string, pubkey string) error {
+	macAddress = normalizeMAC(macAddress)
+
+	v.sessionMutex.Lock()
+	defer v.sessionMutex.Unlock()
+	v.waitUntilSettled(macAddress)
+
+	session, err := v.ownedSession(macAddress, pubkey)
+	if err != nil {
+		return err
+	}
+	return v.resume(session)
+}
+
+// ownedSession returns the session of a MAC address if it was purchased by pubkey.
+// The caller must hold sessionMutex.
+func (v *Valve) ownedSession(macAddress string, pubkey string) (Session, error) {
+	session, exists := v.store.Get(macAddress)
+	if !exists {
+		return session, ErrNoSession
+	}
+	if session.Pubkey == "" || session.Pubkey != pubkey {
+		return session, ErrNotOwner
+	}
+	return session, nil
+}
+
+// pause deauthorizes a session's MAC address and stores what's left of it. The caller must hold sessionMutex.
+func (v *Valve) pause(session Session, reason string) error {
+	if session.IsPaused() {
+		return ErrSessionPaused
+	}
+
+	now := time.Now()
+	if session.IsMetered() {
+		// Count the traffic so far, the backend resets its counter on deauthorization
+		counted, err := v.countUsage(session)
+		if err != nil {
+			log.Printf("Error reading traffic counter for MAC %s: %v", session.MACAddress, err)
+		}
+		session = counted
+	} else {
+		session.Remaining = session.ExpiresAt.Sub(now)
+		if session.Remaining <= 0 {
+			return ErrNoTimeLeft
+		}
+	}
+
+	if err := v.gate.Deauthorize(session.MACAddress); err != nil {
+		return fmt.Errorf("error deauthorizing MAC: %w", err)
+	}
+	v.cancelExistingTimer(session.MACAddress)
+
+	session.PausedAt = now
+	session.PauseReason = reason
+	if err := v.store.Save(session); err != nil {
+		// Without the paused session on disk the client would lose its time on a restart
+		log.Printf("Error persisting paused session for MAC %s: %v", session.MACAddress, err)
+	}
+
+	log.Printf("Paused session of MAC %s (%s) with %s left", session.MACAddress, reason, describeRemaining(session))
+	v.bus.Publish(events.SessionPaused{MACAddress: session.MACAddress, Reason: reason, Remaining: session.Remaining})
+	return nil
+}
+
+// resume authorizes a paused session's MAC address for the rest of its session. The caller must hold sessionMutex.
+func (v *Valve) resume(session Session) error {
+	if !session.IsPaused() {
+		return ErrSessionNotPaused
+	}
+
+	if err := v.authorize(session.MACAddress, session.RateLimit); err != nil {
+		return fmt.Errorf("error authorizing MAC: %w", err)
+	}
+
+	remaining := session.Remaining
+	if session.IsMetered() {
+		// Traffic counted by the backend while paused isn't the client's
+		status, err := v.gate.Status(session.MACAddress)
+		if err != nil {
+			log.Printf("Error reading traffic counter for MAC %s: %v", session.MACAddress, err)
+		}
+		session.CounterBytes = status.Bytes
+	} else {
+		session.ExpiresAt = time.Now().Add(remaining)
+	}
+	session = unpaused(session)
+
+	if err := v.store.Save(session); err != nil {
+		log.Printf("Error persisting resumed session for MAC %s: %v", session.MACAddress, err)
+	}
+	if !session.IsMetered() {
+		v.armTimer(session.MACAddress, remaining)
+	}
+
+	log.Printf("Resumed session of MAC %s with %s left", session.MACAddress, describeRemaining(session))
+	v.bus.Publish(events.SessionResumed{MACAddress: session.MACAddress, Remaining: remaining})
+	return nil
+}
+
+// unpaused returns the session with its pause state cleared
+func unpaused(session Session) Session {
+	session.PausedAt = time.Time{}
+	session.PauseReason = ""
+	session.Remaining = 0
+	return session
+}
+
+// describeRemaining formats what's left of a session for log messages
+func describeRemaining(session Session) string {
+	if session.IsMetered() {
+		return fmt.Sprintf("%d bytes", session.RemainingBytes())
+	}
+	if session.IsPaused() {
+		return session.Remaining.Round(time.Second).String()
+	}
+	return time.Until(session.ExpiresAt).Round(time.Second).String()
+}
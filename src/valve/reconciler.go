@@ -0,0 +1,163 @@
+package valve
+
+import (
+	"log"
+	"time"
+
+	"github.com/OpenTollGate/tollgate-module-basic-go/src/events"
+)
+
+// ReconcileStats counts the discrepancies the reconciler found between the
+// valve's sessions and the clients the gate backend has authorized
+type ReconcileStats struct {
+	Runs    uint64    `json:"runs"`
+	LastRun time.Time `json:"last_run"`
+	// Errors counts runs that couldn't list the backend's clients
+	Errors uint64 `json:"errors"`
+	// RetriedDeauths counts clients whose session ended but that were still
+	// authorized because deauthorizing them failed earlier
+	RetriedDeauths uint64 `json:"retried_deauths"`
+	// UnknownClients counts clients authorized without any session
+	UnknownClients uint64 `json:"unknown_clients"`
+	// FailedDeauths counts deauthorizations that failed during reconciliation
+	FailedDeauths uint64 `json:"failed_deauths"`
+	// MissingClients counts clients with a running session the backend didn't have authorized
+	MissingClients uint64 `json:"missing_clients"`
+	// MissingTimers counts time-based sessions that had no timer to end them
+	MissingTimers uint64 `json:"missing_timers"`
+}
+
+// StartReconciler periodically reconciles the gate backend with the valve's sessions
+func (v *Valve) StartReconciler(interval time.Duration) {
+	log.Printf("Starting gate reconciler, checking every %s", interval)
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for range ticker.C {
+			v.Reconcile()
+		}
+	}()
+}
+
+// ReconcileStats returns the discrepancies counted since the valve was created
+func (v *Valve) ReconcileStats() ReconcileStats {
+	v.sessionMutex.Lock()
+	defer v.sessionMutex.Unlock()
+	return v.stats
+}
+
+// Reconcile compares the clients the gate backend has authorized with the valve's sessions.
+// Clients without a running session are deauthorized, including ones whose deauthorization
+// failed when their session ended, and clients with a running session are authorized again.
+func (v *Valve) Reconcile() {
+	v.sessionMutex.Lock()
+	defer v.sessionMutex.Unlock()
+
+	v.stats.Runs++
+	v.stats.LastRun = time.Now()
+	before := v.stats
+
+	authorizedList, err := v.gate.List()
+	if err != nil {
+		v.stats.Errors++
+		log.Printf("Reconciler failed to list authorized clients: %v", err)
+		return
+	}
+	authorized := make(map[string]bool, len(authorizedList))
+	for _, mac := range authorizedList {
+		authorized[normalizeMAC(mac)] = true
+	}
+
+	v.timerMutex.Lock()
+	timers := make(map[string]bool, len(v.activeTimers))
+	for mac := range v.activeTimers {
+		timers[mac] = true
+	}
+	v.timerMutex.Unlock()
+
+	now := time.Now()
+	expected := make(map[string]bool)
+	closed := make(map[string]bool)
+	for _, session := range v.store.All() {
+		macAddress := session.MACAddress
+		if session.IsPaused() {
+			continue
+		}
+		if v.ending[macAddress] {
+			// EndSession closes the gate once the session is settled
+			expected[macAddress] = true
+			continue
+		}
+
+		if !session.IsMetered() && !timers[macAddress] {
+			v.stats.MissingTimers++
+			v.bus.Publish(events.ReconcileDiscrepancy{MACAddress: macAddress, Kind: events.DiscrepancyMissingTimer})
+			if !session.ExpiresAt.After(now) {
+				log.Printf("Reconciler found expired session for MAC %s without a timer, closing gate", macAddress)
+				v.closeSession(macAddress, events.ReasonTimeout)
+				closed[macAddress] = true
+				continue
+			}
+			log.Printf("Reconciler found session for MAC %s without a timer, re-arming it", macAddress)
+			v.armTimer(macAddress, session.ExpiresAt.Sub(now))
+		}
+		expected[macAddress] = true
+
+		if !authorized[macAddress] {
+			v.stats.MissingClients++
+			v.bus.Publish(events.ReconcileDiscrepancy{MACAddress: macAddress, Kind: events.DiscrepancyMissingClient})
+			log.Printf("Reconciler found MAC %s with a running session not authorized by the gate, authorizing", macAddress)
+			if err := v.authorize(macAddress, session.RateLimit); err != nil {
+				log.Printf("Reconciler failed to authorize MAC %s: %v", macAddress, err)
+			}
+		}
+	}
+
+	// Timers whose session is gone are left to fire, their callback only deauthorizes
+	for mac := range timers {
+		if !expected[mac] {
+			log.Printf("Reconciler found timer for MAC %s without a session", mac)
+		}
+	}
+
+	for mac := range authorized {
+		if expected[mac] || closed[mac] {
+			continue
+		}
+
+		if failedAt, retry := v.failedDeauths[mac]; retry {
+			v.stats.RetriedDeauths++
+			v.bus.Publish(events.ReconcileDiscrepancy{MACAddress: mac, Kind: events.DiscrepancyRetriedDeauth})
+			log.Printf("Reconciler retrying deauthorization of MAC %s, which first failed at %s", mac, failedAt.Format(time.RFC3339))
+		} else {
+			v.stats.UnknownClients++
+			v.bus.Publish(events.ReconcileDiscrepancy{MACAddress: mac, Kind: events.DiscrepancyUnknownClient})
+			log.Printf("Reconciler found MAC %s authorized without a paid session, deauthorizing", mac)
+		}
+
+		if err := v.gate.Deauthorize(mac); err != nil {
+			v.stats.FailedDeauths++
+			v.bus.Publish(events.ReconcileDiscrepancy{MACAddress: mac, Kind: events.DiscrepancyFailedDeauth})
+			if _, retry := v.failedDeauths[mac]; !retry {
+				v.failedDeauths[mac] = now
+			}
+			log.Printf("Reconciler failed to deauthorize MAC %s: %v", mac, err)
+			continue
+		}
+		delete(v.failedDeauths, mac)
+	}
+
+	// Forget failed deauthorizations of clients that left the gate or paid again
+	for mac := range v.failedDeauths {
+		if !authorized[mac] || expected[mac] {
+			delete(v.failedDeauths, mac)
+		}
+	}
+
+	if v.stats != before {
+		log.Printf("Reconciler totals: %d unknown client(s), %d retried and %d failed deauthorization(s), %d missing client(s), %d missing timer(s)",
+			v.stats.UnknownClients, v.stats.RetriedDeauths, v.stats.FailedDeauths, v.stats.MissingClients, v.stats.MissingTimers)
+	}
+}
@@ -0,0 +1,194 @@
+package valve
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/OpenTollGate/tollgate-module-basic-go/src/utils"
+)
+
+// Metrics a session can be metered in
+const (
+	MetricMilliseconds = "milliseconds"
+	MetricBytes        = "bytes"
+)
+
+// Session is a paid period of network access for a single MAC address
+type Session struct {
+	MACAddress      string    `json:"mac_address"`
+	Metric          string    `json:"metric"`
+	StartedAt       time.Time `json:"started_at"`
+	ExpiresAt       time.Time `json:"expires_at"`
+	AmountPaid      uint64    `json:"amount_paid"`
+	Mint            string    `json:"mint"`
+	PurchaseEventID string    `json:"purchase_event_id"`
+	RateLimit       RateLimit `json:"rate_limit"`
+	// PaidSteps is how many steps AmountPaid bought, without free steps
+	PaidSteps uint64 `json:"paid_steps,omitempty"`
+	// VoucherValue is the value of the vouchers redeemed for the session, which isn't in AmountPaid
+	VoucherValue uint64 `json:"voucher_value,omitempty"`
+	// Tier is the name of the tier of the last payment, empty without tiers
+	Tier string `json:"tier,omitempty"`
+	// Pubkey is the nostr pubkey that first paid for the session, which may pause it
+	Pubkey string `json:"pubkey,omitempty"`
+
+	// Paused sessions are deauthorized and keep the time they had left in Remaining
+	PausedAt    time.Time     `json:"paused_at,omitzero"`
+	PauseReason string        `json:"pause_reason,omitempty"`
+	Remaining   time.Duration `json:"remaining,omitempty"`
+
+	// Data-volume sessions track their allowance instead of an expiry.
+	// CounterBytes is the gate's traffic counter at the last usage check.
+	AllowanceBytes uint64 `json:"allowance_bytes,omitempty"`
+	UsedBytes      uint64 `json:"used_bytes,omitempty"`
+	CounterBytes   uint64 `json:"counter_bytes,omitempty"`
+}
+
+// IsMetered reports whether the session is limited by data volume rather than time
+func (s Session) IsMetered() bool {
+	return s.Metric == MetricBytes
+}
+
+// IsPaused reports whether the session is paused
+func (s Session) IsPaused() bool {
+	return !s.PausedAt.IsZero()
+}
+
+// RemainingBytes returns how much of a data-volume session's allowance is left
+func (s Session) RemainingBytes() uint64 {
+	if s.UsedBytes >= s.AllowanceBytes {
+		return 0
+	}
+	return s.AllowanceBytes - s.UsedBytes
+}
+
+// Payment describes what a client paid to open or extend a session
+type Payment struct {
+	Amount uint64
+	// Mint is empty for vouchers, whose Amount is the value of the voucher
+	Mint    string
+	EventID string
+	// PaidSteps is how many steps Amount bought, without free steps
+	PaidSteps uint64
+	// Tier and RateLimit are the name and bandwidth of the tier the client paid for
+	Tier      string
+	RateLimit RateLimit
+	// Pubkey is the nostr pubkey that signed the purchase
+	Pubkey string
+}
+
+// IsVoucher reports whether the payment is the redemption of a voucher rather than ecash
+func (p Payment) IsVoucher() bool {
+	return p.Mint == ""
+}
+
+// SessionStore persists sessions to a JSON file so they survive daemon restarts.
+// Every change rewrites the file through a temporary file and an atomic rename,
+// so a crash leaves either the old or the new state on disk, never a partial one.
+type SessionStore struct {
+	path     string
+	mu       sync.Mutex
+	sessions map[string]Session
+}
+
+// NewSessionStore opens the session store at path, loading any sessions already on disk
+func NewSessionStore(path string) (*SessionStore, error) {
+	store := &SessionStore{
+		path:     path,
+		sessions: make(map[string]Session),
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return store, nil
+		}
+		return nil, fmt.Errorf("failed to read session store %s: %w", path, err)
+	}
+	if len(data) == 0 {
+		return store, nil
+	}
+
+	var sessions []Session
+	if err := json.Unmarshal(data, &sessions); err != nil {
+		return nil, fmt.Errorf("failed to parse session store %s: %w", path, err)
+	}
+	for _, session := range sessions {
+		store.sessions[session.MACAddress] = session
+	}
+	return store, nil
+}
+
+// Get returns the session for a MAC address
+func (s *SessionStore) Get(macAddress string) (Session, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	session, exists := s.sessions[macAddress]
+	return session, exists
+}
+
+// All returns all stored sessions ordered by MAC address
+func (s *SessionStore) All() []Session {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.sortedSessions()
+}
+
+// Save stores a session, replacing any previous session for the same MAC address
+func (s *SessionStore) Save(session Session) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	previous, existed := s.sessions[session.MACAddress]
+	s.sessions[session.MACAddress] = session
+	if err := s.persist(); err != nil {
+		if existed {
+			s.sessions[session.MACAddress] = previous
+		} else {
+			delete(s.sessions, session.MACAddress)
+		}
+		return err
+	}
+	return nil
+}
+
+// Delete removes the session for a MAC address
+func (s *SessionStore) Delete(macAddress string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	previous, existed := s.sessions[macAddress]
+	if !existed {
+		return nil
+	}
+	delete(s.sessions, macAddress)
+	if err := s.persist(); err != nil {
+		s.sessions[macAddress] = previous
+		return err
+	}
+	return nil
+}
+
+func (s *SessionStore) sortedSessions() []Session {
+	sessions := make([]Session, 0, len(s.sessions))
+	for _, session := range s.sessions {
+		sessions = append(sessions, session)
+	}
+	sort.Slice(sessions, func(i, j int) bool {
+		return sessions[i].MACAddress < sessions[j].MACAddress
+	})
+	return sessions
+}
+
+// persist writes the sessions to disk. The caller must hold s.mu.
+func (s *SessionStore) persist() error {
+	data, err := json.Marshal(s.sortedSessions())
+	if err != nil {
+		return fmt.Errorf("failed to marshal sessions: %w", err)
+	}
+	return utils.WriteFileAtomic(s.path, data)
+}
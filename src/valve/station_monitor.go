@@ -0,0 +1,152 @@
+package valve
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+)
+
+// stationLister returns the MAC addresses currently associated with the router's access points
+type stationLister func() (map[string]bool, error)
+
+// StartAutoPause periodically pauses time-based sessions of clients that left the WiFi
+// for longer than grace, and resumes them once the client associates again.
+// Sessions the client paused itself are left alone.
+func (v *Valve) StartAutoPause(interval time.Duration, grace time.Duration) {
+	log.Printf("Starting auto-pause, pausing sessions of clients disassociated for %s", grace)
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for range ticker.C {
+			v.checkAssociations(grace)
+		}
+	}()
+}
+
+// checkAssociations pauses and resumes sessions once based on which clients are associated
+func (v *Valve) checkAssociations(grace time.Duration) {
+	stations, err := v.listStations()
+	if err != nil {
+		// Pausing every session because iw failed would be worse than pausing none
+		log.Printf("Error listing associated WiFi clients, skipping auto-pause: %v", err)
+		return
+	}
+
+	v.sessionMutex.Lock()
+	defer v.sessionMutex.Unlock()
+
+	now := time.Now()
+	for _, session := range v.store.All() {
+		macAddress := session.MACAddress
+		if session.IsMetered() {
+			// Disassociated clients don't use any of their allowance
+			continue
+		}
+		if v.ending[macAddress] {
+			continue
+		}
+
+		if stations[macAddress] {
+			delete(v.missingSince, macAddress)
+			if session.IsPaused() && session.PauseReason == PauseReasonDisassociated {
+				if err := v.resume(session); err != nil {
+					log.Printf("Error resuming session of returning MAC %s: %v", macAddress, err)
+				}
+			}
+			continue
+		}
+
+		if session.IsPaused() {
+			continue
+		}
+
+		since, missing := v.missingSince[macAddress]
+		if !missing {
+			v.missingSince[macAddress] = now
+			continue
+		}
+		if now.Sub(since) < grace {
+			continue
+		}
+
+		if err := v.pause(session, PauseReasonDisassociated); err != nil {
+			log.Printf("Error pausing session of disassociated MAC %s: %v", macAddress, err)
+			continue
+		}
+		delete(v.missingSince, macAddress)
+	}
+
+	// Forget clients whose session ended while they were away
+	for macAddress := range v.missingSince {
+		if _, exists := v.store.Get(macAddress); !exists {
+			delete(v.missingSince, macAddress)
+		}
+	}
+}
+
+// iwStations lists the stations associated with every access point interface using iw
+func iwStations(run commandRunner) (map[string]bool, error) {
+	output, err := run("iw", "dev")
+	if err != nil {
+		return nil, fmt.Errorf("failed to list wireless interfaces: %w", err)
+	}
+
+	interfaces := parseIwAPInterfaces(output)
+	if len(interfaces) == 0 {
+		return nil, fmt.Errorf("no wireless access point interfaces found")
+	}
+
+	stations := make(map[string]bool)
+	for _, iface := range interfaces {
+		output, err := run("iw", "dev", iface, "station", "dump")
+		if err != nil {
+			return nil, fmt.Errorf("failed to list stations of %s: %w", iface, err)
+		}
+		for _, mac := range parseIwStations(output) {
+			stations[mac] = true
+		}
+	}
+	return stations, nil
+}
+
+// parseIwAPInterfaces returns the names of the access point interfaces in `iw dev` output
+func parseIwAPInterfaces(output []byte) []string {
+	var interfaces []string
+	var current string
+
+	scanner := bufio.NewScanner(bytes.NewReader(output))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 2 {
+			continue
+		}
+		switch fields[0] {
+		case "Interface":
+			current = fields[1]
+		case "type":
+			if fields[1] == "AP" && current != "" {
+				interfaces = append(interfaces, current)
+			}
+		}
+	}
+	return interfaces
+}
+
+// parseIwStations returns the MAC addresses in `iw dev <interface> station dump` output
+func parseIwStations(output []byte) []string {
+	var stations []string
+
+	scanner := bufio.NewScanner(bytes.NewReader(output))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) >= 2 && fields[0] == "Station" {
+			stations = append(stations, normalizeMAC(fields[1]))
+		}
+	}
+	return stations
+}
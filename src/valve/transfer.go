@@ -0,0 +1,106 @@
+package valve
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/OpenTollGate/tollgate-module-basic-go/src/events"
+	"github.com/OpenTollGate/tollgate-module-basic-go/src/utils"
+)
+
+// Errors returned when a session can't be transferred
+var (
+	ErrInvalidMAC       = errors.New("invalid MAC address")
+	ErrTargetHasSession = errors.New("target MAC address already has a session")
+	ErrSameMACAddress   = errors.New("session already belongs to this MAC address")
+)
+
+// TransferSession moves what's left of a session to another MAC address, for devices
+// that randomize their MAC address. Only the pubkey that purchased the session may transfer it.
+// A paused session stays paused under its new MAC address.
+func (v *Valve) TransferSession(oldMACAddress string, newMACAddress string, pubkey string) error {
+	if !utils.ValidateMACAddress(newMACAddress) {
+		return fmt.Errorf("%w: %s", ErrInvalidMAC, newMACAddress)
+	}
+	oldMACAddress = normalizeMAC(oldMACAddress)
+	newMACAddress = normalizeMAC(newMACAddress)
+	if oldMACAddress == newMACAddress {
+		return ErrSameMACAddress
+	}
+
+	v.sessionMutex.Lock()
+	defer v.sessionMutex.Unlock()
+	v.waitUntilSettled(oldMACAddress)
+	v.waitUntilSettled(newMACAddress)
+
+	session, err := v.ownedSession(oldMACAddress, pubkey)
+	if err != nil {
+		return err
+	}
+	if _, exists := v.store.Get(newMACAddress); exists {
+		return ErrTargetHasSession
+	}
+
+	now := time.Now()
+	running := !session.IsPaused()
+	if session.IsMetered() && running {
+		// Count the old MAC address' traffic before its counter is gone
+		if counted, err := v.countUsage(session); err == nil {
+			session = counted
+		} else {
+			log.Printf("Error reading traffic counter for MAC %s: %v", oldMACAddress, err)
+		}
+	}
+
+	switch {
+	case session.IsMetered() && session.RemainingBytes() == 0,
+		!session.IsMetered() && session.IsPaused() && session.Remaining <= 0,
+		!session.IsMetered() && running && !session.ExpiresAt.After(now):
+		return ErrNoTimeLeft
+	}
+
+	transferred := session
+	transferred.MACAddress = newMACAddress
+
+	if running {
+		if err := v.authorize(newMACAddress, session.RateLimit); err != nil {
+			return fmt.Errorf("error authorizing MAC: %w", err)
+		}
+		if session.IsMetered() {
+			status, err := v.gate.Status(newMACAddress)
+			if err != nil {
+				log.Printf("Error reading traffic counter for MAC %s: %v", newMACAddress, err)
+			}
+			transferred.CounterBytes = status.Bytes
+		}
+	}
+
+	if err := v.store.Save(transferred); err != nil {
+		// Keep the old session so the client doesn't lose what it paid for
+		if running {
+			v.gate.Deauthorize(newMACAddress)
+		}
+		return fmt.Errorf("error persisting transferred session: %w", err)
+	}
+	if err := v.store.Delete(oldMACAddress); err != nil {
+		log.Printf("Error removing session for MAC %s: %v", oldMACAddress, err)
+	}
+	delete(v.missingSince, oldMACAddress)
+
+	if running {
+		v.cancelExistingTimer(oldMACAddress)
+		if err := v.gate.Deauthorize(oldMACAddress); err != nil {
+			log.Printf("Error deauthorizing MAC %s, the reconciler will retry: %v", oldMACAddress, err)
+			v.failedDeauths[oldMACAddress] = now
+		}
+		if !session.IsMetered() {
+			v.armTimer(newMACAddress, session.ExpiresAt.Sub(now))
+		}
+	}
+
+	log.Printf("Transferred session from MAC %s to MAC %s with %s left", oldMACAddress, newMACAddress, describeRemaining(transferred))
+	v.bus.Publish(events.SessionTransferred{From: oldMACAddress, To: newMACAddress})
+	return nil
+}
@@ -3,19 +3,75 @@ package valve
 import (
 	"fmt"
 	"log"
-	"os/exec"
+	"net"
 	"sync"
 	"time"
-)
 
-// activeTimers keeps track of active timers for each MAC address
-var (
-	activeTimers = make(map[string]*time.Timer)
-	timerMutex   = &sync.Mutex{}
+	"github.com/OpenTollGate/tollgate-module-basic-go/src/events"
 )
 
+// Valve opens and closes the gate for paying clients
+type Valve struct {
+	gate  Gate
+	store *SessionStore
+	bus   *events.Bus
+
+	// sessionMutex serializes read-modify-write cycles on stored sessions
+	sessionMutex sync.Mutex
+	// ending holds the MAC addresses whose session EndSession is settling without holding
+	// sessionMutex. Changes to those sessions wait on endingDone. Guarded by sessionMutex.
+	ending     map[string]bool
+	endingDone *sync.Cond
+
+	// activeTimers keeps track of active timers for each MAC address
+	activeTimers map[string]*time.Timer
+	timerMutex   sync.Mutex
+
+	// failedDeauths holds MAC addresses whose session ended but couldn't be
+	// deauthorized, for the reconciler to retry. Guarded by sessionMutex.
+	failedDeauths map[string]time.Time
+	stats         ReconcileStats
+
+	// listStations and missingSince drive auto-pause of disassociated clients.
+	// missingSince is guarded by sessionMutex.
+	listStations stationLister
+	missingSince map[string]time.Time
+
+	// lookupIP resolves walled garden hosts. gardenAddresses holds the addresses
+	// each host resolved to and when it last did, gardenApplied the addresses handed
+	// to the gate at gardenAppliedAt once gardenSynced is set, all guarded by gardenMutex.
+	lookupIP        func(host string) ([]net.IP, error)
+	gardenMutex     sync.Mutex
+	gardenAddresses map[string]map[string]time.Time
+	gardenApplied   string
+	gardenAppliedAt time.Time
+	gardenSynced    bool
+}
+
+// New creates a valve that controls access through the given gate backend
+// and records sessions in store. Session lifecycle events are published on bus, which may be nil.
+func New(gate Gate, store *SessionStore, bus *events.Bus) *Valve {
+	v := &Valve{
+		gate:          gate,
+		store:         store,
+		bus:           bus,
+		ending:        make(map[string]bool),
+		activeTimers:  make(map[string]*time.Timer),
+		failedDeauths: make(map[string]time.Time),
+		listStations: func() (map[string]bool, error) {
+			return iwStations(runCommand)
+		},
+		missingSince:    make(map[string]time.Time),
+		lookupIP:        net.LookupIP,
+		gardenAddresses: make(map[string]map[string]time.Time),
+	}
+	v.endingDone = sync.NewCond(&v.sessionMutex)
+	return v
+}
+
 // OpenGate authorizes a MAC address for network access for a specified duration
-func OpenGate(macAddress string, durationSeconds int64) error {
+func (v *Valve) OpenGate(macAddress string, durationSeconds int64, payment Payment) error {
+	macAddress = normalizeMAC(macAddress)
 	var durationMinutes int = int(durationSeconds / 60)
 
 	// The minimum of this tollgate is 1 min, otherwise it would default to 24h
@@ -25,90 +81,474 @@ func OpenGate(macAddress string, durationSeconds int64) error {
 
 	log.Printf("Opening gate for %s for the duration of %d minute(s)", macAddress, durationMinutes)
 
+	v.sessionMutex.Lock()
+	defer v.sessionMutex.Unlock()
+	v.waitUntilSettled(macAddress)
+
 	// Check if there's already a timer for this MAC address
-	timerMutex.Lock()
-	_, timerExists := activeTimers[macAddress]
-	timerMutex.Unlock()
+	v.timerMutex.Lock()
+	_, timerExists := v.activeTimers[macAddress]
+	v.timerMutex.Unlock()
+
+	// A data-volume session keeps the client authorized without a timer,
+	// a paused session keeps it deauthorized
+	session, sessionExists := v.store.Get(macAddress)
+	paused := sessionExists && session.IsPaused()
+	meteredExists := sessionExists && session.IsMetered() && !paused
+	extended := sessionExists && (timerExists || (paused && !session.IsMetered()))
+	payment = keepPaidTier(session, payment, extended)
 
-	// Only authorize the MAC address if there's no existing timer
-	if !timerExists {
-		err := authorizeMAC(macAddress)
+	// Only authorize the MAC address if it isn't let through already
+	if !timerExists && !meteredExists {
+		err := v.authorize(macAddress, payment.RateLimit)
 		if err != nil {
 			return fmt.Errorf("error authorizing MAC: %w", err)
 		}
 		log.Printf("New authorization for MAC %s", macAddress)
 	} else {
 		log.Printf("Extending access for already authorized MAC %s", macAddress)
+		v.updateRateLimit(session, payment.RateLimit)
 	}
 
-	// Cancel any existing timers for this MAC address
-	cancelExistingTimer(macAddress)
-
-	// Set up a new timer for this MAC address
+	now := time.Now()
 	duration := time.Duration(durationSeconds) * time.Second
-	timer := time.AfterFunc(duration, func() {
-		err := deauthorizeMAC(macAddress)
+	if !extended {
+		// Buying time ends any data-volume session of the same client
+		session = Session{MACAddress: macAddress, Metric: MetricMilliseconds, StartedAt: now, Pubkey: payment.Pubkey}
+	}
+	if paused && extended {
+		// Paying for a paused session resumes it with the time it had left
+		log.Printf("Resuming paused session of MAC %s with %s left", macAddress, session.Remaining.Round(time.Second))
+		duration += session.Remaining
+		session = unpaused(session)
+	}
+	session.ExpiresAt = now.Add(duration)
+	session = addPayment(session, payment)
+
+	if err := v.store.Save(session); err != nil {
+		// The client paid, so keep the gate open even if the session can't be persisted
+		log.Printf("Error persisting session for MAC %s: %v", macAddress, err)
+	}
+
+	v.armTimer(macAddress, duration)
+
+	if extended {
+		v.bus.Publish(events.SessionExtended{
+			MACAddress: macAddress,
+			Metric:     MetricMilliseconds,
+			Duration:   duration,
+			Amount:     payment.Amount,
+			Mint:       payment.Mint,
+			EventID:    payment.EventID,
+		})
+	} else {
+		v.bus.Publish(events.SessionOpened{
+			MACAddress: macAddress,
+			Metric:     MetricMilliseconds,
+			Duration:   duration,
+			Amount:     payment.Amount,
+			Mint:       payment.Mint,
+			EventID:    payment.EventID,
+		})
+	}
+
+	return nil
+}
+
+// OpenGateForBytes authorizes a MAC address until it has used allowanceBytes of traffic.
+// Buying more while a data-volume session is running adds to its allowance.
+func (v *Valve) OpenGateForBytes(macAddress string, allowanceBytes uint64, payment Payment) error {
+	macAddress = normalizeMAC(macAddress)
+
+	log.Printf("Opening gate for %s for %d bytes", macAddress, allowanceBytes)
+
+	v.sessionMutex.Lock()
+	defer v.sessionMutex.Unlock()
+	v.waitUntilSettled(macAddress)
+
+	v.timerMutex.Lock()
+	_, timerExists := v.activeTimers[macAddress]
+	v.timerMutex.Unlock()
+
+	session, sessionExists := v.store.Get(macAddress)
+	extended := sessionExists && session.IsMetered()
+	payment = keepPaidTier(session, payment, extended)
+	if extended && session.IsPaused() {
+		// Paying for a paused session resumes it with the allowance it had left
+		err := v.authorize(macAddress, payment.RateLimit)
+		if err != nil {
+			return fmt.Errorf("error authorizing MAC: %w", err)
+		}
+		log.Printf("Resuming paused session of MAC %s with %d bytes left", macAddress, session.RemainingBytes())
+
+		status, err := v.gate.Status(macAddress)
 		if err != nil {
-			log.Printf("Error deauthorizing MAC %s after timeout: %v", macAddress, err)
+			log.Printf("Error reading traffic counter for MAC %s: %v", macAddress, err)
+		}
+		session = unpaused(session)
+		session.CounterBytes = status.Bytes
+	} else if extended {
+		log.Printf("Topping up data allowance for already authorized MAC %s", macAddress)
+		v.updateRateLimit(session, payment.RateLimit)
+	} else {
+		if timerExists {
+			// Buying data ends the time-based session of the same client
+			v.cancelExistingTimer(macAddress)
+			log.Printf("Switching MAC %s from a time-based to a data-volume session", macAddress)
+			v.updateRateLimit(session, payment.RateLimit)
 		} else {
-			log.Printf("Successfully deauthorized MAC %s after timeout of %d minutes", macAddress, durationMinutes)
+			err := v.authorize(macAddress, payment.RateLimit)
+			if err != nil {
+				return fmt.Errorf("error authorizing MAC: %w", err)
+			}
+			log.Printf("New authorization for MAC %s", macAddress)
 		}
 
-		// Remove the timer from the map once it's executed
-		timerMutex.Lock()
-		delete(activeTimers, macAddress)
-		timerMutex.Unlock()
-	})
+		// Usage is counted from the backend's current counter, which isn't reset
+		// for clients that were already authorized
+		status, err := v.gate.Status(macAddress)
+		if err != nil {
+			log.Printf("Error reading traffic counter for MAC %s: %v", macAddress, err)
+		}
+		session = Session{
+			MACAddress:   macAddress,
+			Metric:       MetricBytes,
+			StartedAt:    time.Now(),
+			CounterBytes: status.Bytes,
+			Pubkey:       payment.Pubkey,
+		}
+	}
 
-	// Store the timer in the map
-	timerMutex.Lock()
-	activeTimers[macAddress] = timer
-	timerMutex.Unlock()
+	session.AllowanceBytes += allowanceBytes
+	session = addPayment(session, payment)
+
+	if err := v.store.Save(session); err != nil {
+		// The client paid, so keep the gate open even if the session can't be persisted
+		log.Printf("Error persisting session for MAC %s: %v", macAddress, err)
+	}
+
+	if extended {
+		v.bus.Publish(events.SessionExtended{
+			MACAddress:     macAddress,
+			Metric:         MetricBytes,
+			AllowanceBytes: allowanceBytes,
+			Amount:         payment.Amount,
+			Mint:           payment.Mint,
+			EventID:        payment.EventID,
+		})
+	} else {
+		v.bus.Publish(events.SessionOpened{
+			MACAddress:     macAddress,
+			Metric:         MetricBytes,
+			AllowanceBytes: allowanceBytes,
+			Amount:         payment.Amount,
+			Mint:           payment.Mint,
+			EventID:        payment.EventID,
+		})
+	}
 
 	return nil
 }
 
-// cancelExistingTimer cancels any existing timer for the given MAC address
-func cancelExistingTimer(macAddress string) {
-	timerMutex.Lock()
-	defer timerMutex.Unlock()
+// keepPaidTier makes a voucher that extends a session keep the session's tier and rate limit
+func keepPaidTier(session Session, payment Payment, extended bool) Payment {
+	if payment.IsVoucher() && extended {
+		payment.Tier = session.Tier
+		payment.RateLimit = session.RateLimit
+	}
+	return payment
+}
 
-	if timer, exists := activeTimers[macAddress]; exists {
-		timer.Stop()
-		delete(activeTimers, macAddress)
-		log.Printf("Canceled existing timer for MAC %s", macAddress)
+// addPayment records a payment in its session. Vouchers are counted apart from what was paid,
+// so refunds never pay out their value, and leave the mint and purchase of the session as they were.
+func addPayment(session Session, payment Payment) Session {
+	if payment.IsVoucher() {
+		session.VoucherValue += payment.Amount
+	} else {
+		session.AmountPaid += payment.Amount
+		session.PaidSteps += payment.PaidSteps
+		session.Mint = payment.Mint
+		session.PurchaseEventID = payment.EventID
+	}
+	session.RateLimit = payment.RateLimit
+	session.Tier = payment.Tier
+	return session
+}
+
+// CheckRateLimit returns ErrRateLimitUnsupported if the gate backend can't enforce limit,
+// so tiers aren't sold with a bandwidth their clients don't get
+func (v *Valve) CheckRateLimit(limit RateLimit) error {
+	if limit.IsUnlimited() {
+		return nil
+	}
+	if rateLimiter, ok := v.gate.(RateLimiter); ok && rateLimiter.CanRateLimit() {
+		return nil
+	}
+	return ErrRateLimitUnsupported
+}
+
+// authorize grants network access to a MAC address, shaped to limit. Sessions sold with a limit
+// before the gate backend was changed to one that can't enforce it are let through unlimited.
+func (v *Valve) authorize(macAddress string, limit RateLimit) error {
+	if limit.IsUnlimited() {
+		return v.gate.Authorize(macAddress)
+	}
+	if err := v.CheckRateLimit(limit); err != nil {
+		log.Printf("Authorizing MAC %s without its rate limit: %v", macAddress, err)
+		return v.gate.Authorize(macAddress)
+	}
+	return v.gate.(RateLimiter).AuthorizeWithRateLimit(macAddress, limit)
+}
+
+// updateRateLimit applies a new rate limit to an open session when the client bought a different tier
+func (v *Valve) updateRateLimit(session Session, limit RateLimit) {
+	if session.RateLimit == limit {
+		return
+	}
+
+	rateLimiter, ok := v.gate.(RateLimiter)
+	if !ok || !rateLimiter.CanRateLimit() {
+		return
+	}
+	if err := rateLimiter.AuthorizeWithRateLimit(session.MACAddress, limit); err != nil {
+		log.Printf("Error changing rate limit of MAC %s: %v", session.MACAddress, err)
+	}
+}
+
+// StartUsageMonitor periodically adds up the traffic of data-volume sessions
+// and closes the gate for clients that used their allowance
+func (v *Valve) StartUsageMonitor(interval time.Duration) {
+	log.Printf("Starting usage monitor, checking every %s", interval)
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for range ticker.C {
+			v.checkUsage()
+		}
+	}()
+}
+
+// checkUsage reads the backend's traffic counter for every data-volume session once
+func (v *Valve) checkUsage() {
+	v.sessionMutex.Lock()
+	defer v.sessionMutex.Unlock()
+
+	for _, session := range v.store.All() {
+		if !session.IsMetered() || session.IsPaused() || v.ending[session.MACAddress] {
+			continue
+		}
+
+		session, err := v.countUsage(session)
+		if err != nil {
+			log.Printf("Error reading traffic counter for MAC %s: %v", session.MACAddress, err)
+			continue
+		}
+
+		if session.RemainingBytes() == 0 {
+			log.Printf("MAC %s used its allowance of %d bytes", session.MACAddress, session.AllowanceBytes)
+			v.closeSession(session.MACAddress, events.ReasonAllowance)
+			continue
+		}
+
+		if err := v.store.Save(session); err != nil {
+			log.Printf("Error persisting usage for MAC %s: %v", session.MACAddress, err)
+		}
 	}
 }
 
-// authorizeMAC authorizes a MAC address using ndsctl
-func authorizeMAC(macAddress string) error {
-	cmd := exec.Command("ndsctl", "auth", macAddress)
-	output, err := cmd.Output()
+// countUsage adds the traffic counted by the backend since the last check to a data-volume session
+func (v *Valve) countUsage(session Session) (Session, error) {
+	status, err := v.gate.Status(session.MACAddress)
 	if err != nil {
-		log.Printf("Error authorizing MAC address %s: %v", macAddress, err)
-		return err
+		return session, err
 	}
 
-	log.Printf("Authorization successful for MAC %s: %s", macAddress, string(output))
-	return nil
+	// A counter lower than last time was reset by the backend and counts from zero
+	delta := status.Bytes
+	if status.Bytes >= session.CounterBytes {
+		delta = status.Bytes - session.CounterBytes
+	}
+	session.UsedBytes += delta
+	session.CounterBytes = status.Bytes
+	return session, nil
 }
 
-// deauthorizeMAC deauthorizes a MAC address using ndsctl
-func deauthorizeMAC(macAddress string) error {
-	cmd := exec.Command("ndsctl", "deauth", macAddress)
-	output, err := cmd.Output()
+// waitUntilSettled waits until EndSession finished settling the session of macAddress.
+// The caller must hold sessionMutex, which is released while waiting.
+func (v *Valve) waitUntilSettled(macAddress string) {
+	for v.ending[macAddress] {
+		v.endingDone.Wait()
+	}
+}
+
+// closeSession deauthorizes a MAC address and removes its session. The caller must hold sessionMutex.
+func (v *Valve) closeSession(macAddress string, reason string) {
+	err := v.gate.Deauthorize(macAddress)
 	if err != nil {
-		log.Printf("Error deauthorizing MAC address %s: %v", macAddress, err)
-		return err
+		log.Printf("Error deauthorizing MAC %s, the reconciler will retry: %v", macAddress, err)
+		v.failedDeauths[macAddress] = time.Now()
+	} else {
+		log.Printf("Successfully deauthorized MAC %s", macAddress)
 	}
 
-	log.Printf("Deauthorization successful for MAC %s: %s", macAddress, string(output))
+	if err := v.store.Delete(macAddress); err != nil {
+		log.Printf("Error removing session for MAC %s: %v", macAddress, err)
+	}
+
+	v.bus.Publish(events.SessionExpired{MACAddress: macAddress, Reason: reason})
+}
+
+// Restore re-arms the timers of sessions persisted by a previous run of the daemon.
+// Sessions that expired while the daemon was down are closed immediately, and the
+// gate backend is reconciled so that exactly the clients with a running session are authorized.
+func (v *Valve) Restore() error {
+	v.sessionMutex.Lock()
+	defer v.sessionMutex.Unlock()
+
+	authorizedList, err := v.gate.List()
+	if err != nil {
+		return fmt.Errorf("failed to list authorized clients: %w", err)
+	}
+	authorized := make(map[string]bool, len(authorizedList))
+	for _, mac := range authorizedList {
+		authorized[normalizeMAC(mac)] = true
+	}
+
+	now := time.Now()
+	restored := make(map[string]bool)
+	for _, session := range v.store.All() {
+		macAddress := normalizeMAC(session.MACAddress)
+
+		// Paused sessions stay closed, the loop below deauthorizes them if needed
+		if session.IsPaused() {
+			log.Printf("Restored paused session for MAC %s", macAddress)
+			continue
+		}
+
+		if session.IsMetered() && session.RemainingBytes() == 0 {
+			log.Printf("Session for MAC %s has no data allowance left, closing gate", macAddress)
+			if authorized[macAddress] {
+				if err := v.gate.Deauthorize(macAddress); err != nil {
+					log.Printf("Error deauthorizing MAC %s: %v", macAddress, err)
+				}
+			}
+			if err := v.store.Delete(session.MACAddress); err != nil {
+				log.Printf("Error removing session for MAC %s: %v", macAddress, err)
+			}
+			v.bus.Publish(events.SessionExpired{MACAddress: macAddress, Reason: events.ReasonRestore})
+			continue
+		}
+
+		if !session.IsMetered() && !session.ExpiresAt.After(now) {
+			log.Printf("Session for MAC %s expired at %s while the valve was down, closing gate", macAddress, session.ExpiresAt.Format(time.RFC3339))
+			if authorized[macAddress] {
+				if err := v.gate.Deauthorize(macAddress); err != nil {
+					log.Printf("Error deauthorizing expired MAC %s: %v", macAddress, err)
+				}
+			}
+			if err := v.store.Delete(session.MACAddress); err != nil {
+				log.Printf("Error removing expired session for MAC %s: %v", macAddress, err)
+			}
+			v.bus.Publish(events.SessionExpired{MACAddress: macAddress, Reason: events.ReasonRestore})
+			continue
+		}
+
+		if !authorized[macAddress] {
+			if err := v.authorize(macAddress, session.RateLimit); err != nil {
+				log.Printf("Error re-authorizing MAC %s: %v", macAddress, err)
+				continue
+			}
+		}
+		restored[macAddress] = true
+
+		if session.IsMetered() {
+			// The backend counter may have been reset while the valve was down, so
+			// continue counting from its current value
+			if status, err := v.gate.Status(macAddress); err == nil {
+				session.CounterBytes = status.Bytes
+				if err := v.store.Save(session); err != nil {
+					log.Printf("Error persisting session for MAC %s: %v", macAddress, err)
+				}
+			}
+			log.Printf("Restored session for MAC %s with %d bytes remaining", macAddress, session.RemainingBytes())
+			continue
+		}
+
+		remaining := session.ExpiresAt.Sub(now)
+		v.armTimer(macAddress, remaining)
+		log.Printf("Restored session for MAC %s with %s remaining", macAddress, remaining.Round(time.Second))
+	}
+
+	for mac := range authorized {
+		if restored[mac] {
+			continue
+		}
+		log.Printf("MAC %s is authorized without a paid session, deauthorizing", mac)
+		if err := v.gate.Deauthorize(mac); err != nil {
+			log.Printf("Error deauthorizing MAC %s: %v", mac, err)
+		}
+	}
+
+	log.Printf("Restored %d session(s)", len(restored))
 	return nil
 }
 
+// armTimer (re)starts the timer that closes the gate for a MAC address once its session ends
+func (v *Valve) armTimer(macAddress string, duration time.Duration) {
+	v.timerMutex.Lock()
+	defer v.timerMutex.Unlock()
+
+	// Cancel any existing timer for this MAC address
+	if existing, exists := v.activeTimers[macAddress]; exists {
+		existing.Stop()
+		log.Printf("Canceled existing timer for MAC %s", macAddress)
+	}
+
+	// Set up a new timer for this MAC address. The map is updated while holding
+	// the lock, so the callback always sees its own timer unless it was replaced.
+	var timer *time.Timer
+	timer = time.AfterFunc(duration, func() {
+		v.sessionMutex.Lock()
+		defer v.sessionMutex.Unlock()
+		v.waitUntilSettled(macAddress)
+
+		// Remove the timer from the map once it's executed, unless it was replaced in the meantime
+		v.timerMutex.Lock()
+		if v.activeTimers[macAddress] != timer {
+			v.timerMutex.Unlock()
+			return
+		}
+		delete(v.activeTimers, macAddress)
+		v.timerMutex.Unlock()
+
+		log.Printf("Session of MAC %s timed out after %s", macAddress, duration.Round(time.Second))
+		v.closeSession(macAddress, events.ReasonTimeout)
+	})
+	v.activeTimers[macAddress] = timer
+}
+
+// cancelExistingTimer cancels any existing timer for the given MAC address
+func (v *Valve) cancelExistingTimer(macAddress string) {
+	v.timerMutex.Lock()
+	defer v.timerMutex.Unlock()
+
+	if timer, exists := v.activeTimers[macAddress]; exists {
+		timer.Stop()
+		delete(v.activeTimers, macAddress)
+		log.Printf("Canceled existing timer for MAC %s", macAddress)
+	}
+}
+
+// GetSession returns the session of a MAC address
+func (v *Valve) GetSession(macAddress string) (Session, bool) {
+	return v.store.Get(normalizeMAC(macAddress))
+}
+
 // GetActiveTimers returns the number of active timers for debugging
-func GetActiveTimers() int {
-	timerMutex.Lock()
-	defer timerMutex.Unlock()
-	return len(activeTimers)
+func (v *Valve) GetActiveTimers() int {
+	v.timerMutex.Lock()
+	defer v.timerMutex.Unlock()
+	return len(v.activeTimers)
 }
@@ -1,98 +1,1088 @@
 package valve
 
 import (
+	"errors"
 	"fmt"
-	"os"
-	"os/exec"
+	"net"
+	"path/filepath"
+	"sync/atomic"
 	"testing"
 	"time"
+
+	"github.com/OpenTollGate/tollgate-module-basic-go/src/events"
 )
 
-func TestMain(m *testing.M) {
-	if _, err := exec.LookPath("ndsctl"); err != nil {
-		fmt.Println("ndsctl not found, skipping tests")
-		os.Exit(0)
+// newTestValve creates a valve with a session store in a temporary directory
+func newTestValve(t *testing.T, gate Gate) *Valve {
+	t.Helper()
+	store, err := NewSessionStore(filepath.Join(t.TempDir(), "sessions.json"))
+	if err != nil {
+		t.Fatalf("Failed to create session store: %v", err)
 	}
-	m.Run()
+	return New(gate, store, nil)
 }
 
 func TestOpenGate(t *testing.T) {
+	gate := NewMemoryGate()
+	v := newTestValve(t, gate)
 	macAddress := "00:11:22:33:44:55"
 	durationSeconds := int64(1) // 1 second for quick testing
 
-	err := OpenGate(macAddress, durationSeconds)
+	err := v.OpenGate(macAddress, durationSeconds, Payment{})
 	if err != nil {
 		t.Errorf("OpenGate failed: %v", err)
 	}
 
-	timerMutex.Lock()
-	_, timerExists := activeTimers[macAddress]
-	timerMutex.Unlock()
+	v.timerMutex.Lock()
+	_, timerExists := v.activeTimers[macAddress]
+	v.timerMutex.Unlock()
 	if !timerExists {
 		t.Errorf("Timer was not set for MAC %s", macAddress)
 	}
 
+	status, _ := gate.Status(macAddress)
+	if !status.Authorized {
+		t.Errorf("MAC %s was not authorized on the gate", macAddress)
+	}
+
 	time.Sleep(time.Duration(durationSeconds+1) * time.Second)
 
-	timerMutex.Lock()
-	_, timerExists = activeTimers[macAddress]
-	timerMutex.Unlock()
+	v.timerMutex.Lock()
+	_, timerExists = v.activeTimers[macAddress]
+	v.timerMutex.Unlock()
 	if timerExists {
 		t.Errorf("Timer was not removed after expiration for MAC %s", macAddress)
 	}
+
+	status, _ = gate.Status(macAddress)
+	if status.Authorized {
+		t.Errorf("MAC %s was not deauthorized after expiration", macAddress)
+	}
 }
 
 func TestMultipleOpenGateCalls(t *testing.T) {
+	v := newTestValve(t, NewMemoryGate())
 	macAddress := "00:11:22:33:44:56"
 	durationSeconds := int64(2)
 
-	err := OpenGate(macAddress, durationSeconds)
+	err := v.OpenGate(macAddress, durationSeconds, Payment{})
 	if err != nil {
 		t.Errorf("First OpenGate call failed: %v", err)
 	}
 
-	err = OpenGate(macAddress, durationSeconds)
+	err = v.OpenGate(macAddress, durationSeconds, Payment{})
 	if err != nil {
 		t.Errorf("Second OpenGate call failed: %v", err)
 	}
 
-	timerMutex.Lock()
-	_, exists := activeTimers[macAddress]
-	timerMutex.Unlock()
+	v.timerMutex.Lock()
+	_, exists := v.activeTimers[macAddress]
+	v.timerMutex.Unlock()
 	if !exists {
 		t.Errorf("Timer was not reset for MAC %s", macAddress)
 	}
 
 	time.Sleep(time.Duration(durationSeconds+1) * time.Second)
 
-	timerMutex.Lock()
-	_, exists = activeTimers[macAddress]
-	timerMutex.Unlock()
+	v.timerMutex.Lock()
+	_, exists = v.activeTimers[macAddress]
+	v.timerMutex.Unlock()
 	if exists {
 		t.Errorf("Timer was not removed after expiration for MAC %s", macAddress)
 	}
 }
 
 func TestGetActiveTimers(t *testing.T) {
-	initialCount := GetActiveTimers()
+	v := newTestValve(t, NewMemoryGate())
+	initialCount := v.GetActiveTimers()
 
 	macAddress := "00:11:22:33:44:57"
 	durationSeconds := int64(1)
 
-	err := OpenGate(macAddress, durationSeconds)
+	err := v.OpenGate(macAddress, durationSeconds, Payment{})
 	if err != nil {
 		t.Errorf("OpenGate failed: %v", err)
 	}
 
-	newCount := GetActiveTimers()
+	newCount := v.GetActiveTimers()
 	if newCount != initialCount+1 {
 		t.Errorf("GetActiveTimers returned %d, expected %d", newCount, initialCount+1)
 	}
 
 	time.Sleep(time.Duration(durationSeconds+1) * time.Second)
 
-	finalCount := GetActiveTimers()
+	finalCount := v.GetActiveTimers()
 	if finalCount != initialCount {
 		t.Errorf("GetActiveTimers returned %d after timer expiration, expected %d", finalCount, initialCount)
 	}
 }
+
+func TestOpenGateAuthorizeFailure(t *testing.T) {
+	gate := NewNdsctlGate()
+	gate.run = func(name string, args ...string) ([]byte, error) {
+		return nil, fmt.Errorf("ndsctl not available")
+	}
+	v := newTestValve(t, gate)
+
+	err := v.OpenGate("00:11:22:33:44:58", 60, Payment{})
+	if err == nil {
+		t.Errorf("OpenGate succeeded although the gate backend failed")
+	}
+	if v.GetActiveTimers() != 0 {
+		t.Errorf("Timer was set although authorization failed")
+	}
+}
+
+func TestNewGate(t *testing.T) {
+	tests := []struct {
+		backend  string
+		expected string
+	}{
+		{"", "*valve.NdsctlGate"},
+		{BackendNdsctl, "*valve.NdsctlGate"},
+		{BackendOpenNDS, "*valve.OpenNDSGate"},
+		{BackendNftables, "*valve.NftablesGate"},
+		{BackendMemory, "*valve.MemoryGate"},
+	}
+
+	for _, tt := range tests {
+		gate, err := NewGate(GateOptions{Backend: tt.backend})
+		if err != nil {
+			t.Errorf("NewGate(%q) returned error: %v", tt.backend, err)
+			continue
+		}
+		if got := fmt.Sprintf("%T", gate); got != tt.expected {
+			t.Errorf("NewGate(%q) = %s, want %s", tt.backend, got, tt.expected)
+		}
+	}
+
+	if _, err := NewGate(GateOptions{Backend: "iptables"}); err == nil {
+		t.Errorf("NewGate accepted an unknown backend")
+	}
+}
+
+func TestNdsctlGateList(t *testing.T) {
+	output := `{
+"client_length": 2,
+"clients":{
+"AA:BB:CC:DD:EE:01":{"id":1,"ip":"192.168.1.10","mac":"AA:BB:CC:DD:EE:01","state":"Authenticated","downloaded":"1200","uploaded":300},
+"aa:bb:cc:dd:ee:02":{"id":2,"ip":"192.168.1.11","mac":"aa:bb:cc:dd:ee:02","state":"Preauthenticated"}
+}
+}`
+	gate := NewNdsctlGate()
+	gate.run = func(name string, args ...string) ([]byte, error) {
+		return []byte(output), nil
+	}
+
+	macAddresses, err := gate.List()
+	if err != nil {
+		t.Fatalf("List returned error: %v", err)
+	}
+	if len(macAddresses) != 1 || macAddresses[0] != "aa:bb:cc:dd:ee:01" {
+		t.Errorf("List returned %v, expected only the authenticated client", macAddresses)
+	}
+
+	status, err := gate.Status("aa:bb:cc:dd:ee:02")
+	if err != nil {
+		t.Fatalf("Status returned error: %v", err)
+	}
+	if status.Authorized {
+		t.Errorf("Preauthenticated client reported as authorized")
+	}
+
+	status, err = gate.Status("aa:bb:cc:dd:ee:01")
+	if err != nil {
+		t.Fatalf("Status returned error: %v", err)
+	}
+	if status.Bytes != 1500000 {
+		t.Errorf("Status reported %d bytes, expected 1500000", status.Bytes)
+	}
+}
+
+func TestNftablesGateList(t *testing.T) {
+	output := `{"nftables": [{"metainfo": {"version": "1.0.9"}}, {"set": {"family": "inet", "name": "tollgate_clients", "table": "fw4", "type": "ether_addr",
+"elem": ["aa:bb:cc:dd:ee:01", {"elem": {"val": "AA:BB:CC:DD:EE:02", "counter": {"packets": 10, "bytes": 1500}}}]}}]}`
+
+	var calls [][]string
+	gate := NewNftablesGate(GateOptions{})
+	gate.run = func(name string, args ...string) ([]byte, error) {
+		calls = append(calls, append([]string{name}, args...))
+		return []byte(output), nil
+	}
+
+	macAddresses, err := gate.List()
+	if err != nil {
+		t.Fatalf("List returned error: %v", err)
+	}
+	if len(macAddresses) != 2 || macAddresses[0] != "aa:bb:cc:dd:ee:01" || macAddresses[1] != "aa:bb:cc:dd:ee:02" {
+		t.Errorf("List returned %v", macAddresses)
+	}
+
+	if err := gate.Authorize("AA:BB:CC:DD:EE:03"); err != nil {
+		t.Fatalf("Authorize returned error: %v", err)
+	}
+	last := calls[len(calls)-1]
+	expected := []string{"nft", "add", "element", "inet", "fw4", "tollgate_clients", "{ aa:bb:cc:dd:ee:03 }"}
+	if fmt.Sprint(last) != fmt.Sprint(expected) {
+		t.Errorf("Authorize ran %v, expected %v", last, expected)
+	}
+}
+
+func TestSessionStorePersistence(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "sessions.json")
+	store, err := NewSessionStore(path)
+	if err != nil {
+		t.Fatalf("NewSessionStore returned error: %v", err)
+	}
+	v := New(NewMemoryGate(), store, nil)
+
+	macAddress := "00:11:22:33:44:59"
+	err = v.OpenGate(macAddress, 600, Payment{Amount: 10, Mint: "https://mint.example", EventID: "event1"})
+	if err != nil {
+		t.Fatalf("OpenGate failed: %v", err)
+	}
+
+	reopened, err := NewSessionStore(path)
+	if err != nil {
+		t.Fatalf("Reopening session store returned error: %v", err)
+	}
+	session, exists := reopened.Get(macAddress)
+	if !exists {
+		t.Fatalf("Session for %s was not persisted", macAddress)
+	}
+	if session.AmountPaid != 10 || session.Mint != "https://mint.example" || session.PurchaseEventID != "event1" {
+		t.Errorf("Persisted session does not match payment: %+v", session)
+	}
+	if remaining := time.Until(session.ExpiresAt); remaining < 590*time.Second || remaining > 600*time.Second {
+		t.Errorf("Persisted session expires in %s, expected about 10 minutes", remaining)
+	}
+
+	err = v.OpenGate(macAddress, 600, Payment{Amount: 5, Mint: "https://mint.example", EventID: "event2"})
+	if err != nil {
+		t.Fatalf("Extending session failed: %v", err)
+	}
+	session, _ = store.Get(macAddress)
+	if session.AmountPaid != 15 || session.PurchaseEventID != "event2" {
+		t.Errorf("Extended session was not updated: %+v", session)
+	}
+}
+
+func TestRestore(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "sessions.json")
+	store, err := NewSessionStore(path)
+	if err != nil {
+		t.Fatalf("NewSessionStore returned error: %v", err)
+	}
+
+	now := time.Now()
+	active := Session{MACAddress: "00:11:22:33:44:60", StartedAt: now.Add(-time.Minute), ExpiresAt: now.Add(time.Hour)}
+	expired := Session{MACAddress: "00:11:22:33:44:61", StartedAt: now.Add(-time.Hour), ExpiresAt: now.Add(-time.Minute)}
+	for _, session := range []Session{active, expired} {
+		if err := store.Save(session); err != nil {
+			t.Fatalf("Save returned error: %v", err)
+		}
+	}
+
+	gate := NewMemoryGate()
+	gate.Authorize(expired.MACAddress)
+	gate.Authorize("00:11:22:33:44:62") // authorized without a session
+
+	reopened, err := NewSessionStore(path)
+	if err != nil {
+		t.Fatalf("Reopening session store returned error: %v", err)
+	}
+	v := New(gate, reopened, nil)
+	if err := v.Restore(); err != nil {
+		t.Fatalf("Restore returned error: %v", err)
+	}
+
+	authorized, _ := gate.List()
+	if len(authorized) != 1 || authorized[0] != active.MACAddress {
+		t.Errorf("Gate has %v authorized after restore, expected only %s", authorized, active.MACAddress)
+	}
+	if v.GetActiveTimers() != 1 {
+		t.Errorf("Restore armed %d timers, expected 1", v.GetActiveTimers())
+	}
+	if _, exists := reopened.Get(expired.MACAddress); exists {
+		t.Errorf("Expired session was not removed from the store")
+	}
+}
+
+func TestOpenGateForBytes(t *testing.T) {
+	gate := NewMemoryGate()
+	v := newTestValve(t, gate)
+	macAddress := "00:11:22:33:44:63"
+
+	if err := v.OpenGateForBytes(macAddress, 1000, Payment{Amount: 1, Mint: "https://mint.example"}); err != nil {
+		t.Fatalf("OpenGateForBytes failed: %v", err)
+	}
+	if status, _ := gate.Status(macAddress); !status.Authorized {
+		t.Fatalf("MAC %s was not authorized on the gate", macAddress)
+	}
+	if v.GetActiveTimers() != 0 {
+		t.Errorf("Data-volume session armed a timer")
+	}
+
+	gate.SetBytes(macAddress, 600)
+	v.checkUsage()
+	session, _ := v.store.Get(macAddress)
+	if session.UsedBytes != 600 || session.RemainingBytes() != 400 {
+		t.Errorf("Session after 600 bytes: %+v", session)
+	}
+
+	// Top-ups add to the remaining allowance
+	if err := v.OpenGateForBytes(macAddress, 1000, Payment{Amount: 1, Mint: "https://mint.example"}); err != nil {
+		t.Fatalf("Topping up failed: %v", err)
+	}
+	session, _ = v.store.Get(macAddress)
+	if session.RemainingBytes() != 1400 || session.AmountPaid != 2 {
+		t.Errorf("Session after top-up: %+v", session)
+	}
+
+	// A counter reset by the backend counts from zero
+	gate.SetBytes(macAddress, 400)
+	v.checkUsage()
+	session, _ = v.store.Get(macAddress)
+	if session.UsedBytes != 1000 {
+		t.Errorf("Session used %d bytes after counter reset, expected 1000", session.UsedBytes)
+	}
+	if status, _ := gate.Status(macAddress); !status.Authorized {
+		t.Errorf("MAC %s was deauthorized before using its allowance", macAddress)
+	}
+
+	gate.SetBytes(macAddress, 1400)
+	v.checkUsage()
+	if status, _ := gate.Status(macAddress); status.Authorized {
+		t.Errorf("MAC %s was not deauthorized after using its allowance", macAddress)
+	}
+	if _, exists := v.store.Get(macAddress); exists {
+		t.Errorf("Session was not removed after using its allowance")
+	}
+}
+
+func TestOpenGateForBytesAfterTimeSession(t *testing.T) {
+	gate := NewMemoryGate()
+	v := newTestValve(t, gate)
+	macAddress := "00:11:22:33:44:64"
+
+	if err := v.OpenGate(macAddress, 600, Payment{}); err != nil {
+		t.Fatalf("OpenGate failed: %v", err)
+	}
+	gate.SetBytes(macAddress, 5000)
+
+	if err := v.OpenGateForBytes(macAddress, 1000, Payment{}); err != nil {
+		t.Fatalf("OpenGateForBytes failed: %v", err)
+	}
+	if v.GetActiveTimers() != 0 {
+		t.Errorf("Timer of the time-based session was not canceled")
+	}
+
+	// Traffic from before the data-volume session doesn't count towards it
+	v.checkUsage()
+	session, _ := v.store.Get(macAddress)
+	if !session.IsMetered() || session.UsedBytes != 0 {
+		t.Errorf("Session after switching to bytes: %+v", session)
+	}
+}
+
+func TestOpenGateRateLimit(t *testing.T) {
+	gate := NewMemoryGate()
+	v := newTestValve(t, gate)
+	macAddress := "00:11:22:33:44:65"
+	basic := RateLimit{DownloadKbps: 2000, UploadKbps: 1000}
+	fast := RateLimit{DownloadKbps: 20000, UploadKbps: 5000}
+
+	if err := v.OpenGate(macAddress, 600, Payment{Mint: "https://mint.example", RateLimit: basic}); err != nil {
+		t.Fatalf("OpenGate failed: %v", err)
+	}
+	if limit := gate.RateLimitOf(macAddress); limit != basic {
+		t.Errorf("Gate applied %+v, expected %+v", limit, basic)
+	}
+
+	// Extending with a different tier replaces the limit
+	if err := v.OpenGate(macAddress, 600, Payment{Mint: "https://mint.example", RateLimit: fast}); err != nil {
+		t.Fatalf("Extending failed: %v", err)
+	}
+	if limit := gate.RateLimitOf(macAddress); limit != fast {
+		t.Errorf("Gate applied %+v after upgrade, expected %+v", limit, fast)
+	}
+	if session, _ := v.store.Get(macAddress); session.RateLimit != fast {
+		t.Errorf("Session has rate limit %+v, expected %+v", session.RateLimit, fast)
+	}
+}
+
+func TestOpenGateVoucherKeepsPayment(t *testing.T) {
+	gate := NewMemoryGate()
+	v := newTestValve(t, gate)
+	macAddress := "00:11:22:33:44:6a"
+	fast := RateLimit{DownloadKbps: 20000, UploadKbps: 5000}
+
+	paid := Payment{Amount: 10, Mint: "https://mint.example", EventID: "event1", Tier: "fast", RateLimit: fast}
+	if err := v.OpenGate(macAddress, 600, paid); err != nil {
+		t.Fatalf("OpenGate failed: %v", err)
+	}
+
+	// A voucher of the default tier adds time to the paid session without changing what was paid
+	if err := v.OpenGate(macAddress, 600, Payment{Amount: 100}); err != nil {
+		t.Fatalf("Redeeming a voucher failed: %v", err)
+	}
+	session, _ := v.store.Get(macAddress)
+	if session.AmountPaid != 10 || session.VoucherValue != 100 || session.Mint != paid.Mint || session.PurchaseEventID != paid.EventID {
+		t.Errorf("Session after voucher: %+v", session)
+	}
+	if session.Tier != "fast" || session.RateLimit != fast || gate.RateLimitOf(macAddress) != fast {
+		t.Errorf("Voucher changed the tier to %q at %+v", session.Tier, gate.RateLimitOf(macAddress))
+	}
+}
+
+func TestOpenNDSGateRateLimit(t *testing.T) {
+	var calls [][]string
+	gate := NewOpenNDSGate()
+	gate.run = func(name string, args ...string) ([]byte, error) {
+		calls = append(calls, append([]string{name}, args...))
+		if args[0] == "json" {
+			return []byte(`{"clients":{}}`), nil
+		}
+		return nil, nil
+	}
+
+	if err := gate.AuthorizeWithRateLimit("aa:bb:cc:dd:ee:01", RateLimit{DownloadKbps: 2000, UploadKbps: 500}); err != nil {
+		t.Fatalf("AuthorizeWithRateLimit returned error: %v", err)
+	}
+	last := calls[len(calls)-1]
+	expected := []string{"ndsctl", "auth", "aa:bb:cc:dd:ee:01", "0", "500", "2000"}
+	if fmt.Sprint(last) != fmt.Sprint(expected) {
+		t.Errorf("AuthorizeWithRateLimit ran %v, expected %v", last, expected)
+	}
+}
+
+func TestNftablesGateRateLimit(t *testing.T) {
+	chain := `{"nftables": [{"chain": {"family": "inet", "table": "fw4", "name": "tollgate_shaping", "handle": 1}},
+{"rule": {"family": "inet", "table": "fw4", "chain": "tollgate_shaping", "handle": 7, "comment": "tollgate-aa:bb:cc:dd:ee:01"}},
+{"rule": {"family": "inet", "table": "fw4", "chain": "tollgate_shaping", "handle": 8, "comment": "tollgate-aa:bb:cc:dd:ee:02"}}]}`
+
+	var calls []string
+	gate := NewNftablesGate(GateOptions{NftShapingChain: "tollgate_shaping"})
+	gate.run = func(name string, args ...string) ([]byte, error) {
+		calls = append(calls, fmt.Sprint(append([]string{name}, args...)))
+		if args[0] == "-a" {
+			return []byte(chain), nil
+		}
+		return nil, nil
+	}
+
+	gate.readLeases = func() ([]byte, error) {
+		return []byte("1767225600 aa:bb:cc:dd:ee:01 192.168.1.12 phone *\n"), nil
+	}
+
+	if err := gate.AuthorizeWithRateLimit("AA:BB:CC:DD:EE:01", RateLimit{DownloadKbps: 2000, UploadKbps: 1000}); err != nil {
+		t.Fatalf("AuthorizeWithRateLimit returned error: %v", err)
+	}
+
+	expected := []string{
+		"[nft add element inet fw4 tollgate_clients { aa:bb:cc:dd:ee:01 }]",
+		"[nft -a -j list chain inet fw4 tollgate_shaping]",
+		"[nft delete rule inet fw4 tollgate_shaping handle 7]",
+		`[nft add rule inet fw4 tollgate_shaping ether saddr aa:bb:cc:dd:ee:01 limit rate over 125 kbytes/second drop comment "tollgate-aa:bb:cc:dd:ee:01"]`,
+		`[nft add rule inet fw4 tollgate_shaping ip daddr 192.168.1.12 limit rate over 250 kbytes/second drop comment "tollgate-aa:bb:cc:dd:ee:01"]`,
+	}
+	if fmt.Sprint(calls) != fmt.Sprint(expected) {
+		t.Errorf("AuthorizeWithRateLimit ran\n%v\nexpected\n%v", calls, expected)
+	}
+
+	// A client without a lease can't be limited by IP and isn't authorized unlimited either
+	calls = nil
+	if err := gate.AuthorizeWithRateLimit("aa:bb:cc:dd:ee:03", RateLimit{DownloadKbps: 2000}); err == nil {
+		t.Errorf("AuthorizeWithRateLimit of a MAC without a DHCP lease succeeded")
+	}
+	if len(calls) != 0 {
+		t.Errorf("AuthorizeWithRateLimit of a MAC without a DHCP lease ran %v", calls)
+	}
+}
+
+func TestCheckRateLimit(t *testing.T) {
+	limit := RateLimit{DownloadKbps: 2000}
+	tests := []struct {
+		name      string
+		gate      Gate
+		supported bool
+	}{
+		{"nodogsplash", NewNdsctlGate(), false},
+		{"openNDS", NewOpenNDSGate(), true},
+		{"nftables without shaping chain", NewNftablesGate(GateOptions{}), false},
+		{"nftables with shaping chain", NewNftablesGate(GateOptions{NftShapingChain: "tollgate_shaping"}), true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			v := New(tt.gate, nil, nil)
+			if err := v.CheckRateLimit(RateLimit{}); err != nil {
+				t.Errorf("CheckRateLimit of no limit returned %v", err)
+			}
+			err := v.CheckRateLimit(limit)
+			if tt.supported && err != nil {
+				t.Errorf("CheckRateLimit returned %v, expected the limit to be supported", err)
+			}
+			if !tt.supported && !errors.Is(err, ErrRateLimitUnsupported) {
+				t.Errorf("CheckRateLimit returned %v, expected ErrRateLimitUnsupported", err)
+			}
+		})
+	}
+}
+
+// failingDeauthGate is a MemoryGate whose Deauthorize fails while failDeauth is set
+type failingDeauthGate struct {
+	*MemoryGate
+	failDeauth atomic.Bool
+}
+
+func (g *failingDeauthGate) Deauthorize(macAddress string) error {
+	if g.failDeauth.Load() {
+		return fmt.Errorf("ndsctl unavailable")
+	}
+	return g.MemoryGate.Deauthorize(macAddress)
+}
+
+func TestReconcile(t *testing.T) {
+	gate := &failingDeauthGate{MemoryGate: NewMemoryGate()}
+	gate.failDeauth.Store(true)
+	v := newTestValve(t, gate)
+
+	expiring := "00:11:22:33:44:66"
+	running := "00:11:22:33:44:67"
+	unknown := "00:11:22:33:44:68"
+
+	if err := v.OpenGate(expiring, 0, Payment{}); err != nil {
+		t.Fatalf("OpenGate failed: %v", err)
+	}
+	if err := v.OpenGate(running, 600, Payment{}); err != nil {
+		t.Fatalf("OpenGate failed: %v", err)
+	}
+	gate.Authorize(unknown)
+	gate.MemoryGate.Deauthorize(running) // lost by the backend, e.g. after a restart
+
+	// The expiring session's deauthorization fails when its timer fires
+	time.Sleep(100 * time.Millisecond)
+	if status, _ := gate.Status(expiring); !status.Authorized {
+		t.Fatalf("Expected failed deauthorization to leave MAC %s authorized", expiring)
+	}
+
+	bus := events.NewBus()
+	discrepancies := make(chan events.ReconcileDiscrepancy, 10)
+	events.Subscribe(bus, "test", func(event events.ReconcileDiscrepancy) { discrepancies <- event })
+	v.sessionMutex.Lock()
+	v.bus = bus
+	v.sessionMutex.Unlock()
+
+	gate.failDeauth.Store(false)
+	v.Reconcile()
+
+	authorized, _ := gate.List()
+	if len(authorized) != 1 || authorized[0] != running {
+		t.Errorf("Gate has %v authorized after reconciling, expected only %s", authorized, running)
+	}
+
+	stats := v.ReconcileStats()
+	if stats.Runs != 1 || stats.RetriedDeauths != 1 || stats.UnknownClients != 1 || stats.MissingClients != 1 {
+		t.Errorf("Unexpected reconcile stats: %+v", stats)
+	}
+
+	found := make(map[string]string)
+	for len(found) < 3 {
+		select {
+		case event := <-discrepancies:
+			found[event.Kind] = event.MACAddress
+		case <-time.After(time.Second):
+			t.Fatalf("Received discrepancies %v, expected three", found)
+		}
+	}
+	if found[events.DiscrepancyRetriedDeauth] != expiring || found[events.DiscrepancyUnknownClient] != unknown || found[events.DiscrepancyMissingClient] != running {
+		t.Errorf("Received discrepancies %v", found)
+	}
+
+	// A second run finds nothing to fix
+	v.Reconcile()
+	if again := v.ReconcileStats(); again.RetriedDeauths != 1 || again.UnknownClients != 1 || again.MissingClients != 1 {
+		t.Errorf("Second run changed stats: %+v", again)
+	}
+}
+
+func TestSessionEvents(t *testing.T) {
+	store, err := NewSessionStore(filepath.Join(t.TempDir(), "sessions.json"))
+	if err != nil {
+		t.Fatalf("Failed to create session store: %v", err)
+	}
+	bus := events.NewBus()
+	received := make(chan any, 3)
+	events.Subscribe(bus, "test", func(event events.SessionOpened) { received <- event })
+	events.Subscribe(bus, "test", func(event events.SessionExtended) { received <- event })
+	events.Subscribe(bus, "test", func(event events.SessionExpired) { received <- event })
+
+	v := New(NewMemoryGate(), store, bus)
+	macAddress := "00:11:22:33:44:69"
+	if err := v.OpenGateForBytes(macAddress, 1000, Payment{Amount: 1}); err != nil {
+		t.Fatalf("OpenGateForBytes failed: %v", err)
+	}
+	if err := v.OpenGateForBytes(macAddress, 1000, Payment{Amount: 1}); err != nil {
+		t.Fatalf("OpenGateForBytes failed: %v", err)
+	}
+	v.gate.(*MemoryGate).SetBytes(macAddress, 2000)
+	v.checkUsage()
+
+	// Each event type has its own subscriber, so they may arrive in any order
+	seen := make(map[string]bool)
+	for range 3 {
+		select {
+		case event := <-received:
+			seen[fmt.Sprintf("%T", event)] = true
+		case <-time.After(time.Second):
+			t.Fatalf("Timed out waiting for events, received %v", seen)
+		}
+	}
+	for _, name := range []string{"events.SessionOpened", "events.SessionExtended", "events.SessionExpired"} {
+		if !seen[name] {
+			t.Errorf("Did not receive %s", name)
+		}
+	}
+}
+
+func TestPauseAndResumeSession(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "sessions.json")
+	store, err := NewSessionStore(path)
+	if err != nil {
+		t.Fatalf("NewSessionStore returned error: %v", err)
+	}
+	gate := NewMemoryGate()
+	v := New(gate, store, nil)
+	macAddress := "00:11:22:33:44:70"
+	owner := "owner-pubkey"
+
+	if err := v.OpenGate(macAddress, 600, Payment{Pubkey: owner}); err != nil {
+		t.Fatalf("OpenGate failed: %v", err)
+	}
+
+	if err := v.PauseSession(macAddress, "someone-else"); !errors.Is(err, ErrNotOwner) {
+		t.Errorf("Pausing with another pubkey returned %v, expected ErrNotOwner", err)
+	}
+	if err := v.ResumeSession(macAddress, owner); !errors.Is(err, ErrSessionNotPaused) {
+		t.Errorf("Resuming a running session returned %v, expected ErrSessionNotPaused", err)
+	}
+
+	if err := v.PauseSession(macAddress, owner); err != nil {
+		t.Fatalf("PauseSession failed: %v", err)
+	}
+	if status, _ := gate.Status(macAddress); status.Authorized {
+		t.Errorf("MAC %s is still authorized after pausing", macAddress)
+	}
+	if v.GetActiveTimers() != 0 {
+		t.Errorf("Timer is still running after pausing")
+	}
+
+	// The paused session survives a restart
+	reopened, err := NewSessionStore(path)
+	if err != nil {
+		t.Fatalf("Reopening session store returned error: %v", err)
+	}
+	v = New(gate, reopened, nil)
+	if err := v.Restore(); err != nil {
+		t.Fatalf("Restore returned error: %v", err)
+	}
+	session, _ := reopened.Get(macAddress)
+	if !session.IsPaused() || session.Remaining < 590*time.Second || session.Remaining > 600*time.Second {
+		t.Fatalf("Restored session is not paused with about 10 minutes left: %+v", session)
+	}
+
+	if err := v.ResumeSession(macAddress, owner); err != nil {
+		t.Fatalf("ResumeSession failed: %v", err)
+	}
+	if status, _ := gate.Status(macAddress); !status.Authorized {
+		t.Errorf("MAC %s is not authorized after resuming", macAddress)
+	}
+	session, _ = reopened.Get(macAddress)
+	if session.IsPaused() || time.Until(session.ExpiresAt) < 590*time.Second {
+		t.Errorf("Resumed session did not keep its remaining time: %+v", session)
+	}
+	if v.GetActiveTimers() != 1 {
+		t.Errorf("Resumed session has no timer")
+	}
+}
+
+func TestAutoPause(t *testing.T) {
+	gate := NewMemoryGate()
+	v := newTestValve(t, gate)
+	macAddress := "00:11:22:33:44:71"
+	associated := true
+	v.listStations = func() (map[string]bool, error) {
+		return map[string]bool{macAddress: associated}, nil
+	}
+
+	if err := v.OpenGate(macAddress, 600, Payment{}); err != nil {
+		t.Fatalf("OpenGate failed: %v", err)
+	}
+
+	v.checkAssociations(0)
+	associated = false
+	v.checkAssociations(0) // first seen missing
+	if session, _ := v.store.Get(macAddress); session.IsPaused() {
+		t.Fatalf("Session was paused on the first check without the client")
+	}
+	v.checkAssociations(0)
+	session, _ := v.store.Get(macAddress)
+	if !session.IsPaused() || session.PauseReason != PauseReasonDisassociated {
+		t.Fatalf("Session of disassociated client was not paused: %+v", session)
+	}
+
+	associated = true
+	v.checkAssociations(0)
+	if session, _ := v.store.Get(macAddress); session.IsPaused() {
+		t.Errorf("Session was not resumed when the client came back")
+	}
+	if status, _ := gate.Status(macAddress); !status.Authorized {
+		t.Errorf("MAC %s is not authorized after coming back", macAddress)
+	}
+}
+
+func TestParseIwOutput(t *testing.T) {
+	devices := `phy#1
+	Interface phy1-sta0
+		ifindex 12
+		type managed
+phy#0
+	Interface phy0-ap0
+		ifindex 11
+		addr 94:83:c4:00:00:01
+		type AP
+`
+	interfaces := parseIwAPInterfaces([]byte(devices))
+	if len(interfaces) != 1 || interfaces[0] != "phy0-ap0" {
+		t.Errorf("parseIwAPInterfaces returned %v, expected [phy0-ap0]", interfaces)
+	}
+
+	dump := `Station AA:BB:CC:DD:EE:01 (on phy0-ap0)
+	inactive time:	120 ms
+	rx bytes:	123456
+Station aa:bb:cc:dd:ee:02 (on phy0-ap0)
+	inactive time:	10 ms
+`
+	stations := parseIwStations([]byte(dump))
+	if len(stations) != 2 || stations[0] != "aa:bb:cc:dd:ee:01" || stations[1] != "aa:bb:cc:dd:ee:02" {
+		t.Errorf("parseIwStations returned %v", stations)
+	}
+}
+
+func TestTransferSession(t *testing.T) {
+	gate := NewMemoryGate()
+	v := newTestValve(t, gate)
+	oldMAC := "00:11:22:33:44:72"
+	newMAC := "00:11:22:33:44:73"
+	owner := "owner-pubkey"
+
+	if err := v.OpenGate(oldMAC, 600, Payment{Amount: 10, Mint: "https://mint.example", Pubkey: owner}); err != nil {
+		t.Fatalf("OpenGate failed: %v", err)
+	}
+
+	if err := v.TransferSession(oldMAC, "not-a-mac", owner); !errors.Is(err, ErrInvalidMAC) {
+		t.Errorf("Transfer to an invalid MAC returned %v, expected ErrInvalidMAC", err)
+	}
+	if err := v.TransferSession(oldMAC, newMAC, "someone-else"); !errors.Is(err, ErrNotOwner) {
+		t.Errorf("Transfer by another pubkey returned %v, expected ErrNotOwner", err)
+	}
+
+	if err := v.TransferSession(oldMAC, newMAC, owner); err != nil {
+		t.Fatalf("TransferSession failed: %v", err)
+	}
+
+	authorized, _ := gate.List()
+	if len(authorized) != 1 || authorized[0] != newMAC {
+		t.Errorf("Gate has %v authorized after transfer, expected only %s", authorized, newMAC)
+	}
+	if _, exists := v.store.Get(oldMAC); exists {
+		t.Errorf("Old session still exists after transfer")
+	}
+	session, exists := v.store.Get(newMAC)
+	if !exists || session.AmountPaid != 10 || session.Pubkey != owner || time.Until(session.ExpiresAt) < 590*time.Second {
+		t.Errorf("Transferred session does not match the original: %+v", session)
+	}
+
+	v.timerMutex.Lock()
+	_, oldTimer := v.activeTimers[oldMAC]
+	_, newTimer := v.activeTimers[newMAC]
+	v.timerMutex.Unlock()
+	if oldTimer || !newTimer {
+		t.Errorf("Timer was not moved to the new MAC address")
+	}
+}
+
+func TestTransferSessionWithoutTimeLeft(t *testing.T) {
+	gate := NewMemoryGate()
+	v := newTestValve(t, gate)
+	oldMAC := "00:11:22:33:44:74"
+	owner := "owner-pubkey"
+
+	if err := v.OpenGateForBytes(oldMAC, 1000, Payment{Pubkey: owner}); err != nil {
+		t.Fatalf("OpenGateForBytes failed: %v", err)
+	}
+	gate.SetBytes(oldMAC, 1000)
+
+	if err := v.TransferSession(oldMAC, "00:11:22:33:44:75", owner); !errors.Is(err, ErrNoTimeLeft) {
+		t.Errorf("Transferring a used up session returned %v, expected ErrNoTimeLeft", err)
+	}
+}
+
+func TestWalledGarden(t *testing.T) {
+	gate := NewMemoryGate()
+	v := newTestValve(t, gate)
+
+	mintAddresses := []net.IP{net.ParseIP("203.0.113.10"), net.ParseIP("2001:db8::10")}
+	failing := false
+	v.lookupIP = func(host string) ([]net.IP, error) {
+		switch {
+		case host == "mint.example.com" && !failing:
+			return mintAddresses, nil
+		case host == "lnurl.example.com":
+			return []net.IP{net.ParseIP("203.0.113.20"), net.ParseIP("203.0.113.10")}, nil
+		}
+		return nil, fmt.Errorf("no such host")
+	}
+
+	hosts := []string{"mint.example.com", "LNURL.example.com", "198.51.100.1", "unknown.example.com"}
+	if err := v.RefreshWalledGarden(hosts); err != nil {
+		t.Fatalf("RefreshWalledGarden failed: %v", err)
+	}
+	expected := "198.51.100.1,2001:db8::10,203.0.113.10,203.0.113.20"
+	if allowed := addressKey(gate.AllowedAddresses()); allowed != expected {
+		t.Errorf("Walled garden is %s, expected %s", allowed, expected)
+	}
+
+	// A host that stops resolving keeps its last addresses
+	failing = true
+	if err := v.RefreshWalledGarden(hosts); err != nil {
+		t.Fatalf("RefreshWalledGarden failed: %v", err)
+	}
+	if allowed := addressKey(gate.AllowedAddresses()); allowed != expected {
+		t.Errorf("Walled garden is %s after a failed lookup, expected %s", allowed, expected)
+	}
+
+	// A mint that moves keeps its old address, and the change waits for gardenApplyInterval
+	failing = false
+	mintAddresses = []net.IP{net.ParseIP("203.0.113.11")}
+	if err := v.RefreshWalledGarden(hosts); err != nil {
+		t.Fatalf("RefreshWalledGarden failed: %v", err)
+	}
+	if allowed := addressKey(gate.AllowedAddresses()); allowed != expected {
+		t.Errorf("Walled garden is %s right after the last update, expected %s", allowed, expected)
+	}
+	v.gardenAppliedAt = v.gardenAppliedAt.Add(-gardenApplyInterval)
+	if err := v.RefreshWalledGarden(hosts); err != nil {
+		t.Fatalf("RefreshWalledGarden failed: %v", err)
+	}
+	expected = "198.51.100.1,2001:db8::10,203.0.113.10,203.0.113.11,203.0.113.20"
+	if allowed := addressKey(gate.AllowedAddresses()); allowed != expected {
+		t.Errorf("Walled garden is %s after the mint moved, expected %s", allowed, expected)
+	}
+
+	// Addresses the mint stopped resolving to expire after gardenAddressTTL
+	v.gardenAddresses["mint.example.com"]["2001:db8::10"] = time.Now().Add(-gardenAddressTTL - time.Minute)
+	v.gardenAppliedAt = v.gardenAppliedAt.Add(-gardenApplyInterval)
+	if err := v.RefreshWalledGarden(hosts); err != nil {
+		t.Fatalf("RefreshWalledGarden failed: %v", err)
+	}
+	expected = "198.51.100.1,203.0.113.10,203.0.113.11,203.0.113.20"
+	if allowed := addressKey(gate.AllowedAddresses()); allowed != expected {
+		t.Errorf("Walled garden is %s after an address expired, expected %s", allowed, expected)
+	}
+
+	// A new host without an applied address is let through right away
+	if err := v.RefreshWalledGarden(append(hosts, "203.0.113.30")); err != nil {
+		t.Fatalf("RefreshWalledGarden failed: %v", err)
+	}
+	expected = "198.51.100.1,203.0.113.10,203.0.113.11,203.0.113.20,203.0.113.30"
+	if allowed := addressKey(gate.AllowedAddresses()); allowed != expected {
+		t.Errorf("Walled garden is %s after adding a host, expected %s", allowed, expected)
+	}
+
+	// Removing a mint removes its addresses
+	v.gardenAppliedAt = v.gardenAppliedAt.Add(-gardenApplyInterval)
+	if err := v.RefreshWalledGarden([]string{"lnurl.example.com"}); err != nil {
+		t.Fatalf("RefreshWalledGarden failed: %v", err)
+	}
+	expected = "203.0.113.10,203.0.113.20"
+	if allowed := addressKey(gate.AllowedAddresses()); allowed != expected {
+		t.Errorf("Walled garden is %s after removing a mint, expected %s", allowed, expected)
+	}
+}
+
+func TestNftablesGateWalledGarden(t *testing.T) {
+	var calls []string
+	gate := NewNftablesGate(GateOptions{})
+	gate.run = func(name string, args ...string) ([]byte, error) {
+		calls = append(calls, fmt.Sprint(append([]string{name}, args...)))
+		return nil, nil
+	}
+
+	addresses := []net.IP{net.ParseIP("203.0.113.10"), net.ParseIP("203.0.113.20"), net.ParseIP("2001:db8::10")}
+	if err := gate.SetAllowedAddresses(addresses); err != nil {
+		t.Fatalf("SetAllowedAddresses returned error: %v", err)
+	}
+
+	expected := []string{
+		"[nft flush set inet fw4 tollgate_walled_garden_v4]",
+		"[nft add element inet fw4 tollgate_walled_garden_v4 { 203.0.113.10, 203.0.113.20 }]",
+		"[nft flush set inet fw4 tollgate_walled_garden_v6]",
+		"[nft add element inet fw4 tollgate_walled_garden_v6 { 2001:db8::10 }]",
+	}
+	if fmt.Sprint(calls) != fmt.Sprint(expected) {
+		t.Errorf("SetAllowedAddresses ran\n%v\nexpected\n%v", calls, expected)
+	}
+}
+
+func TestNdsctlGateWalledGarden(t *testing.T) {
+	show := "nodogsplash.cfg01.preauthenticated_users='allow tcp port 53' 'allow tcp port 443 to 203.0.113.99'\n"
+
+	var calls []string
+	gate := NewNdsctlGate()
+	gate.run = func(name string, args ...string) ([]byte, error) {
+		calls = append(calls, fmt.Sprint(append([]string{name}, args...)))
+		if len(args) > 1 && args[1] == "show" {
+			return []byte(show), nil
+		}
+		return nil, nil
+	}
+
+	addresses := []net.IP{net.ParseIP("203.0.113.10"), net.ParseIP("2001:db8::10")}
+	if err := gate.SetAllowedAddresses(addresses); err != nil {
+		t.Fatalf("SetAllowedAddresses returned error: %v", err)
+	}
+
+	fill := []string{
+		"[ipset -exist create tollgate_walled_garden hash:ip family inet]",
+		"[ipset -exist create tollgate_walled_garden_new hash:ip family inet]",
+		"[ipset flush tollgate_walled_garden_new]",
+		"[ipset -exist add tollgate_walled_garden_new 203.0.113.10]",
+		"[ipset swap tollgate_walled_garden_new tollgate_walled_garden]",
+		"[ipset destroy tollgate_walled_garden_new]",
+		"[uci -q show nodogsplash.@nodogsplash[0].preauthenticated_users]",
+	}
+	expected := append(fill,
+		"[uci -q delete nodogsplash.@nodogsplash[0].preauthenticated_users]",
+		"[uci add_list nodogsplash.@nodogsplash[0].preauthenticated_users=allow tcp port 53]",
+		"[uci add_list nodogsplash.@nodogsplash[0].preauthenticated_users=allow tcp port 80 ipset tollgate_walled_garden]",
+		"[uci add_list nodogsplash.@nodogsplash[0].preauthenticated_users=allow tcp port 443 ipset tollgate_walled_garden]",
+		"[uci commit nodogsplash]",
+		"[/etc/init.d/nodogsplash restart]",
+		"[ndsctl json]",
+	)
+	if fmt.Sprint(calls) != fmt.Sprint(expected) {
+		t.Errorf("SetAllowedAddresses ran\n%v\nexpected\n%v", calls, expected)
+	}
+
+	// Once the rules are installed, changed addresses only refill the ipset and don't restart nodogsplash
+	show = "nodogsplash.cfg01.preauthenticated_users='allow tcp port 53' 'allow tcp port 80 ipset tollgate_walled_garden' 'allow tcp port 443 ipset tollgate_walled_garden'\n"
+	calls = nil
+	if err := gate.SetAllowedAddresses(addresses); err != nil {
+		t.Fatalf("SetAllowedAddresses returned error: %v", err)
+	}
+	if fmt.Sprint(calls) != fmt.Sprint(fill) {
+		t.Errorf("SetAllowedAddresses with installed rules ran\n%v\nexpected\n%v", calls, fill)
+	}
+}
+
+func TestEndSession(t *testing.T) {
+	gate := NewMemoryGate()
+	v := newTestValve(t, gate)
+	macAddress := "00:11:22:33:44:74"
+	owner := "owner-pubkey"
+
+	if err := v.OpenGate(macAddress, 600, Payment{Pubkey: owner}); err != nil {
+		t.Fatalf("OpenGate failed: %v", err)
+	}
+
+	// A failing settlement keeps the session
+	settleErr := fmt.Errorf("mint unreachable")
+	err := v.EndSession(macAddress, owner, events.ReasonRefund, func(Session) error { return settleErr })
+	if !errors.Is(err, settleErr) {
+		t.Errorf("EndSession returned %v, expected the settlement error", err)
+	}
+	if status, _ := gate.Status(macAddress); !status.Authorized {
+		t.Errorf("MAC %s lost its session after a failed settlement", macAddress)
+	}
+
+	err = v.EndSession(macAddress, "someone-else", events.ReasonRefund, func(Session) error { return nil })
+	if !errors.Is(err, ErrNotOwner) {
+		t.Errorf("Ending with another pubkey returned %v, expected ErrNotOwner", err)
+	}
+
+	var settled Session
+	err = v.EndSession(macAddress, owner, events.ReasonRefund, func(session Session) error {
+		settled = session
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("EndSession failed: %v", err)
+	}
+	if settled.Remaining < 590*time.Second || settled.Remaining > 600*time.Second {
+		t.Errorf("Settled session has %s left, expected about 10 minutes", settled.Remaining)
+	}
+	if status, _ := gate.Status(macAddress); status.Authorized {
+		t.Errorf("MAC %s is still authorized after ending its session", macAddress)
+	}
+	if _, exists := v.store.Get(macAddress); exists {
+		t.Errorf("Session of MAC %s still exists after ending it", macAddress)
+	}
+	if v.GetActiveTimers() != 0 {
+		t.Errorf("Timer is still running after ending the session")
+	}
+}
+
+func TestEndSessionSettlesUnlocked(t *testing.T) {
+	gate := NewMemoryGate()
+	v := newTestValve(t, gate)
+	macAddress := "00:11:22:33:44:75"
+	owner := "owner-pubkey"
+
+	if err := v.OpenGate(macAddress, 600, Payment{Pubkey: owner, Mint: "https://mint.example"}); err != nil {
+		t.Fatalf("OpenGate failed: %v", err)
+	}
+
+	settling := make(chan struct{})
+	release := make(chan struct{})
+	ended := make(chan error)
+	go func() {
+		ended <- v.EndSession(macAddress, owner, events.ReasonRefund, func(Session) error {
+			close(settling)
+			<-release
+			return nil
+		})
+	}()
+	<-settling
+
+	// Other sessions can change while a settlement is in progress
+	if err := v.OpenGate("00:11:22:33:44:76", 600, Payment{Mint: "https://mint.example"}); err != nil {
+		t.Fatalf("OpenGate of another MAC failed during a settlement: %v", err)
+	}
+
+	// A payment for the ending session waits until it is closed and opens a new one
+	extended := make(chan error)
+	go func() {
+		extended <- v.OpenGate(macAddress, 300, Payment{Pubkey: owner, Mint: "https://mint.example"})
+	}()
+	select {
+	case err := <-extended:
+		t.Fatalf("OpenGate of the ending session returned %v before the settlement finished", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	close(release)
+	if err := <-ended; err != nil {
+		t.Fatalf("EndSession failed: %v", err)
+	}
+	if err := <-extended; err != nil {
+		t.Fatalf("OpenGate failed after the settlement: %v", err)
+	}
+	session, _ := v.GetSession(macAddress)
+	if remaining := time.Until(session.ExpiresAt); remaining > 300*time.Second {
+		t.Errorf("New session has %s left, expected at most 5 minutes", remaining)
+	}
+	if status, _ := gate.Status(macAddress); !status.Authorized {
+		t.Errorf("MAC %s is not authorized after paying again", macAddress)
+	}
+}
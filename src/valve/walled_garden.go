@@ -0,0 +1,170 @@
+package valve
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"sort"
+	"strings"
+	"time"
+)
+
+// StartWalledGarden periodically resolves the hosts unauthorized clients need to reach
+// to pay, such as mints and LNURL services, and lets them through the gate.
+// hosts is called on every refresh so changes to the mint list are picked up.
+func (v *Valve) StartWalledGarden(hosts func() []string, interval time.Duration) {
+	if _, ok := v.gate.(Allowlist); !ok {
+		log.Printf("Gate backend doesn't support a walled garden, unpaid clients can't reach mints")
+		return
+	}
+	log.Printf("Starting walled garden, resolving hosts every %s", interval)
+
+	go func() {
+		if err := v.RefreshWalledGarden(hosts()); err != nil {
+			log.Printf("Error refreshing walled garden: %v", err)
+		}
+
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for range ticker.C {
+			if err := v.RefreshWalledGarden(hosts()); err != nil {
+				log.Printf("Error refreshing walled garden: %v", err)
+			}
+		}
+	}()
+}
+
+const (
+	// gardenAddressTTL is how long an address a host stopped resolving to stays in the walled garden,
+	// so clients that looked up the host earlier or got another round-robin answer can still reach it
+	gardenAddressTTL = 1 * time.Hour
+	// gardenApplyInterval is how often changes to the walled garden are applied at most, so hosts rotating
+	// through many addresses don't rewrite the firewall sets on every refresh. A host without any applied
+	// address is applied right away.
+	gardenApplyInterval = 10 * time.Minute
+)
+
+// RefreshWalledGarden resolves hosts and hands their addresses to the gate if they changed.
+// Addresses are merged with the ones hosts resolved to before and expire after gardenAddressTTL,
+// and a host that fails to resolve keeps its known addresses, so a DNS hiccup doesn't lock clients
+// out of their mint.
+func (v *Valve) RefreshWalledGarden(hosts []string) error {
+	allowlist, ok := v.gate.(Allowlist)
+	if !ok {
+		return fmt.Errorf("gate backend doesn't support a walled garden")
+	}
+
+	v.gardenMutex.Lock()
+	defer v.gardenMutex.Unlock()
+
+	now := time.Now()
+	known := make(map[string]map[string]time.Time, len(hosts))
+	for _, host := range hosts {
+		host = strings.ToLower(strings.TrimSpace(host))
+		if host == "" {
+			continue
+		}
+		if ip := net.ParseIP(host); ip != nil {
+			known[host] = map[string]time.Time{ip.String(): now}
+			continue
+		}
+
+		seen := v.gardenAddresses[host]
+		if seen == nil {
+			seen = make(map[string]time.Time)
+		}
+		ips, err := v.lookupIP(host)
+		if err != nil || len(ips) == 0 {
+			log.Printf("Error resolving walled garden host %s, keeping %d known address(es): %v", host, len(seen), err)
+			known[host] = seen
+			continue
+		}
+		for _, ip := range ips {
+			seen[ip.String()] = now
+		}
+		for address, lastSeen := range seen {
+			if now.Sub(lastSeen) > gardenAddressTTL {
+				delete(seen, address)
+			}
+		}
+		known[host] = seen
+	}
+	v.gardenAddresses = known
+
+	addresses := uniqueAddresses(known)
+	key := addressKey(addresses)
+	if v.gardenSynced && key == v.gardenApplied {
+		return nil
+	}
+	if v.gardenSynced && now.Sub(v.gardenAppliedAt) < gardenApplyInterval && !v.hostMissing(known) {
+		log.Printf("Walled garden changed, applying it once %s passed since the last update", gardenApplyInterval)
+		return nil
+	}
+
+	if err := allowlist.SetAllowedAddresses(addresses); err != nil {
+		return fmt.Errorf("error updating walled garden: %w", err)
+	}
+	v.gardenApplied = key
+	v.gardenAppliedAt = now
+	v.gardenSynced = true
+	log.Printf("Walled garden updated to %d address(es) of %d host(s)", len(addresses), len(known))
+
+	// Installing the walled garden rules of nodogsplash and openNDS restarts the captive
+	// portal once, which drops authorized clients that the reconciler lets through again
+	v.Reconcile()
+	return nil
+}
+
+// hostMissing reports whether a host resolved to addresses none of which were applied.
+// The caller must hold gardenMutex.
+func (v *Valve) hostMissing(known map[string]map[string]time.Time) bool {
+	applied := make(map[string]bool)
+	for _, address := range strings.Split(v.gardenApplied, ",") {
+		applied[address] = true
+	}
+	for _, seen := range known {
+		if len(seen) == 0 {
+			continue
+		}
+		missing := true
+		for address := range seen {
+			if applied[address] {
+				missing = false
+				break
+			}
+		}
+		if missing {
+			return true
+		}
+	}
+	return false
+}
+
+// uniqueAddresses returns the addresses of all hosts without duplicates in sorted order
+func uniqueAddresses(known map[string]map[string]time.Time) []net.IP {
+	seen := make(map[string]bool)
+	var addresses []net.IP
+	for _, hostAddresses := range known {
+		for address := range hostAddresses {
+			if seen[address] {
+				continue
+			}
+			seen[address] = true
+			addresses = append(addresses, net.ParseIP(address))
+		}
+	}
+	sort.Slice(addresses, func(i, j int) bool {
+		return addresses[i].String() < addresses[j].String()
+	})
+	return addresses
+}
+
+// addressKey formats sorted addresses for comparing walled gardens
+func addressKey(addresses []net.IP) string {
+	formatted := make([]string, len(addresses))
+	for i, ip := range addresses {
+		formatted[i] = ip.String()
+	}
+	return strings.Join(formatted, ",")
+}
@@ -0,0 +1,7 @@
+module github.com/OpenTollGate/tollgate-module-basic-go/src/voucher
+
+go 1.24.2
+
+require github.com/OpenTollGate/tollgate-module-basic-go/src/utils v0.0.0
+
+replace github.com/OpenTollGate/tollgate-module-basic-go/src/utils => ../utils
@@ -0,0 +1,339 @@
+package voucher
+
+import (
+	"crypto/rand"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/OpenTollGate/tollgate-module-basic-go/src/utils"
+)
+
+// Metrics a voucher can be worth, matching the metrics sessions are sold in
+const (
+	MetricMilliseconds = "milliseconds"
+	MetricBytes        = "bytes"
+)
+
+// Errors returned when a voucher can't be redeemed
+var (
+	ErrUnknownVoucher = errors.New("unknown voucher")
+	ErrVoucherExpired = errors.New("voucher expired")
+	ErrVoucherUsed    = errors.New("voucher already used")
+	ErrWrongMetric    = errors.New("voucher is for another metric")
+)
+
+// codeAlphabet leaves out characters that are easily confused when printed, like 0 and O
+const codeAlphabet = "23456789ABCDEFGHJKLMNPQRSTUVWXYZ"
+
+// codeLength is the number of characters of a code, 50 bits of randomness
+const codeLength = 10
+
+// maxBatchSize bounds how many vouchers are generated at once
+const maxBatchSize = 10000
+
+// Voucher is a prepaid code worth an allotment of network access
+type Voucher struct {
+	Code  string `json:"code"`
+	Batch string `json:"batch"`
+	// Allotment is in Metric, milliseconds of access or bytes of data
+	Metric    string `json:"metric"`
+	Allotment uint64 `json:"allotment"`
+	// Value is what the voucher was sold for in sats, reported with the sales
+	Value     uint64    `json:"value"`
+	CreatedAt time.Time `json:"created_at"`
+	// ExpiresAt is when the voucher can no longer be redeemed, zero if never
+	ExpiresAt   time.Time    `json:"expires_at,omitzero"`
+	MaxUses     int          `json:"max_uses"`
+	Redemptions []Redemption `json:"redemptions,omitempty"`
+}
+
+// Redemption records a device that redeemed a voucher
+type Redemption struct {
+	MACAddress string    `json:"mac_address"`
+	At         time.Time `json:"at"`
+}
+
+// UsesLeft returns how many more times the voucher can be redeemed
+func (v Voucher) UsesLeft() int {
+	return max(v.MaxUses-len(v.Redemptions), 0)
+}
+
+// Batch describes a batch of vouchers to generate
+type Batch struct {
+	Name      string
+	Count     int
+	Metric    string
+	Allotment uint64
+	Value     uint64
+	ExpiresAt time.Time
+	// MaxUses is how many devices can redeem each voucher, 0 for single use
+	MaxUses int
+}
+
+// Store persists vouchers to a JSON file, rewritten atomically on every change
+type Store struct {
+	path     string
+	mu       sync.Mutex
+	vouchers map[string]Voucher
+}
+
+// NewStore opens the voucher store at path, loading any vouchers already on disk
+func NewStore(path string) (*Store, error) {
+	store := &Store{
+		path:     path,
+		vouchers: make(map[string]Voucher),
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return store, nil
+		}
+		return nil, fmt.Errorf("failed to read voucher store %s: %w", path, err)
+	}
+	if len(data) == 0 {
+		return store, nil
+	}
+
+	var vouchers []Voucher
+	if err := json.Unmarshal(data, &vouchers); err != nil {
+		return nil, fmt.Errorf("failed to parse voucher store %s: %w", path, err)
+	}
+	for _, voucher := range vouchers {
+		store.vouchers[voucher.Code] = voucher
+	}
+	return store, nil
+}
+
+// Generate creates a batch of vouchers with random codes
+func (s *Store) Generate(batch Batch, now time.Time) ([]Voucher, error) {
+	if batch.Name == "" {
+		return nil, fmt.Errorf("batch needs a name")
+	}
+	if batch.Count < 1 || batch.Count > maxBatchSize {
+		return nil, fmt.Errorf("batch size must be between 1 and %d, got %d", maxBatchSize, batch.Count)
+	}
+	if batch.Metric != MetricMilliseconds && batch.Metric != MetricBytes {
+		return nil, fmt.Errorf("invalid voucher metric %q", batch.Metric)
+	}
+	if batch.Allotment == 0 {
+		return nil, fmt.Errorf("vouchers must be worth some %s", batch.Metric)
+	}
+	if !batch.ExpiresAt.IsZero() && !batch.ExpiresAt.After(now) {
+		return nil, fmt.Errorf("batch expires at %s, which has passed", batch.ExpiresAt)
+	}
+	maxUses := max(batch.MaxUses, 1)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	vouchers := make([]Voucher, 0, batch.Count)
+	for len(vouchers) < batch.Count {
+		code, err := generateCode()
+		if err != nil {
+			return nil, err
+		}
+		if _, exists := s.vouchers[code]; exists {
+			continue
+		}
+		voucher := Voucher{
+			Code:      code,
+			Batch:     batch.Name,
+			Metric:    batch.Metric,
+			Allotment: batch.Allotment,
+			Value:     batch.Value,
+			CreatedAt: now,
+			ExpiresAt: batch.ExpiresAt,
+			MaxUses:   maxUses,
+		}
+		s.vouchers[code] = voucher
+		vouchers = append(vouchers, voucher)
+	}
+
+	if err := s.persist(); err != nil {
+		for _, voucher := range vouchers {
+			delete(s.vouchers, voucher.Code)
+		}
+		return nil, err
+	}
+	return vouchers, nil
+}
+
+// generateCode returns a random code formatted as two groups of five characters
+func generateCode() (string, error) {
+	var code strings.Builder
+	alphabetSize := big.NewInt(int64(len(codeAlphabet)))
+	for i := 0; i < codeLength; i++ {
+		if i == codeLength/2 {
+			code.WriteByte('-')
+		}
+		index, err := rand.Int(rand.Reader, alphabetSize)
+		if err != nil {
+			return "", fmt.Errorf("failed to generate voucher code: %w", err)
+		}
+		code.WriteByte(codeAlphabet[index.Int64()])
+	}
+	return code.String(), nil
+}
+
+// normalizeCode accepts codes typed in lower case, without the dash or with spaces
+func normalizeCode(code string) string {
+	code = strings.ToUpper(code)
+	code = strings.NewReplacer("-", "", " ", "").Replace(code)
+	if len(code) != codeLength {
+		return code
+	}
+	return code[:codeLength/2] + "-" + code[codeLength/2:]
+}
+
+// Redeem uses the voucher with code for macAddress and returns it.
+// Vouchers can only be redeemed while sessions are sold in their metric.
+func (s *Store) Redeem(code string, macAddress string, metric string, now time.Time) (Voucher, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	voucher, exists := s.vouchers[normalizeCode(code)]
+	if !exists {
+		return Voucher{}, ErrUnknownVoucher
+	}
+	if !voucher.ExpiresAt.IsZero() && !now.Before(voucher.ExpiresAt) {
+		return Voucher{}, fmt.Errorf("%w on %s", ErrVoucherExpired, voucher.ExpiresAt.Format(time.DateOnly))
+	}
+	if voucher.UsesLeft() == 0 {
+		return Voucher{}, ErrVoucherUsed
+	}
+	if voucher.Metric != metric {
+		return Voucher{}, fmt.Errorf("%w: it is worth %s but %s are sold", ErrWrongMetric, voucher.Metric, metric)
+	}
+
+	previous := voucher
+	voucher.Redemptions = append(voucher.Redemptions[:len(voucher.Redemptions):len(voucher.Redemptions)],
+		Redemption{MACAddress: macAddress, At: now})
+	s.vouchers[voucher.Code] = voucher
+	if err := s.persist(); err != nil {
+		s.vouchers[voucher.Code] = previous
+		return Voucher{}, err
+	}
+	return voucher, nil
+}
+
+// Cancel takes back the last redemption of a voucher by macAddress, for when the gate couldn't be opened
+func (s *Store) Cancel(code string, macAddress string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	voucher, exists := s.vouchers[normalizeCode(code)]
+	if !exists {
+		return ErrUnknownVoucher
+	}
+	for i := len(voucher.Redemptions) - 1; i >= 0; i-- {
+		if voucher.Redemptions[i].MACAddress != macAddress {
+			continue
+		}
+		previous := voucher
+		voucher.Redemptions = append(voucher.Redemptions[:i:i], voucher.Redemptions[i+1:]...)
+		s.vouchers[voucher.Code] = voucher
+		if err := s.persist(); err != nil {
+			s.vouchers[voucher.Code] = previous
+			return err
+		}
+		return nil
+	}
+	return nil
+}
+
+// Vouchers returns the vouchers of a batch, or all vouchers if batch is empty, oldest first
+func (s *Store) Vouchers(batch string) []Voucher {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	vouchers := make([]Voucher, 0)
+	for _, voucher := range s.sortedVouchers() {
+		if batch == "" || voucher.Batch == batch {
+			vouchers = append(vouchers, voucher)
+		}
+	}
+	return vouchers
+}
+
+func (s *Store) sortedVouchers() []Voucher {
+	vouchers := make([]Voucher, 0, len(s.vouchers))
+	for _, voucher := range s.vouchers {
+		vouchers = append(vouchers, voucher)
+	}
+	sort.Slice(vouchers, func(i, j int) bool {
+		if !vouchers[i].CreatedAt.Equal(vouchers[j].CreatedAt) {
+			return vouchers[i].CreatedAt.Before(vouchers[j].CreatedAt)
+		}
+		return vouchers[i].Code < vouchers[j].Code
+	})
+	return vouchers
+}
+
+// persist writes the vouchers to disk. The caller must hold s.mu.
+func (s *Store) persist() error {
+	data, err := json.Marshal(s.sortedVouchers())
+	if err != nil {
+		return fmt.Errorf("failed to marshal vouchers: %w", err)
+	}
+	return utils.WriteFileAtomic(s.path, data)
+}
+
+// WriteCSV exports vouchers for printing, one row per voucher with a human-readable allotment
+func WriteCSV(w io.Writer, vouchers []Voucher) error {
+	writer := csv.NewWriter(w)
+	writer.Write([]string{"code", "batch", "allotment", "value_sats", "expires", "max_uses", "uses_left"})
+	for _, voucher := range vouchers {
+		expires := ""
+		if !voucher.ExpiresAt.IsZero() {
+			expires = voucher.ExpiresAt.Format(time.DateOnly)
+		}
+		writer.Write([]string{
+			voucher.Code,
+			voucher.Batch,
+			FormatAllotment(voucher.Metric, voucher.Allotment),
+			fmt.Sprintf("%d", voucher.Value),
+			expires,
+			fmt.Sprintf("%d", voucher.MaxUses),
+			fmt.Sprintf("%d", voucher.UsesLeft()),
+		})
+	}
+	writer.Flush()
+	return writer.Error()
+}
+
+// FormatAllotment describes an allotment the way it is printed on vouchers, like "2h" or "500 MB"
+func FormatAllotment(metric string, allotment uint64) string {
+	if metric == MetricBytes {
+		switch {
+		case allotment >= 1000000000 && allotment%1000000000 == 0:
+			return fmt.Sprintf("%d GB", allotment/1000000000)
+		case allotment >= 1000000 && allotment%1000000 == 0:
+			return fmt.Sprintf("%d MB", allotment/1000000)
+		default:
+			return fmt.Sprintf("%d bytes", allotment)
+		}
+	}
+
+	duration := (time.Duration(allotment) * time.Millisecond).Round(time.Second)
+	var formatted strings.Builder
+	if hours := duration / time.Hour; hours > 0 {
+		fmt.Fprintf(&formatted, "%dh", hours)
+	}
+	if minutes := duration % time.Hour / time.Minute; minutes > 0 {
+		fmt.Fprintf(&formatted, "%dm", minutes)
+	}
+	if seconds := duration % time.Minute / time.Second; seconds > 0 || formatted.Len() == 0 {
+		fmt.Fprintf(&formatted, "%ds", seconds)
+	}
+	return formatted.String()
+}
@@ -0,0 +1,175 @@
+package voucher
+
+import (
+	"bytes"
+	"errors"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+var now = time.Date(2025, 3, 1, 12, 0, 0, 0, time.UTC)
+
+func newTestStore(t *testing.T) *Store {
+	t.Helper()
+	store, err := NewStore(filepath.Join(t.TempDir(), "vouchers.json"))
+	if err != nil {
+		t.Fatalf("Failed to open voucher store: %v", err)
+	}
+	return store
+}
+
+func TestGenerate(t *testing.T) {
+	store := newTestStore(t)
+
+	invalid := []Batch{
+		{Count: 1, Metric: MetricBytes, Allotment: 1},
+		{Name: "empty", Count: 0, Metric: MetricBytes, Allotment: 1},
+		{Name: "huge", Count: maxBatchSize + 1, Metric: MetricBytes, Allotment: 1},
+		{Name: "metric", Count: 1, Metric: "sats", Allotment: 1},
+		{Name: "worthless", Count: 1, Metric: MetricBytes},
+		{Name: "expired", Count: 1, Metric: MetricBytes, Allotment: 1, ExpiresAt: now},
+	}
+	for _, batch := range invalid {
+		if _, err := store.Generate(batch, now); err == nil {
+			t.Errorf("Generated invalid batch %+v", batch)
+		}
+	}
+
+	vouchers, err := store.Generate(Batch{Name: "lobby", Count: 50, Metric: MetricBytes, Allotment: 500000000, Value: 50}, now)
+	if err != nil {
+		t.Fatalf("Failed to generate vouchers: %v", err)
+	}
+	codes := make(map[string]bool)
+	for _, voucher := range vouchers {
+		if len(voucher.Code) != codeLength+1 || voucher.Code[codeLength/2] != '-' {
+			t.Errorf("Code %q is not formatted as XXXXX-XXXXX", voucher.Code)
+		}
+		if strings.ContainsAny(voucher.Code, "01IO") {
+			t.Errorf("Code %q contains characters that are easily confused", voucher.Code)
+		}
+		if voucher.MaxUses != 1 || voucher.UsesLeft() != 1 {
+			t.Errorf("Voucher has %d uses, expected single use by default", voucher.MaxUses)
+		}
+		codes[voucher.Code] = true
+	}
+	if len(codes) != 50 {
+		t.Errorf("Generated %d distinct codes, expected 50", len(codes))
+	}
+
+	// Vouchers survive a restart
+	reopened, err := NewStore(store.path)
+	if err != nil {
+		t.Fatalf("Failed to reopen voucher store: %v", err)
+	}
+	if got := reopened.Vouchers("lobby"); len(got) != 50 {
+		t.Errorf("Reopened store has %d vouchers in batch lobby, expected 50", len(got))
+	}
+	if got := reopened.Vouchers("other"); len(got) != 0 {
+		t.Errorf("Reopened store has %d vouchers in batch other, expected none", len(got))
+	}
+}
+
+func TestRedeem(t *testing.T) {
+	store := newTestStore(t)
+	expiresAt := now.Add(24 * time.Hour)
+	vouchers, err := store.Generate(Batch{
+		Name:      "conference",
+		Count:     1,
+		Metric:    MetricMilliseconds,
+		Allotment: 3600000,
+		ExpiresAt: expiresAt,
+		MaxUses:   2,
+	}, now)
+	if err != nil {
+		t.Fatalf("Failed to generate vouchers: %v", err)
+	}
+	code := vouchers[0].Code
+
+	if _, err := store.Redeem("AAAAA-AAAAA", "00:11:22:33:44:01", MetricMilliseconds, now); !errors.Is(err, ErrUnknownVoucher) {
+		t.Errorf("Redeeming an unknown code returned %v, expected ErrUnknownVoucher", err)
+	}
+	if _, err := store.Redeem(code, "00:11:22:33:44:01", MetricBytes, now); !errors.Is(err, ErrWrongMetric) {
+		t.Errorf("Redeeming while bytes are sold returned %v, expected ErrWrongMetric", err)
+	}
+
+	// Codes are accepted the way guests type them
+	typed := strings.ToLower(strings.Replace(code, "-", " ", 1))
+	redeemed, err := store.Redeem(typed, "00:11:22:33:44:01", MetricMilliseconds, now)
+	if err != nil || redeemed.UsesLeft() != 1 {
+		t.Fatalf("First redemption returned %+v, %v, expected one use left", redeemed, err)
+	}
+
+	// Cancelling gives the use back, for when the gate couldn't be opened
+	if err := store.Cancel(code, "00:11:22:33:44:01"); err != nil {
+		t.Fatalf("Failed to cancel redemption: %v", err)
+	}
+	if left := store.Vouchers("")[0].UsesLeft(); left != 2 {
+		t.Errorf("Voucher has %d uses left after cancelling, expected 2", left)
+	}
+
+	for _, macAddress := range []string{"00:11:22:33:44:01", "00:11:22:33:44:02"} {
+		if _, err := store.Redeem(code, macAddress, MetricMilliseconds, now); err != nil {
+			t.Fatalf("Redemption by %s failed: %v", macAddress, err)
+		}
+	}
+	if _, err := store.Redeem(code, "00:11:22:33:44:03", MetricMilliseconds, now); !errors.Is(err, ErrVoucherUsed) {
+		t.Errorf("Redeeming a used up voucher returned %v, expected ErrVoucherUsed", err)
+	}
+
+	unused, _ := store.Generate(Batch{Name: "conference", Count: 1, Metric: MetricMilliseconds, Allotment: 1000, ExpiresAt: expiresAt}, now)
+	if _, err := store.Redeem(unused[0].Code, "00:11:22:33:44:04", MetricMilliseconds, expiresAt); !errors.Is(err, ErrVoucherExpired) {
+		t.Errorf("Redeeming an expired voucher returned %v, expected ErrVoucherExpired", err)
+	}
+
+	reopened, err := NewStore(store.path)
+	if err != nil {
+		t.Fatalf("Failed to reopen voucher store: %v", err)
+	}
+	for _, voucher := range reopened.Vouchers("conference") {
+		if voucher.Code == code && len(voucher.Redemptions) != 2 {
+			t.Errorf("Reopened voucher has %d redemptions, expected 2", len(voucher.Redemptions))
+		}
+	}
+}
+
+func TestWriteCSV(t *testing.T) {
+	vouchers := []Voucher{
+		{Code: "ABCDE-FGHJK", Batch: "lobby", Metric: MetricMilliseconds, Allotment: 5400000, Value: 21, MaxUses: 1},
+		{Code: "LMNPQ-RSTUV", Batch: "lobby", Metric: MetricBytes, Allotment: 2000000000, MaxUses: 3,
+			ExpiresAt: now, Redemptions: []Redemption{{MACAddress: "00:11:22:33:44:01", At: now}}},
+	}
+
+	var buffer bytes.Buffer
+	if err := WriteCSV(&buffer, vouchers); err != nil {
+		t.Fatalf("Failed to write CSV: %v", err)
+	}
+	expected := "code,batch,allotment,value_sats,expires,max_uses,uses_left\n" +
+		"ABCDE-FGHJK,lobby,1h30m,21,,1,1\n" +
+		"LMNPQ-RSTUV,lobby,2 GB,0,2025-03-01,3,2\n"
+	if buffer.String() != expected {
+		t.Errorf("CSV is\n%s\nexpected\n%s", buffer.String(), expected)
+	}
+}
+
+func TestFormatAllotment(t *testing.T) {
+	tests := []struct {
+		metric    string
+		allotment uint64
+		expected  string
+	}{
+		{MetricMilliseconds, 7200000, "2h"},
+		{MetricMilliseconds, 30000, "30s"},
+		{MetricMilliseconds, 0, "0s"},
+		{MetricMilliseconds, 3661000, "1h1m1s"},
+		{MetricBytes, 500000000, "500 MB"},
+		{MetricBytes, 1000000000, "1 GB"},
+		{MetricBytes, 1234, "1234 bytes"},
+	}
+	for _, test := range tests {
+		if got := FormatAllotment(test.metric, test.allotment); got != test.expected {
+			t.Errorf("FormatAllotment(%s, %d) = %q, expected %q", test.metric, test.allotment, got, test.expected)
+		}
+	}
+}